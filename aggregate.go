@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// aggregator accumulates parsed queries in memory until they are saved.
+type aggregator struct {
+	parse   lineParser // of --input-format
+	clients clientFilter
+	rejects *rejectLog
+	sink    *clickhouseSink // optional per-query output
+	queries *queryLog       // optional per-query rows for the queries table
+
+	// anonymizer, when not nil, disguises clients before they are recorded
+	// (see --anonymize-clients); anonymized caches its work.
+	anonymizer *anonymizer
+	anonymized map[string]string
+
+	// queryTypes, when not nil, counts the queries of each record type.
+	queryTypes map[string]int64
+
+	domains   map[string]domainTimes
+	perClient map[domainClient]domainTimes
+	hours     map[domainHour]int64
+
+	// resolutions counts how each domain's queries were answered, as followed
+	// by resolver across the lines after each query.
+	resolutions map[string]resolution
+	resolver    *resolver
+
+	// source is the input file being read, set by beginSource; sources
+	// records which domains were seen in it, and from which syslog hosts.
+	// sourceHost and sourceTimes cache the entry of sources the last line
+	// went to.
+	source      string
+	sources     sourceDomains
+	sourceHost  string
+	sourceTimes map[string]domainTimes
+
+	// types counts each domain's queries by record type, and addresses the
+	// addresses its answers carried, as followed by answering (see addAnswer).
+	types     map[domainType]domainTimes
+	addresses map[domainAddress]domainTimes
+	answering answerChain
+
+	// devices holds the DHCP leases acknowledged (see addLease).
+	devices map[device]domainTimes
+
+	// names interns the domains and clients held in the maps above, so a
+	// repeated name costs a lookup rather than a new string.
+	names     map[string]string
+	reversed  []byte // reused for reversing each domain
+	canonical []byte // reused for the canonical form of a domain logged otherwise
+
+	linesProcessed uint64
+}
+
+func newAggregator(clients clientFilter, rejects *rejectLog) *aggregator {
+	a := &aggregator{parse: lineFormat(parseAnyLine).at(time.Now()), clients: clients, rejects: rejects, resolver: newResolver()}
+	a.reset()
+	return a
+}
+
+func (a *aggregator) reset() {
+	a.domains = make(map[string]domainTimes)
+	a.perClient = make(map[domainClient]domainTimes)
+	a.hours = make(map[domainHour]int64)
+	a.resolutions = make(map[string]resolution)
+	a.sources = make(sourceDomains)
+	a.sourceTimes = nil
+	a.types = make(map[domainType]domainTimes)
+	a.addresses = make(map[domainAddress]domainTimes)
+	a.devices = make(map[device]domainTimes)
+	a.names = make(map[string]string)
+	a.anonymized = make(map[string]string)
+	if a.queries != nil {
+		a.queries.reset()
+	}
+	if a.queryTypes != nil {
+		clear(a.queryTypes)
+	}
+}
+
+// intern returns b as a string, reusing an earlier copy when there is one.
+func (a *aggregator) intern(b []byte) string {
+	if s, ok := a.names[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	a.names[s] = s
+	return s
+}
+
+// beginSource attributes the lines added from now on to the input file path.
+func (a *aggregator) beginSource(path string) {
+	a.source = path
+	a.sourceTimes = nil
+}
+
+// addLine records the query or DHCP lease on line, if it is one and its client
+// passes the filter. line is not retained.
+func (a *aggregator) addLine(line []byte) {
+	l, err := a.parse(line)
+	a.addResult(line, l, err)
+}
+
+// addResult records what parsing line gave, as addLine does, for lines parsed
+// elsewhere (see parsePool).
+func (a *aggregator) addResult(line []byte, l logLine, err error) {
+	atomic.AddUint64(&a.linesProcessed, 1)
+	if err != nil {
+		a.rejects.add(string(line), err)
+		return
+	}
+	a.addParsed(l)
+}
+
+// addParsed records l, a line parsed already, as addLine does.
+func (a *aggregator) addParsed(l logLine) {
+	if l.isLease() {
+		a.addLease(l)
+		return
+	}
+	if len(l.Domain) == 0 {
+		return
+	}
+	if needsCanonical(l.Domain) {
+		a.canonical = append(a.canonical[:0], canonicalDomain(string(l.Domain))...)
+		l.Domain = a.canonical
+	}
+	if !l.isQuery() {
+		a.addAction(l)
+		return
+	}
+	client := a.intern(l.Client)
+	if !a.clients.matches(client) {
+		return
+	}
+	if a.anonymizer != nil {
+		client = a.anonymize(client)
+	}
+	if a.sink != nil {
+		a.sink.add(queryRow{Timestamp: l.Timestamp, Domain: string(l.Domain), Client: client})
+	}
+
+	if a.queryTypes != nil {
+		a.queryTypes[a.intern(l.queryType())]++
+	}
+	if a.queries != nil {
+		a.queries.add(queryEvent{Timestamp: l.Timestamp, Domain: a.intern(l.Domain), Type: a.intern(l.queryType()), Client: client})
+	}
+
+	a.reversed = append(a.reversed[:0], l.Domain...)
+	reverseLabels(a.reversed)
+	reversed := a.intern(a.reversed)
+	a.resolver.query(l, a.intern(l.Domain), reversed)
+	seen := domainTimes{FirstSeen: l.Timestamp, LastSeen: l.Timestamp, Count: 1}
+	mergeInto(a.domains, reversed, seen)
+	a.hours[domainHour{Domain: reversed, Hour: hourOf(l.Timestamp)}]++
+	if a.sourceTimes == nil || string(l.Host) != a.sourceHost {
+		a.sourceHost = a.intern(l.Host)
+		a.sourceTimes = a.sources.of(inputSource{a.source, a.sourceHost})
+	}
+	mergeInto(a.sourceTimes, reversed, seen)
+	mergeInto(a.types, domainType{Domain: reversed, Type: a.intern(l.queryType())}, seen)
+	if client != "" {
+		mergeInto(a.perClient, domainClient{Domain: reversed, Client: client}, seen)
+	}
+}
+
+// anonymize returns the disguise of client, working each out once per batch.
+func (a *aggregator) anonymize(client string) string {
+	if s, ok := a.anonymized[client]; ok {
+		return s
+	}
+	s := a.anonymizer.client(client)
+	a.anonymized[client] = s
+	return s
+}
+
+// addAction records what l says dnsmasq did with an earlier query.
+func (a *aggregator) addAction(l logLine) {
+	a.resolver.answer(l, a.resolutions)
+	a.addAnswer(l)
+	if a.queries == nil {
+		return
+	}
+	if e := a.queries.takeAwaiting(l.Domain); e != nil {
+		e.Action = a.intern(l.action())
+	}
+}
+
+// fork returns an empty aggregator that parses, filters and anonymizes lines
+// as a does, for what it aggregates to be merged into a. Queries are followed
+// through their answers within a fork only, so each must be given whole inputs.
+func (a *aggregator) fork() *aggregator {
+	f := newAggregator(a.clients, a.rejects)
+	f.parse = a.parse
+	f.sink = a.sink
+	f.anonymizer = a.anonymizer
+	if a.queries != nil {
+		f.queries = newQueryLog(a.queries.retention)
+	}
+	if a.queryTypes != nil {
+		f.queryTypes = make(map[string]int64)
+	}
+	return f
+}
+
+// merge adds everything aggregated by o, which must not be used concurrently.
+func (a *aggregator) merge(o *aggregator) {
+	for domain, t := range o.domains {
+		mergeInto(a.domains, domain, t)
+	}
+	for key, t := range o.perClient {
+		mergeInto(a.perClient, key, t)
+	}
+	for key, count := range o.hours {
+		a.hours[key] += count
+	}
+	for domain, r := range o.resolutions {
+		mergeResolution(a.resolutions, domain, r)
+	}
+	a.sources.mergeFrom(o.sources)
+	for key, t := range o.types {
+		mergeInto(a.types, key, t)
+	}
+	for key, t := range o.addresses {
+		mergeInto(a.addresses, key, t)
+	}
+	for key, t := range o.devices {
+		mergeInto(a.devices, key, t)
+	}
+	if a.queryTypes != nil {
+		for typ, n := range o.queryTypes {
+			a.queryTypes[typ] += n
+		}
+	}
+	if a.queries != nil && o.queries != nil {
+		a.queries.events = append(a.queries.events, o.queries.events...)
+	}
+	atomic.AddUint64(&a.linesProcessed, atomic.LoadUint64(&o.linesProcessed))
+}
+
+// mergeInto folds t into m[key]: the earliest first_seen, the latest last_seen
+// and the summed count, whatever order the lines were seen in.
+func mergeInto[K comparable](m map[K]domainTimes, key K, t domainTimes) {
+	if stored, ok := m[key]; ok {
+		t.FirstSeen = min(t.FirstSeen, stored.FirstSeen)
+		t.LastSeen = max(t.LastSeen, stored.LastSeen)
+		t.Count += stored.Count
+	}
+	m[key] = t
+}
+
+// pending reports the number of domains and DHCP leases waiting to be saved.
+func (a *aggregator) pending() int {
+	return len(a.domains) + len(a.devices)
+}
+
+// save merges everything accumulated so far into the database and starts
+// afresh. Each table written is traced as a span (see startSpan).
+func (a *aggregator) save(ctx context.Context, st store) error {
+	type step struct {
+		table string
+		rows  int
+		save  func(context.Context) error
+	}
+	steps := []step{
+		{"domains", len(a.domains), func(ctx context.Context) error { return st.saveDomains(ctx, a.domains) }},
+		{"domain_clients", len(a.perClient), func(ctx context.Context) error { return st.saveDomainClients(ctx, a.perClient) }},
+		{"domain_hours", len(a.hours), func(ctx context.Context) error { return st.saveDomainHours(ctx, a.hours) }},
+		{"domain_resolution", len(a.resolutions), func(ctx context.Context) error { return st.saveDomainResolutions(ctx, a.resolutions) }},
+		{"domain_sources", len(a.sources), func(ctx context.Context) error {
+			if err := st.saveDomainSources(ctx, a.sources); err != nil {
+				return fmt.Errorf("saving sources: %w", err)
+			}
+			return nil
+		}},
+		{"domain_types", len(a.types), func(ctx context.Context) error { return st.saveDomainTypes(ctx, a.types) }},
+		{"domain_addresses", len(a.addresses), func(ctx context.Context) error { return st.saveDomainAddresses(ctx, a.addresses) }},
+		{"domain_scores", len(a.domains), func(ctx context.Context) error { return st.saveDomainScores(ctx, scoreDomains(a.domains)) }},
+		{"devices", len(a.devices), func(ctx context.Context) error { return st.saveDevices(ctx, a.devices) }},
+	}
+	if db, ok := st.(*database); ok && a.queries != nil && len(a.queries.events) > 0 {
+		steps = append(steps, step{"queries", len(a.queries.events), func(ctx context.Context) error {
+			if err := db.saveQueries(ctx, a.queries.events, a.queries.retention); err != nil {
+				return fmt.Errorf("saving queries: %w", err)
+			}
+			return nil
+		}})
+	}
+	for _, step := range steps {
+		if err := traced(ctx, "save "+step.table, step.save, "db.table", step.table, "rows", step.rows); err != nil {
+			return err
+		}
+	}
+	a.reset()
+	return nil
+}
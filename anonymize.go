@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// anonymizeOptions configures --anonymize-clients, which stores clients
+// disguised rather than as the addresses they query from, for databases
+// shared beyond the people the network belongs to.
+type anonymizeOptions struct {
+	Mode     string
+	SaltFile string
+}
+
+// addAnonymizeFlags registers --anonymize-clients and --anonymize-salt on fs.
+func addAnonymizeFlags(fs *flag.FlagSet) *anonymizeOptions {
+	o := &anonymizeOptions{}
+	fs.StringVar(&o.Mode, "anonymize-clients", "", "store clients as `mode`: hash, a salted hash of the address, or truncate, its /24 (IPv4) or /48 (IPv6) network; DHCP leases are then not recorded")
+	fs.StringVar(&o.SaltFile, "anonymize-salt", "", "read the salt of --anonymize-clients from `file`, creating it with a random salt if missing; truncate hashes clients that are not addresses with it")
+	return o
+}
+
+// enable makes agg anonymize clients when --anonymize-clients is given. Both
+// modes need the salt: truncate hashes the clients that are not addresses.
+func (o *anonymizeOptions) enable(agg *aggregator) error {
+	switch o.Mode {
+	case "":
+		return nil
+	case "hash", "truncate":
+		if o.SaltFile == "" {
+			return fmt.Errorf("--anonymize-clients %s needs --anonymize-salt", o.Mode)
+		}
+		salt, err := loadSalt(o.SaltFile)
+		if err != nil {
+			return err
+		}
+		agg.anonymizer = &anonymizer{salt: salt, truncate: o.Mode == "truncate"}
+		return nil
+	}
+	return fmt.Errorf("unknown --anonymize-clients mode %q", o.Mode)
+}
+
+// loadSalt reads the salt in path, first writing a random one there if the
+// file does not exist. Keeping the salt lets later runs hash a client the
+// same way, so its rows still merge; losing it starts every client afresh.
+func loadSalt(path string) ([]byte, error) {
+	salt, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt = []byte(rand.Text())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(salt); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return salt, f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("%s: empty salt", path)
+	}
+	return salt, nil
+}
+
+// anonymizer disguises client addresses as "anon-" and the first 8 bytes of
+// their HMAC-SHA256 in hex, or when truncating as their network, such as
+// 192.168.1.0/24. It is safe for concurrent use.
+type anonymizer struct {
+	salt     []byte
+	truncate bool
+}
+
+// client returns the disguise of client. Clients that are not addresses are
+// hashed whatever the mode, and the empty client stays empty.
+func (z *anonymizer) client(client string) string {
+	if client == "" {
+		return ""
+	}
+	addr, err := netip.ParseAddr(client)
+	if err == nil {
+		addr = addr.Unmap()
+		client = addr.String()
+	}
+	if z.truncate && err == nil {
+		bits := 24
+		if addr.Is6() {
+			bits = 48
+		}
+		return netip.PrefixFrom(addr, bits).Masked().String()
+	}
+	mac := hmac.New(sha256.New, z.salt)
+	mac.Write([]byte(client))
+	return "anon-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
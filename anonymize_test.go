@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnonymizerClient(t *testing.T) {
+	salt := []byte("test-salt")
+	tests := []struct {
+		client   string
+		hash     string
+		truncate string
+	}{
+		{"192.168.1.77", "anon-50ea63aa47f5dedb", "192.168.1.0/24"},
+		{"2001:db8:1234:5678::1", "anon-1731bb5758649c4f", "2001:db8:1234::/48"},
+		{"::ffff:10.1.2.3", "anon-033f5d0920e2b671", "10.1.2.0/24"}, // as 10.1.2.3
+		{"10.1.2.3", "anon-033f5d0920e2b671", "10.1.2.0/24"},
+		{"laptop.lan", "anon-e2b6c9e0d7e594c8", "anon-e2b6c9e0d7e594c8"},
+		{"", "", ""},
+	}
+	hash := &anonymizer{salt: salt}
+	truncate := &anonymizer{salt: salt, truncate: true}
+	for _, tt := range tests {
+		if got := hash.client(tt.client); got != tt.hash {
+			t.Errorf("hash of %q = %q, want %q", tt.client, got, tt.hash)
+		}
+		if got := truncate.client(tt.client); got != tt.truncate {
+			t.Errorf("truncation of %q = %q, want %q", tt.client, got, tt.truncate)
+		}
+	}
+
+	other := &anonymizer{salt: []byte("other-salt"), truncate: true}
+	if got := other.client("laptop.lan"); got != "anon-fd55d5f9e51b6674" {
+		t.Errorf("truncation of laptop.lan with another salt = %q, want anon-fd55d5f9e51b6674", got)
+	}
+}
+
+func TestAnonymizeOptionsNeedSalt(t *testing.T) {
+	for _, mode := range []string{"hash", "truncate"} {
+		if err := (&anonymizeOptions{Mode: mode}).enable(newAggregator(nil, nil)); err == nil {
+			t.Errorf("--anonymize-clients %s without --anonymize-salt: no error", mode)
+		}
+
+		path := filepath.Join(t.TempDir(), "salt")
+		agg := newAggregator(nil, nil)
+		if err := (&anonymizeOptions{Mode: mode, SaltFile: path}).enable(agg); err != nil {
+			t.Fatalf("--anonymize-clients %s: %v", mode, err)
+		}
+		salt, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("--anonymize-clients %s: salt not written: %v", mode, err)
+		}
+		if string(agg.anonymizer.salt) != string(salt) || len(salt) == 0 {
+			t.Errorf("--anonymize-clients %s: salt %q, want %q from the file", mode, agg.anonymizer.salt, salt)
+		}
+		if agg.anonymizer.truncate != (mode == "truncate") {
+			t.Errorf("--anonymize-clients %s: truncate = %t", mode, agg.anonymizer.truncate)
+		}
+	}
+}
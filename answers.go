@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+)
+
+// domainType keys the queries of a (reversed) domain for one record type,
+// such as A or HTTPS.
+type domainType struct {
+	Domain string
+	Type   string
+}
+
+// domainAddress keys the answers of a (reversed) domain carrying one address.
+type domainAddress struct {
+	Domain  string
+	Address string
+}
+
+// domainTypeRow is the stored observation window of a domain for one query type.
+type domainTypeRow struct {
+	domainType
+	domainTimes
+}
+
+// domainAddressRow is the stored observation window of a domain resolving to
+// one address.
+type domainAddressRow struct {
+	domainAddress
+	domainTimes
+}
+
+// answerChain follows the answer lines of one reply. dnsmasq logs a reply
+// through CNAMEs as a line per name, such as "reply www.example.com is
+// <CNAME>" followed by "reply example.edgekey.net is 192.0.2.1", so the
+// addresses at the end of the chain are those of the name at its head.
+type answerChain struct {
+	serial uint64
+	head   string // reversed, as queried
+	last   string // reversed, the name of the latest line
+	cname  bool   // the latest line was a CNAME, so the chain goes on
+}
+
+// addAnswer records the address l answers its chain's head with, if it
+// carries one. Addresses 0.0.0.0 and :: are left out: they are how blocked
+// domains are answered, not where they resolve. With a client filter, only
+// the answers of domains the filtered clients queried since the last save are
+// kept.
+func (a *aggregator) addAnswer(l logLine) {
+	if len(l.Answer) == 0 {
+		return
+	}
+	a.reversed = append(a.reversed[:0], l.Domain...)
+	reverseLabels(a.reversed)
+	reversed := a.intern(a.reversed)
+
+	c := &a.answering
+	if !(c.cname && c.serial == l.Serial) && reversed != c.last {
+		*c = answerChain{serial: l.Serial, head: reversed}
+	}
+	c.last, c.cname = reversed, string(l.Answer) == "<CNAME>"
+
+	addr, err := netip.ParseAddr(string(l.Answer))
+	if err != nil || addr.IsUnspecified() {
+		return
+	}
+	if len(a.clients) > 0 {
+		if _, ok := a.domains[c.head]; !ok {
+			return
+		}
+	}
+	seen := domainTimes{FirstSeen: l.Timestamp, LastSeen: l.Timestamp, Count: 1}
+	mergeInto(a.addresses, domainAddress{Domain: c.head, Address: a.intern([]byte(addr.Unmap().String()))}, seen)
+}
+
+func (db *database) saveDomainTypes(ctx context.Context, types map[domainType]domainTimes) error {
+	args := make([]any, 0, 5*len(types))
+	for key, times := range types {
+		args = append(args, key.Domain, key.Type, times.FirstSeen, times.LastSeen, times.Count)
+	}
+	return db.upsertRows(ctx, "domain_types", []upsertColumn{
+		{"domain", mergeKey},
+		{"type", mergeKey},
+		{"first_seen", mergeMin},
+		{"last_seen", mergeMax},
+		{"count", mergeAdd},
+	}, args)
+}
+
+func (db *database) saveDomainAddresses(ctx context.Context, addresses map[domainAddress]domainTimes) error {
+	args := make([]any, 0, 5*len(addresses))
+	for key, times := range addresses {
+		args = append(args, key.Domain, key.Address, times.FirstSeen, times.LastSeen, times.Count)
+	}
+	return db.upsertRows(ctx, "domain_addresses", []upsertColumn{
+		{"domain", mergeKey},
+		{"address", mergeKey},
+		{"first_seen", mergeMin},
+		{"last_seen", mergeMax},
+		{"count", mergeAdd},
+	}, args)
+}
+
+func (db *database) loadDomainTypes(ctx context.Context) ([]domainTypeRow, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, type, first_seen, last_seen, count FROM domain_types")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []domainTypeRow
+	for rows.Next() {
+		var r domainTypeRow
+		if err := rows.Scan(&r.Domain, &r.Type, &r.FirstSeen, &r.LastSeen, &r.Count); err != nil {
+			return nil, err
+		}
+		types = append(types, r)
+	}
+	return types, rows.Err()
+}
+
+func (db *database) loadDomainAddresses(ctx context.Context) ([]domainAddressRow, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, address, first_seen, last_seen, count FROM domain_addresses")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []domainAddressRow
+	for rows.Next() {
+		var r domainAddressRow
+		if err := rows.Scan(&r.Domain, &r.Address, &r.FirstSeen, &r.LastSeen, &r.Count); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, r)
+	}
+	return addresses, rows.Err()
+}
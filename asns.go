@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// asnSummary is what the stored answers say of one autonomous system.
+type asnSummary struct {
+	ASN       int64
+	Org       string
+	Countries []string
+	FirstSeen int64 // of the earliest answer with one of its addresses
+	LastSeen  int64
+	Answers   int64
+	Domains   []string // forward, in order
+}
+
+// runASNs implements the asns subcommand: the networks resolved addresses
+// belong to, as looked up by enrich --geoip. By default only those first seen
+// recently are shown, with the domains resolving into them: domains suddenly
+// pointing at a network never talked to before deserve a look.
+func runASNs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("asns", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	newSince := fs.String("new", "7d", "show the networks first seen after this `time` (duration such as 24h or 7d, or a date)")
+	all := fs.Bool("all", false, "show every network, by answers")
+	n := addLimitFlag(fs, 5, "list at most `n` domains per network (0 for all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	cutoff, err := parseSince(*newSince, time.Now())
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	info, err := st.loadAddressInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if len(info) == 0 {
+		return errors.New("no address information stored: run enrich --geoip first")
+	}
+	rows, err := st.loadDomainAddresses(ctx)
+	if err != nil {
+		return err
+	}
+
+	asns := summarizeASNs(rows, info)
+	if !*all {
+		asns = slices.DeleteFunc(asns, func(a asnSummary) bool { return a.FirstSeen < cutoff })
+		slices.SortFunc(asns, func(a, b asnSummary) int { return cmpInt(b.FirstSeen, a.FirstSeen) })
+		fmt.Printf("%d networks first seen since %s\n\n", len(asns), time.Unix(cutoff, 0).Format("2006-01-02 15:04"))
+	}
+	if len(asns) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tCOUNTRY\tFIRST SEEN\tLAST SEEN\tANSWERS\tDOMAINS")
+	for _, a := range asns {
+		domains := a.Domains
+		if *n > 0 && len(domains) > *n {
+			domains = append(slices.Clip(domains[:*n]), fmt.Sprintf("(%d more)", len(a.Domains)-*n))
+		}
+		country := strings.Join(a.Countries, ",")
+		if country == "" {
+			country = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", addressInfo{ASN: a.ASN, ASOrg: a.Org}.network(), country,
+			formatUnix(a.FirstSeen), formatUnix(a.LastSeen), a.Answers, strings.Join(domains, " "))
+	}
+	return tw.Flush()
+}
+
+// summarizeASNs groups the answers of rows by the autonomous system of their
+// address, leaving out addresses of no known one, by answers, most first.
+func summarizeASNs(rows []domainAddressRow, info map[string]addressInfo) []asnSummary {
+	byASN := make(map[int64]*asnSummary)
+	domains := make(map[int64]map[string]bool)
+	for _, r := range rows {
+		i := info[r.Address]
+		if i.ASN == 0 {
+			continue
+		}
+		a, ok := byASN[i.ASN]
+		if !ok {
+			a = &asnSummary{ASN: i.ASN, Org: i.ASOrg, FirstSeen: r.FirstSeen, LastSeen: r.LastSeen}
+			byASN[i.ASN] = a
+			domains[i.ASN] = make(map[string]bool)
+		}
+		a.FirstSeen = min(a.FirstSeen, r.FirstSeen)
+		a.LastSeen = max(a.LastSeen, r.LastSeen)
+		a.Answers += r.Count
+		if i.Country != "" && !slices.Contains(a.Countries, i.Country) {
+			a.Countries = append(a.Countries, i.Country)
+		}
+		domains[i.ASN][reverseDomainParts(r.Domain)] = true
+	}
+
+	asns := make([]asnSummary, 0, len(byASN))
+	for asn, a := range byASN {
+		for domain := range domains[asn] {
+			a.Domains = append(a.Domains, domain)
+		}
+		slices.Sort(a.Domains)
+		slices.Sort(a.Countries)
+		asns = append(asns, *a)
+	}
+	slices.SortFunc(asns, func(a, b asnSummary) int {
+		if c := cmpInt(b.Answers, a.Answers); c != 0 {
+			return c
+		}
+		return cmpInt(a.ASN, b.ASN)
+	})
+	return asns
+}
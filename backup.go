@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// backupFormat and backupVersion identify backup files in their header record.
+const (
+	backupFormat  = "dnsmasq-parse-backup"
+	backupVersion = 1
+)
+
+// restoreBatch is the number of records restore holds before saving them.
+const restoreBatch = 100_000
+
+// backupHeader is the first record of a backup file.
+type backupHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Created string `json:"created"`
+}
+
+// backupRecord is one row of a backup: a gzip-compressed JSON Lines file with
+// one record per stored row, its table named in Table and only that table's
+// columns set. Domains are stored reversed, as in the database.
+type backupRecord struct {
+	Table string `json:"table"`
+
+	Domain    string `json:"domain,omitempty"`
+	Client    string `json:"client,omitempty"`
+	Hour      int64  `json:"hour,omitempty"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
+	Count     int64  `json:"count,omitempty"`
+
+	Cached       int64 `json:"cached,omitempty"`
+	Forwarded    int64 `json:"forwarded,omitempty"`
+	Blocked      int64 `json:"blocked,omitempty"`
+	Replies      int64 `json:"replies,omitempty"`
+	LatencyMs    int64 `json:"latency_ms,omitempty"`
+	MaxLatencyMs int64 `json:"max_latency_ms,omitempty"`
+
+	Path string `json:"path,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	Address   string `json:"address,omitempty"`
+	Country   string `json:"country,omitempty"`
+	ASN       int64  `json:"asn,omitempty"`
+	ASOrg     string `json:"as_org,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+
+	RegisteredAt int64 `json:"registered_at,omitempty"`
+	CheckedAt    int64 `json:"checked_at,omitempty"`
+	Rank         int64 `json:"rank,omitempty"`
+
+	Status    string `json:"status,omitempty"`
+	Addresses string `json:"addresses,omitempty"`
+
+	Name  string `json:"name,omitempty"`
+	Zone  string `json:"zone,omitempty"`
+	Codes string `json:"codes,omitempty"`
+
+	MAC      string `json:"mac,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Action    string `json:"action,omitempty"`
+}
+
+// runBackup implements the backup subcommand: dump every table of the database
+// in a format any backend can restore, for moving between them (SQLite to
+// Postgres, say) without hand-written SQL. Checkpoints and the fingerprints of
+// parsed files are left out, as they describe files on the host that parsed
+// them.
+func runBackup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	output := fs.String("output", "", "write the backup to `path` (- for standard output)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *output == "" {
+		return errors.New("backup needs --output")
+	}
+
+	st, ok, err := openExistingStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no database at %s", dbOpts.Path)
+	}
+	defer st.Close()
+
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *output != stdinPath {
+		if f, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	gz := gzip.NewWriter(bw)
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	counts, err := writeBackup(ctx, gz, st)
+	if err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	slog.Info("saved backup", append([]any{"path", *output}, backupAttrs(counts)...)...)
+	return nil
+}
+
+// writeBackup writes the header and every row of st to w, returning the number
+// of rows per table.
+func writeBackup(ctx context.Context, w io.Writer, st store) (map[string]int, error) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(backupHeader{backupFormat, backupVersion, time.Now().Format(time.RFC3339)}); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	write := func(r backupRecord) error {
+		counts[r.Table]++
+		return enc.Encode(r)
+	}
+
+	domains, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range domains {
+		if err := write(backupRecord{Table: "domains", Domain: d.Domain, FirstSeen: d.FirstSeen, LastSeen: d.LastSeen, Count: d.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	clients, err := st.loadDomainClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clients {
+		if err := write(backupRecord{Table: "domain_clients", Domain: c.Domain, Client: c.Client, FirstSeen: c.FirstSeen, LastSeen: c.LastSeen, Count: c.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	hours, err := st.loadDomainHours(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hours {
+		if err := write(backupRecord{Table: "domain_hours", Domain: h.Domain, Hour: h.Hour, Count: h.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	resolutions, err := st.loadDomainResolutions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for domain, r := range resolutions {
+		if err := write(backupRecord{Table: "domain_resolution", Domain: domain, Cached: r.Cached, Forwarded: r.Forwarded,
+			Blocked: r.Blocked, Replies: r.Replies, LatencyMs: r.LatencyMs, MaxLatencyMs: r.MaxLatencyMs}); err != nil {
+			return nil, err
+		}
+	}
+
+	sources, err := st.loadDomainSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range sources {
+		if err := write(backupRecord{Table: "domain_sources", Domain: r.Domain, Path: r.Path, Host: r.Host,
+			FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Count: r.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	types, err := st.loadDomainTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range types {
+		if err := write(backupRecord{Table: "domain_types", Domain: r.Domain, Type: r.Type, FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Count: r.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	addresses, err := st.loadDomainAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range addresses {
+		if err := write(backupRecord{Table: "domain_addresses", Domain: r.Domain, Address: r.Address, FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Count: r.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	devices, err := st.loadDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range devices {
+		if err := write(backupRecord{Table: "devices", Address: r.Address, MAC: r.MAC, Hostname: r.Hostname, FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Count: r.Count}); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := st.loadAddressInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for addr, i := range info {
+		if err := write(backupRecord{Table: "addresses", Address: addr, Country: i.Country, ASN: i.ASN, ASOrg: i.ASOrg, UpdatedAt: i.UpdatedAt}); err != nil {
+			return nil, err
+		}
+	}
+
+	registrations, err := st.loadRegistrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for domain, r := range registrations {
+		if err := write(backupRecord{Table: "registrations", Domain: domain, RegisteredAt: r.RegisteredAt, CheckedAt: r.CheckedAt}); err != nil {
+			return nil, err
+		}
+	}
+
+	ranks, err := st.loadRanks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for domain, r := range ranks {
+		if err := write(backupRecord{Table: "ranks", Domain: domain, Rank: r.Rank, UpdatedAt: r.UpdatedAt}); err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := st.loadDNSBL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for key, r := range results {
+		rec := backupRecord{Table: "dnsbl_results", Name: key.Name, Zone: key.Zone, Codes: strings.Join(r.Codes, ","), CheckedAt: r.CheckedAt}
+		if err := write(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	checks, err := st.loadLiveness(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for domain, l := range checks {
+		rec := backupRecord{Table: "domain_liveness", Domain: domain, Status: l.Status, Addresses: strings.Join(l.Addresses, ","), CheckedAt: l.CheckedAt}
+		if err := write(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	if db, ok := st.(*database); ok {
+		err := db.eachQuery(ctx, func(e queryEvent) error {
+			return write(backupRecord{Table: "queries", Timestamp: e.Timestamp, Domain: e.Domain, Type: e.Type, Client: e.Client, Action: e.Action})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// eachQuery calls fn with every row of the queries table.
+func (db *database) eachQuery(ctx context.Context, fn func(queryEvent) error) error {
+	rows, err := db.QueryContext(ctx, "SELECT timestamp, domain, type, client, action FROM queries")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e queryEvent
+		if err := rows.Scan(&e.Timestamp, &e.Domain, &e.Type, &e.Client, &e.Action); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// runRestore implements the restore subcommand: load a backup into the
+// database. Rows merge into what is stored as when parsing, so restoring into
+// an empty database reproduces the one backed up.
+func runRestore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: restore [flags] backup.jsonl.gz")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("restore needs one backup file (- for standard input)")
+	}
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	counts, err := restoreBackup(ctx, st, *dbOpts, in)
+	if err != nil {
+		return fmt.Errorf("restoring %s: %w", fs.Arg(0), err)
+	}
+	slog.Info("restored backup", append([]any{"path", fs.Arg(0)}, backupAttrs(counts)...)...)
+	return nil
+}
+
+// restoreBackup reads a backup from r into st, saving every restoreBatch
+// records, and returns the number of rows per table.
+func restoreBackup(ctx context.Context, st store, dbOpts dbOptions, r io.Reader) (map[string]int, error) {
+	dec := json.NewDecoder(r)
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if header.Format != backupFormat {
+		return nil, errors.New("not a backup file")
+	}
+	if header.Version > backupVersion {
+		return nil, fmt.Errorf("backup version %d is newer than this program supports (%d)", header.Version, backupVersion)
+	}
+
+	db, _ := st.(*database)
+	agg := newAggregator(nil, nil)
+	var queries []queryEvent
+	info := make(map[string]addressInfo)
+	registrations := make(map[string]registration)
+	ranks := make(map[string]domainRank)
+	checks := make(map[string]liveness)
+	results := make(map[dnsblKey]dnsblResult)
+	pending := 0
+	skippedQueries := false
+	counts := make(map[string]int)
+	save := func() error {
+		saveCtx, cancel := dbOpts.withTimeout(ctx)
+		defer cancel()
+		if err := agg.save(saveCtx, st); err != nil {
+			return err
+		}
+		if err := st.saveAddressInfo(saveCtx, info); err != nil {
+			return err
+		}
+		clear(info)
+		if err := st.saveRegistrations(saveCtx, registrations); err != nil {
+			return err
+		}
+		clear(registrations)
+		if err := st.saveRanks(saveCtx, ranks); err != nil {
+			return err
+		}
+		clear(ranks)
+		if err := st.saveLiveness(saveCtx, checks); err != nil {
+			return err
+		}
+		clear(checks)
+		if err := st.saveDNSBL(saveCtx, results); err != nil {
+			return err
+		}
+		clear(results)
+		if len(queries) > 0 {
+			if err := db.saveQueries(saveCtx, queries, 0); err != nil {
+				return fmt.Errorf("saving queries: %w", err)
+			}
+			queries = queries[:0]
+		}
+		pending = 0
+		return nil
+	}
+
+	for {
+		var rec backupRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return counts, err
+		}
+		t := domainTimes{FirstSeen: rec.FirstSeen, LastSeen: rec.LastSeen, Count: rec.Count}
+		switch rec.Table {
+		case "domains":
+			mergeInto(agg.domains, rec.Domain, t)
+		case "domain_clients":
+			mergeInto(agg.perClient, domainClient{Domain: rec.Domain, Client: rec.Client}, t)
+		case "domain_hours":
+			agg.hours[domainHour{Domain: rec.Domain, Hour: rec.Hour}] += rec.Count
+		case "domain_resolution":
+			mergeResolution(agg.resolutions, rec.Domain, resolution{Cached: rec.Cached, Forwarded: rec.Forwarded,
+				Blocked: rec.Blocked, Replies: rec.Replies, LatencyMs: rec.LatencyMs, MaxLatencyMs: rec.MaxLatencyMs})
+		case "domain_sources":
+			mergeInto(agg.sources.of(inputSource{rec.Path, rec.Host}), rec.Domain, t)
+		case "domain_types":
+			mergeInto(agg.types, domainType{Domain: rec.Domain, Type: rec.Type}, t)
+		case "domain_addresses":
+			mergeInto(agg.addresses, domainAddress{Domain: rec.Domain, Address: rec.Address}, t)
+		case "devices":
+			mergeInto(agg.devices, device{Address: rec.Address, MAC: rec.MAC, Hostname: rec.Hostname}, t)
+		case "addresses":
+			info[rec.Address] = addressInfo{Country: rec.Country, ASN: rec.ASN, ASOrg: rec.ASOrg, UpdatedAt: rec.UpdatedAt}
+		case "registrations":
+			registrations[rec.Domain] = registration{RegisteredAt: rec.RegisteredAt, CheckedAt: rec.CheckedAt}
+		case "ranks":
+			ranks[rec.Domain] = domainRank{Rank: rec.Rank, UpdatedAt: rec.UpdatedAt}
+		case "domain_liveness":
+			l := liveness{Status: rec.Status, CheckedAt: rec.CheckedAt}
+			if rec.Addresses != "" {
+				l.Addresses = strings.Split(rec.Addresses, ",")
+			}
+			checks[rec.Domain] = l
+		case "dnsbl_results":
+			r := dnsblResult{CheckedAt: rec.CheckedAt}
+			if rec.Codes != "" {
+				r.Codes = strings.Split(rec.Codes, ",")
+			}
+			results[dnsblKey{Name: rec.Name, Zone: rec.Zone}] = r
+		case "queries":
+			if db == nil {
+				if !skippedQueries {
+					slog.Warn("skipping the queries table, which needs a SQL database")
+					skippedQueries = true
+				}
+				continue
+			}
+			queries = append(queries, queryEvent{Timestamp: rec.Timestamp, Domain: rec.Domain, Type: rec.Type, Client: rec.Client, Action: rec.Action})
+		default:
+			return counts, fmt.Errorf("unknown table %q", rec.Table)
+		}
+		counts[rec.Table]++
+		if pending++; pending >= restoreBatch {
+			if err := save(); err != nil {
+				return counts, err
+			}
+		}
+	}
+	return counts, save()
+}
+
+func backupAttrs(counts map[string]int) []any {
+	var attrs []any
+	for _, table := range []string{"domains", "domain_clients", "domain_hours", "domain_resolution", "domain_sources", "domain_types", "domain_addresses", "devices", "addresses", "registrations", "ranks", "domain_liveness", "dnsbl_results", "queries"} {
+		attrs = append(attrs, table, counts[table])
+	}
+	return attrs
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// benchRun is the outcome of parsing the sample once.
+type benchRun struct {
+	lines, bytes, allocated int64
+	elapsed                 time.Duration
+}
+
+func (r benchRun) linesPerSec() float64 {
+	return float64(r.lines) / r.elapsed.Seconds()
+}
+
+// runBench implements the bench subcommand: parse the sample files several
+// times into memory, without a database, and report the throughput of each run
+// so performance changes can be measured reproducibly.
+func runBench(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	n := fs.Int("n", 5, "number of `runs`")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of goroutines parsing lines (1 parses on the reading goroutine)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *n < 1 {
+		return fmt.Errorf("-n must be at least 1")
+	}
+	inputs := inputPaths(fs)
+	if slices.Contains(inputs, stdinPath) {
+		return fmt.Errorf("bench reads its input more than once and cannot use stdin")
+	}
+
+	ctx, stop := notifyInterrupt(ctx)
+	defer stop()
+	rejects, err := newRejectLog("")
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "run\tlines\ttime\tlines/s\tMiB/s\tB/line\t")
+	var runs []benchRun
+	for i := range *n {
+		run, err := benchOnce(ctx, inputs, *workers, rejects)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		runs = append(runs, run)
+		fmt.Fprintf(tw, "%d\t%s\n", i+1, run.columns())
+	}
+
+	slices.SortFunc(runs, func(a, b benchRun) int { return int(a.elapsed - b.elapsed) })
+	fmt.Fprintf(tw, "best\t%s\n", runs[0].columns())
+	fmt.Fprintf(tw, "median\t%s\n", runs[len(runs)/2].columns())
+	return tw.Flush()
+}
+
+// benchOnce parses inputs once into a fresh aggregator.
+func benchOnce(ctx context.Context, inputs []string, workers int, rejects *rejectLog) (benchRun, error) {
+	prog, err := startProgress("off", inputs)
+	if err != nil {
+		return benchRun{}, err
+	}
+	agg := newAggregator(nil, rejects)
+	var lines lineSink = agg
+	var pool *parsePool
+	if workers > 1 {
+		pool = startParsePool(agg, workers)
+		defer pool.wait()
+		lines = pool
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for _, path := range inputs {
+		if _, _, err := parseFile(ctx, nil, dbOptions{}, path, lines, nil, prog); err != nil {
+			return benchRun{}, err
+		}
+	}
+	pool.wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	read, _ := prog.position()
+	return benchRun{
+		lines:     prog.lines.Load(),
+		bytes:     read,
+		allocated: int64(after.TotalAlloc - before.TotalAlloc),
+		elapsed:   elapsed,
+	}, nil
+}
+
+// columns formats the run for the table printed by runBench.
+func (r benchRun) columns() string {
+	perLine := 0.0
+	if r.lines > 0 {
+		perLine = float64(r.allocated) / float64(r.lines)
+	}
+	return fmt.Sprintf("%d\t%s\t%.0f\t%.1f\t%.1f\t", r.lines, r.elapsed.Round(time.Millisecond),
+		r.linesPerSec(), float64(r.bytes)/(1<<20)/r.elapsed.Seconds(), perLine)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// isBINDLine reports whether line looks like a line of BIND's log rather than
+// dnsmasq's: a query, or a line starting with the time named prints itself.
+func isBINDLine(line []byte) bool {
+	return isBINDTime(line) || isISOTime(line) || bytes.Contains(line, []byte("): query: "))
+}
+
+// isBINDTime and isISOTime report whether line starts like the two forms of
+// time bindTimestamp parses.
+func isBINDTime(line []byte) bool {
+	return len(line) >= 20 && line[2] == '-' && line[6] == '-' && line[11] == ' '
+}
+
+func isISOTime(line []byte) bool {
+	return len(line) >= 19 && line[4] == '-' && line[10] == 'T'
+}
+
+// parseBINDLine parses a line of named's queries category, logged to a file
+// channel with print-time or to syslog:
+//
+//	15-Mar-2024 10:22:33.123 queries: info: client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN A +E(0)K (192.168.1.1)
+//	Mar 15 10:22:33 ns1 named[1234]: client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN A +E(0)K (192.168.1.1)
+//
+// BIND logs queries only, so lines of other categories yield an empty Domain
+// and no query is ever answered.
+func parseBINDLine(line []byte, now time.Time) (logLine, error) {
+	var l logLine
+	var rest []byte
+	if t, ok := parseSyslogTimestamp(line, now); ok {
+		l.Timestamp = t.Unix()
+		rest = line[syslogTimestampLen:]
+		// Syslog puts the host name before the program tag, e.g. "named[1234]:".
+		var prev []byte
+		for {
+			var field []byte
+			if field, rest = nextField(rest); len(field) == 0 {
+				return l, nil
+			}
+			if field[len(field)-1] == ':' {
+				l.Host = prev
+				break
+			}
+			prev = field
+		}
+	} else if t, after, ok := bindTimestamp(line); ok {
+		l.Timestamp, rest = t.Unix(), after
+	} else {
+		return logLine{}, errBadTimestamp
+	}
+
+	// client [@0x...] address#port (name): query: name class type flags (server)
+	if rest = skipPast(rest, "client"); rest == nil {
+		return l, nil
+	}
+	client, rest := nextField(rest)
+	if bytes.HasPrefix(client, []byte("@0x")) {
+		client, rest = nextField(rest)
+	}
+	if rest = skipPast(rest, "query:"); rest == nil {
+		return l, nil
+	}
+	domain, rest := nextField(rest)
+	_, rest = nextField(rest) // the class, IN
+	qtype, _ := nextField(rest)
+	if len(qtype) == 0 {
+		return logLine{}, errBadQuery
+	}
+	l.Client, _, _ = bytes.Cut(client, []byte("#"))
+	l.Domain, l.Verb = domain, queryVerb(qtype)
+	return l, nil
+}
+
+// skipPast returns what follows the first field of s equal to word, or nil
+// when there is none.
+func skipPast(s []byte, word string) []byte {
+	for {
+		var field []byte
+		if field, s = nextField(s); len(field) == 0 {
+			return nil
+		}
+		if string(field) == word {
+			return s
+		}
+	}
+}
+
+// bindTimestamp parses the time named prints at the start of a line, as
+// 15-Mar-2024 10:22:33.123 (print-time yes or local) or in ISO 8601
+// (print-time iso8601 or iso8601-utc), and returns it with the rest of line.
+func bindTimestamp(line []byte) (time.Time, []byte, bool) {
+	// Both forms end at the first space after the date.
+	end := len(line)
+	if i := bytes.IndexByte(line[min(12, len(line)):], ' '); i >= 0 {
+		end = min(12, len(line)) + i
+	}
+	switch {
+	case isBINDTime(line):
+		t, err := time.ParseInLocation("02-Jan-2006 15:04:05", string(line[:end]), time.Local)
+		return t, line[end:], err == nil
+	case isISOTime(line):
+		t, err := time.Parse(time.RFC3339, string(line[:end]))
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02T15:04:05", string(line[:end]), time.Local)
+		}
+		return t, line[end:], err == nil
+	}
+	return time.Time{}, nil, false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseBINDLine(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.Local)
+	syslogTime, _ := parseSyslogTimestamp([]byte("Mar 15 10:22:33"), now)
+	local := time.Date(2024, time.March, 15, 10, 22, 33, 0, time.Local).Unix()
+	tests := []struct {
+		line                       string
+		timestamp                  int64
+		host, client, domain, verb string
+		err                        error
+	}{
+		{"15-Mar-2024 10:22:33.123 queries: info: client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN A +E(0)K (192.168.1.1)",
+			local, "", "192.168.1.10", "example.com", "query[A]", nil},
+		{"Mar 15 10:22:33 ns1 named[1234]: client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN AAAA +E(0)K (192.168.1.1)",
+			syslogTime.Unix(), "ns1", "192.168.1.10", "example.com", "query[AAAA]", nil},
+		{"2024-03-15T10:22:33.123Z queries: info: client @0x7f8b2c0a1b20 2001:db8::10#53422 (www.example.org): query: www.example.org IN HTTPS -E(0)DC (2001:db8::1)",
+			time.Date(2024, time.March, 15, 10, 22, 33, 0, time.UTC).Unix(), "", "2001:db8::10", "www.example.org", "query[HTTPS]", nil},
+		{"2024-03-15T10:22:33.123+01:00 client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN MX + (192.168.1.1)",
+			time.Date(2024, time.March, 15, 9, 22, 33, 0, time.UTC).Unix(), "", "192.168.1.10", "example.com", "query[MX]", nil},
+		{"2024-03-15T10:22:33.123 client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN TXT + (192.168.1.1)",
+			local, "", "192.168.1.10", "example.com", "query[TXT]", nil},
+		// BIND before 9.11 logs no client object address.
+		{"15-Mar-2024 10:22:33.123 client 192.168.1.10#53422 (example.com): query: example.com IN TYPE65 + (192.168.1.1)",
+			local, "", "192.168.1.10", "example.com", "query[TYPE65]", nil},
+		// Other categories say nothing about a query.
+		{"15-Mar-2024 10:22:33.123 general: info: zone example.com/IN: loaded serial 2024031501",
+			local, "", "", "", "", nil},
+		{"Mar 15 10:22:33 ns1 named[1234]: client @0x7f8b2c0a1b20 192.168.1.10#53422: received notify for zone 'example.com'",
+			syslogTime.Unix(), "ns1", "", "", "", nil},
+		{"15-Mar-2024 10:22:33.123 client 192.168.1.10#53422 (example.com): query: example.com IN",
+			0, "", "", "", "", errBadQuery},
+		{"yesterday client 192.168.1.10#53422 (example.com): query: example.com IN A +",
+			0, "", "", "", "", errBadTimestamp},
+		{"32-Mar-2024 10:22:33.123 client 192.168.1.10#53422 (example.com): query: example.com IN A +",
+			0, "", "", "", "", errBadTimestamp},
+	}
+	for _, tt := range tests {
+		l, err := parseBINDLine([]byte(tt.line), now)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q: error %v, want %v", tt.line, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if l.Timestamp != tt.timestamp || string(l.Host) != tt.host || string(l.Client) != tt.client || string(l.Domain) != tt.domain || string(l.Verb) != tt.verb {
+			t.Errorf("%q:\ngot  %d host %q client %q domain %q verb %q\nwant %d host %q client %q domain %q verb %q", tt.line,
+				l.Timestamp, l.Host, l.Client, l.Domain, l.Verb, tt.timestamp, tt.host, tt.client, tt.domain, tt.verb)
+		}
+		if tt.domain != "" && !l.isQuery() {
+			t.Errorf("%q: not a query", tt.line)
+		}
+	}
+}
+
+func TestParseAnyLine(t *testing.T) {
+	tests := []struct {
+		line, client, domain string
+	}{
+		{"15-Mar-2024 10:22:33.123 queries: info: client @0x7f8b2c0a1b20 192.168.1.10#53422 (example.com): query: example.com IN A +E(0)K (192.168.1.1)", "192.168.1.10", "example.com"},
+		{"Mar 15 10:22:33 ns1 named[1234]: client @0x7f8b2c0a1b20 192.168.1.11#53422 (example.org): query: example.org IN A + (192.168.1.1)", "192.168.1.11", "example.org"},
+		{"Mar 15 10:22:33 dnsmasq[812]: query[A] example.net from 192.168.1.12", "192.168.1.12", "example.net"},
+		{"[1710498153] unbound[1234:0] info: 192.168.1.13 example.com. A IN", "192.168.1.13", "example.com"},
+		{"Mar 15 10:22:33 ns1 unbound: [1234:0] info: 192.168.1.14 example.org. A IN", "192.168.1.14", "example.org"},
+	}
+	for _, tt := range tests {
+		l, err := parseAnyLine([]byte(tt.line), time.Now())
+		if err != nil {
+			t.Fatalf("%q: %v", tt.line, err)
+		}
+		if string(l.Client) != tt.client || string(l.Domain) != tt.domain {
+			t.Errorf("%q: client %q domain %q, want %q %q", tt.line, l.Client, l.Domain, tt.client, tt.domain)
+		}
+	}
+}
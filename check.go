@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// blocklist is a list of domains to check the database against. Listing a
+// domain lists its subdomains too, except those under an exception.
+type blocklist struct {
+	Name       string
+	Source     string // file path or URL
+	domains    map[string]bool
+	exceptions map[string]bool
+}
+
+// hostsNames are the names hosts files map to themselves, not blocked domains.
+var hostsNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// parseBlocklistArg reads a blocklist argument, name=source or source, naming
+// the list after the file name of the source, without extensions, unless
+// given.
+func parseBlocklistArg(arg string) *blocklist {
+	if name, source, ok := strings.Cut(arg, "="); ok && name != "" && !strings.ContainsAny(name, "/:") {
+		return &blocklist{Name: name, Source: source}
+	}
+	base := filepath.Base(arg)
+	if u, err := url.Parse(arg); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		base = path.Base(u.Path)
+		if base == "/" || base == "." {
+			base = u.Host
+		}
+	}
+	base = strings.TrimSuffix(base, ".gz")
+	return &blocklist{Name: strings.TrimSuffix(base, filepath.Ext(base)), Source: arg}
+}
+
+// load reads the list from its file, or downloads it from its URL.
+func (b *blocklist) load(ctx context.Context, client *http.Client) error {
+	if !strings.HasPrefix(b.Source, "http://") && !strings.HasPrefix(b.Source, "https://") {
+		in, err := openInput(b.Source)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return b.parse(in)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.Source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", b.Source, resp.Status)
+	}
+	return b.parse(resp.Body)
+}
+
+// parse reads the entries of a hosts file ("0.0.0.0 example.com"), a domain
+// list, or an AdGuard or Adblock Plus filter list: "||example.com^" rules and
+// "@@||example.com^" exceptions. Rules that depend on more than the domain,
+// such as those with $client or $dnstype modifiers, wildcards or regular
+// expressions, are skipped.
+func (b *blocklist) parse(r io.Reader) error {
+	b.domains, b.exceptions = make(map[string]bool), make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			exception := strings.HasPrefix(line, "@@")
+			rule, modifiers, _ := strings.Cut(strings.TrimPrefix(line, "@@"), "$")
+			if modifiers != "" && modifiers != "important" {
+				continue
+			}
+			domain, ok := strings.CutSuffix(strings.TrimPrefix(rule, "||"), "^")
+			if !ok && strings.ContainsAny(domain, "^/") {
+				continue
+			}
+			if domain = canonicalDomain(domain); validListDomain(domain) {
+				if exception {
+					b.exceptions[domain] = true
+				} else {
+					b.domains[domain] = true
+				}
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:] // hosts: address then names
+		}
+		for _, f := range fields {
+			domain := canonicalDomain(strings.TrimPrefix(f, "*."))
+			if validListDomain(domain) && !hostsNames[domain] {
+				b.domains[domain] = true
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", b.Source, err)
+	}
+	return nil
+}
+
+// validListDomain reports whether a list entry is a plain domain name, with
+// no wildcards or other pattern characters left in it.
+func validListDomain(domain string) bool {
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") || strings.Contains(domain, "..") {
+		return false
+	}
+	for _, c := range domain {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the entry of the list that domain (forward order) falls
+// under, itself or a parent, or "" when not listed or excepted.
+func (b *blocklist) match(domain string) string {
+	var entry string
+	for d := domain; ; {
+		if b.exceptions[d] {
+			return ""
+		}
+		if entry == "" && b.domains[d] {
+			entry = d
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			return entry
+		}
+		d = d[i+1:]
+	}
+}
+
+// checkMatch is a stored domain found on one or more lists.
+type checkMatch struct {
+	domainRow
+	Lists []string // "name" when listed as is, "name (entry)" when under an entry
+}
+
+// runCheck implements the check subcommand: the stored domains found on the
+// given blocklists, such as threat feeds, with the lists they are on.
+func runCheck(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	since := fs.String("since", "", "only check domains last seen after this `time` (duration such as 24h or 7d, or a date)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: check [flags] [name=]list...")
+		fmt.Fprintln(fs.Output(), "Each list is a file or an http(s) URL of a hosts file, a domain list or an AdGuard filter list.")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("check needs at least one blocklist")
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	lists := make([]*blocklist, fs.NArg())
+	for i, arg := range fs.Args() {
+		lists[i] = parseBlocklistArg(arg)
+		if err := lists[i].load(ctx, client); err != nil {
+			return fmt.Errorf("loading blocklist %s: %w", lists[i].Name, err)
+		}
+		slog.Info("loaded blocklist", "name", lists[i].Name, "domains", len(lists[i].domains), "exceptions", len(lists[i].exceptions))
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+
+	matched := make([]int, len(lists))
+	var matches []checkMatch
+	for _, row := range rows {
+		if row.LastSeen < cutoff {
+			continue
+		}
+		domain := reverseDomainParts(row.Domain)
+		var on []string
+		for i, l := range lists {
+			switch entry := l.match(domain); entry {
+			case "":
+				continue
+			case domain:
+				on = append(on, l.Name)
+			default:
+				on = append(on, fmt.Sprintf("%s (%s)", l.Name, entry))
+			}
+			matched[i]++
+		}
+		if len(on) > 0 {
+			matches = append(matches, checkMatch{domainRow: row, Lists: on})
+		}
+	}
+	slices.SortFunc(matches, func(a, b checkMatch) int {
+		if c := cmpInt(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LIST\tENTRIES\tDOMAINS SEEN")
+	for i, l := range lists {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", l.Name, len(l.domains), matched[i])
+	}
+	if len(matches) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "DOMAIN\tFIRST SEEN\tLAST SEEN\tQUERIES\tLISTS")
+		for _, m := range matches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", reverseDomainParts(m.Domain), formatUnix(m.FirstSeen),
+				formatUnix(m.LastSeen), m.Count, strings.Join(m.Lists, ", "))
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// errInterrupted is returned when a run stops early on SIGINT or SIGTERM after
+// saving what it had read so far.
+var errInterrupted = errors.New("interrupted")
+
+// exitInterrupted is the exit status of an interrupted run (128 + SIGINT, as shells report it).
+const exitInterrupted = 130
+
+// notifyInterrupt returns a context derived from ctx that is also cancelled on
+// SIGINT or SIGTERM.
+func notifyInterrupt(ctx context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+}
+
+// checkpoint is how far into a log file a run got, so the next run can resume there.
+type checkpoint struct {
+	Path   string
+	Inode  uint64
+	Offset int64
+}
+
+// resumes reports whether the checkpoint still applies to the file described by
+// info: the same file (where inodes are available) that has not been truncated.
+func (c checkpoint) resumes(info os.FileInfo) bool {
+	if c.Inode != 0 && c.Inode != fileInode(info) {
+		return false
+	}
+	return info.Size() >= c.Offset
+}
+
+func (db *database) loadCheckpoint(ctx context.Context, path string) (checkpoint, bool, error) {
+	c := checkpoint{Path: path}
+	err := db.QueryRowContext(ctx, "SELECT inode, byte_offset FROM checkpoints WHERE path = ?", path).Scan(&c.Inode, &c.Offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	return c, true, nil
+}
+
+func (db *database) saveCheckpoints(ctx context.Context, checkpoints []checkpoint) error {
+	now := time.Now().Unix()
+	args := make([]any, 0, 4*len(checkpoints))
+	for _, c := range checkpoints {
+		args = append(args, c.Path, c.Inode, c.Offset, now)
+	}
+	return db.upsertRows(ctx, "checkpoints", []upsertColumn{
+		{"path", mergeKey},
+		{"inode", mergeReplace},
+		{"byte_offset", mergeReplace},
+		{"updated_at", mergeReplace},
+	}, args)
+}
+
+// clearCheckpoints forgets the checkpoints of files that were read to the end.
+func (db *database) clearCheckpoints(ctx context.Context, paths []string) error {
+	for _, path := range paths {
+		if _, err := db.ExecContext(ctx, "DELETE FROM checkpoints WHERE path = ?", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// domainClient keys the per-client observations of a (reversed) domain.
+type domainClient struct {
+	Domain string
+	Client string
+}
+
+// clientFilter is a list of client prefixes; single addresses are stored as /32 or /128.
+// It implements flag.Value so --client can be given more than once.
+type clientFilter []netip.Prefix
+
+func (f *clientFilter) String() string {
+	parts := make([]string, len(*f))
+	for i, p := range *f {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *clientFilter) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return err
+			}
+			*f = append(*f, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return nil
+}
+
+// matches reports whether client falls inside one of the filter prefixes.
+// A client stored as a network by --anonymize-clients truncate matches when
+// all of it does. An empty filter matches everything, including lines with no
+// client.
+func (f clientFilter) matches(client string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	network, err := netip.ParsePrefix(client)
+	if err != nil {
+		addr, err := netip.ParseAddr(client)
+		if err != nil {
+			return false
+		}
+		network = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	}
+	for _, p := range f {
+		if p.Bits() <= network.Bits() && p.Contains(network.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *database) saveDomainClients(ctx context.Context, clients map[domainClient]domainTimes) error {
+	args := make([]any, 0, 5*len(clients))
+	for key, times := range clients {
+		args = append(args, key.Domain, key.Client, times.FirstSeen, times.LastSeen, times.Count)
+	}
+	return db.upsertRows(ctx, "domain_clients", []upsertColumn{
+		{"domain", mergeKey},
+		{"client", mergeKey},
+		{"first_seen", mergeMin},
+		{"last_seen", mergeMax},
+		{"count", mergeAdd},
+	}, args)
+}
+
+func (db *database) loadDomainClients(ctx context.Context) ([]domainClientRow, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, client, first_seen, last_seen, count FROM domain_clients")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []domainClientRow
+	for rows.Next() {
+		var r domainClientRow
+		if err := rows.Scan(&r.Domain, &r.Client, &r.FirstSeen, &r.LastSeen, &r.Count); err != nil {
+			return nil, err
+		}
+		clients = append(clients, r)
+	}
+	return clients, rows.Err()
+}
+
+const clientFlagUsage = "only include queries from this client `address or CIDR` (repeatable)"
+
+// addClientFlag registers the repeatable --client filter on fs.
+func addClientFlag(fs *flag.FlagSet) *clientFilter {
+	var clients clientFilter
+	fs.Var(&clients, "client", clientFlagUsage)
+	return &clients
+}
+
+// loadClientDomainRows returns the domains queried by clients matching the filter,
+// with first/last seen aggregated over those clients only.
+func loadClientDomainRows(ctx context.Context, st store, clients clientFilter) ([]domainRow, error) {
+	rows, err := st.loadDomainClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byDomain := make(map[string]domainTimes)
+	for _, r := range rows {
+		if !clients.matches(r.Client) {
+			continue
+		}
+		current, exists := byDomain[r.Domain]
+		if !exists {
+			current.FirstSeen, current.LastSeen = r.FirstSeen, r.LastSeen
+		}
+		current.FirstSeen = min(current.FirstSeen, r.FirstSeen)
+		current.LastSeen = max(current.LastSeen, r.LastSeen)
+		current.Count += r.Count
+		byDomain[r.Domain] = current
+	}
+
+	domains := make([]domainRow, 0, len(byDomain))
+	for domain, times := range byDomain {
+		domains = append(domains, domainRow{Domain: domain, FirstSeen: times.FirstSeen, LastSeen: times.LastSeen, Count: times.Count})
+	}
+	return domains, nil
+}
+
+// runClients implements the clients subcommand: the activity of each client,
+// with its busiest domains, as a fingerprint of every device on the network.
+func runClients(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("clients", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	since := fs.String("since", "", "only include domains a client queried after this `time` (duration such as 24h or 7d, or a date), with their all-time counts")
+	n := addLimitFlag(fs, 5, "list the top `n` domains of each client")
+	format := fs.String("format", "text", "output `format`: text, csv or jsonl")
+	output := fs.String("output", "", "write to `path` instead of standard output")
+	ouiPath := fs.String("oui", "", ouiFlagUsage)
+	naming := addClientNamesFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	write, ok := map[string]func(io.Writer, []reportClient) error{
+		"text":  writeClientsText,
+		"csv":   writeClientsCSV,
+		"jsonl": writeClientsJSONL,
+	}[*format]
+	if !ok {
+		return fmt.Errorf("unknown clients format %q", *format)
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+	oui, err := loadOUI(*ouiPath)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainClients(loadCtx)
+	if err != nil {
+		return err
+	}
+	leases, err := st.loadDevices(loadCtx)
+	if err != nil {
+		return err
+	}
+	summary := summarizeClients(rows, *clients, cutoff, *n)
+	devices := currentDevices(leases)
+	addresses := make([]string, len(summary))
+	for i, c := range summary {
+		addresses[i] = c.Client
+	}
+	names, err := nameClients(loadCtx, devices, *naming, addresses)
+	if err != nil {
+		return err
+	}
+	for i, c := range summary {
+		summary[i].Hostname = names[c.Client]
+		if d, ok := devices[c.Client]; ok {
+			summary[i].MAC, summary[i].Vendor = d.MAC, oui.vendor(d.MAC)
+		}
+	}
+
+	if *output == "" {
+		return write(os.Stdout, summary)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := write(f, summary); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	slog.Info("saved clients", "path", *output, "clients", len(summary))
+	return nil
+}
+
+// summarizeClients totals the stored rows of each client matching filter that
+// were last seen at or after cutoff, busiest client first, along with its n
+// most-queried domains.
+func summarizeClients(rows []domainClientRow, filter clientFilter, cutoff int64, n int) []reportClient {
+	byClient := make(map[string]*reportClient)
+	domains := make(map[string][]domainCount)
+	for _, r := range rows {
+		if r.LastSeen < cutoff || !filter.matches(r.Client) {
+			continue
+		}
+		c, ok := byClient[r.Client]
+		if !ok {
+			c = &reportClient{Client: r.Client, FirstSeen: time.Unix(r.FirstSeen, 0), LastSeen: time.Unix(r.LastSeen, 0)}
+			byClient[r.Client] = c
+		}
+		c.Queries += r.Count
+		c.Domains++
+		if first := time.Unix(r.FirstSeen, 0); first.Before(c.FirstSeen) {
+			c.FirstSeen = first
+		}
+		if last := time.Unix(r.LastSeen, 0); last.After(c.LastSeen) {
+			c.LastSeen = last
+		}
+		if n > 0 {
+			domains[r.Client] = append(domains[r.Client], domainCount{r.Domain, r.Count})
+		}
+	}
+
+	summary := make([]reportClient, 0, len(byClient))
+	for client, c := range byClient {
+		top := domains[client]
+		sortDomainCounts(top)
+		for _, d := range top[:min(n, len(top))] {
+			c.TopDomains = append(c.TopDomains, domainCount{reverseDomainParts(d.Domain), d.Count})
+		}
+		summary = append(summary, *c)
+	}
+	slices.SortFunc(summary, func(a, b reportClient) int {
+		if c := cmpInt(b.Queries, a.Queries); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Client, b.Client)
+	})
+	return summary
+}
+
+func writeClientsText(w io.Writer, clients []reportClient) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tVENDOR\tQUERIES\tDOMAINS\tFIRST SEEN\tLAST SEEN\tTOP DOMAINS")
+	for _, c := range clients {
+		top := make([]string, len(c.TopDomains))
+		for i, d := range c.TopDomains {
+			top[i] = fmt.Sprintf("%s (%d)", d.Domain, d.Count)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", c.Label(), cmp.Or(c.Vendor, "-"), c.Queries, c.Domains,
+			c.FirstSeen.Format("2006-01-02 15:04"), c.LastSeen.Format("2006-01-02 15:04"), strings.Join(top, ", "))
+	}
+	return tw.Flush()
+}
+
+// writeClientsCSV writes a CSV document with a header row, timestamps in RFC
+// 3339 as in domain exports, and the top domains as domain:count pairs joined by
+// semicolons.
+func writeClientsCSV(w io.Writer, clients []reportClient) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"client", "hostname", "mac", "vendor", "queries", "domains", "first_seen", "last_seen", "top_domains"})
+	for _, c := range clients {
+		top := make([]string, len(c.TopDomains))
+		for i, d := range c.TopDomains {
+			top[i] = d.Domain + ":" + strconv.FormatInt(d.Count, 10)
+		}
+		cw.Write([]string{
+			c.Client,
+			c.Hostname,
+			c.MAC,
+			c.Vendor,
+			strconv.FormatInt(c.Queries, 10),
+			strconv.FormatInt(c.Domains, 10),
+			c.FirstSeen.Format(time.RFC3339),
+			c.LastSeen.Format(time.RFC3339),
+			strings.Join(top, ";"),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// clientRecord is the JSON Lines representation of a client summary.
+type clientRecord struct {
+	Client       string            `json:"client"`
+	Hostname     string            `json:"hostname,omitempty"`
+	MAC          string            `json:"mac,omitempty"`
+	Vendor       string            `json:"vendor,omitempty"`
+	Queries      int64             `json:"queries"`
+	Domains      int64             `json:"domains"`
+	FirstSeen    int64             `json:"first_seen"`
+	FirstSeenISO string            `json:"first_seen_iso"`
+	LastSeen     int64             `json:"last_seen"`
+	LastSeenISO  string            `json:"last_seen_iso"`
+	TopDomains   []topDomainRecord `json:"top_domains"`
+}
+
+type topDomainRecord struct {
+	Domain string `json:"domain"`
+	Count  int64  `json:"count"`
+}
+
+func newClientRecord(c reportClient) clientRecord {
+	top := make([]topDomainRecord, len(c.TopDomains))
+	for i, d := range c.TopDomains {
+		top[i] = topDomainRecord{d.Domain, d.Count}
+	}
+	return clientRecord{
+		Client:       c.Client,
+		Hostname:     c.Hostname,
+		MAC:          c.MAC,
+		Vendor:       c.Vendor,
+		Queries:      c.Queries,
+		Domains:      c.Domains,
+		FirstSeen:    c.FirstSeen.Unix(),
+		FirstSeenISO: c.FirstSeen.Format(time.RFC3339),
+		LastSeen:     c.LastSeen.Unix(),
+		LastSeenISO:  c.LastSeen.Format(time.RFC3339),
+		TopDomains:   top,
+	}
+}
+
+func writeClientsJSONL(w io.Writer, clients []reportClient) error {
+	enc := json.NewEncoder(w)
+	for _, c := range clients {
+		if err := enc.Encode(newClientRecord(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClientFilter(t *testing.T) {
+	tests := []struct {
+		flags   []string // --client values
+		str     string
+		matches []string
+		misses  []string
+	}{
+		{nil, "", []string{"192.168.1.10", "2001:db8::1", "laptop.lan", ""}, nil},
+		{[]string{"192.168.1.10"}, "192.168.1.10/32",
+			[]string{"192.168.1.10", "::ffff:192.168.1.10"},
+			[]string{"192.168.1.11", "192.168.1.0/24", "laptop.lan", ""}},
+		{[]string{"192.168.1.77/24"}, "192.168.1.0/24",
+			[]string{"192.168.1.1", "192.168.1.255", "192.168.1.0/24", "192.168.1.128/25"},
+			[]string{"192.168.2.1", "192.168.0.0/16", "10.0.0.1", "::ffff:c0a8:0101/120"}},
+		{[]string{"2001:db8::/32"}, "2001:db8::/32",
+			[]string{"2001:db8::1", "2001:db8:ffff::1", "2001:db8:1234::/48"},
+			[]string{"2001:db9::1", "2001::/16", "192.168.1.1"}},
+		{[]string{"10.0.0.0/8, 2001:db8::/32", "192.168.1.10"}, "10.0.0.0/8,2001:db8::/32,192.168.1.10/32",
+			[]string{"10.255.0.1", "2001:db8::53", "192.168.1.10"},
+			[]string{"11.0.0.1", "192.168.1.11"}},
+		{[]string{" 10.0.0.1 ,,"}, "10.0.0.1/32", []string{"10.0.0.1"}, []string{"10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		var f clientFilter
+		for _, v := range tt.flags {
+			if err := f.Set(v); err != nil {
+				t.Fatalf("--client %q: %v", v, err)
+			}
+		}
+		if got := f.String(); got != tt.str {
+			t.Errorf("--client %q: %q, want %q", tt.flags, got, tt.str)
+		}
+		for _, client := range tt.matches {
+			if !f.matches(client) {
+				t.Errorf("--client %q does not match %q", tt.flags, client)
+			}
+		}
+		for _, client := range tt.misses {
+			if f.matches(client) {
+				t.Errorf("--client %q matches %q", tt.flags, client)
+			}
+		}
+	}
+}
+
+func TestClientFilterInvalid(t *testing.T) {
+	for _, v := range []string{"10.0.0.0/33", "laptop.lan", "10.0.0.1/x", "10.0.0.256", "10.0.0.1,bad"} {
+		var f clientFilter
+		if err := f.Set(v); err == nil {
+			t.Errorf("--client %q: no error", v)
+		}
+	}
+}
+
+func TestLoadClientDomainRows(t *testing.T) {
+	ctx := context.Background()
+	st := newMemoryStore()
+	err := st.saveDomainClients(ctx, map[domainClient]domainTimes{
+		{"com.example", "192.168.1.10"}: {FirstSeen: 100, LastSeen: 200, Count: 2},
+		{"com.example", "192.168.1.11"}: {FirstSeen: 50, LastSeen: 150, Count: 3},
+		{"com.example", "10.0.0.1"}:     {FirstSeen: 10, LastSeen: 900, Count: 9},
+		{"org.example", "192.168.1.11"}: {FirstSeen: 300, LastSeen: 300, Count: 1},
+		{"net.example", "10.0.0.1"}:     {FirstSeen: 400, LastSeen: 400, Count: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		want   []domainRow
+	}{
+		{"192.168.1.0/24", []domainRow{
+			{Domain: "com.example", FirstSeen: 50, LastSeen: 200, Count: 5},
+			{Domain: "org.example", FirstSeen: 300, LastSeen: 300, Count: 1},
+		}},
+		{"192.168.1.10", []domainRow{{Domain: "com.example", FirstSeen: 100, LastSeen: 200, Count: 2}}},
+		{"10.0.0.0/8", []domainRow{
+			{Domain: "com.example", FirstSeen: 10, LastSeen: 900, Count: 9},
+			{Domain: "net.example", FirstSeen: 400, LastSeen: 400, Count: 1},
+		}},
+		{"172.16.0.0/12", []domainRow{}},
+	}
+	for _, tt := range tests {
+		var f clientFilter
+		if err := f.Set(tt.client); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadClientDomainRows(ctx, st, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.SortFunc(got, func(a, b domainRow) int { return strings.Compare(a.Domain, b.Domain) })
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("--client %s: %v, want %v", tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestClientFilterWhileParsing(t *testing.T) {
+	var f clientFilter
+	if err := f.Set("192.168.1.0/24,2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	agg := newAggregator(f, nil)
+	for _, line := range []string{
+		"Mar  1 00:00:01 dnsmasq[812]: query[A] example.com from 192.168.1.10",
+		"Mar  1 00:00:02 dnsmasq[812]: query[A] example.org from 10.0.0.1",
+		"Mar  1 00:00:03 dnsmasq[812]: query[AAAA] example.net from 2001:db8::53",
+		"Mar  1 00:00:04 dnsmasq[812]: query[A] example.com from 192.168.2.10",
+		"Mar  1 00:00:05 dnsmasq[812]: forwarded example.org to 1.1.1.1",
+	} {
+		agg.addLine([]byte(line))
+	}
+	var domains, clients []string
+	for d := range agg.domains {
+		domains = append(domains, d)
+	}
+	for key := range agg.perClient {
+		clients = append(clients, key.Client)
+	}
+	slices.Sort(domains)
+	slices.Sort(clients)
+	if want := []string{"com.example", "net.example"}; !slices.Equal(domains, want) {
+		t.Errorf("domains %q, want %q", domains, want)
+	}
+	if want := []string{"192.168.1.10", "2001:db8::53"}; !slices.Equal(clients, want) {
+		t.Errorf("clients %q, want %q", clients, want)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// runCollect implements the collect subcommand: serve the gRPC API of
+// proto/dnsmasq_parse.proto, saving the queries agents send (see forward) to
+// the database and answering lookups from it.
+func runCollect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	rejectsPath := addRejectsFlag(fs)
+	anonymize := addAnonymizeFlags(fs)
+	format := addInputFormatFlag(fs)
+	listen := fs.String("listen", ":8054", "serve gRPC at `address`")
+	certFile := fs.String("tls-cert", "", "serve TLS with the certificate in `file`, with --tls-key")
+	keyFile := fs.String("tls-key", "", "the private key of --tls-cert, in `file`")
+	interval := fs.Duration("flush", 30*time.Second, "how often to save to the database")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		return errors.New("--tls-cert and --tls-key go together")
+	}
+	parse, err := inputFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return fmt.Errorf("initializing database: %w", err)
+	}
+	defer st.Close()
+
+	rejects, err := newRejectLog(*rejectsPath)
+	if err != nil {
+		return err
+	}
+	defer rejects.close()
+
+	c := &collector{st: st, dbOpts: *dbOpts, rejects: rejects, agg: newAggregator(*clients, rejects)}
+	c.agg.parse = parse.live()
+	if err := anonymize.enable(c.agg); err != nil {
+		return err
+	}
+	protocols := new(http.Protocols)
+	if *certFile != "" {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	srv := &http.Server{
+		Handler:           c.handler(),
+		Protocols:         protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	served := make(chan error, 1)
+	go func() {
+		if *certFile != "" {
+			served <- srv.ServeTLS(ln, *certFile, *keyFile)
+		} else {
+			served <- srv.Serve(ln)
+		}
+	}()
+	slog.Info("serving gRPC", "address", ln.Addr().String())
+
+	ctx, stop := notifyInterrupt(ctx)
+	defer stop()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.flush(ctx); err != nil {
+				srv.Close()
+				return err
+			}
+		case err := <-served:
+			return err
+		case <-ctx.Done():
+			// Agents keep their streams open, so give them a moment to
+			// finish the calls in flight, then save what they sent.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			srv.Shutdown(shutdownCtx)
+			cancel()
+			srv.Close()
+			return c.flush(context.WithoutCancel(ctx))
+		}
+	}
+}
+
+// collector serves the gRPC API, aggregating what is ingested until flush
+// saves it.
+type collector struct {
+	st      store
+	dbOpts  dbOptions
+	rejects *rejectLog
+
+	mu  sync.Mutex // guards agg, which flush saves in place
+	agg *aggregator
+}
+
+// handler serves the methods of the API.
+func (c *collector) handler() http.Handler {
+	return grpcHandler(map[string]func(*grpcStream) error{
+		"Ingest":       c.ingest,
+		"Lookup":       c.lookup,
+		"ListNewSince": c.listNewSince,
+	})
+}
+
+func (c *collector) flush(ctx context.Context) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.rejects.flush(); err != nil {
+		return err
+	}
+	n := c.agg.pending()
+	if n == 0 {
+		return nil
+	}
+	ctx, span := startSpan(ctx, "flush", "domains", n)
+	defer func() { span.end(err) }()
+	saveCtx, cancel := c.dbOpts.withTimeout(ctx)
+	defer cancel()
+	if err := c.agg.save(saveCtx, c.st); err != nil {
+		return fmt.Errorf("saving domains to database: %w", err)
+	}
+	slog.Info("saved domains", "domains", n)
+	return nil
+}
+
+// ingest implements Ingest, adding each message as it arrives. Messages
+// without a source are attributed to the agent's address.
+func (c *collector) ingest(s *grpcStream) error {
+	host, _, _ := net.SplitHostPort(s.r.RemoteAddr)
+	var resp ingestResponse
+	for {
+		var req ingestRequest
+		err := s.recv(&req)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if req.Source == "" {
+			req.Source = host
+		}
+		c.mu.Lock()
+		c.agg.beginSource(req.Source)
+		for _, line := range req.Lines {
+			c.agg.addLine([]byte(line))
+		}
+		for _, q := range req.Queries {
+			c.agg.addParsed(logLine{
+				Timestamp: q.Timestamp,
+				Verb:      []byte("query[" + q.Type + "]"),
+				Domain:    []byte(q.Domain),
+				Client:    []byte(q.Client),
+			})
+		}
+		c.mu.Unlock()
+		resp.Lines += uint64(len(req.Lines))
+		resp.Queries += uint64(len(req.Queries))
+	}
+	slog.Debug("ingested", "agent", host, "lines", resp.Lines, "queries", resp.Queries)
+	return s.send(&resp)
+}
+
+// lookup implements Lookup.
+func (c *collector) lookup(s *grpcStream) error {
+	var req lookupRequest
+	if err := s.recvRequest(&req); err != nil {
+		return err
+	}
+	reversed := reverseDomainParts(canonicalDomain(req.Domain))
+	ctx, cancel := c.dbOpts.withTimeout(s.r.Context())
+	defer cancel()
+	rows, err := c.st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Domain == reversed {
+			return s.send(newDomainMessage(row))
+		}
+	}
+	return grpcErrorf(grpcNotFound, "domain %s not found", req.Domain)
+}
+
+// listNewSince implements ListNewSince.
+func (c *collector) listNewSince(s *grpcStream) error {
+	var req listNewSinceRequest
+	if err := s.recvRequest(&req); err != nil {
+		return err
+	}
+	ctx, cancel := c.dbOpts.withTimeout(s.r.Context())
+	defer cancel()
+	rows, err := c.st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	var fresh []domainRow
+	for _, row := range rows {
+		if row.FirstSeen >= req.Since {
+			fresh = append(fresh, row)
+		}
+	}
+	sortDomainRows(fresh, "first_seen", false)
+	for _, row := range fresh {
+		if err := s.send(newDomainMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDomainMessage(row domainRow) *domainMessage {
+	return &domainMessage{
+		Domain:    reverseDomainParts(row.Domain),
+		FirstSeen: row.FirstSeen,
+		LastSeen:  row.LastSeen,
+		Count:     row.Count,
+	}
+}
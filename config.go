@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// envPrefix prefixes the environment variables that stand in for flags,
+// e.g. DNSMASQ_PARSE_DB for --db or DNSMASQ_PARSE_EXPORT_FORMAT for export --format.
+const envPrefix = "DNSMASQ_PARSE_"
+
+// parseFlags parses args into fs, then fills every flag not given on the command line
+// from the environment or the YAML config file, in that order. Config values are
+// looked up in the sections named after the command (fs.Name() unless sections are
+// given), then at the top level of the file.
+//
+// Commands that read logs, those with --input-format, take their input files from
+// DNSMASQ_PARSE_INPUTS (a list like PATH) or an inputs list when given none.
+//
+//	db: /var/lib/dnsmasq-parse/unique_domains.db
+//	client: [192.168.30.0/24]
+//	inputs: [/var/log/dnsmasq.log]
+//	export:
+//	  format: csv
+func parseFlags(fs *flag.FlagSet, args []string, sections ...string) error {
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML configuration `file`")
+	logging := addLogFlags(fs)
+	profiling := addProfileFlags(fs)
+	telemetry := addTelemetryFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(sections) == 0 {
+		sections = []string{fs.Name()}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var config map[string]any
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("reading %s: %w", *configPath, err)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "config" {
+			return
+		}
+		if values, ok := flagFromEnv(f.Name, sections); ok {
+			err = setFlag(fs, f.Name, values, "environment")
+			return
+		}
+		if values, ok := flagFromConfig(config, f.Name, sections); ok {
+			err = setFlag(fs, f.Name, values, *configPath)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 && fs.Lookup("input-format") != nil {
+		if err := setInputs(fs, config, sections); err != nil {
+			return err
+		}
+	}
+	if err := logging.setup(); err != nil {
+		return err
+	}
+	if err := profiling.start(); err != nil {
+		return err
+	}
+	return telemetry.start()
+}
+
+func setFlag(fs *flag.FlagSet, name string, values []string, source string) error {
+	for _, v := range values {
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("invalid value %q for %s from %s: %w", v, name, source, err)
+		}
+	}
+	return nil
+}
+
+// setInputs makes the configured input files the positional arguments of fs.
+func setInputs(fs *flag.FlagSet, config map[string]any, sections []string) error {
+	inputs, ok := flagFromEnv("inputs", sections)
+	if ok {
+		inputs = filepath.SplitList(inputs[0])
+	} else {
+		inputs, _ = flagFromConfig(config, "inputs", sections)
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+	return fs.Parse(append([]string{"--"}, inputs...))
+}
+
+// flagFromEnv looks up DNSMASQ_PARSE_<SECTION>_<FLAG>, then DNSMASQ_PARSE_<FLAG>.
+func flagFromEnv(name string, sections []string) ([]string, bool) {
+	key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	for _, section := range sections {
+		section = strings.ToUpper(strings.ReplaceAll(section, "-", "_"))
+		if v, ok := os.LookupEnv(envPrefix + section + "_" + key); ok {
+			return []string{v}, true
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + key); ok {
+		return []string{v}, true
+	}
+	return nil, false
+}
+
+// flagFromConfig looks up name in the command sections of config, then at its top level.
+// Lists yield one value per element so repeatable flags can be configured.
+func flagFromConfig(config map[string]any, name string, sections []string) ([]string, bool) {
+	for _, section := range sections {
+		if m, ok := config[section].(map[string]any); ok {
+			if v, ok := m[name]; ok {
+				return configValues(v), true
+			}
+		}
+	}
+	if v, ok := config[name]; ok {
+		if _, isSection := v.(map[string]any); !isSection {
+			return configValues(v), true
+		}
+	}
+	return nil, false
+}
+
+func configValues(v any) []string {
+	if list, ok := v.([]any); ok {
+		values := make([]string, len(list))
+		for i, item := range list {
+			values[i] = fmt.Sprint(item)
+		}
+		return values
+	}
+	return []string{fmt.Sprint(v)}
+}
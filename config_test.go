@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// parseTestFlags parses args into a parse-like flag set, reading config as
+// the YAML configuration file.
+func parseTestFlags(t *testing.T, config string, args ...string) (*flag.FlagSet, *dbOptions) {
+	t.Helper()
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	dbOpts := addDBFlag(fs)
+	addInputFormatFlag(fs)
+	if err := parseFlags(fs, append([]string{"--config", path}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return fs, dbOpts
+}
+
+func TestParseFlagsPrecedence(t *testing.T) {
+	const config = "db: file.db\nparse:\n  input-format: bind\n"
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		db     string
+		format string
+	}{
+		{"file", nil, nil, "file.db", "bind"},
+		{"env over file", map[string]string{"DNSMASQ_PARSE_DB": "env.db", "DNSMASQ_PARSE_PARSE_INPUT_FORMAT": "unbound"}, nil, "env.db", "unbound"},
+		{"command section env over plain env", map[string]string{"DNSMASQ_PARSE_INPUT_FORMAT": "dnsmasq", "DNSMASQ_PARSE_PARSE_INPUT_FORMAT": "unbound"}, nil, "file.db", "unbound"},
+		{"command line over env", map[string]string{"DNSMASQ_PARSE_DB": "env.db"}, []string{"--db", "cli.db", "--input-format", "auto"}, "cli.db", "auto"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs, dbOpts := parseTestFlags(t, config, tt.args...)
+			if dbOpts.Path != tt.db {
+				t.Errorf("db %q, want %q", dbOpts.Path, tt.db)
+			}
+			if format := fs.Lookup("input-format").Value.String(); format != tt.format {
+				t.Errorf("input format %q, want %q", format, tt.format)
+			}
+		})
+	}
+}
+
+func TestParseFlagsInputs(t *testing.T) {
+	const config = "inputs: [a.log, b.log]\n"
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want []string
+	}{
+		{"file", "", nil, []string{"a.log", "b.log"}},
+		{"env over file", "c.log" + string(filepath.ListSeparator) + "d.log", nil, []string{"c.log", "d.log"}},
+		{"arguments over env", "c.log", []string{"e.log"}, []string{"e.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("DNSMASQ_PARSE_INPUTS", tt.env)
+			}
+			fs, _ := parseTestFlags(t, config, tt.args...)
+			if got := fs.Args(); !slices.Equal(got, tt.want) {
+				t.Errorf("inputs %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Commands that read no logs keep their own arguments.
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	t.Setenv("DNSMASQ_PARSE_INPUTS", "c.log")
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	if err := parseFlags(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fs.NArg() != 0 {
+		t.Errorf("search given inputs %q", fs.Args())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errReload ends a daemon's run on SIGHUP, for the next to read the
+// configuration again.
+var errReload = errors.New("reload requested")
+
+// daemon is what the daemon subcommand adds to tail: systemd notifications,
+// reloading on SIGHUP, a syslog receiver and exports on a timer. Its methods do nothing on a nil
+// daemon, which is how tail runs.
+type daemon struct {
+	syslogAddr string // --syslog-listen
+	schedule   *scheduleOptions
+
+	notifySocket string
+	reload       chan os.Signal
+	pinger       *time.Ticker // of the systemd watchdog; nil without one
+}
+
+// runDaemon implements the daemon subcommand: tail as a service. It follows
+// a log file, receives syslog, or both, saving every --flush, and runs until
+// SIGINT or SIGTERM, which stop it cleanly. SIGHUP saves what was read and
+// starts again with the configuration file and environment read afresh; a
+// configuration that no longer parses stops the daemon. Under systemd it
+// reports readiness and keeps the watchdog fed. With --interval it writes the
+// exports, and a --report, on a timer too:
+//
+//	[Service]
+//	Type=notify
+//	ExecStart=/usr/local/bin/dnsmasq-parse daemon --config /etc/dnsmasq-parse.yaml /var/log/dnsmasq.log
+//	ExecReload=/bin/kill -HUP $MAINPID
+//	WatchdogSec=60
+//	Restart=on-failure
+func runDaemon(ctx context.Context, args []string) error {
+	d := newDaemon()
+	defer d.stop()
+	for {
+		err := followLog(ctx, args, d)
+		if !errors.Is(err, errReload) {
+			d.notify("STOPPING=1")
+			if errors.Is(err, errInterrupted) {
+				slog.Info("stopped")
+				return nil
+			}
+			return err
+		}
+		slog.Info("reloading configuration")
+		d.notify("RELOADING=1")
+		if err := restartProcessFlags(); err != nil {
+			slog.Warn("finishing profiles and telemetry: " + err.Error())
+		}
+	}
+}
+
+func newDaemon() *daemon {
+	d := &daemon{notifySocket: os.Getenv("NOTIFY_SOCKET"), reload: make(chan os.Signal, 1)}
+	signal.Notify(d.reload, syscall.SIGHUP)
+	if interval, ok := watchdogInterval(); ok && d.notifySocket != "" {
+		d.pinger = time.NewTicker(interval)
+	}
+	return d
+}
+
+func (d *daemon) stop() {
+	signal.Stop(d.reload)
+	if d.pinger != nil {
+		d.pinger.Stop()
+	}
+}
+
+// watchdogInterval returns how often to feed systemd's watchdog: twice per
+// WATCHDOG_USEC, if it is set for this process.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
+
+// restartProcessFlags finishes the profiles and telemetry the last run's
+// parseFlags started, for the next run's to start again.
+func restartProcessFlags() error {
+	err := errors.Join(stopProfiling(), stopTelemetry())
+	stopProfiling = func() error { return nil }
+	stopTelemetry = func() error { return nil }
+	telemetry = nil
+	return err
+}
+
+// addFlags registers the daemon's own flags on fs.
+func (d *daemon) addFlags(fs *flag.FlagSet) {
+	if d == nil {
+		return
+	}
+	fs.StringVar(&d.syslogAddr, "syslog-listen", "", "also receive dnsmasq's log as BSD syslog (RFC 3164) over UDP at `address`, such as :5514; the log file is then followed only when given")
+	d.schedule = addScheduleFlags(fs)
+}
+
+// startSchedule starts the --interval runs, if asked for.
+func (d *daemon) startSchedule(st store, dbOpts dbOptions, clients clientFilter) (*scheduler, error) {
+	if d == nil {
+		return nil, nil
+	}
+	return d.schedule.startSchedule(st, dbOpts, clients)
+}
+
+func (d *daemon) listensForSyslog() bool {
+	return d != nil && d.syslogAddr != ""
+}
+
+// notify sends state to systemd, when run as a notify service.
+func (d *daemon) notify(state string) {
+	if d == nil || d.notifySocket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", d.notifySocket)
+	if err != nil {
+		slog.Warn("notifying systemd", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("notifying systemd", "err", err)
+	}
+}
+
+// ready tells systemd the daemon is reading its inputs.
+func (d *daemon) ready(path, syslogAddr string) {
+	if d == nil {
+		return
+	}
+	var inputs []string
+	for _, in := range []string{path, syslogAddr} {
+		if in != "" {
+			inputs = append(inputs, in)
+		}
+	}
+	d.notify("READY=1\nSTATUS=following " + strings.Join(inputs, " and "))
+}
+
+func (d *daemon) reloads() <-chan os.Signal {
+	if d == nil {
+		return nil
+	}
+	return d.reload
+}
+
+func (d *daemon) watchdog() <-chan time.Time {
+	if d == nil || d.pinger == nil {
+		return nil
+	}
+	return d.pinger.C
+}
+
+// ping feeds the watchdog. It is called from the loop reading the inputs, so
+// a loop that hangs gets the daemon restarted.
+func (d *daemon) ping() {
+	d.notify("WATCHDOG=1")
+}
+
+// syslogBacklog is the number of received lines held for the reading loop.
+const syslogBacklog = 4096
+
+// syslogListener receives log lines sent as syslog over UDP.
+type syslogListener struct {
+	conn  net.PacketConn
+	lines chan []byte
+	done  chan struct{}
+}
+
+// listenSyslog starts receiving syslog at --syslog-listen, if given.
+func (d *daemon) listenSyslog() (*syslogListener, error) {
+	if !d.listensForSyslog() {
+		return nil, nil
+	}
+	conn, err := net.ListenPacket("udp", d.syslogAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &syslogListener{conn: conn, lines: make(chan []byte, syslogBacklog), done: make(chan struct{})}
+	go s.receive()
+	slog.Info("receiving syslog", "address", conn.LocalAddr().String())
+	return s, nil
+}
+
+// receive passes on the lines of each message, without the <PRI> that starts
+// it, until the listener is closed.
+func (s *syslogListener) receive() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		if len(msg) > 0 && msg[0] == '<' {
+			if end := bytes.IndexByte(msg, '>'); end > 0 {
+				msg = msg[end+1:]
+			}
+		}
+		for line := range bytes.Lines(msg) {
+			line = bytes.TrimRight(line, "\r\n\x00")
+			if len(line) == 0 {
+				continue
+			}
+			select {
+			case s.lines <- bytes.Clone(line):
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// received returns the lines received, or nil from a nil listener.
+func (s *syslogListener) received() <-chan []byte {
+	if s == nil {
+		return nil
+	}
+	return s.lines
+}
+
+// addr names the listener as an input source, as syslog:address.
+func (s *syslogListener) addr() string {
+	if s == nil {
+		return ""
+	}
+	return "syslog:" + s.conn.LocalAddr().String()
+}
+
+func (s *syslogListener) close() {
+	if s != nil {
+		close(s.done)
+		s.conn.Close()
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// defaultDBPath is the database used when --db is not given.
+const defaultDBPath = "unique_domains.db"
+
+// sqliteBusyTimeout is how long a SQLite connection waits for a lock held by
+// another process before failing with SQLITE_BUSY.
+const sqliteBusyTimeout = 5 * time.Second
+
+// maxBindParams is the most bind parameters put in one statement, the lowest
+// limit of the supported databases (SQLite's).
+const maxBindParams = 32766
+
+// upsertCommitRows is how many rows a save writes per transaction, which keeps
+// transactions and the SQLite WAL bounded when saving millions of domains.
+const upsertCommitRows = 100_000
+
+// dbOptions selects the database and bounds the time spent on each operation.
+type dbOptions struct {
+	Path    string
+	Driver  string
+	Timeout time.Duration
+	// CacheMiB is the SQLite page cache size per connection.
+	CacheMiB int
+	// BatchSize is the number of rows per multi-row INSERT.
+	BatchSize int
+}
+
+// addDBFlag registers the database flags shared by every subcommand.
+func addDBFlag(fs *flag.FlagSet) *dbOptions {
+	o := &dbOptions{}
+	fs.StringVar(&o.Path, "db", defaultDBPath, "SQLite database `path`, a .duckdb file, or a postgres:// or mysql:// URL")
+	fs.StringVar(&o.Driver, "db-driver", "", "storage `driver`: sqlite, postgres, mysql, duckdb or bolt (default: inferred from --db)")
+	fs.DurationVar(&o.Timeout, "db-timeout", 0, "give up on a database operation after this `duration` (0 waits indefinitely)")
+	fs.IntVar(&o.CacheMiB, "sqlite-cache", 64, "SQLite page cache size in `MiB` (0 keeps the SQLite default)")
+	fs.IntVar(&o.BatchSize, "batch-size", 64, "`rows` per INSERT statement when saving")
+	return o
+}
+
+// driver returns --db-driver, or the driver implied by the form of --db.
+func (o dbOptions) driver() string {
+	if o.Driver != "" {
+		return o.Driver
+	}
+	switch {
+	case strings.HasPrefix(o.Path, "postgres://"), strings.HasPrefix(o.Path, "postgresql://"):
+		return "postgres"
+	case strings.HasPrefix(o.Path, "mysql://"), strings.HasPrefix(o.Path, "mariadb://"):
+		return "mysql"
+	case strings.HasPrefix(o.Path, "duckdb://"), strings.HasSuffix(o.Path, ".duckdb"):
+		return "duckdb"
+	}
+	return "sqlite"
+}
+
+// localPath returns the file behind a file-based store.
+func (o dbOptions) localPath() (string, bool) {
+	switch o.driver() {
+	case "sqlite", "bolt":
+		return o.Path, true
+	case "duckdb":
+		return strings.TrimPrefix(o.Path, "duckdb://"), true
+	}
+	return "", false
+}
+
+// withTimeout derives the context for one database operation from ctx.
+func (o dbOptions) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
+
+// openDatabase opens a SQL database and brings its schema up to date.
+func openDatabase(ctx context.Context, o dbOptions) (*database, error) {
+	d, err := dialectFor(o.driver())
+	if err != nil {
+		return nil, err
+	}
+	source, err := d.dataSource(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := d.(sqliteDialect); ok {
+		source = sqliteDataSource(source, o, false)
+	}
+	conn, err := sql.Open(d.driver(), source)
+	if err != nil {
+		return nil, err
+	}
+	db := &database{DB: conn, dialect: d, batchSize: o.BatchSize}
+
+	ctx, cancel := o.withTimeout(ctx)
+	defer cancel()
+	if err := initDatabase(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDatabaseReadOnly opens a SQL database as it is, read-only where the driver
+// supports it.
+func openDatabaseReadOnly(o dbOptions) (*database, error) {
+	d, err := dialectFor(o.driver())
+	if err != nil {
+		return nil, err
+	}
+	source, err := d.dataSource(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch d.(type) {
+	case sqliteDialect:
+		source = sqliteDataSource("file:"+source+"?mode=ro", o, true)
+	case duckdbDialect:
+		source += "?access_mode=read_only"
+	}
+	conn, err := sql.Open(d.driver(), source)
+	if err != nil {
+		return nil, err
+	}
+	return &database{DB: conn, dialect: d}, nil
+}
+
+// sqliteDataSource adds the connection pragmas to a SQLite data source. WAL
+// journaling lets reports read while a long import writes, and makes
+// synchronous=NORMAL safe; the busy timeout covers the brief moments when a
+// writer still needs the lock. Read-only connections leave the journal alone.
+func sqliteDataSource(source string, o dbOptions, readOnly bool) string {
+	pragmas := []string{fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds())}
+	if o.CacheMiB > 0 {
+		// Negative sizes are in KiB rather than pages.
+		pragmas = append(pragmas, fmt.Sprintf("cache_size(%d)", -o.CacheMiB*1024))
+	}
+	if !readOnly {
+		pragmas = append(pragmas, "journal_mode(wal)", "synchronous(normal)")
+	}
+
+	sep := "?"
+	if strings.Contains(source, "?") {
+		sep = "&"
+	}
+	for _, p := range pragmas {
+		source += sep + "_pragma=" + p
+		sep = "&"
+	}
+	return source
+}
+
+// domainTimes holds the observation window of a domain. Count is the number of
+// queries seen in the current run; it is added to the stored count on save.
+type domainTimes struct {
+	FirstSeen int64
+	LastSeen  int64
+	Count     int64
+}
+
+func initDatabase(ctx context.Context, db *database) error {
+	for _, stmt := range db.dialect.schema() {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return migrateSchema(ctx, db)
+}
+
+func (db *database) saveDomains(ctx context.Context, domains map[string]domainTimes) error {
+	if db.known != nil {
+		fresh, err := db.touchKnownDomains(ctx, domains)
+		if err != nil {
+			return err
+		}
+		domains = fresh
+	}
+
+	args := make([]any, 0, 4*len(domains))
+	for domain, times := range domains {
+		args = append(args, domain, times.FirstSeen, times.LastSeen, times.Count)
+	}
+	err := db.upsertRows(ctx, "domains", []upsertColumn{
+		{"domain", mergeKey},
+		{"first_seen", mergeMin},
+		{"last_seen", mergeMax},
+		{"count", mergeAdd},
+	}, args)
+	if err == nil && db.known != nil {
+		for domain, times := range domains {
+			db.known.add(domain, times.FirstSeen)
+		}
+	}
+	return err
+}
+
+// touchKnownDomains saves the domains known to be stored whose first_seen
+// cannot move earlier with a plain update, and returns the rest for upserting.
+func (db *database) touchKnownDomains(ctx context.Context, domains map[string]domainTimes) (map[string]domainTimes, error) {
+	touch := make(map[string]domainTimes)
+	fresh := make(map[string]domainTimes)
+	for domain, times := range domains {
+		if firstSeen, ok := db.known.firstSeen(domain); ok && times.FirstSeen >= firstSeen {
+			touch[domain] = times
+		} else {
+			fresh[domain] = times
+		}
+	}
+	if len(touch) == 0 {
+		return fresh, nil
+	}
+	missing, err := db.touchDomains(ctx, touch)
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range missing {
+		fresh[domain] = touch[domain]
+	}
+	slog.Debug("saved known domains", "updated", len(touch)-len(missing), "upserting", len(fresh))
+	return fresh, nil
+}
+
+// upsertRows merges rows into table with multi-row upserts of up to
+// --batch-size rows. args holds the values of each row in turn, in the order
+// of columns. The rows are committed every upsertCommitRows, so a failure
+// part-way through a large save keeps the rows already committed. Without key
+// columns the rows are simply inserted.
+func (db *database) upsertRows(ctx context.Context, table string, columns []upsertColumn, args []any) error {
+	statement := db.dialect.upsert
+	if !slices.ContainsFunc(columns, func(c upsertColumn) bool { return c.Merge == mergeKey }) {
+		statement = func(table string, columns []upsertColumn, rows int) string {
+			insert, _ := insertColumns(table, columns, rows, db.dialect)
+			return insert
+		}
+	}
+
+	rows := len(args) / len(columns)
+	batch := min(max(db.batchSize, 1), maxBindParams/len(columns))
+	commitEvery := max(upsertCommitRows/batch, 1) * batch
+
+	var tx *sql.Tx
+	var full *sql.Stmt // prepared upsert of a whole batch, reused within tx
+	finish := func(err error) error {
+		if tx == nil {
+			return err
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		tx, full = nil, nil
+		return err
+	}
+
+	for start := 0; start < rows; start += batch {
+		if tx == nil {
+			var err error
+			if tx, err = db.BeginTx(ctx, nil); err != nil {
+				return err
+			}
+		}
+
+		n := min(batch, rows-start)
+		values := args[start*len(columns) : (start+n)*len(columns)]
+		var err error
+		if n == batch {
+			if full == nil {
+				full, err = tx.PrepareContext(ctx, statement(table, columns, batch))
+			}
+			if err == nil {
+				_, err = full.ExecContext(ctx, values...)
+			}
+		} else {
+			_, err = tx.ExecContext(ctx, statement(table, columns, n), values...)
+		}
+		if err != nil {
+			return finish(err)
+		}
+
+		if (start+n)%commitEvery == 0 {
+			if err := finish(nil); err != nil {
+				return err
+			}
+		}
+	}
+	return finish(nil)
+}
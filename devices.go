@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// device keys the DHCP leases of an address to one hardware address and host
+// name. A device renamed, or an address handed to another device, makes a new
+// key; the latest lease of an address tells who holds it now.
+type device struct {
+	Address  string
+	MAC      string
+	Hostname string // as the client sent it, lower case; empty when it sent none
+}
+
+// deviceRow is the stored observation window of a lease: Count is the number
+// of DHCPACKs logged for it.
+type deviceRow struct {
+	device
+	domainTimes
+}
+
+// isLease reports whether the line acknowledges a DHCPv4 lease, as in
+// "DHCPACK(br0) 192.168.1.23 aa:bb:cc:dd:ee:ff laptop".
+func (l logLine) isLease() bool {
+	return bytes.HasPrefix(l.Verb, []byte("DHCPACK("))
+}
+
+// addLease records the lease l acknowledges, if its address passes the client
+// filter. With --anonymize-clients leases are not recorded, as the MAC and
+// host name would undo the anonymizing.
+func (a *aggregator) addLease(l logLine) {
+	if a.anonymizer != nil {
+		return
+	}
+	addr, err := netip.ParseAddr(string(l.Client))
+	if err != nil {
+		return
+	}
+	address := addr.Unmap().String()
+	if !a.clients.matches(address) {
+		return
+	}
+	mac, err := net.ParseMAC(string(l.MAC))
+	if err != nil {
+		return
+	}
+	key := device{
+		Address:  a.intern([]byte(address)),
+		MAC:      a.intern([]byte(mac.String())),
+		Hostname: a.intern(bytes.ToLower(l.Hostname)),
+	}
+	mergeInto(a.devices, key, domainTimes{FirstSeen: l.Timestamp, LastSeen: l.Timestamp, Count: 1})
+}
+
+// currentDevices returns the latest lease of each address in rows, keeping
+// the host name of an earlier lease of the same device when the latest came
+// without one.
+func currentDevices(rows []deviceRow) map[string]deviceRow {
+	current := make(map[string]deviceRow)
+	for _, r := range rows {
+		c, ok := current[r.Address]
+		switch {
+		case !ok || r.LastSeen > c.LastSeen:
+			if ok && r.Hostname == "" && r.MAC == c.MAC {
+				r.Hostname = c.Hostname
+			}
+			current[r.Address] = r
+		case c.Hostname == "" && r.MAC == c.MAC:
+			c.Hostname = r.Hostname
+			current[r.Address] = c
+		}
+	}
+	return current
+}
+
+// ouiTable maps the first three octets of a MAC address, as "aabbcc", to the
+// vendor they are assigned to.
+type ouiTable map[string]string
+
+const ouiFlagUsage = "name the vendors of MAC addresses from `file`, the IEEE oui.txt or oui.csv or Wireshark's manuf"
+
+// loadOUI reads the IEEE MA-L registry, as oui.txt ("28-6F-B9   (hex)
+// Nokia") or oui.csv ("MA-L,286FB9,Nokia,..."), or Wireshark's manuf file
+// ("28:6F:B9<tab>Nokia<tab>Nokia Shanghai Bell"). Longer prefixes, of the
+// MA-M and MA-S registries, are skipped. An empty path loads nothing.
+func loadOUI(path string) (ouiTable, error) {
+	table := make(ouiTable)
+	if path == "" {
+		return table, nil
+	}
+	in, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		var prefix, vendor string
+		switch {
+		case line == "" || line[0] == '#':
+			continue
+		case strings.Contains(line, "(hex)"):
+			before, after, _ := strings.Cut(line, "(hex)")
+			prefix, vendor = before, after
+		case strings.HasPrefix(line, "MA-L,"):
+			record, err := csv.NewReader(strings.NewReader(line)).Read()
+			if err != nil || len(record) < 3 {
+				continue
+			}
+			prefix, vendor = record[1], record[2]
+		default:
+			fields := strings.Split(line, "\t")
+			if len(fields) < 2 || strings.Contains(fields[0], "/") {
+				continue
+			}
+			prefix, vendor = fields[0], fields[len(fields)-1]
+		}
+		prefix = strings.ToLower(strings.NewReplacer("-", "", ":", "", ".", "").Replace(strings.TrimSpace(prefix)))
+		if len(prefix) == 6 {
+			table[prefix] = strings.TrimSpace(vendor)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return table, nil
+}
+
+// vendor returns the vendor of mac, "(randomized)" for a locally administered
+// address such as the private addresses phones use, or "" when unknown.
+func (t ouiTable) vendor(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) < 3 {
+		return ""
+	}
+	if hw[0]&0x02 != 0 {
+		return "(randomized)"
+	}
+	return t[fmt.Sprintf("%02x%02x%02x", hw[0], hw[1], hw[2])]
+}
+
+// runDevices implements the devices subcommand: the devices dnsmasq leased
+// addresses to, with the queries made from each address since.
+func runDevices(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	ouiPath := fs.String("oui", "", ouiFlagUsage)
+	all := fs.Bool("all", false, "list every lease seen, not only the latest of each address")
+	since := fs.String("since", "", "only list leases acknowledged after this `time` (duration such as 24h or 7d, or a date)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+	oui, err := loadOUI(*ouiPath)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDevices(loadCtx)
+	if err != nil {
+		return err
+	}
+	clientRows, err := st.loadDomainClients(loadCtx)
+	if err != nil {
+		return err
+	}
+	queries := make(map[string]int64)
+	for _, c := range clientRows {
+		queries[c.Client] += c.Count
+	}
+
+	if !*all {
+		current := currentDevices(rows)
+		rows = rows[:0]
+		for _, r := range current {
+			rows = append(rows, r)
+		}
+	}
+	rows = slices.DeleteFunc(rows, func(r deviceRow) bool { return r.LastSeen < cutoff || !clients.matches(r.Address) })
+	slices.SortFunc(rows, func(a, b deviceRow) int {
+		if c := compareAddresses(a.Address, b.Address); c != 0 {
+			return c
+		}
+		return cmpInt(b.LastSeen, a.LastSeen)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tHOSTNAME\tMAC\tVENDOR\tFIRST LEASED\tLAST LEASED\tLEASES\tQUERIES")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", r.Address, cmp.Or(r.Hostname, "-"), r.MAC, cmp.Or(oui.vendor(r.MAC), "-"),
+			formatUnix(r.FirstSeen), formatUnix(r.LastSeen), r.Count, queries[r.Address])
+	}
+	return tw.Flush()
+}
+
+// compareAddresses orders IP addresses numerically, and anything else after
+// them as text.
+func compareAddresses(a, b string) int {
+	x, errA := netip.ParseAddr(a)
+	y, errB := netip.ParseAddr(b)
+	switch {
+	case errA == nil && errB == nil:
+		return x.Compare(y)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func (db *database) saveDevices(ctx context.Context, devices map[device]domainTimes) error {
+	args := make([]any, 0, 6*len(devices))
+	for key, times := range devices {
+		args = append(args, key.Address, key.MAC, key.Hostname, times.FirstSeen, times.LastSeen, times.Count)
+	}
+	return db.upsertRows(ctx, "devices", []upsertColumn{
+		{"address", mergeKey},
+		{"mac", mergeKey},
+		{"hostname", mergeKey},
+		{"first_seen", mergeMin},
+		{"last_seen", mergeMax},
+		{"count", mergeAdd},
+	}, args)
+}
+
+func (db *database) loadDevices(ctx context.Context) ([]deviceRow, error) {
+	rows, err := db.QueryContext(ctx, "SELECT address, mac, hostname, first_seen, last_seen, count FROM devices")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []deviceRow
+	for rows.Next() {
+		var r deviceRow
+		if err := rows.Scan(&r.Address, &r.MAC, &r.Hostname, &r.FirstSeen, &r.LastSeen, &r.Count); err != nil {
+			return nil, err
+		}
+		devices = append(devices, r)
+	}
+	return devices, rows.Err()
+}
+
+// deviceKey and parseDeviceKey key leases in bbolt as their NUL-separated
+// address, MAC and host name.
+func deviceKey(key device) []byte {
+	return []byte(key.Address + "\x00" + key.MAC + "\x00" + key.Hostname)
+}
+
+func parseDeviceKey(k []byte) device {
+	fields := strings.SplitN(string(k), "\x00", 3)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+	return device{Address: fields[0], MAC: fields[1], Hostname: fields[2]}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseLease(t *testing.T) {
+	tests := []struct {
+		line                  string
+		lease                 bool
+		client, mac, hostname string
+	}{
+		{"Mar  1 10:00:00 dnsmasq-dhcp[812]: DHCPACK(br0) 192.168.1.23 aa:bb:cc:dd:ee:ff laptop", true, "192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop"},
+		{"Mar  1 10:00:00 dnsmasq-dhcp[812]: DHCPACK(eth0) 192.168.1.24 AA:BB:CC:DD:EE:01", true, "192.168.1.24", "AA:BB:CC:DD:EE:01", ""},
+		// log-dhcp puts a transaction number before the verb.
+		{"Mar  1 10:00:00 dnsmasq-dhcp[812]: 3526318462 DHCPACK(br0) 192.168.1.25 aa:bb:cc:dd:ee:02 Phone", true, "192.168.1.25", "aa:bb:cc:dd:ee:02", "Phone"},
+		{"Mar  1 10:00:00 router dnsmasq-dhcp[812]: DHCPACK(br0) 192.168.1.26 aa:bb:cc:dd:ee:03 tv", true, "192.168.1.26", "aa:bb:cc:dd:ee:03", "tv"},
+		{"Mar  1 10:00:00 dnsmasq-dhcp[812]: DHCPREQUEST(br0) 192.168.1.23 aa:bb:cc:dd:ee:ff", false, "", "", ""},
+		{"Mar  1 10:00:00 dnsmasq-dhcp[812]: DHCPOFFER(br0) 192.168.1.23 aa:bb:cc:dd:ee:ff", false, "", "", ""},
+		{"Mar  1 10:00:00 dnsmasq[812]: query[A] example.com from 192.168.1.23", false, "192.168.1.23", "", ""},
+	}
+	for _, tt := range tests {
+		l, err := parseLogLine([]byte(tt.line), time.Now())
+		if err != nil {
+			t.Fatalf("%q: %v", tt.line, err)
+		}
+		if l.isLease() != tt.lease {
+			t.Errorf("%q: lease %t, want %t", tt.line, l.isLease(), tt.lease)
+			continue
+		}
+		if string(l.Client) != tt.client || string(l.MAC) != tt.mac || string(l.Hostname) != tt.hostname {
+			t.Errorf("%q: address %q, MAC %q, host name %q; want %q, %q, %q", tt.line, l.Client, l.MAC, l.Hostname, tt.client, tt.mac, tt.hostname)
+		}
+		if tt.lease && len(l.Domain) != 0 {
+			t.Errorf("%q: lease parsed as a query of %q", tt.line, l.Domain)
+		}
+	}
+}
+
+func TestAddLease(t *testing.T) {
+	at := func(stamp string) int64 {
+		ts, ok := parseSyslogTimestamp([]byte(stamp), time.Now())
+		if !ok {
+			t.Fatalf("bad timestamp %q", stamp)
+		}
+		return ts.Unix()
+	}
+	lines := []string{
+		"Mar  1 10:00:00 dnsmasq-dhcp[812]: DHCPACK(br0) 192.168.1.23 AA:BB:CC:DD:EE:FF Laptop",
+		"Mar  1 11:00:00 dnsmasq-dhcp[812]: DHCPACK(br0) 192.168.1.23 aa:bb:cc:dd:ee:ff laptop",
+		"Mar  1 12:00:00 dnsmasq-dhcp[812]: DHCPACK(br0) 192.168.1.23 aa:bb:cc:dd:ee:ff",
+		"Mar  1 10:30:00 dnsmasq-dhcp[812]: DHCPACK(br0) 10.0.0.5 aa:bb:cc:dd:ee:01 outside",
+		"Mar  1 10:30:00 dnsmasq-dhcp[812]: DHCPACK(br0) 192.168.1.30 not-a-mac bad",
+		"Mar  1 10:30:00 dnsmasq-dhcp[812]: DHCPACK(br0) printer.lan aa:bb:cc:dd:ee:02 bad",
+		"Mar  1 10:30:00 dnsmasq-dhcp[812]: DHCPREQUEST(br0) 192.168.1.31 aa:bb:cc:dd:ee:03",
+	}
+	var clients clientFilter
+	if err := clients.Set("192.168.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		clients   clientFilter
+		anonymize bool
+		want      map[device]domainTimes
+	}{
+		{"all", nil, false, map[device]domainTimes{
+			{"192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop"}: {FirstSeen: at("Mar  1 10:00:00"), LastSeen: at("Mar  1 11:00:00"), Count: 2},
+			{"192.168.1.23", "aa:bb:cc:dd:ee:ff", ""}:       {FirstSeen: at("Mar  1 12:00:00"), LastSeen: at("Mar  1 12:00:00"), Count: 1},
+			{"10.0.0.5", "aa:bb:cc:dd:ee:01", "outside"}:    {FirstSeen: at("Mar  1 10:30:00"), LastSeen: at("Mar  1 10:30:00"), Count: 1},
+		}},
+		{"client filter", clients, false, map[device]domainTimes{
+			{"192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop"}: {FirstSeen: at("Mar  1 10:00:00"), LastSeen: at("Mar  1 11:00:00"), Count: 2},
+			{"192.168.1.23", "aa:bb:cc:dd:ee:ff", ""}:       {FirstSeen: at("Mar  1 12:00:00"), LastSeen: at("Mar  1 12:00:00"), Count: 1},
+		}},
+		// The MAC and host name would undo the anonymizing.
+		{"anonymized", nil, true, map[device]domainTimes{}},
+	}
+	for _, tt := range tests {
+		agg := newAggregator(tt.clients, nil)
+		if tt.anonymize {
+			agg.anonymizer = &anonymizer{salt: []byte("test-salt")}
+		}
+		for _, line := range lines {
+			agg.addLine([]byte(line))
+		}
+		if !maps.Equal(agg.devices, tt.want) {
+			t.Errorf("%s: devices\n%v\nwant\n%v", tt.name, agg.devices, tt.want)
+		}
+		if len(agg.domains) != 0 {
+			t.Errorf("%s: leases recorded as domains %v", tt.name, agg.domains)
+		}
+	}
+}
+
+func TestCurrentDevices(t *testing.T) {
+	lease := func(address, mac, hostname string, lastSeen int64) deviceRow {
+		return deviceRow{device{address, mac, hostname}, domainTimes{FirstSeen: lastSeen - 10, LastSeen: lastSeen, Count: 1}}
+	}
+	tests := []struct {
+		name string
+		rows []deviceRow
+		want map[string]deviceRow
+	}{
+		{"latest lease wins", []deviceRow{
+			lease("192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop", 100),
+			lease("192.168.1.23", "aa:bb:cc:dd:ee:01", "phone", 200),
+			lease("192.168.1.24", "aa:bb:cc:dd:ee:02", "tv", 50),
+		}, map[string]deviceRow{
+			"192.168.1.23": lease("192.168.1.23", "aa:bb:cc:dd:ee:01", "phone", 200),
+			"192.168.1.24": lease("192.168.1.24", "aa:bb:cc:dd:ee:02", "tv", 50),
+		}},
+		{"host name kept from an earlier lease, in either order", []deviceRow{
+			lease("192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop", 100),
+			lease("192.168.1.23", "aa:bb:cc:dd:ee:ff", "", 200),
+			lease("192.168.1.24", "aa:bb:cc:dd:ee:02", "", 200),
+			lease("192.168.1.24", "aa:bb:cc:dd:ee:02", "tv", 100),
+		}, map[string]deviceRow{
+			"192.168.1.23": lease("192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop", 200),
+			"192.168.1.24": lease("192.168.1.24", "aa:bb:cc:dd:ee:02", "tv", 200),
+		}},
+		{"not from another device", []deviceRow{
+			lease("192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop", 100),
+			lease("192.168.1.23", "aa:bb:cc:dd:ee:01", "", 200),
+		}, map[string]deviceRow{
+			"192.168.1.23": lease("192.168.1.23", "aa:bb:cc:dd:ee:01", "", 200),
+		}},
+	}
+	for _, tt := range tests {
+		if got := currentDevices(tt.rows); !maps.Equal(got, tt.want) {
+			t.Errorf("%s:\n%v\nwant\n%v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadOUI(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"oui.txt", `OUI/MA-L                                                    Organization
+company_id                                                  Organization
+                                                            Address
+
+28-6F-B9   (hex)		Nokia Shanghai Bell Co., Ltd.
+286FB9     (base 16)		Nokia Shanghai Bell Co., Ltd.
+				No.388 Ning Qiao Road,Jin Qiao Pudong Shanghai
+
+00-1A-11   (hex)		Google, Inc.
+001A11     (base 16)		Google, Inc.
+`},
+		{"oui.csv", `Registry,Assignment,Organization Name,Organization Address
+MA-L,286FB9,"Nokia Shanghai Bell Co., Ltd.","No.388 Ning Qiao Road,Jin Qiao Pudong Shanghai"
+MA-L,001A11,"Google, Inc.",1600 Amphitheatre Parkway Mountain View CA US 94043
+`},
+		{"manuf", `# Wireshark manuf
+28:6F:B9	Nokia	Nokia Shanghai Bell Co., Ltd.
+00:1A:11	Google	Google, Inc.
+00:1B:C5:00:00/36	Convergi	Converging Systems Inc.
+`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.name)
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		table, err := loadOUI(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := ouiTable{"286fb9": "Nokia Shanghai Bell Co., Ltd.", "001a11": "Google, Inc."}
+		if !maps.Equal(table, want) {
+			t.Errorf("%s: %v, want %v", tt.name, table, want)
+		}
+	}
+
+	if table, err := loadOUI(""); err != nil || len(table) != 0 {
+		t.Errorf("loadOUI with no file = %v, %v; want an empty table", table, err)
+	}
+	if _, err := loadOUI(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing OUI file: no error")
+	}
+}
+
+func TestOUIVendor(t *testing.T) {
+	table := ouiTable{"286fb9": "Nokia", "001a11": "Google, Inc."}
+	tests := []struct{ mac, want string }{
+		{"28:6f:b9:12:34:56", "Nokia"},
+		{"00-1A-11-00-00-01", "Google, Inc."},
+		{"00:11:22:33:44:55", ""},
+		{"da:a1:19:00:00:01", "(randomized)"}, // locally administered
+		{"not-a-mac", ""},
+	}
+	for _, tt := range tests {
+		if got := table.vendor(tt.mac); got != tt.want {
+			t.Errorf("vendor(%q) = %q, want %q", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestCompareAddresses(t *testing.T) {
+	addresses := []string{"printer.lan", "192.168.1.100", "2001:db8::1", "192.168.1.9", "10.0.0.1", "laptop.lan"}
+	slices.SortFunc(addresses, compareAddresses)
+	want := []string{"10.0.0.1", "192.168.1.9", "192.168.1.100", "2001:db8::1", "laptop.lan", "printer.lan"}
+	if !slices.Equal(addresses, want) {
+		t.Errorf("sorted %v, want %v", addresses, want)
+	}
+}
+
+func TestSaveDevices(t *testing.T) {
+	ctx := context.Background()
+	laptop := device{"192.168.1.23", "aa:bb:cc:dd:ee:ff", "laptop"}
+	unnamed := device{"192.168.1.23", "aa:bb:cc:dd:ee:ff", ""}
+	rounds := []map[device]domainTimes{
+		{laptop: {FirstSeen: 100, LastSeen: 200, Count: 2}, unnamed: {FirstSeen: 150, LastSeen: 150, Count: 1}},
+		{laptop: {FirstSeen: 50, LastSeen: 120, Count: 3}},
+	}
+	want := []deviceRow{
+		{unnamed, domainTimes{FirstSeen: 150, LastSeen: 150, Count: 1}},
+		{laptop, domainTimes{FirstSeen: 50, LastSeen: 200, Count: 5}},
+	}
+	for name, open := range testStores {
+		st := open(t)
+		for _, round := range rounds {
+			if err := st.saveDevices(ctx, round); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		got, err := st.loadDevices(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		slices.SortFunc(got, func(a, b deviceRow) int { return cmpInt(a.Count, b.Count) })
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: devices %v, want %v", name, got, want)
+		}
+	}
+}
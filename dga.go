@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dgaSummary is a registrable domain whose name looks machine generated, and
+// what was seen under it.
+type dgaSummary struct {
+	Domain    string
+	Score     int64
+	FirstSeen int64
+	LastSeen  int64
+	Queries   int64
+	Clients   int
+	Names     []string // queried names under Domain, forward, in order
+}
+
+// runDGA implements the dga subcommand: the registrable domains whose names
+// score high for looking algorithmically generated (see dgaScore), as the
+// command and control domains of malware often are.
+func runDGA(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("dga", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	minScore := fs.Int64("min", 50, "show the domains scoring at least `score`, from 0 to 100")
+	since := fs.String("since", "", "only show domains last seen after this `time` (duration such as 24h or 7d, or a date)")
+	n := addLimitFlag(fs, 5, "list at most `n` queried names per domain (0 for all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	scores, err := st.loadDomainScores(ctx)
+	if err != nil {
+		return err
+	}
+	clients, err := st.loadDomainClients(ctx)
+	if err != nil {
+		return err
+	}
+	rows = slices.DeleteFunc(rows, func(r domainRow) bool { return r.LastSeen < cutoff })
+	clients = slices.DeleteFunc(clients, func(c domainClientRow) bool { return c.LastSeen < cutoff })
+
+	domains := summarizeDGA(rows, scores, clients, *minScore)
+	fmt.Printf("%d domains scoring %d or more\n", len(domains), *minScore)
+	if len(domains) == 0 {
+		return nil
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCORE\tDOMAIN\tFIRST SEEN\tLAST SEEN\tQUERIES\tCLIENTS\tNAMES")
+	for _, d := range domains {
+		names := d.Names
+		if *n > 0 && len(names) > *n {
+			names = append(slices.Clip(names[:*n]), fmt.Sprintf("(%d more)", len(d.Names)-*n))
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", d.Score, d.Domain,
+			formatUnix(d.FirstSeen), formatUnix(d.LastSeen), d.Queries, d.Clients, strings.Join(names, " "))
+	}
+	return tw.Flush()
+}
+
+// summarizeDGA groups rows by registrable domain, keeping those scoring at
+// least minScore, highest first. Domains saved before scores were stored are
+// scored here.
+func summarizeDGA(rows []domainRow, scores map[string]int64, clients []domainClientRow, minScore int64) []dgaSummary {
+	byDomain := make(map[string]*dgaSummary)
+	for _, row := range rows {
+		score, ok := scores[row.Domain]
+		name := reverseDomainParts(row.Domain)
+		if !ok {
+			score = dgaScore(name)
+		}
+		if score < minScore {
+			continue
+		}
+		domain := registrableDomain(name)
+		d, ok := byDomain[domain]
+		if !ok {
+			d = &dgaSummary{Domain: domain, FirstSeen: row.FirstSeen, LastSeen: row.LastSeen}
+			byDomain[domain] = d
+		}
+		d.Score = max(d.Score, score)
+		d.FirstSeen = min(d.FirstSeen, row.FirstSeen)
+		d.LastSeen = max(d.LastSeen, row.LastSeen)
+		d.Queries += row.Count
+		d.Names = append(d.Names, name)
+	}
+
+	seen := make(map[string]map[string]bool)
+	for _, c := range clients {
+		domain := registrableDomain(reverseDomainParts(c.Domain))
+		if _, ok := byDomain[domain]; !ok {
+			continue
+		}
+		if seen[domain] == nil {
+			seen[domain] = make(map[string]bool)
+		}
+		seen[domain][c.Client] = true
+	}
+
+	domains := make([]dgaSummary, 0, len(byDomain))
+	for domain, d := range byDomain {
+		d.Clients = len(seen[domain])
+		slices.Sort(d.Names)
+		domains = append(domains, *d)
+	}
+	slices.SortFunc(domains, func(a, b dgaSummary) int {
+		if c := cmpInt(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return domains
+}
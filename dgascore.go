@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// commonBigrams are the letter pairs frequent in English text. Names made of
+// words are mostly these; machine-generated ones mostly are not.
+var commonBigrams = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, b := range strings.Fields(`
+		th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng
+		se ha as ou io le ve co me de hi ri ro ic ne ea ra ce li ch ll be ma si
+		om ur ca el ta la ns di fo ho pe ec pr no ct us ac ot il tr ly nc et ut
+		ss so rs un lo wa ge ie wh ee wi em ad ol rt po we na ul ni ts mo ow pa
+		im mi ai sh ir su id os iv ia am fi ci vi pl ig tu ev ld ry mp fe bl ab
+		gh ty op wo sa ay ex ke fr oo av ag if ap gr od bo sp rd do uc bu ei ov
+		by rm ep tt oc fa ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va
+		um pp ua up lu go ht ru ug ds lt pi rc rr eg au ck ew mu br bi pt ak pu
+		ui rg ib tl ny ki rk ys ob mm fu ph og ms ye ud mb ip ub oi rl gu dr hr
+		cc tw ft wn nu af hu nn eo vo rv nf xp gn sm fl iz ok nl my gl aw ju oa
+		sy sl ps jo lf nk kn gs dy hy ze ks xt bs ik dd cy rp sk xi oe oy ws`) {
+		m[b] = true
+	}
+	return m
+}()
+
+// dgaScore rates how machine-generated the registrable label of domain
+// (forward order, the "example" of www.example.co.uk) looks, from 0 to 100.
+// Names made of words, or too short to tell, score low; long runs of
+// uncommon letter pairs, consonants and digits mixed into letters, as in the
+// names domain generation algorithms make up for malware to reach its
+// command and control servers, score high. It is a heuristic for ranking
+// names to look at, not a verdict.
+func dgaScore(domain string) int64 {
+	label, _, _ := strings.Cut(registrableDomain(strings.ToLower(domain)), ".")
+	if strings.HasPrefix(label, "xn--") {
+		return 0 // punycode looks random whatever it encodes
+	}
+	n := len(label)
+	if n <= 4 {
+		return 0
+	}
+
+	var counts [256]int
+	letters, digits, run, longestRun := 0, 0, 0, 0
+	for i := 0; i < n; i++ {
+		c := label[i]
+		counts[c]++
+		switch {
+		case c >= 'a' && c <= 'z':
+			letters++
+			if strings.IndexByte("aeiouy", c) < 0 {
+				run++
+				longestRun = max(longestRun, run)
+				continue
+			}
+		case c >= '0' && c <= '9':
+			digits++
+		}
+		run = 0
+	}
+	entropy := 0.0
+	for _, k := range counts {
+		if k > 0 {
+			p := float64(k) / float64(n)
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	// Pairs of letters not common in English, and changes between letters
+	// and digits, are uncommon; digit pairs and hyphens are left out.
+	pairs, uncommon := 0, 0
+	for i := 1; i < n; i++ {
+		a, b := label[i-1], label[i]
+		aLetter, bLetter := a >= 'a' && a <= 'z', b >= 'a' && b <= 'z'
+		aDigit, bDigit := a >= '0' && a <= '9', b >= '0' && b <= '9'
+		switch {
+		case aLetter && bLetter:
+			pairs++
+			if !commonBigrams[label[i-1:i+1]] {
+				uncommon++
+			}
+		case aLetter && bDigit, aDigit && bLetter:
+			pairs++
+			uncommon++
+		}
+	}
+	rarity := 0.0
+	if pairs > 0 {
+		rarity = float64(uncommon) / float64(pairs)
+	}
+	mixed := 0.0
+	if letters > 0 {
+		mixed = min(1, 2*float64(digits)/float64(n))
+	}
+
+	score := 0.55*rarity +
+		0.2*clamp01((entropy-2.5)/1.5) +
+		0.1*mixed +
+		0.15*clamp01(float64(longestRun-2)/4)
+	length := clamp01(float64(n-4) / 8) // a short name says little
+	return int64(math.Round(100 * score * length))
+}
+
+func clamp01(v float64) float64 {
+	return min(1, max(0, v))
+}
+
+// scoreDomains returns the DGA score of each of domains, keyed by reversed
+// domain.
+func scoreDomains(domains map[string]domainTimes) map[string]int64 {
+	scores := make(map[string]int64, len(domains))
+	for domain := range domains {
+		scores[domain] = dgaScore(reverseDomainParts(domain))
+	}
+	return scores
+}
+
+func (db *database) saveDomainScores(ctx context.Context, scores map[string]int64) error {
+	args := make([]any, 0, 2*len(scores))
+	for domain, score := range scores {
+		args = append(args, domain, score)
+	}
+	return db.upsertRows(ctx, "domain_scores", []upsertColumn{
+		{"domain", mergeKey},
+		{"score", mergeReplace},
+	}, args)
+}
+
+func (db *database) loadDomainScores(ctx context.Context) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, score FROM domain_scores")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := make(map[string]int64)
+	for rows.Next() {
+		var domain string
+		var score int64
+		if err := rows.Scan(&domain, &score); err != nil {
+			return nil, err
+		}
+		scores[domain] = score
+	}
+	return scores, rows.Err()
+}
+
+// encodeScore and decodeScore store a score in bbolt as a big-endian uint64,
+// so larger scores compare larger.
+func encodeScore(score int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(score))
+}
+
+func decodeScore(v []byte) int64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
@@ -0,0 +1,190 @@
+//go:build duckdb
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	_ "github.com/duckdb/duckdb-go/v2"
+)
+
+type duckdbDialect struct{}
+
+func (duckdbDialect) driver() string { return "duckdb" }
+
+func (duckdbDialect) dataSource(dsn string) (string, error) {
+	return strings.TrimPrefix(dsn, "duckdb://"), nil
+}
+
+func (duckdbDialect) placeholder(int) string { return "?" }
+
+// DuckDB has no AUTOINCREMENT; domains.id and sources.id come from sequences instead.
+func (duckdbDialect) schema() []string {
+	return []string{
+		`CREATE SEQUENCE IF NOT EXISTS domains_id_seq`,
+		`CREATE SEQUENCE IF NOT EXISTS sources_id_seq`, `
+	CREATE TABLE IF NOT EXISTS domains (
+		id BIGINT PRIMARY KEY DEFAULT nextval('domains_id_seq'),
+		domain VARCHAR UNIQUE NOT NULL,
+		first_seen BIGINT NOT NULL DEFAULT (epoch(current_timestamp)::BIGINT),
+		last_seen BIGINT NOT NULL,
+		count BIGINT NOT NULL DEFAULT 0
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_clients (
+		domain VARCHAR NOT NULL,
+		client VARCHAR NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		count BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (domain, client)
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_hours (
+		domain VARCHAR NOT NULL,
+		hour BIGINT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (domain, hour)
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_resolution (
+		domain VARCHAR PRIMARY KEY,
+		cached BIGINT NOT NULL,
+		forwarded BIGINT NOT NULL,
+		blocked BIGINT NOT NULL,
+		replies BIGINT NOT NULL,
+		latency_ms BIGINT NOT NULL,
+		max_latency_ms BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS sources (
+		id BIGINT PRIMARY KEY DEFAULT nextval('sources_id_seq'),
+		path VARCHAR NOT NULL,
+		host VARCHAR NOT NULL,
+		UNIQUE (path, host)
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_sources (
+		domain VARCHAR NOT NULL,
+		source_id BIGINT NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (domain, source_id)
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_types (
+		domain VARCHAR NOT NULL,
+		type VARCHAR NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (domain, type)
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_addresses (
+		domain VARCHAR NOT NULL,
+		address VARCHAR NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (domain, address)
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_scores (
+		domain VARCHAR PRIMARY KEY,
+		score BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS domain_liveness (
+		domain VARCHAR PRIMARY KEY,
+		status VARCHAR NOT NULL,
+		addresses VARCHAR NOT NULL,
+		checked_at BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS addresses (
+		address VARCHAR PRIMARY KEY,
+		country VARCHAR NOT NULL,
+		asn BIGINT NOT NULL,
+		as_org VARCHAR NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS registrations (
+		domain VARCHAR PRIMARY KEY,
+		registered_at BIGINT NOT NULL,
+		checked_at BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS ranks (
+		domain VARCHAR PRIMARY KEY,
+		list_rank BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS dnsbl_results (
+		name VARCHAR NOT NULL,
+		zone VARCHAR NOT NULL,
+		codes VARCHAR NOT NULL,
+		checked_at BIGINT NOT NULL,
+		PRIMARY KEY (name, zone)
+	)`, `
+	CREATE TABLE IF NOT EXISTS devices (
+		address VARCHAR NOT NULL,
+		mac VARCHAR NOT NULL,
+		hostname VARCHAR NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (address, mac, hostname)
+	)`, `
+	CREATE TABLE IF NOT EXISTS checkpoints (
+		path VARCHAR PRIMARY KEY,
+		inode UBIGINT NOT NULL,
+		byte_offset BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS parsed_files (
+		hash VARCHAR PRIMARY KEY,
+		path VARCHAR NOT NULL,
+		inode UBIGINT NOT NULL,
+		size BIGINT NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		parsed_at BIGINT NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS queries (
+		timestamp BIGINT NOT NULL,
+		domain VARCHAR NOT NULL,
+		type VARCHAR NOT NULL,
+		client VARCHAR NOT NULL,
+		action VARCHAR NOT NULL
+	)`,
+		`CREATE INDEX IF NOT EXISTS queries_timestamp ON queries (timestamp)`,
+	}
+}
+
+func (d duckdbDialect) upsert(table string, columns []upsertColumn, rows int) string {
+	insert, keys := insertColumns(table, columns, rows, d)
+	var sets []string
+	for _, c := range columns {
+		switch c.Merge {
+		case mergeMin:
+			sets = append(sets, fmt.Sprintf("%[1]s = LEAST(%[1]s, excluded.%[1]s)", c.Name))
+		case mergeMax:
+			sets = append(sets, fmt.Sprintf("%[1]s = GREATEST(%[1]s, excluded.%[1]s)", c.Name))
+		case mergeAdd:
+			sets = append(sets, fmt.Sprintf("%[1]s = %[1]s + excluded.%[1]s", c.Name))
+		case mergeReplace:
+			sets = append(sets, fmt.Sprintf("%[1]s = excluded.%[1]s", c.Name))
+		}
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insert, strings.Join(keys, ", "), strings.Join(sets, ", "))
+}
+
+func (d duckdbDialect) touch(rows int) string {
+	return "UPDATE domains SET last_seen = GREATEST(domains.last_seen, v.last_seen), count = domains.count + v.count" +
+		" FROM (VALUES " + valueRows(d, rows, "CAST(%s AS VARCHAR)", "CAST(%s AS BIGINT)", "CAST(%s AS BIGINT)") + ") AS v (domain, last_seen, count)" +
+		" WHERE domains.domain = v.domain"
+}
+
+func (duckdbDialect) migrations() []migration {
+	return []migration{
+		{5, "count blocked queries", func(ctx context.Context, db *database) error {
+			// DuckDB cannot add a column with constraints; the default keeps
+			// it from being NULL all the same.
+			_, err := db.ExecContext(ctx, "ALTER TABLE domain_resolution ADD COLUMN IF NOT EXISTS blocked BIGINT DEFAULT 0")
+			return err
+		}},
+	}
+}
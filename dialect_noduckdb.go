@@ -0,0 +1,21 @@
+//go:build !duckdb
+
+package main
+
+import "errors"
+
+// duckdbDialect stands in for DuckDB support, which needs cgo and is only
+// compiled in with the duckdb build tag.
+type duckdbDialect struct{}
+
+func (duckdbDialect) driver() string { return "duckdb" }
+
+func (duckdbDialect) dataSource(string) (string, error) {
+	return "", errors.New("DuckDB support is not compiled in; rebuild with -tags duckdb")
+}
+
+func (duckdbDialect) placeholder(int) string                    { return "?" }
+func (duckdbDialect) schema() []string                          { return nil }
+func (duckdbDialect) upsert(string, []upsertColumn, int) string { return "" }
+func (duckdbDialect) touch(int) string                          { return "" }
+func (duckdbDialect) migrations() []migration                   { return nil }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of domainChange, in the order they are listed.
+const (
+	changeNew      = "new"      // only in the newer database
+	changeGone     = "gone"     // only in the older database
+	changeAdvanced = "advanced" // in both, seen again since
+)
+
+// domainChange is a difference between two databases in one domain. Before is
+// zero for new domains, After for gone ones.
+type domainChange struct {
+	Change string
+	Domain string // forward order
+	Before domainTimes
+	After  domainTimes
+}
+
+// runDiff implements the diff subcommand: what changed between an older copy
+// of a database, such as one saved before a parse, and --db.
+func runDiff(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	oldDriver := fs.String("old-driver", "", "storage `driver` of the older database (default: inferred from it)")
+	format := fs.String("format", "text", "output `format`: text, csv or jsonl")
+	output := fs.String("output", "", "write to `path` instead of standard output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: diff [flags] old.db")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("diff needs the older database to compare --db with")
+	}
+
+	write, ok := map[string]func(io.Writer, []domainChange) error{
+		"text":  writeChangesText,
+		"csv":   writeChangesCSV,
+		"jsonl": writeChangesJSONL,
+	}[*format]
+	if !ok {
+		return fmt.Errorf("unknown diff format %q", *format)
+	}
+
+	oldOpts := dbOptions{Path: fs.Arg(0), Driver: *oldDriver, Timeout: dbOpts.Timeout}
+	before, err := loadDomainTimes(ctx, oldOpts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", oldOpts.Path, err)
+	}
+	after, err := loadDomainTimes(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	changes := diffDomains(before, after)
+
+	if *output == "" {
+		return write(os.Stdout, changes)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := write(f, changes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	slog.Info("saved diff", "path", *output, "changes", len(changes))
+	return nil
+}
+
+// loadDomainTimes returns the stored domains of the existing database o.
+func loadDomainTimes(ctx context.Context, o dbOptions) (map[string]domainTimes, error) {
+	st, ok, err := openExistingStore(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("no such database")
+	}
+	defer st.Close()
+
+	ctx, cancel := o.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string]domainTimes, len(rows))
+	for _, r := range rows {
+		mergeInto(domains, r.Domain, domainTimes{FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Count: r.Count})
+	}
+	return domains, nil
+}
+
+// diffDomains returns the new, gone and advanced domains between the reversed
+// domains before and after, each kind in reversed-domain order so related
+// names stay together.
+func diffDomains(before, after map[string]domainTimes) []domainChange {
+	var changes []domainChange
+	for domain, a := range after {
+		b, ok := before[domain]
+		switch {
+		case !ok:
+			changes = append(changes, domainChange{Change: changeNew, Domain: domain, After: a})
+		case a.LastSeen > b.LastSeen:
+			changes = append(changes, domainChange{Change: changeAdvanced, Domain: domain, Before: b, After: a})
+		}
+	}
+	for domain, b := range before {
+		if _, ok := after[domain]; !ok {
+			changes = append(changes, domainChange{Change: changeGone, Domain: domain, Before: b})
+		}
+	}
+
+	order := map[string]int{changeNew: 0, changeGone: 1, changeAdvanced: 2}
+	slices.SortFunc(changes, func(a, b domainChange) int {
+		if c := order[a.Change] - order[b.Change]; c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	for i := range changes {
+		changes[i].Domain = reverseDomainParts(changes[i].Domain)
+	}
+	return changes
+}
+
+func writeChangesText(w io.Writer, changes []domainChange) error {
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Change]++
+	}
+	fmt.Fprintf(w, "%d new, %d gone, %d seen again\n", counts[changeNew], counts[changeGone], counts[changeAdvanced])
+	if len(changes) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nCHANGE\tDOMAIN\tFIRST SEEN\tLAST SEEN\tQUERIES")
+	for _, c := range changes {
+		switch c.Change {
+		case changeNew:
+			fmt.Fprintf(tw, "+\t%s\t%s\t%s\t%d\n", c.Domain, formatUnix(c.After.FirstSeen), formatUnix(c.After.LastSeen), c.After.Count)
+		case changeGone:
+			fmt.Fprintf(tw, "-\t%s\t%s\t%s\t%d\n", c.Domain, formatUnix(c.Before.FirstSeen), formatUnix(c.Before.LastSeen), c.Before.Count)
+		default:
+			fmt.Fprintf(tw, "~\t%s\t%s\t%s → %s\t%+d\n", c.Domain, formatUnix(c.After.FirstSeen),
+				formatUnix(c.Before.LastSeen), formatUnix(c.After.LastSeen), c.After.Count-c.Before.Count)
+		}
+	}
+	return tw.Flush()
+}
+
+func formatUnix(t int64) string {
+	return time.Unix(t, 0).Format("2006-01-02 15:04")
+}
+
+// writeChangesCSV writes a CSV document with a header row and timestamps in
+// RFC 3339 as in domain exports. The previous_* columns are empty for new
+// domains, the others for gone ones.
+func writeChangesCSV(w io.Writer, changes []domainChange) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"change", "domain", "first_seen", "last_seen", "count", "previous_last_seen", "previous_count"})
+	for _, c := range changes {
+		record := []string{c.Change, c.Domain, "", "", "", "", ""}
+		if c.Change != changeGone {
+			record[2] = time.Unix(c.After.FirstSeen, 0).Format(time.RFC3339)
+			record[3] = time.Unix(c.After.LastSeen, 0).Format(time.RFC3339)
+			record[4] = strconv.FormatInt(c.After.Count, 10)
+		}
+		if c.Change != changeNew {
+			if c.Change == changeGone {
+				record[2] = time.Unix(c.Before.FirstSeen, 0).Format(time.RFC3339)
+			}
+			record[5] = time.Unix(c.Before.LastSeen, 0).Format(time.RFC3339)
+			record[6] = strconv.FormatInt(c.Before.Count, 10)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// changeRecord is the JSON Lines representation of a domainChange.
+type changeRecord struct {
+	Change           string `json:"change"`
+	Domain           string `json:"domain"`
+	FirstSeen        int64  `json:"first_seen"`
+	LastSeen         int64  `json:"last_seen,omitempty"`
+	Count            int64  `json:"count,omitempty"`
+	PreviousLastSeen int64  `json:"previous_last_seen,omitempty"`
+	PreviousCount    int64  `json:"previous_count,omitempty"`
+}
+
+func writeChangesJSONL(w io.Writer, changes []domainChange) error {
+	enc := json.NewEncoder(w)
+	for _, c := range changes {
+		r := changeRecord{Change: c.Change, Domain: c.Domain}
+		if c.Change == changeGone {
+			r.FirstSeen = c.Before.FirstSeen
+		} else {
+			r.FirstSeen, r.LastSeen, r.Count = c.After.FirstSeen, c.After.LastSeen, c.After.Count
+		}
+		if c.Change != changeNew {
+			r.PreviousLastSeen, r.PreviousCount = c.Before.LastSeen, c.Before.Count
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/digest.txt
+var digestText string
+
+// digestRetry is how soon a digest that could not be sent is tried again.
+const digestRetry = time.Hour
+
+// smtpOptions configures sending mail.
+type smtpOptions struct {
+	Addr     string
+	User     string
+	Password string
+	From     string
+	To       stringList
+}
+
+// addSMTPFlags registers the SMTP flags on fs.
+func addSMTPFlags(fs *flag.FlagSet) *smtpOptions {
+	o := &smtpOptions{}
+	fs.StringVar(&o.Addr, "smtp", "", "SMTP server `host:port`; port 465 uses TLS, others STARTTLS when offered")
+	fs.StringVar(&o.User, "smtp-user", "", "SMTP user `name`, to authenticate")
+	fs.StringVar(&o.Password, "smtp-password", "", "SMTP `password` (better set with DNSMASQ_PARSE_SMTP_PASSWORD or the config file)")
+	fs.StringVar(&o.From, "from", "", "sender `address`")
+	fs.Var(&o.To, "to", "recipient `address` (repeatable)")
+	return o
+}
+
+func (o smtpOptions) validate() error {
+	if o.Addr == "" || o.From == "" || len(o.To) == 0 {
+		return fmt.Errorf("--smtp, --from and --to are required")
+	}
+	if _, _, err := net.SplitHostPort(o.Addr); err != nil {
+		return fmt.Errorf("invalid --smtp address: %w", err)
+	}
+	return nil
+}
+
+// send mails msg, a complete message with headers, to the recipients.
+func (o smtpOptions) send(ctx context.Context, msg []byte) error {
+	host, port, _ := net.SplitHostPort(o.Addr)
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", o.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", o.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if o.User != "" {
+		// PlainAuth refuses to send the password unencrypted, but to localhost.
+		if err := c.Auth(smtp.PlainAuth("", o.User, o.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(o.From); err != nil {
+		return err
+	}
+	for _, to := range o.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("%s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// digestData is what a digest shows: the period since the last digest.
+type digestData struct {
+	reportData
+	Host            string
+	MoreNew         int            // new domains beyond NewDomains
+	Blocked         int64          // blocked queries in the period
+	TopBlocked      []reportDomain // most blocked domains in the period
+	BlockedLifetime bool           // Blocked counts all time, with no earlier digest to count from
+}
+
+// digestState is what the next digest starts from.
+type digestState struct {
+	SentAt int64 `json:"sent_at"`
+	// Blocked is the number of blocked queries of each domain when the
+	// digest was sent, as resolutions are only kept as lifetime totals.
+	Blocked map[string]int64 `json:"blocked"`
+}
+
+// runDigest implements the digest subcommand.
+func runDigest(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	mail := addSMTPFlags(fs)
+	since := fs.String("since", "7d", "period of the first digest (duration such as 24h or 7d, or a date); later digests cover the time since the previous one")
+	every := fs.Duration("every", 0, "keep running and send a digest every `interval`, such as 168h (default: send one and exit)")
+	statePath := fs.String("state", "", "remember when the last digest was sent in `file`, so runs from cron or restarts neither repeat nor skip a period")
+	n := addLimitFlag(fs, 10, "list the top `n` talkers and blocked domains")
+	maxNew := fs.Int("max-new", 100, "list at most `n` new domains, counting the rest")
+	dryRun := fs.Bool("dry-run", false, "print the message rather than sending it, and leave the state file alone")
+	naming := addClientNamesFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := mail.validate(); err != nil {
+			return err
+		}
+	}
+	if *every < 0 {
+		return fmt.Errorf("--every must not be negative")
+	}
+
+	state, err := loadDigestState(*statePath)
+	if err != nil {
+		return err
+	}
+	if state.SentAt == 0 {
+		cutoff, err := parseSince(*since, time.Now())
+		if err != nil {
+			return err
+		}
+		state.SentAt = cutoff
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, stop := notifyInterrupt(ctx)
+	defer stop()
+	due := time.Unix(state.SentAt, 0).Add(*every)
+	for {
+		if *every > 0 {
+			slog.Info("next digest", "at", due.Format(time.DateTime))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		msg, next, err := buildDigest(ctx, st, *dbOpts, *mail, state, *n, *maxNew, *naming)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			_, err := os.Stdout.Write(msg)
+			return err
+		}
+		if err := mail.send(ctx, msg); err != nil {
+			if *every == 0 {
+				return fmt.Errorf("sending digest: %w", err)
+			}
+			// Keep the period open, so the digest sent next covers it.
+			slog.Error("sending digest", "err", err)
+			due = time.Now().Add(min(*every, digestRetry))
+			continue
+		}
+		slog.Info("sent digest", "to", mail.To.String())
+		state = next
+		if err := saveDigestState(*statePath, state); err != nil {
+			return err
+		}
+		due = time.Unix(state.SentAt, 0).Add(*every)
+		if *every == 0 {
+			return nil
+		}
+	}
+}
+
+// buildDigest renders the digest of the period since state.SentAt as a mail
+// message, and returns the state the next digest starts from.
+func buildDigest(ctx context.Context, st store, dbOpts dbOptions, mail smtpOptions, state digestState, n, maxNew int, naming string) ([]byte, digestState, error) {
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	report, err := collectReport(ctx, st, state.SentAt, n, now, naming)
+	if err != nil {
+		return nil, state, err
+	}
+	data := digestData{reportData: report, BlockedLifetime: state.Blocked == nil}
+	data.Host, _ = os.Hostname()
+	if extra := len(data.NewDomains) - maxNew; extra > 0 {
+		data.NewDomains, data.MoreNew = data.NewDomains[:maxNew], extra
+	}
+	data.Clients = data.Clients[:min(n, len(data.Clients))]
+
+	resolutions, err := st.loadDomainResolutions(ctx)
+	if err != nil {
+		return nil, state, err
+	}
+	next := digestState{SentAt: now.Unix(), Blocked: make(map[string]int64)}
+	var blocked []domainCount
+	for domain, r := range resolutions {
+		if r.Blocked == 0 {
+			continue
+		}
+		next.Blocked[domain] = r.Blocked
+		if count := r.Blocked - state.Blocked[domain]; count > 0 {
+			data.Blocked += count
+			blocked = append(blocked, domainCount{domain, count})
+		}
+	}
+	sortDomainCounts(blocked)
+	for _, c := range blocked[:min(n, len(blocked))] {
+		data.TopBlocked = append(data.TopBlocked, reportDomain{Domain: reverseDomainParts(c.Domain), Count: c.Count})
+	}
+
+	tmpl, err := template.New("digest").Funcs(template.FuncMap{
+		"add": func(a, b int) int { return a + b },
+	}).Parse(digestText)
+	if err != nil {
+		return nil, state, err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return nil, state, err
+	}
+
+	subject := fmt.Sprintf("DNS digest: %d new domains", len(data.NewDomains)+data.MoreNew)
+	if data.Host != "" {
+		subject = fmt.Sprintf("DNS digest for %s: %d new domains", data.Host, len(data.NewDomains)+data.MoreNew)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", mail.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(mail.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+	qp.Close()
+	return msg.Bytes(), next, nil
+}
+
+// loadDigestState reads the state file at path; without one, or when it does
+// not exist yet, the state is empty.
+func loadDigestState(path string) (digestState, error) {
+	var state digestState
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// saveDigestState replaces the state file at path, if any.
+func saveDigestState(path string, state digestState) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsblSaveEvery is how many names enrich --dnsbl looks up between saves.
+const dnsblSaveEvery = 500
+
+// dnsblKey is a name looked up on a DNSBL zone: a registrable domain on a
+// domain zone such as dbl.spamhaus.org, or an address on an IP zone such as
+// zen.spamhaus.org.
+type dnsblKey struct {
+	Name string
+	Zone string
+}
+
+// dnsblResult is what a zone answered for a name: the return codes listing
+// it, such as 127.0.1.2, or none when it is not listed.
+type dnsblResult struct {
+	Codes     []string
+	CheckedAt int64
+}
+
+// dnsblOptions configures the DNSBL lookups of enrich and tail. Only enrich
+// looks addresses up, and sets IPZones and Workers.
+type dnsblOptions struct {
+	DomainZones stringList
+	IPZones     stringList
+	TTL         time.Duration
+	Resolver    string
+	Workers     int
+}
+
+// addDNSBLFlags registers the --dnsbl flags on fs.
+func addDNSBLFlags(fs *flag.FlagSet) *dnsblOptions {
+	o := &dnsblOptions{Workers: 1}
+	fs.Var(&o.DomainZones, "dnsbl", "look registrable domains up on the domain blocklist `zone`, such as dbl.spamhaus.org (repeatable)")
+	fs.DurationVar(&o.TTL, "dnsbl-ttl", 24*time.Hour, "look domains up again once their stored DNSBL result is older than `age`")
+	fs.StringVar(&o.Resolver, "dnsbl-resolver", "", "query the DNSBL zones through the DNS server at `host[:port]` (default: the first nameserver of /etc/resolv.conf)")
+	return o
+}
+
+func (o *dnsblOptions) enabled() bool {
+	return len(o.DomainZones) > 0 || len(o.IPZones) > 0
+}
+
+// dnsblQuery returns the name to look up on zone for name: a domain as is, an
+// IPv4 address with its octets reversed and an IPv6 address with its nibbles
+// reversed, as RFC 5782 has it.
+func dnsblQuery(name, zone string) string {
+	addr, err := netip.ParseAddr(name)
+	if err != nil {
+		return name + "." + zone
+	}
+	addr = addr.Unmap()
+	var labels []string
+	if addr.Is4() {
+		for _, b := range addr.As4() {
+			labels = append(labels, strconv.Itoa(int(b)))
+		}
+	} else {
+		for _, b := range addr.As16() {
+			labels = append(labels, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+		}
+	}
+	slices.Reverse(labels)
+	return strings.Join(labels, ".") + "." + zone
+}
+
+// lookupDNSBL asks zone whether it lists name. NXDOMAIN means it does not.
+// Answers in 127.255.255.0/24 are the zone refusing the query, as Spamhaus
+// does for queries through public resolvers, and answers outside 127.0.0.0/8
+// a resolver rewriting NXDOMAIN: both are errors rather than listings.
+func lookupDNSBL(ctx context.Context, c dnsClient, name, zone string) (dnsblResult, error) {
+	r := dnsblResult{CheckedAt: time.Now().Unix()}
+	resp, err := c.exchange(ctx, dnsblQuery(name, zone), dnsmessage.TypeA)
+	switch {
+	case err != nil:
+		return r, err
+	case resp.RCode == dnsmessage.RCodeNameError:
+		return r, nil
+	case resp.RCode != dnsmessage.RCodeSuccess:
+		return r, fmt.Errorf("%s: %s", zone, resp.RCode)
+	}
+	for _, rr := range resp.Answers {
+		a, ok := rr.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		code := netip.AddrFrom4(a.A)
+		if a.A[0] != 127 || a.A[1] == 255 && a.A[2] == 255 {
+			return r, fmt.Errorf("%s: unusable answer %s", zone, code)
+		}
+		r.Codes = append(r.Codes, code.String())
+	}
+	slices.Sort(r.Codes)
+	return r, nil
+}
+
+// listing describes the listing of a name on zone for reports, as the zone
+// followed by its return codes.
+func (r dnsblResult) listing(zone string) string {
+	return fmt.Sprintf("%s (%s)", zone, strings.Join(r.Codes, " "))
+}
+
+// dnsblListings returns the listings of each listed name in results, in zone
+// order.
+func dnsblListings(results map[dnsblKey]dnsblResult) map[string][]string {
+	listings := make(map[string][]string)
+	for key, r := range results {
+		if len(r.Codes) > 0 {
+			listings[key.Name] = append(listings[key.Name], r.listing(key.Zone))
+		}
+	}
+	for _, l := range listings {
+		slices.Sort(l)
+	}
+	return listings
+}
+
+// dnsblChecker looks names up on the configured zones, reusing results
+// younger than the TTL. It is safe for concurrent use.
+type dnsblChecker struct {
+	opts   dnsblOptions
+	client dnsClient
+
+	mu    sync.Mutex
+	cache map[dnsblKey]dnsblResult
+	fresh map[dnsblKey]dnsblResult // looked up since the last take
+}
+
+// newDNSBLChecker returns a checker starting from the results stored in st.
+func newDNSBLChecker(ctx context.Context, st store, dbOpts dbOptions, o dnsblOptions) (*dnsblChecker, error) {
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	cache, err := st.loadDNSBL(loadCtx)
+	if err != nil {
+		return nil, fmt.Errorf("loading DNSBL results: %w", err)
+	}
+	return &dnsblChecker{
+		opts:   o,
+		client: newDNSClient(o.Resolver),
+		cache:  cache,
+		fresh:  make(map[dnsblKey]dnsblResult),
+	}, nil
+}
+
+// zones returns the zones to look name up on: the IP zones for an address
+// and the domain zones otherwise.
+func (c *dnsblChecker) zones(name string) []string {
+	if _, err := netip.ParseAddr(name); err == nil {
+		return c.opts.IPZones
+	}
+	return c.opts.DomainZones
+}
+
+// check looks name up on its zones, where the result is missing or older than
+// the TTL, and returns its listings. Zones that fail are left out, and the
+// first error is returned with what the others answered.
+func (c *dnsblChecker) check(ctx context.Context, name string) ([]string, error) {
+	var listings []string
+	var firstErr error
+	for _, zone := range c.zones(name) {
+		key := dnsblKey{Name: name, Zone: zone}
+		c.mu.Lock()
+		r, ok := c.cache[key]
+		c.mu.Unlock()
+		if !ok || time.Since(time.Unix(r.CheckedAt, 0)) >= c.opts.TTL {
+			var err error
+			if r, err = lookupDNSBL(ctx, c.client, name, zone); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			c.mu.Lock()
+			c.cache[key] = r
+			c.fresh[key] = r
+			c.mu.Unlock()
+		}
+		if len(r.Codes) > 0 {
+			listings = append(listings, r.listing(zone))
+		}
+	}
+	return listings, firstErr
+}
+
+// take returns the results looked up since the last call, to save. It returns
+// nil on a nil checker.
+func (c *dnsblChecker) take() map[dnsblKey]dnsblResult {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fresh := c.fresh
+	c.fresh = make(map[dnsblKey]dnsblResult)
+	return fresh
+}
+
+// enrichDNSBL looks the registrable domains of the stored names up on the
+// domain zones of o, and the public addresses they resolved to on its IP
+// zones, saving the results. It reports how many names it looked up and how
+// many of them are listed on at least one zone.
+func enrichDNSBL(ctx context.Context, st store, dbOpts dbOptions, o *dnsblOptions) (looked, listed int, err error) {
+	checker, err := newDNSBLChecker(ctx, st, dbOpts, *o)
+	if err != nil {
+		return 0, 0, err
+	}
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	wanted := make(map[string]bool)
+	if len(o.DomainZones) > 0 {
+		rows, err := st.loadDomainRows(loadCtx)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, row := range rows {
+			if name := reverseDomainParts(row.Domain); publicDomain(name) {
+				wanted[registrableDomain(name)] = true
+			}
+		}
+	}
+	if len(o.IPZones) > 0 {
+		addresses, err := st.loadDomainAddresses(loadCtx)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, a := range addresses {
+			if addr, err := netip.ParseAddr(a.Address); err == nil && addr.IsGlobalUnicast() && !addr.IsPrivate() {
+				wanted[addr.Unmap().String()] = true
+			}
+		}
+	}
+	slog.Info("looking up DNSBL listings", "names", len(wanted), "zones", len(o.DomainZones)+len(o.IPZones))
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range max(o.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				if _, err := checker.check(ctx, name); err != nil && ctx.Err() == nil {
+					slog.Warn("DNSBL lookup failed", "name", name, "err", err)
+				}
+			}
+		}()
+	}
+
+	names := make(map[string]bool)
+	listedNames := make(map[string]bool)
+	save := func() error {
+		batch := checker.take()
+		for key, r := range batch {
+			names[key.Name] = true
+			if len(r.Codes) > 0 {
+				listedNames[key.Name] = true
+			}
+		}
+		saveCtx, cancel := dbOpts.withTimeout(context.WithoutCancel(ctx))
+		defer cancel()
+		return st.saveDNSBL(saveCtx, batch)
+	}
+	sent := 0
+	for name := range wanted {
+		select {
+		case jobs <- name:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if sent++; sent%dnsblSaveEvery == 0 {
+			if err := save(); err != nil {
+				close(jobs)
+				wg.Wait()
+				return len(names), len(listedNames), err
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := save(); err != nil {
+		return len(names), len(listedNames), err
+	}
+	return len(names), len(listedNames), ctx.Err()
+}
+
+func (db *database) saveDNSBL(ctx context.Context, results map[dnsblKey]dnsblResult) error {
+	args := make([]any, 0, 4*len(results))
+	for key, r := range results {
+		args = append(args, key.Name, key.Zone, strings.Join(r.Codes, ","), r.CheckedAt)
+	}
+	return db.upsertRows(ctx, "dnsbl_results", []upsertColumn{
+		{"name", mergeKey},
+		{"zone", mergeKey},
+		{"codes", mergeReplace},
+		{"checked_at", mergeReplace},
+	}, args)
+}
+
+func (db *database) loadDNSBL(ctx context.Context) (map[dnsblKey]dnsblResult, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, zone, codes, checked_at FROM dnsbl_results")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[dnsblKey]dnsblResult)
+	for rows.Next() {
+		var key dnsblKey
+		var codes string
+		var r dnsblResult
+		if err := rows.Scan(&key.Name, &key.Zone, &codes, &r.CheckedAt); err != nil {
+			return nil, err
+		}
+		if codes != "" {
+			r.Codes = strings.Split(codes, ",")
+		}
+		results[key] = r
+	}
+	return results, rows.Err()
+}
+
+// dnsblBoltKey, encodeDNSBL and decodeDNSBL store DNSBL results in bbolt, keyed
+// by name and zone and holding the codes and time of the lookup, NUL-separated.
+func dnsblBoltKey(key dnsblKey) []byte {
+	return []byte(key.Name + "\x00" + key.Zone)
+}
+
+func encodeDNSBL(r dnsblResult) []byte {
+	return []byte(strings.Join(r.Codes, ",") + "\x00" + strconv.FormatInt(r.CheckedAt, 10))
+}
+
+func decodeDNSBL(k, v []byte) (dnsblKey, dnsblResult) {
+	name, zone, _ := strings.Cut(string(k), "\x00")
+	codes, checkedAt, _ := strings.Cut(string(v), "\x00")
+	var r dnsblResult
+	if codes != "" {
+		r.Codes = strings.Split(codes, ",")
+	}
+	r.CheckedAt, _ = strconv.ParseInt(checkedAt, 10, 64)
+	return dnsblKey{Name: name, Zone: zone}, r
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// domainNode is a label of the domain tree, such as example under com, with
+// what is rolled up from the stored domains at and under it.
+type domainNode struct {
+	Label     string
+	Domains   int64 // stored domains at or under the node
+	Count     int64
+	FirstSeen int64
+	LastSeen  int64
+	Children  map[string]*domainNode
+}
+
+// buildDomainTree rolls rows up by label. Stored domains are reversed, so
+// their labels already run from the top of the tree down.
+func buildDomainTree(rows []domainRow) *domainNode {
+	root := &domainNode{Children: make(map[string]*domainNode)}
+	for _, row := range rows {
+		node := root
+		for label := range strings.SplitSeq(row.Domain, ".") {
+			child, ok := node.Children[label]
+			if !ok {
+				child = &domainNode{Label: label, Children: make(map[string]*domainNode)}
+				node.Children[label] = child
+			}
+			child.add(row)
+			node = child
+		}
+	}
+	return root
+}
+
+// add rolls row up into n.
+func (n *domainNode) add(row domainRow) {
+	if n.Domains == 0 || row.FirstSeen < n.FirstSeen {
+		n.FirstSeen = row.FirstSeen
+	}
+	n.LastSeen = max(n.LastSeen, row.LastSeen)
+	n.Domains++
+	n.Count += row.Count
+}
+
+// children returns the children of n in the export's order: by label for
+// the domain sorts, and otherwise by the rolled-up value of the sort key.
+func (n *domainNode) children(opts exportOptions) []*domainNode {
+	nodes := make([]*domainNode, 0, len(n.Children))
+	for _, child := range n.Children {
+		nodes = append(nodes, child)
+	}
+	cmp := func(a, b *domainNode) int { return strings.Compare(a.Label, b.Label) }
+	switch opts.Sort {
+	case "first_seen":
+		cmp = func(a, b *domainNode) int { return cmpInt(a.FirstSeen, b.FirstSeen) }
+	case "last_seen":
+		cmp = func(a, b *domainNode) int { return cmpInt(a.LastSeen, b.LastSeen) }
+	case "count":
+		cmp = func(a, b *domainNode) int { return cmpInt(a.Count, b.Count) }
+	}
+	slices.SortFunc(nodes, func(a, b *domainNode) int {
+		c := cmp(a, b)
+		if opts.Desc {
+			c = -c
+		}
+		if c == 0 {
+			c = strings.Compare(a.Label, b.Label)
+		}
+		return c
+	})
+	return nodes
+}
+
+// writeDomainsTree writes rows as a tree of labels, com above example above
+// www, each indented under its parent with the number of domains stored at
+// or under it, their queries and when the first was first seen and the last
+// last seen. Nodes deeper than opts.TreeDepth, when set, are left out.
+func writeDomainsTree(w io.Writer, rows []domainRow, opts exportOptions) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tDOMAINS\tQUERIES\tFIRST SEEN\tLAST SEEN")
+	var write func(n *domainNode, depth int)
+	write = func(n *domainNode, depth int) {
+		for _, child := range n.children(opts) {
+			fmt.Fprintf(tw, "%s%s\t%d\t%d\t%s\t%s\n", strings.Repeat("  ", depth), child.Label,
+				child.Domains, child.Count, unixToDateTime(child.FirstSeen), unixToDateTime(child.LastSeen))
+			if opts.TreeDepth == 0 || depth+1 < opts.TreeDepth {
+				write(child, depth+1)
+			}
+		}
+	}
+	write(buildDomainTree(rows), 0)
+	return tw.Flush()
+}
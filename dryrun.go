@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// reportDryRun prints how the aggregated queries would change the store, reading
+// it without modifying or creating it.
+func reportDryRun(ctx context.Context, dbOpts dbOptions, agg *aggregator) error {
+	existing, err := loadExistingDomains(ctx, dbOpts)
+	if err != nil {
+		return err
+	}
+
+	var newDomains []string
+	var queries int64
+	for domain, times := range agg.domains {
+		queries += times.Count
+		if !existing[domain] {
+			newDomains = append(newDomains, domain)
+		}
+	}
+	slices.Sort(newDomains)
+	for _, domain := range newDomains {
+		slog.Debug("would insert", "domain", reverseDomainParts(domain))
+	}
+
+	fmt.Printf("Dry run: %d lines, %d queries, %d domains\n", agg.linesProcessed, queries, len(agg.domains))
+	fmt.Printf("  would insert: %d new domains\n", len(newDomains))
+	fmt.Printf("  would update: %d existing domains\n", len(agg.domains)-len(newDomains))
+	fmt.Printf("  would record: %d client/domain pairs, %d hourly buckets\n", len(agg.perClient), len(agg.hours))
+	return nil
+}
+
+// loadExistingDomains returns the stored domains, or an empty set when a local
+// store does not exist yet. Local files are opened read-only.
+func loadExistingDomains(ctx context.Context, dbOpts dbOptions) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	st, ok, err := openExistingStore(ctx, dbOpts)
+	if err != nil || !ok {
+		return existing, err
+	}
+	defer st.Close()
+
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		existing[r.Domain] = true
+	}
+	return existing, nil
+}
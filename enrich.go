@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+// runEnrich implements the enrich subcommand: look up what outside sources
+// know of the stored domains and addresses, and store it for reports such as
+// asns, obscure, registered and listed to use.
+func runEnrich(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	var geoipPaths stringList
+	fs.Var(&geoipPaths, "geoip", "look up the country and ASN of resolved addresses in the MaxMind or DB-IP database `file` (repeatable, e.g. one Country and one ASN database)")
+	ranksPath := fs.String("ranks", "", "store the rank of each registrable domain in the popularity list `file`, a Tranco or Umbrella CSV, plain, gzipped or zipped")
+	rdap := addRDAPFlags(fs)
+	dnsbl := addDNSBLFlags(fs)
+	fs.Var(&dnsbl.IPZones, "dnsbl-ip", "look resolved addresses up on the IP blocklist `zone`, such as zen.spamhaus.org (repeatable)")
+	fs.IntVar(&dnsbl.Workers, "dnsbl-workers", 8, "make up to `n` DNSBL queries at a time")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if len(geoipPaths) == 0 && *ranksPath == "" && !rdap.Enabled && !dnsbl.enabled() {
+		return errors.New("enrich needs --geoip, --ranks, --rdap, --dnsbl or --dnsbl-ip")
+	}
+
+	var geo *geoIP
+	if len(geoipPaths) > 0 {
+		var err error
+		if geo, err = openGeoIP(geoipPaths); err != nil {
+			return err
+		}
+	}
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if geo != nil {
+		geoCtx, cancel := dbOpts.withTimeout(ctx)
+		found, total, err := enrichGeoIP(geoCtx, st, geo)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("enriching addresses: %w", err)
+		}
+		slog.Info("enriched addresses from GeoIP", "found", found, "addresses", total)
+	}
+	if *ranksPath != "" {
+		ranksCtx, cancel := dbOpts.withTimeout(ctx)
+		ranked, total, err := enrichRanks(ranksCtx, st, *ranksPath)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("enriching domains: %w", err)
+		}
+		slog.Info("enriched domains from popularity list", "ranked", ranked, "domains", total)
+	}
+	if rdap.Enabled {
+		looked, registered, err := enrichRDAP(ctx, st, *dbOpts, rdap)
+		slog.Info("enriched domains from RDAP", "looked_up", looked, "registered", registered)
+		if err != nil {
+			return fmt.Errorf("enriching domains: %w", err)
+		}
+	}
+	if dnsbl.enabled() {
+		looked, listed, err := enrichDNSBL(ctx, st, *dbOpts, dnsbl)
+		slog.Info("enriched names from DNSBLs", "looked_up", looked, "listed", listed)
+		if err != nil {
+			return fmt.Errorf("enriching from DNSBLs: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"golang.org/x/net/publicsuffix"
+)
+
+// exportColumns lists the columns available to text and csv exports.
+var exportColumns = []string{"domain", "reversed_domain", "first_seen", "last_seen", "count"}
+
+// textColumns is the default column set of text exports.
+var textColumns = []string{"first_seen", "last_seen", "reversed_domain"}
+
+// sortKeys lists the orderings accepted by --sort.
+var sortKeys = []string{"reversed", "domain", "first_seen", "last_seen", "count"}
+
+type exportOptions struct {
+	Format  string
+	Columns []string
+
+	// Allowlist holds forward-order domains that blocklist formats must not emit.
+	Allowlist map[string]bool
+
+	// Target is the address dnsmasq exports answer with; "#" means NXDOMAIN/0.0.0.0.
+	Target string
+
+	// Collapse reduces blocklist entries to their registrable domain (eTLD+1).
+	Collapse bool
+
+	// Sort orders the export; see sortKeys. Desc reverses it.
+	Sort string
+	Desc bool
+
+	// Limit caps the number of rows written; 0 means no limit.
+	Limit int
+
+	// Only, when not nil, holds the reversed domains to export, leaving out
+	// the rest (--only-new).
+	Only map[string]bool
+
+	// TreeDepth is the number of label levels tree exports show; 0 shows all.
+	TreeDepth int
+
+	// Template, when set, formats each row instead of Format.
+	Template *template.Template
+
+	// Compress is how the file is compressed as it is written: "" for not at
+	// all, gzip or zstd.
+	Compress string
+
+	// Uploads are where the file goes once written (--upload).
+	Uploads []uploadTarget
+}
+
+// exportFlags are the command-line flags that configure exports.
+type exportFlags struct {
+	format, columns, sortKey, tmpl, output string
+	allowlist, target, compress            string
+	desc, collapse                         bool
+	byLastSeen, byCount                    bool
+	limit, treeDepth                       int
+	uploads, uploadHeaders                 stringList
+}
+
+// addExportFlags registers the export flags on fs.
+func addExportFlags(fs *flag.FlagSet) *exportFlags {
+	f := &exportFlags{}
+	fs.StringVar(&f.format, "format", "text", "export `format`: text, csv, jsonl, parquet, hosts, dnsmasq, adblock, rpz, pihole, pihole-regex, domains or tree (rolled up by label)")
+	fs.StringVar(&f.columns, "columns", "", "comma-separated `list` of columns for text and csv exports: "+strings.Join(exportColumns, ", "))
+	fs.StringVar(&f.allowlist, "allowlist", "", "`file` of domains (and their subdomains) to leave out of blocklist exports")
+	fs.StringVar(&f.target, "dnsmasq-target", "#", "`address` returned by dnsmasq-format exports (# blocks the domain)")
+	fs.StringVar(&f.sortKey, "sort", "reversed", "sort `key` for the export: "+strings.Join(sortKeys, ", "))
+	fs.BoolVar(&f.desc, "desc", false, "sort the export in descending order")
+	fs.IntVar(&f.limit, "limit", 0, "write at most `n` rows per export (0 for all)")
+	fs.IntVar(&f.treeDepth, "tree-depth", 0, "show `n` levels of labels in tree exports, such as 2 for com and example.com (0 for all)")
+	fs.StringVar(&f.tmpl, "template", "", "Go text/template `text` used to format each exported row (@file reads it from a file)")
+	fs.StringVar(&f.output, "output", "", "write a single export to `path` instead of the default unique_domains files; - writes it to standard output")
+	fs.BoolVar(&f.collapse, "collapse", false, "collapse blocklist entries to their registrable domain")
+	fs.BoolVar(&f.byLastSeen, "by-last-seen", false, "also write unique_domains_by_last_seen, the most recently active domains first")
+	fs.BoolVar(&f.byCount, "by-count", false, "also write unique_domains_by_count, the most queried domains first")
+	fs.StringVar(&f.compress, "compress", "", "compress exports as they are written, with gzip or zstd; the default files get a .gz or .zst extension")
+	fs.Var(&f.uploads, "upload", uploadFlagUsage)
+	fs.Var(&f.uploadHeaders, "upload-header", "`name=value` header for HTTP uploads, such as an Authorization token (repeatable)")
+	return f
+}
+
+// specs validates the flags and returns the exports they describe.
+func (f *exportFlags) specs() ([]exportSpec, error) {
+	opts, err := newExportOptions(f.format, f.columns, f.sortKey)
+	if err != nil {
+		return nil, err
+	}
+	opts.Target = f.target
+	opts.Collapse = f.collapse
+	opts.Desc = f.desc
+	opts.Limit = f.limit
+	opts.TreeDepth = f.treeDepth
+	switch f.compress {
+	case "", "gzip", "zstd":
+		if f.compress != "" && f.format == "parquet" {
+			return nil, errors.New("--compress does not apply to parquet, which compresses its columns itself")
+		}
+		opts.Compress = f.compress
+	default:
+		return nil, fmt.Errorf("unknown --compress %q (want gzip or zstd)", f.compress)
+	}
+	if f.tmpl != "" {
+		opts.Template, err = parseTemplate(f.tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template: %w", err)
+		}
+	}
+	if f.allowlist != "" {
+		opts.Allowlist, err = loadDomainList(f.allowlist)
+		if err != nil {
+			return nil, fmt.Errorf("loading allowlist: %w", err)
+		}
+	}
+
+	headers := make(http.Header)
+	for _, pair := range f.uploadHeaders {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --upload-header %q: want name=value", pair)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	for _, raw := range f.uploads {
+		target, err := parseUploadTarget(raw, headers)
+		if err != nil {
+			return nil, err
+		}
+		if f.output == stdinPath {
+			return nil, errors.New("--upload needs a file to upload, not --output -")
+		}
+		if target.single() && f.output == "" {
+			return nil, fmt.Errorf("--upload %s names a file, so needs --output for a single export", target)
+		}
+		opts.Uploads = append(opts.Uploads, target)
+	}
+
+	if f.output != "" {
+		if f.byLastSeen || f.byCount {
+			return nil, errors.New("--by-last-seen and --by-count add to the default export files, so cannot go with --output")
+		}
+		return []exportSpec{{Path: f.output, exportOptions: opts}}, nil
+	}
+	specs := defaultExportSpecs(opts)
+	if f.byLastSeen {
+		specs = append(specs, orderedExportSpec(opts, "last_seen"))
+	}
+	if f.byCount {
+		specs = append(specs, orderedExportSpec(opts, "count"))
+	}
+	return specs, nil
+}
+
+// exportSpec describes one export file.
+type exportSpec struct {
+	Path string
+
+	// ByPrefix keeps only the earliest-seen domain per first-two-components prefix.
+	ByPrefix bool
+
+	exportOptions
+}
+
+func newExportOptions(format, columns, sortKey string) (exportOptions, error) {
+	opts := exportOptions{Format: format, Sort: sortKey}
+	switch format {
+	case "text", "csv", "jsonl", "parquet", "hosts", "dnsmasq", "adblock", "rpz", "pihole", "pihole-regex", "domains", "tree":
+	default:
+		return opts, fmt.Errorf("unknown export format %q", format)
+	}
+	if !slices.Contains(sortKeys, sortKey) {
+		return opts, fmt.Errorf("unknown sort key %q (available: %s)", sortKey, strings.Join(sortKeys, ", "))
+	}
+
+	for _, c := range strings.Split(columns, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !slices.Contains(exportColumns, c) {
+			return opts, fmt.Errorf("unknown export column %q (available: %s)", c, strings.Join(exportColumns, ", "))
+		}
+		opts.Columns = append(opts.Columns, c)
+	}
+	if len(opts.Columns) == 0 {
+		opts.Columns = exportColumns
+		if format == "text" {
+			opts.Columns = textColumns
+		}
+	}
+	return opts, nil
+}
+
+// parseTemplate parses a per-row export template. A value starting with "@" names
+// a file holding the template.
+func parseTemplate(text string) (*template.Template, error) {
+	if name, ok := strings.CutPrefix(text, "@"); ok {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New("row").Parse(strings.TrimSuffix(text, "\n"))
+}
+
+// defaultExportSpecs returns the classic pair of export files: every domain, and the
+// first-seen domain per prefix in first_seen order.
+func defaultExportSpecs(opts exportOptions) []exportSpec {
+	byFirstSeen := opts
+	byFirstSeen.Sort, byFirstSeen.Desc = "first_seen", false
+	return []exportSpec{
+		{Path: "unique_domains" + opts.extension(), exportOptions: opts},
+		{Path: "unique_domains_by_first_seen" + opts.extension(), ByPrefix: true, exportOptions: byFirstSeen},
+	}
+}
+
+// orderedExportSpec returns the export of every domain in descending order of
+// key, named unique_domains_by_<key>.
+func orderedExportSpec(opts exportOptions, key string) exportSpec {
+	opts.Sort, opts.Desc = key, true
+	return exportSpec{Path: "unique_domains_by_" + key + opts.extension(), exportOptions: opts}
+}
+
+// loadExportRows reads the rows to export from the domains table, or from the
+// per-client observations when a client filter is given.
+func loadExportRows(ctx context.Context, st store, clients clientFilter) ([]domainRow, error) {
+	if len(clients) > 0 {
+		slog.Info("exports limited to clients", "clients", clients.String())
+		return loadClientDomainRows(ctx, st, clients)
+	}
+	return st.loadDomainRows(ctx)
+}
+
+// writeExports writes every spec from domains, uploading each file written,
+// and stops early if ctx is cancelled.
+func writeExports(ctx context.Context, domains []domainRow, specs []exportSpec) error {
+	for _, spec := range specs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeExportFile(selectRows(domains, spec), spec); err != nil {
+			return err
+		}
+		for _, target := range spec.Uploads {
+			if err := target.upload(ctx, spec.Path); err != nil {
+				return fmt.Errorf("uploading %s to %s: %w", spec.Path, target, err)
+			}
+		}
+	}
+	return nil
+}
+
+type domainRow struct {
+	Domain    string
+	FirstSeen int64
+	LastSeen  int64
+	Count     int64
+
+	forward string // forward-order domain, filled in when sorting by it
+}
+
+func (db *database) loadDomainRows(ctx context.Context) ([]domainRow, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, first_seen, last_seen, count FROM domains")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDomainRows(rows)
+}
+
+func scanDomainRows(rows *sql.Rows) ([]domainRow, error) {
+	var domains []domainRow
+	for rows.Next() {
+		var domain sql.NullString
+		var firstSeen, lastSeen, count int64
+
+		err := rows.Scan(&domain, &firstSeen, &lastSeen, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		// Convert null string to regular string if not NULL
+		domainStr := ""
+		if domain.Valid {
+			domainStr = domain.String
+		}
+
+		domains = append(domains, domainRow{Domain: domainStr, FirstSeen: firstSeen, LastSeen: lastSeen, Count: count})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// selectRows returns a sorted, limited copy of domains for spec.
+func selectRows(domains []domainRow, spec exportSpec) []domainRow {
+	rows := slices.Clone(domains)
+	if spec.Only != nil {
+		rows = slices.DeleteFunc(rows, func(row domainRow) bool { return !spec.Only[row.Domain] })
+	}
+	sortDomainRows(rows, "reversed", false)
+
+	if spec.ByPrefix {
+		sortDomainRows(rows, "first_seen", false)
+		rows = firstSeenByPrefix(rows)
+	}
+
+	sortDomainRows(rows, spec.Sort, spec.Desc)
+	if spec.Limit > 0 && len(rows) > spec.Limit {
+		rows = rows[:spec.Limit]
+	}
+	return rows
+}
+
+// sortDomainRows stably sorts rows in place by key.
+func sortDomainRows(rows []domainRow, key string, desc bool) {
+	var cmp func(a, b domainRow) int
+	switch key {
+	case "domain":
+		for i := range rows {
+			rows[i].forward = reverseDomainParts(rows[i].Domain)
+		}
+		cmp = func(a, b domainRow) int { return strings.Compare(a.forward, b.forward) }
+	case "first_seen":
+		cmp = func(a, b domainRow) int { return cmpInt(a.FirstSeen, b.FirstSeen) }
+	case "last_seen":
+		cmp = func(a, b domainRow) int { return cmpInt(a.LastSeen, b.LastSeen) }
+	case "count":
+		cmp = func(a, b domainRow) int { return cmpInt(a.Count, b.Count) }
+	default:
+		cmp = func(a, b domainRow) int { return strings.Compare(a.Domain, b.Domain) }
+	}
+	if desc {
+		slices.SortStableFunc(rows, func(a, b domainRow) int { return cmp(b, a) })
+		return
+	}
+	slices.SortStableFunc(rows, cmp)
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// firstTwoComponents returns the first two dot-separated components of domain (e.g. "com.example.www" -> "com.example").
+func firstTwoComponents(domain string) string {
+	parts := strings.SplitN(domain, ".", 3)
+	if len(parts) < 2 {
+		return domain
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// firstSeenByPrefix keeps one row per distinct first-two-components prefix:
+// the domain with the earliest first_seen for that prefix. Rows must be in first_seen ascending order.
+func firstSeenByPrefix(rows []domainRow) []domainRow {
+	var byPrefix []domainRow
+	seenPrefix := make(map[string]bool)
+
+	for _, row := range rows {
+		prefix := firstTwoComponents(row.Domain)
+		if seenPrefix[prefix] {
+			continue
+		}
+		seenPrefix[prefix] = true
+		byPrefix = append(byPrefix, row)
+	}
+	return byPrefix
+}
+
+// writeExportFile writes rows to the file of spec, or to stdout when its path
+// is "-"; logs and progress go to stderr, so stdout holds only the export.
+func writeExportFile(rows []domainRow, spec exportSpec) error {
+	outFile := os.Stdout
+	if spec.Path != stdinPath {
+		var err error
+		if outFile, err = os.Create(spec.Path); err != nil {
+			return err
+		}
+		defer outFile.Close()
+	}
+
+	writer := bufio.NewWriter(outFile)
+	compressed, err := compressWriter(writer, spec.Compress)
+	if err != nil {
+		return err
+	}
+	if err := writeDomains(compressed, rows, spec.exportOptions); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if spec.Path != stdinPath {
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("saved export", "path", spec.Path, "domains", len(rows), "by_prefix", spec.ByPrefix)
+	return nil
+}
+
+// compressWriter returns a writer compressing to w with method, as named by
+// --compress, or w itself when method is empty. Closing it finishes the
+// compressed stream but leaves w open.
+func compressWriter(w io.Writer, method string) (io.WriteCloser, error) {
+	switch method {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// extension returns the file extension used for the export format, with that
+// of its compression.
+func (o exportOptions) extension() string {
+	switch o.Compress {
+	case "gzip":
+		return o.formatExtension() + ".gz"
+	case "zstd":
+		return o.formatExtension() + ".zst"
+	}
+	return o.formatExtension()
+}
+
+// formatExtension returns the file extension of the export format.
+func (o exportOptions) formatExtension() string {
+	switch o.Format {
+	case "csv":
+		return ".csv"
+	case "jsonl":
+		return ".jsonl"
+	case "parquet":
+		return ".parquet"
+	case "hosts":
+		return ".hosts"
+	case "dnsmasq":
+		return ".conf"
+	case "adblock":
+		return ".adblock.txt"
+	case "rpz":
+		return ".rpz.zone"
+	case "pihole":
+		return ".pihole.txt"
+	case "pihole-regex":
+		return ".pihole-regex.txt"
+	case "domains":
+		return ".domains.txt"
+	case "tree":
+		return ".tree.txt"
+	}
+	return ".txt"
+}
+
+// writeDomains writes rows to w in the configured format.
+func writeDomains(w io.Writer, rows []domainRow, opts exportOptions) error {
+	if opts.Template != nil {
+		return writeDomainsTemplate(w, rows, opts.Template)
+	}
+
+	switch opts.Format {
+	case "csv":
+		return writeDomainsCSV(w, rows, opts.Columns)
+	case "jsonl":
+		return writeDomainsJSONL(w, rows)
+	case "parquet":
+		return writeDomainsParquet(w, rows)
+	case "hosts":
+		return writeDomainsHosts(w, rows, opts)
+	case "dnsmasq":
+		return writeDomainsDnsmasq(w, rows, opts)
+	case "adblock":
+		return writeDomainsAdblock(w, rows, opts)
+	case "rpz":
+		return writeDomainsRPZ(w, rows, opts, time.Now())
+	case "pihole", "domains":
+		return writeDomainsPlain(w, rows, opts)
+	case "pihole-regex":
+		return writeDomainsPiholeRegex(w, rows, opts)
+	case "tree":
+		return writeDomainsTree(w, rows, opts)
+	}
+
+	record := make([]string, len(opts.Columns))
+	for _, row := range rows {
+		for i, c := range opts.Columns {
+			if c == "first_seen" || c == "last_seen" {
+				record[i] = unixToDateTime(columnTime(row, c))
+				continue
+			}
+			record[i] = columnValue(row, c)
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(record, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unixToDateTime(unix int64) string {
+	t := time.Unix(unix, 0)
+	return t.Format("Jan _2 2006 15:04:05 MST")
+}
+
+// templateRow is the data passed to --template for each exported row.
+type templateRow struct {
+	Domain         string
+	ReversedDomain string
+	FirstSeen      time.Time
+	LastSeen       time.Time
+	Count          int64
+}
+
+// writeDomainsTemplate executes tmpl once per row, each on its own line.
+func writeDomainsTemplate(w io.Writer, rows []domainRow, tmpl *template.Template) error {
+	for _, row := range rows {
+		if err := tmpl.Execute(w, templateRow{
+			Domain:         reverseDomainParts(row.Domain),
+			ReversedDomain: row.Domain,
+			FirstSeen:      time.Unix(row.FirstSeen, 0),
+			LastSeen:       time.Unix(row.LastSeen, 0),
+			Count:          row.Count,
+		}); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDomainsCSV writes an RFC 4180 CSV document with a header row.
+// Timestamps are written in RFC 3339 so spreadsheets and pandas parse them directly.
+func writeDomainsCSV(w io.Writer, rows []domainRow, columns []string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, c := range columns {
+			record[i] = columnValue(row, c)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// columnTime returns the epoch value of a timestamp column.
+func columnTime(row domainRow, column string) int64 {
+	if column == "first_seen" {
+		return row.FirstSeen
+	}
+	return row.LastSeen
+}
+
+// columnValue formats a single export column of row.
+func columnValue(row domainRow, column string) string {
+	switch column {
+	case "domain":
+		return reverseDomainParts(row.Domain)
+	case "reversed_domain":
+		return row.Domain
+	case "first_seen":
+		return time.Unix(row.FirstSeen, 0).Format(time.RFC3339)
+	case "last_seen":
+		return time.Unix(row.LastSeen, 0).Format(time.RFC3339)
+	case "count":
+		return strconv.FormatInt(row.Count, 10)
+	}
+	return ""
+}
+
+// domainRecord is the JSON Lines representation of a domain row.
+type domainRecord struct {
+	Domain         string `json:"domain"`
+	ReversedDomain string `json:"reversed_domain"`
+	FirstSeen      int64  `json:"first_seen"`
+	FirstSeenISO   string `json:"first_seen_iso"`
+	LastSeen       int64  `json:"last_seen"`
+	LastSeenISO    string `json:"last_seen_iso"`
+	Count          int64  `json:"count"`
+}
+
+func newDomainRecord(row domainRow) domainRecord {
+	return domainRecord{
+		Domain:         reverseDomainParts(row.Domain),
+		ReversedDomain: row.Domain,
+		FirstSeen:      row.FirstSeen,
+		FirstSeenISO:   columnValue(row, "first_seen"),
+		LastSeen:       row.LastSeen,
+		LastSeenISO:    columnValue(row, "last_seen"),
+		Count:          row.Count,
+	}
+}
+
+// writeDomainsJSONL writes one JSON object per line, ready for Elasticsearch or Loki ingestion.
+func writeDomainsJSONL(w io.Writer, rows []domainRow) error {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := enc.Encode(newDomainRecord(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parquetDomain is the Parquet schema of a domain row. Timestamps use the
+// TIMESTAMP(MILLIS) logical type so DuckDB and Spark read them as timestamps.
+type parquetDomain struct {
+	Domain         string `parquet:"domain,dict,zstd"`
+	ReversedDomain string `parquet:"reversed_domain,zstd"`
+	FirstSeen      int64  `parquet:"first_seen,timestamp(millisecond),delta"`
+	LastSeen       int64  `parquet:"last_seen,timestamp(millisecond),delta"`
+	Count          int64  `parquet:"count"`
+}
+
+// parquetQuery is the Parquet schema of a row of the queries table.
+type parquetQuery struct {
+	Timestamp int64  `parquet:"timestamp,timestamp(millisecond),delta"`
+	Domain    string `parquet:"domain,dict,zstd"`
+	Type      string `parquet:"type,dict"`
+	Client    string `parquet:"client,dict,zstd"`
+	Action    string `parquet:"action,dict"`
+}
+
+// parquetRowGroupSize bounds the rows buffered before a row group is flushed.
+const parquetRowGroupSize = 64 * 1024
+
+// parquetRows writes rows of schema T to a Parquet file, a row group of at
+// most parquetRowGroupSize rows at a time.
+type parquetRows[T any] struct {
+	pw    *parquet.GenericWriter[T]
+	batch []T
+}
+
+func newParquetRows[T any](w io.Writer, sizeHint int) *parquetRows[T] {
+	return &parquetRows[T]{
+		pw:    parquet.NewGenericWriter[T](w, parquet.Compression(&parquet.Zstd)),
+		batch: make([]T, 0, min(sizeHint, parquetRowGroupSize)),
+	}
+}
+
+func (p *parquetRows[T]) add(row T) error {
+	p.batch = append(p.batch, row)
+	if len(p.batch) < parquetRowGroupSize {
+		return nil
+	}
+	if _, err := p.pw.Write(p.batch); err != nil {
+		return err
+	}
+	p.batch = p.batch[:0]
+	return p.pw.Flush()
+}
+
+// close writes the rows still buffered and the file's footer.
+func (p *parquetRows[T]) close() error {
+	if _, err := p.pw.Write(p.batch); err != nil {
+		return err
+	}
+	return p.pw.Close()
+}
+
+func writeDomainsParquet(w io.Writer, rows []domainRow) error {
+	pw := newParquetRows[parquetDomain](w, len(rows))
+	for _, row := range rows {
+		err := pw.add(parquetDomain{
+			Domain:         reverseDomainParts(row.Domain),
+			ReversedDomain: row.Domain,
+			FirstSeen:      row.FirstSeen * 1000,
+			LastSeen:       row.LastSeen * 1000,
+			Count:          row.Count,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return pw.close()
+}
+
+// exportQueries writes the queries table of st (see --queries), limited to
+// clients when given, to path as Parquet; - writes it to standard output.
+func exportQueries(ctx context.Context, st store, dbOpts dbOptions, clients clientFilter, path string) error {
+	db, ok := st.(*database)
+	if !ok {
+		return errors.New("--queries-parquet needs a SQL database, the only kind with a queries table")
+	}
+	outFile := os.Stdout
+	if path != stdinPath {
+		var err error
+		if outFile, err = os.Create(path); err != nil {
+			return err
+		}
+		defer outFile.Close()
+	}
+	writer := bufio.NewWriter(outFile)
+
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	pw := newParquetRows[parquetQuery](writer, parquetRowGroupSize)
+	var n int
+	err := db.eachQuery(loadCtx, func(e queryEvent) error {
+		if !clients.matches(e.Client) {
+			return nil
+		}
+		n++
+		return pw.add(parquetQuery{Timestamp: e.Timestamp * 1000, Domain: e.Domain, Type: e.Type, Client: e.Client, Action: e.Action})
+	})
+	if err != nil {
+		return withExitCode(exitDatabase, err)
+	}
+	if err := pw.close(); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if path != stdinPath {
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+	}
+	slog.Info("saved queries export", "path", path, "queries", n)
+	return nil
+}
+
+// loadDomainList reads a file with one domain per line. Blank lines, comments and
+// hosts-style address prefixes ("0.0.0.0 example.com") are tolerated.
+func loadDomainList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := fields[len(fields)-1]
+		domains[strings.ToLower(strings.TrimSuffix(domain, "."))] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// allowlisted reports whether domain or one of its parent domains is in the allowlist.
+func allowlisted(domain string, allowlist map[string]bool) bool {
+	if len(allowlist) == 0 {
+		return false
+	}
+	for {
+		if allowlist[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// registrableDomain returns the eTLD+1 of a forward-order domain, or the domain
+// itself when it has no registrable part (e.g. "lan" or a bare public suffix).
+func registrableDomain(domain string) string {
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return registrable
+}
+
+// blockedDomains returns the forward-order domains of rows for blocklist formats,
+// skipping duplicates and allowlisted domains.
+func blockedDomains(rows []domainRow, opts exportOptions) []string {
+	seen := make(map[string]bool, len(rows))
+	var domains []string
+	for _, row := range rows {
+		domain := strings.ToLower(reverseDomainParts(row.Domain))
+		if opts.Collapse {
+			domain = registrableDomain(domain)
+		}
+		if seen[domain] || allowlisted(domain, opts.Allowlist) {
+			continue
+		}
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// writeDomainsHosts writes a hosts-file blocklist ("0.0.0.0 example.com").
+func writeDomainsHosts(w io.Writer, rows []domainRow, opts exportOptions) error {
+	for _, domain := range blockedDomains(rows, opts) {
+		if _, err := fmt.Fprintf(w, "0.0.0.0 %s\n", domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDomainsDnsmasq writes dnsmasq address= directives ("address=/example.com/#").
+func writeDomainsDnsmasq(w io.Writer, rows []domainRow, opts exportOptions) error {
+	target := opts.Target
+	if target == "" {
+		target = "#"
+	}
+	for _, domain := range blockedDomains(rows, opts) {
+		if _, err := fmt.Fprintf(w, "address=/%s/%s\n", domain, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDomainsAdblock writes AdGuard/uBlock network filter rules ("||example.com^"),
+// which also match every subdomain of the listed domain.
+func writeDomainsAdblock(w io.Writer, rows []domainRow, opts exportOptions) error {
+	for _, domain := range blockedDomains(rows, opts) {
+		if _, err := fmt.Fprintf(w, "||%s^\n", domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDomainsRPZ writes a Response Policy Zone that answers NXDOMAIN ("CNAME .")
+// for every domain. The SOA serial is the run time in seconds, which always increases
+// between runs. Collapsed exports also block all subdomains via wildcard records.
+func writeDomainsRPZ(w io.Writer, rows []domainRow, opts exportOptions, now time.Time) error {
+	header := `$TTL 300
+@	IN	SOA	localhost. hostmaster.localhost. (
+		%d	; serial
+		3600	; refresh
+		600	; retry
+		604800	; expire
+		300 )	; minimum
+	IN	NS	localhost.
+`
+	if _, err := fmt.Fprintf(w, header, now.Unix()); err != nil {
+		return err
+	}
+
+	for _, domain := range blockedDomains(rows, opts) {
+		if _, err := fmt.Fprintf(w, "%s\tCNAME\t.\n", domain); err != nil {
+			return err
+		}
+		if opts.Collapse {
+			if _, err := fmt.Fprintf(w, "*.%s\tCNAME\t.\n", domain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeDomainsPlain writes one domain per line, as used by Pi-hole exact-match lists.
+func writeDomainsPlain(w io.Writer, rows []domainRow, opts exportOptions) error {
+	for _, domain := range blockedDomains(rows, opts) {
+		if _, err := fmt.Fprintln(w, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDomainsPiholeRegex writes Pi-hole regex filters. Collapsed exports match the
+// domain and all its subdomains ("(\.|^)example\.com$"); otherwise only the exact name.
+func writeDomainsPiholeRegex(w io.Writer, rows []domainRow, opts exportOptions) error {
+	for _, domain := range blockedDomains(rows, opts) {
+		pattern := "^" + regexp.QuoteMeta(domain) + "$"
+		if opts.Collapse {
+			pattern = `(\.|^)` + regexp.QuoteMeta(domain) + "$"
+		}
+		if _, err := fmt.Fprintln(w, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// testExportRows are stored domains, reversed, for the export tests.
+var testExportRows = []domainRow{
+	{Domain: "com.example.www", FirstSeen: 1700000000, LastSeen: 1700003600, Count: 5},
+	{Domain: "com.example.ads", FirstSeen: 1700000100, LastSeen: 1700000100, Count: 1},
+	{Domain: "org.example", FirstSeen: 1699990000, LastSeen: 1700090000, Count: 12},
+	{Domain: "uk.co.example.cdn", FirstSeen: 1700050000, LastSeen: 1700060000, Count: 3},
+	{Domain: "lan.router", FirstSeen: 1699900000, LastSeen: 1700100000, Count: 40},
+}
+
+// inUTC formats times in UTC until the test ends, so golden exports do not
+// depend on the time zone of the machine running it.
+func inUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+}
+
+func TestWriteDomainsCSV(t *testing.T) {
+	inUTC(t)
+	tests := []struct {
+		columns string
+		want    string
+	}{
+		{"", `domain,reversed_domain,first_seen,last_seen,count
+www.example.com,com.example.www,2023-11-14T22:13:20Z,2023-11-14T23:13:20Z,5
+ads.example.com,com.example.ads,2023-11-14T22:15:00Z,2023-11-14T22:15:00Z,1
+example.org,org.example,2023-11-14T19:26:40Z,2023-11-15T23:13:20Z,12
+cdn.example.co.uk,uk.co.example.cdn,2023-11-15T12:06:40Z,2023-11-15T14:53:20Z,3
+router.lan,lan.router,2023-11-13T18:26:40Z,2023-11-16T02:00:00Z,40
+`},
+		{"count, domain", `count,domain
+5,www.example.com
+1,ads.example.com
+12,example.org
+3,cdn.example.co.uk
+40,router.lan
+`},
+		{"last_seen,,reversed_domain", `last_seen,reversed_domain
+2023-11-14T23:13:20Z,com.example.www
+2023-11-14T22:15:00Z,com.example.ads
+2023-11-15T23:13:20Z,org.example
+2023-11-15T14:53:20Z,uk.co.example.cdn
+2023-11-16T02:00:00Z,lan.router
+`},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions("csv", tt.columns, "reversed")
+		if err != nil {
+			t.Fatalf("--columns %q: %v", tt.columns, err)
+		}
+		var b bytes.Buffer
+		if err := writeDomains(&b, testExportRows, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.ReplaceAll(b.String(), "\r\n", "\n"); got != tt.want {
+			t.Errorf("--columns %q:\n%s\nwant\n%s", tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestExportColumnsInvalid(t *testing.T) {
+	for _, columns := range []string{"domain,size", "Domain", "first-seen"} {
+		if _, err := newExportOptions("csv", columns, "reversed"); err == nil {
+			t.Errorf("--columns %q: no error", columns)
+		}
+	}
+}
+
+func TestWriteDomainsJSONL(t *testing.T) {
+	inUTC(t)
+	opts, err := newExportOptions("jsonl", "", "reversed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := writeDomains(&b, testExportRows, opts); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(testExportRows) {
+		t.Fatalf("%d lines, want one for each of the %d rows:\n%s", len(lines), len(testExportRows), b.String())
+	}
+	tests := []struct {
+		line   int
+		want   string
+		record domainRecord
+	}{
+		{0, `{"domain":"www.example.com","reversed_domain":"com.example.www","first_seen":1700000000,"first_seen_iso":"2023-11-14T22:13:20Z","last_seen":1700003600,"last_seen_iso":"2023-11-14T23:13:20Z","count":5}`,
+			domainRecord{"www.example.com", "com.example.www", 1700000000, "2023-11-14T22:13:20Z", 1700003600, "2023-11-14T23:13:20Z", 5}},
+		{3, `{"domain":"cdn.example.co.uk","reversed_domain":"uk.co.example.cdn","first_seen":1700050000,"first_seen_iso":"2023-11-15T12:06:40Z","last_seen":1700060000,"last_seen_iso":"2023-11-15T14:53:20Z","count":3}`,
+			domainRecord{"cdn.example.co.uk", "uk.co.example.cdn", 1700050000, "2023-11-15T12:06:40Z", 1700060000, "2023-11-15T14:53:20Z", 3}},
+		{4, `{"domain":"router.lan","reversed_domain":"lan.router","first_seen":1699900000,"first_seen_iso":"2023-11-13T18:26:40Z","last_seen":1700100000,"last_seen_iso":"2023-11-16T02:00:00Z","count":40}`,
+			domainRecord{"router.lan", "lan.router", 1699900000, "2023-11-13T18:26:40Z", 1700100000, "2023-11-16T02:00:00Z", 40}},
+	}
+	for _, tt := range tests {
+		if lines[tt.line] != tt.want {
+			t.Errorf("line %d:\n%s\nwant\n%s", tt.line+1, lines[tt.line], tt.want)
+		}
+		var got domainRecord
+		if err := json.Unmarshal([]byte(lines[tt.line]), &got); err != nil {
+			t.Fatalf("line %d: %v", tt.line+1, err)
+		}
+		if got != tt.record {
+			t.Errorf("line %d decodes to %+v, want %+v", tt.line+1, got, tt.record)
+		}
+	}
+}
+
+func TestWriteDomainsParquet(t *testing.T) {
+	many := make([]domainRow, parquetRowGroupSize+1)
+	for i := range many {
+		many[i] = domainRow{Domain: fmt.Sprintf("com.example.host%d", i), FirstSeen: int64(i), LastSeen: int64(2 * i), Count: int64(i % 7)}
+	}
+	tests := []struct {
+		name      string
+		rows      []domainRow
+		rowGroups int
+	}{
+		{"rows", testExportRows, 1},
+		{"no rows", nil, 0},
+		{"more than a row group", many, 2},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := writeDomainsParquet(&b, tt.rows); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		f, err := parquet.OpenFile(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := len(f.RowGroups()); got != tt.rowGroups {
+			t.Errorf("%s: %d row groups, want %d", tt.name, got, tt.rowGroups)
+		}
+		for _, column := range []string{"first_seen", "last_seen"} {
+			field, ok := f.Schema().Lookup(column)
+			if !ok {
+				t.Fatalf("%s: no %s column", tt.name, column)
+			}
+			ts, ok := field.Node.Type().LogicalType().Value.(*format.TimestampType)
+			if !ok || ts.Unit.String() != "MILLIS" {
+				t.Errorf("%s: %s is %v, want TIMESTAMP(MILLIS)", tt.name, column, field.Node.Type().LogicalType())
+			}
+		}
+
+		got, err := parquet.Read[parquetDomain](bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(got) != len(tt.rows) {
+			t.Fatalf("%s: read %d rows, want %d", tt.name, len(got), len(tt.rows))
+		}
+		for i, row := range tt.rows {
+			want := parquetDomain{
+				Domain:         reverseDomainParts(row.Domain),
+				ReversedDomain: row.Domain,
+				FirstSeen:      row.FirstSeen * 1000,
+				LastSeen:       row.LastSeen * 1000,
+				Count:          row.Count,
+			}
+			if got[i] != want {
+				t.Errorf("%s: row %d = %+v, want %+v", tt.name, i, got[i], want)
+				break
+			}
+		}
+	}
+}
+
+func TestLoadDomainList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist")
+	list := `# allowlist
+example.org
+0.0.0.0 Ads.Example.com   # hosts-style
+127.0.0.1	tracker.example.net.
+
+  router.lan
+`
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadDomainList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"example.org": true, "ads.example.com": true, "tracker.example.net": true, "router.lan": true}
+	if !maps.Equal(got, want) {
+		t.Errorf("loadDomainList = %v, want %v", got, want)
+	}
+
+	if _, err := loadDomainList(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing allowlist: no error")
+	}
+}
+
+func TestAllowlisted(t *testing.T) {
+	allowlist := map[string]bool{"example.org": true, "cdn.example.co.uk": true}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.org", true},
+		{"www.example.org", true},
+		{"a.b.example.org", true},
+		{"notexample.org", false},
+		{"org", false},
+		{"cdn.example.co.uk", true},
+		{"example.co.uk", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := allowlisted(tt.domain, allowlist); got != tt.want {
+			t.Errorf("allowlisted(%q) = %t, want %t", tt.domain, got, tt.want)
+		}
+	}
+	if allowlisted("example.org", nil) {
+		t.Error("allowlisted with no allowlist = true")
+	}
+}
+
+func TestWriteDomainsHosts(t *testing.T) {
+	rows := append(slices.Clone(testExportRows), domainRow{Domain: "com.EXAMPLE.WWW", Count: 1})
+	tests := []struct {
+		name      string
+		allowlist map[string]bool
+		want      string
+	}{
+		{"no allowlist", nil, `0.0.0.0 www.example.com
+0.0.0.0 ads.example.com
+0.0.0.0 example.org
+0.0.0.0 cdn.example.co.uk
+0.0.0.0 router.lan
+`},
+		{"allowlist", map[string]bool{"example.com": true, "router.lan": true}, `0.0.0.0 example.org
+0.0.0.0 cdn.example.co.uk
+`},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions("hosts", "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Allowlist = tt.allowlist
+		var b bytes.Buffer
+		if err := writeDomains(&b, rows, opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, b.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteDomainsDnsmasq(t *testing.T) {
+	rows := testExportRows[:3]
+	tests := []struct {
+		target    string
+		allowlist map[string]bool
+		want      string
+	}{
+		{"", nil, `address=/www.example.com/#
+address=/ads.example.com/#
+address=/example.org/#
+`},
+		{"#", map[string]bool{"www.example.com": true}, `address=/ads.example.com/#
+address=/example.org/#
+`},
+		{"0.0.0.0", nil, `address=/www.example.com/0.0.0.0
+address=/ads.example.com/0.0.0.0
+address=/example.org/0.0.0.0
+`},
+		{"::", map[string]bool{"example.com": true}, `address=/example.org/::
+`},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions("dnsmasq", "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Target, opts.Allowlist = tt.target, tt.allowlist
+		var b bytes.Buffer
+		if err := writeDomains(&b, rows, opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("--dnsmasq-target %q:\n%s\nwant\n%s", tt.target, b.String(), tt.want)
+		}
+	}
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct{ domain, want string }{
+		{"www.example.com", "example.com"},
+		{"example.com", "example.com"},
+		{"a.b.cdn.example.co.uk", "example.co.uk"},
+		{"foo.github.io", "foo.github.io"}, // github.io is a public suffix
+		{"router.lan", "router.lan"},
+		{"lan", "lan"},
+		{"co.uk", "co.uk"},
+	}
+	for _, tt := range tests {
+		if got := registrableDomain(tt.domain); got != tt.want {
+			t.Errorf("registrableDomain(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDomainsAdblock(t *testing.T) {
+	rows := append(slices.Clone(testExportRows), domainRow{Domain: "io.github.foo.pages"})
+	tests := []struct {
+		name      string
+		collapse  bool
+		allowlist map[string]bool
+		want      string
+	}{
+		{"exact", false, nil, `||www.example.com^
+||ads.example.com^
+||example.org^
+||cdn.example.co.uk^
+||router.lan^
+||pages.foo.github.io^
+`},
+		{"collapsed", true, nil, `||example.com^
+||example.org^
+||example.co.uk^
+||router.lan^
+||foo.github.io^
+`},
+		{"collapsed with allowlist", true, map[string]bool{"example.com": true, "github.io": true}, `||example.org^
+||example.co.uk^
+||router.lan^
+`},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions("adblock", "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Collapse, opts.Allowlist = tt.collapse, tt.allowlist
+		var b bytes.Buffer
+		if err := writeDomains(&b, rows, opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, b.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteDomainsRPZ(t *testing.T) {
+	const header = `$TTL 300
+@	IN	SOA	localhost. hostmaster.localhost. (
+		1700000000	; serial
+		3600	; refresh
+		600	; retry
+		604800	; expire
+		300 )	; minimum
+	IN	NS	localhost.
+`
+	tests := []struct {
+		name      string
+		collapse  bool
+		allowlist map[string]bool
+		want      string
+	}{
+		{"exact", false, nil, header + `www.example.com	CNAME	.
+ads.example.com	CNAME	.
+example.org	CNAME	.
+cdn.example.co.uk	CNAME	.
+router.lan	CNAME	.
+`},
+		{"collapsed", true, map[string]bool{"router.lan": true}, header + `example.com	CNAME	.
+*.example.com	CNAME	.
+example.org	CNAME	.
+*.example.org	CNAME	.
+example.co.uk	CNAME	.
+*.example.co.uk	CNAME	.
+`},
+		{"everything allowlisted", false, map[string]bool{"com": true, "org": true, "uk": true, "lan": true}, header},
+	}
+	now := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		opts, err := newExportOptions("rpz", "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Collapse, opts.Allowlist = tt.collapse, tt.allowlist
+		var b bytes.Buffer
+		if err := writeDomainsRPZ(&b, testExportRows, opts, now); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, b.String(), tt.want)
+		}
+	}
+
+	// The serial is the run time, so it increases from one export to the next.
+	var earlier, later bytes.Buffer
+	opts, _ := newExportOptions("rpz", "", "reversed")
+	if err := writeDomainsRPZ(&earlier, nil, opts, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDomainsRPZ(&later, nil, opts, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if serial := rpzSerial(t, later.String()); serial <= rpzSerial(t, earlier.String()) {
+		t.Errorf("serial %d of a later export does not increase", serial)
+	}
+}
+
+// rpzSerial returns the SOA serial of an RPZ zone.
+func rpzSerial(t *testing.T, zone string) int64 {
+	t.Helper()
+	for line := range strings.Lines(zone) {
+		if value, ok := strings.CutSuffix(strings.TrimSpace(line), "; serial"); ok {
+			serial, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return serial
+		}
+	}
+	t.Fatalf("no serial in\n%s", zone)
+	return 0
+}
+
+func TestWriteDomainsPihole(t *testing.T) {
+	tests := []struct {
+		format   string
+		collapse bool
+		want     string
+	}{
+		{"pihole", false, `www.example.com
+ads.example.com
+example.org
+cdn.example.co.uk
+`},
+		{"pihole", true, `example.com
+example.org
+example.co.uk
+`},
+		{"pihole-regex", false, `^www\.example\.com$
+^ads\.example\.com$
+^example\.org$
+^cdn\.example\.co\.uk$
+`},
+		{"pihole-regex", true, `(\.|^)example\.com$
+(\.|^)example\.org$
+(\.|^)example\.co\.uk$
+`},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions(tt.format, "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Collapse = tt.collapse
+		opts.Allowlist = map[string]bool{"router.lan": true}
+		var b bytes.Buffer
+		if err := writeDomains(&b, testExportRows, opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s, collapse %t:\n%s\nwant\n%s", tt.format, tt.collapse, b.String(), tt.want)
+		}
+	}
+}
+
+func TestPiholeRegexMatches(t *testing.T) {
+	tests := []struct {
+		collapse bool
+		name     string
+		want     bool
+	}{
+		{false, "www.example.com", true},
+		{false, "example.com", false},
+		{false, "wwwxexample.com", false}, // the dots are literal
+		{false, "a.www.example.com", false},
+		{true, "example.com", true},
+		{true, "www.example.com", true},
+		{true, "a.b.example.com", true},
+		{true, "badexample.com", false},
+		{true, "example.com.evil", false},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions("pihole-regex", "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Collapse = tt.collapse
+		var b bytes.Buffer
+		if err := writeDomains(&b, []domainRow{{Domain: "com.example.www"}}, opts); err != nil {
+			t.Fatal(err)
+		}
+		pattern := strings.TrimSuffix(b.String(), "\n")
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		if got := re.MatchString(tt.name); got != tt.want {
+			t.Errorf("%s matches %s = %t, want %t", pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortDomainRows(t *testing.T) {
+	// example.net ties www.example.com on every key but the domain.
+	rows := append(slices.Clone(testExportRows), domainRow{Domain: "net.example", FirstSeen: 1700000000, LastSeen: 1700003600, Count: 5})
+	tests := []struct {
+		key  string
+		desc bool
+		want []string
+	}{
+		{"reversed", false, []string{"com.example.ads", "com.example.www", "lan.router", "net.example", "org.example", "uk.co.example.cdn"}},
+		{"reversed", true, []string{"uk.co.example.cdn", "org.example", "net.example", "lan.router", "com.example.www", "com.example.ads"}},
+		{"domain", false, []string{"com.example.ads", "uk.co.example.cdn", "net.example", "org.example", "lan.router", "com.example.www"}},
+		{"first_seen", false, []string{"lan.router", "org.example", "com.example.www", "net.example", "com.example.ads", "uk.co.example.cdn"}},
+		{"first_seen", true, []string{"uk.co.example.cdn", "com.example.ads", "com.example.www", "net.example", "org.example", "lan.router"}},
+		{"last_seen", false, []string{"com.example.ads", "com.example.www", "net.example", "uk.co.example.cdn", "org.example", "lan.router"}},
+		{"count", false, []string{"com.example.ads", "uk.co.example.cdn", "com.example.www", "net.example", "org.example", "lan.router"}},
+		{"count", true, []string{"lan.router", "org.example", "com.example.www", "net.example", "uk.co.example.cdn", "com.example.ads"}},
+	}
+	for _, tt := range tests {
+		sorted := slices.Clone(rows)
+		sortDomainRows(sorted, tt.key, tt.desc)
+		var got []string
+		for _, row := range sorted {
+			got = append(got, row.Domain)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("--sort %s, desc %t: %v, want %v", tt.key, tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestExportSortKeyInvalid(t *testing.T) {
+	for _, key := range []string{"", "size", "Count", "first-seen"} {
+		if _, err := newExportOptions("domains", "", key); err == nil {
+			t.Errorf("--sort %q: no error", key)
+		}
+	}
+}
+
+func TestWriteDomainsDomains(t *testing.T) {
+	rows := append(slices.Clone(testExportRows), domainRow{Domain: "com.Example.WWW", Count: 7})
+	opts, err := newExportOptions("domains", "domain,count", "count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Desc = true
+	opts.Allowlist = map[string]bool{"example.org": true}
+	sortDomainRows(rows, opts.Sort, opts.Desc)
+	var b bytes.Buffer
+	if err := writeDomains(&b, rows, opts); err != nil {
+		t.Fatal(err)
+	}
+	// One lowercase domain per line in --sort order, whatever the columns.
+	want := `router.lan
+www.example.com
+cdn.example.co.uk
+ads.example.com
+`
+	if b.String() != want {
+		t.Errorf("domains export:\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestExportFlagsSpecs(t *testing.T) {
+	type spec struct {
+		path     string
+		byPrefix bool
+		sort     string
+		desc     bool
+	}
+	tests := []struct {
+		args []string
+		want []spec
+	}{
+		{nil, []spec{
+			{"unique_domains.txt", false, "reversed", false},
+			{"unique_domains_by_first_seen.txt", true, "first_seen", false},
+		}},
+		{[]string{"-format", "csv", "-sort", "count", "-desc", "-by-last-seen"}, []spec{
+			{"unique_domains.csv", false, "count", true},
+			{"unique_domains_by_first_seen.csv", true, "first_seen", false},
+			{"unique_domains_by_last_seen.csv", false, "last_seen", true},
+		}},
+		{[]string{"-format", "rpz", "-compress", "zstd", "-by-count"}, []spec{
+			{"unique_domains.rpz.zone.zst", false, "reversed", false},
+			{"unique_domains_by_first_seen.rpz.zone.zst", true, "first_seen", false},
+			{"unique_domains_by_count.rpz.zone.zst", false, "count", true},
+		}},
+		{[]string{"-format", "hosts", "-output", "blocklist", "-sort", "domain"}, []spec{
+			{"blocklist", false, "domain", false},
+		}},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		f := addExportFlags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		specs, err := f.specs()
+		if err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		var got []spec
+		for _, s := range specs {
+			got = append(got, spec{s.Path, s.ByPrefix, s.Sort, s.Desc})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: specs %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestExportFlagsSpecsInvalid(t *testing.T) {
+	tests := [][]string{
+		{"-format", "xml"},
+		{"-sort", "size"},
+		{"-columns", "domain,size"},
+		{"-compress", "lz4"},
+		{"-format", "parquet", "-compress", "gzip"},
+		{"-template", "{{.Domain"},
+		{"-allowlist", filepath.Join(t.TempDir(), "missing")},
+		{"-output", "domains.txt", "-by-count"},
+		{"-output", "domains.txt", "-by-last-seen"},
+	}
+	for _, args := range tests {
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		f := addExportFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.specs(); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
+
+func TestSelectRows(t *testing.T) {
+	opts, err := newExportOptions("text", "", "reversed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byCount := orderedExportSpec(opts, "count")
+	byCount.Limit = 2
+	only := exportSpec{exportOptions: opts}
+	only.Only = map[string]bool{"org.example": true, "lan.router": true, "net.example": true}
+	tests := []struct {
+		name string
+		spec exportSpec
+		want []string
+	}{
+		{"all", defaultExportSpecs(opts)[0], []string{"com.example.ads", "com.example.www", "lan.router", "org.example", "uk.co.example.cdn"}},
+		// com.example.www was seen before com.example.ads, so stands for com.example.
+		{"by prefix", defaultExportSpecs(opts)[1], []string{"lan.router", "org.example", "com.example.www", "uk.co.example.cdn"}},
+		{"limited", byCount, []string{"lan.router", "org.example"}},
+		{"only", only, []string{"lan.router", "org.example"}},
+	}
+	for _, tt := range tests {
+		domains := slices.Clone(testExportRows)
+		var got []string
+		for _, row := range selectRows(domains, tt.spec) {
+			got = append(got, row.Domain)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+		if !slices.Equal(domains, testExportRows) {
+			t.Errorf("%s: selectRows reordered the domains it was given", tt.name)
+		}
+	}
+}
+
+func TestFirstTwoComponents(t *testing.T) {
+	tests := []struct{ domain, want string }{
+		{"com.example.www", "com.example"},
+		{"com.example", "com.example"},
+		{"uk.co.example.cdn", "uk.co"},
+		{"lan", "lan"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := firstTwoComponents(tt.domain); got != tt.want {
+			t.Errorf("firstTwoComponents(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDomainsText(t *testing.T) {
+	inUTC(t)
+	tests := []struct {
+		columns, template string
+		want              string
+	}{
+		{"", "", `Nov 14 2023 22:13:20 UTC	Nov 14 2023 23:13:20 UTC	com.example.www
+Nov 14 2023 22:15:00 UTC	Nov 14 2023 22:15:00 UTC	com.example.ads
+`},
+		{"domain,count,last_seen", "", `www.example.com	5	Nov 14 2023 23:13:20 UTC
+ads.example.com	1	Nov 14 2023 22:15:00 UTC
+`},
+		{"", `{{.Domain}} {{.Count}} {{.FirstSeen.Format "2006-01-02"}}`, `www.example.com 5 2023-11-14
+ads.example.com 1 2023-11-14
+`},
+		{"count", `{{.ReversedDomain}},{{.LastSeen.Unix}}`, `com.example.www,1700003600
+com.example.ads,1700000100
+`},
+	}
+	for _, tt := range tests {
+		opts, err := newExportOptions("text", tt.columns, "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.template != "" {
+			if opts.Template, err = parseTemplate(tt.template); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var b bytes.Buffer
+		if err := writeDomains(&b, testExportRows[:2], opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("--columns %q --template %q:\n%s\nwant\n%s", tt.columns, tt.template, b.String(), tt.want)
+		}
+	}
+}
+
+func TestParseTemplateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "row.tmpl")
+	if err := os.WriteFile(path, []byte("{{.Domain}}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := parseTemplate("@" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := writeDomainsTemplate(&b, testExportRows[:2], tmpl); err != nil {
+		t.Fatal(err)
+	}
+	// The file's trailing newline is not doubled.
+	if want := "www.example.com\nads.example.com\n"; b.String() != want {
+		t.Errorf("@file template wrote %q, want %q", b.String(), want)
+	}
+	if _, err := parseTemplate("@" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing template file: no error")
+	}
+}
+
+func TestWriteExports(t *testing.T) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	dir := t.TempDir()
+	var specs []exportSpec
+	for _, compress := range []string{"", "gzip", "zstd"} {
+		opts, err := newExportOptions("domains", "", "reversed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Compress = compress
+		specs = append(specs, exportSpec{Path: filepath.Join(dir, "unique_domains"+opts.extension()), exportOptions: opts})
+	}
+	if err := writeExports(context.Background(), testExportRows, specs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "ads.example.com\nwww.example.com\nrouter.lan\nexample.org\ncdn.example.co.uk\n"
+	for _, spec := range specs {
+		file, err := os.Open(spec.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		var r io.Reader = file
+		switch spec.Compress {
+		case "gzip":
+			if r, err = gzip.NewReader(file); err != nil {
+				t.Fatalf("%s: %v", spec.Path, err)
+			}
+		case "zstd":
+			dec, err := zstd.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dec.Close()
+			r = dec
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", spec.Path, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s holds\n%s\nwant\n%s", filepath.Base(spec.Path), got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := []exportSpec{{Path: filepath.Join(dir, "cancelled.txt"), exportOptions: specs[0].exportOptions}}
+	if err := writeExports(ctx, testExportRows, cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("writeExports after cancellation = %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(cancelled[0].Path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cancelled export written: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// fingerprintChunk is how many bytes from each end of a file its fingerprint covers.
+const fingerprintChunk = 64 << 10
+
+const alreadyParsedFlagUsage = "what to do with input files parsed to the end before, by content: skip (and parse only what was appended to one since), warn (and parse them again) or parse"
+
+// fileFingerprint records an input file parsed to the end, so parsing the same
+// content again, under its name or another, is caught before every query in it
+// is counted twice.
+type fileFingerprint struct {
+	Hash  string // see contentHash
+	Path  string
+	Inode uint64
+	Size  int64
+	// FirstSeen and LastSeen are the timestamps of the first and last lines read.
+	FirstSeen int64
+	LastSeen  int64
+	ParsedAt  int64
+}
+
+// fingerprintInput fingerprints the input file at path. ok is false for stdin,
+// pipes and empty files, which have nothing to fingerprint.
+func fingerprintInput(path string) (fp fileFingerprint, ok bool, err error) {
+	if path == stdinPath {
+		return fp, false, nil
+	}
+	in, err := openInput(path)
+	if err != nil {
+		return fp, false, err
+	}
+	defer in.Close()
+	if !in.info.Mode().IsRegular() || in.info.Size() == 0 {
+		return fp, false, nil
+	}
+	var hash string
+	if in.compressed {
+		hash, err = fingerprintStream(in)
+	} else {
+		hash, err = fingerprintPlain(in.file, in.info.Size())
+	}
+	if err != nil {
+		return fp, false, fmt.Errorf("fingerprinting %s: %w", path, err)
+	}
+	return fileFingerprint{Hash: hash, Path: path, Inode: fileInode(in.info), Size: in.info.Size()}, true, nil
+}
+
+// contentHash returns the hex SHA-256 of the length of the log lines of a
+// file, their first fingerprintChunk bytes and their last fingerprintChunk
+// bytes, all of them when there are fewer. It is taken of the decompressed
+// lines, so a log compressed after rotation matches the plain file it was.
+// Log lines start with timestamps, so different logs of one length with the
+// same start and end do not happen in practice, and leaving the middle unread
+// keeps fingerprinting an archive of plain logs cheap.
+func contentHash(length int64, head, tail []byte) string {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(length)))
+	h.Write(head)
+	h.Write(tail)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fingerprintPlain returns the contentHash of the first size bytes of a plain
+// file, reading only its ends.
+func fingerprintPlain(f io.ReaderAt, size int64) (string, error) {
+	head := make([]byte, min(size, fingerprintChunk))
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return "", err
+	}
+	tail := make([]byte, len(head))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return "", err
+	}
+	return contentHash(size, head, tail), nil
+}
+
+// fingerprintStream returns the contentHash of the lines of a compressed file,
+// which it decompresses to the end: only the gzip trailer records their
+// length, and that modulo 2^32.
+func fingerprintStream(r io.Reader) (string, error) {
+	head := make([]byte, fingerprintChunk)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return contentHash(int64(n), head[:n], head[:n]), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// Keep at least the last fingerprintChunk bytes read in tail.
+	length := int64(n)
+	tail := append(make([]byte, 0, 4*fingerprintChunk), head...)
+	for {
+		if cap(tail)-len(tail) < fingerprintChunk {
+			tail = append(tail[:0], tail[len(tail)-fingerprintChunk:]...)
+		}
+		n, err := r.Read(tail[len(tail):cap(tail)])
+		tail = tail[:len(tail)+n]
+		length += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return contentHash(length, head, tail[len(tail)-fingerprintChunk:]), nil
+}
+
+// checkAlreadyParsed applies the --already-parsed policy to the input file fp:
+// it reports whether to skip it when it was parsed before, by this run (see
+// parsed) or an earlier one, and otherwise how far into it to resume: past
+// the lines an earlier run parsed when the file was only appended to since.
+func checkAlreadyParsed(ctx context.Context, st store, dbOpts dbOptions, fp fileFingerprint, parsed map[string]fileFingerprint, policy string) (skip bool, resume int64, err error) {
+	if policy == "parse" {
+		return false, 0, nil
+	}
+	before, ok := parsed[fp.Hash]
+	if !ok {
+		loadCtx, cancel := dbOpts.withTimeout(ctx)
+		defer cancel()
+		if before, ok, err = st.loadFingerprint(loadCtx, fp.Hash); err != nil {
+			return false, 0, withExitCode(exitDatabase, fmt.Errorf("loading fingerprint: %w", err))
+		}
+	}
+	if !ok {
+		resume, err := checkAppended(ctx, st, dbOpts, fp, policy)
+		return false, resume, err
+	}
+	attrs := []any{"path", fp.Path, "parsed_as", before.Path}
+	if before.ParsedAt != 0 {
+		attrs = append(attrs, "parsed_at", time.Unix(before.ParsedAt, 0).Format(time.DateTime))
+	}
+	if before.FirstSeen != 0 {
+		attrs = append(attrs, "from", formatUnix(before.FirstSeen), "to", formatUnix(before.LastSeen))
+	}
+	if policy == "skip" {
+		slog.Warn("skipping file already parsed (--already-parsed=parse to parse it again)", attrs...)
+		return true, 0, nil
+	}
+	slog.Warn("parsing file already parsed; its queries are counted again (--already-parsed=skip to skip it)", attrs...)
+	return false, 0, nil
+}
+
+// checkAppended applies the --already-parsed policy to the input file fp when
+// an earlier run parsed the same file, by inode, to the end while it was
+// shorter, and what it parsed then is still the start of the file, as when a
+// log is appended to and then renamed by rotation: it returns the length
+// parsed then, to resume from, under skip.
+func checkAppended(ctx context.Context, st store, dbOpts dbOptions, fp fileFingerprint, policy string) (int64, error) {
+	if fp.Inode == 0 {
+		return 0, nil
+	}
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	before, ok, err := st.loadInodeFingerprint(loadCtx, fp.Inode)
+	if err != nil {
+		return 0, withExitCode(exitDatabase, fmt.Errorf("loading fingerprint: %w", err))
+	}
+	if !ok || before.Size >= fp.Size {
+		return 0, nil
+	}
+	in, err := openInput(fp.Path)
+	if err != nil {
+		return 0, withExitCode(exitInput, err)
+	}
+	defer in.Close()
+	if in.compressed {
+		return 0, nil
+	}
+	if hash, err := fingerprintPlain(in.file, before.Size); err != nil {
+		return 0, withExitCode(exitInput, fmt.Errorf("fingerprinting %s: %w", fp.Path, err))
+	} else if hash != before.Hash {
+		return 0, nil // rewritten rather than appended to
+	}
+
+	attrs := []any{"path", fp.Path, "parsed_as", before.Path, "parsed_size", before.Size, "size", fp.Size}
+	if before.ParsedAt != 0 {
+		attrs = append(attrs, "parsed_at", time.Unix(before.ParsedAt, 0).Format(time.DateTime))
+	}
+	if policy == "skip" {
+		slog.Info("parsing only what was appended to a file already parsed", attrs...)
+		return before.Size, nil
+	}
+	slog.Warn("parsing file appended to since it was parsed; its earlier queries are counted again (--already-parsed=skip to parse only what was appended)", attrs...)
+	return 0, nil
+}
+
+func (db *database) loadFingerprint(ctx context.Context, hash string) (fileFingerprint, bool, error) {
+	fp := fileFingerprint{Hash: hash}
+	err := db.QueryRowContext(ctx, "SELECT path, inode, size, first_seen, last_seen, parsed_at FROM parsed_files WHERE hash = ?", hash).
+		Scan(&fp.Path, &fp.Inode, &fp.Size, &fp.FirstSeen, &fp.LastSeen, &fp.ParsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fp, false, nil
+	}
+	if err != nil {
+		return fp, false, err
+	}
+	return fp, true, nil
+}
+
+func (db *database) loadInodeFingerprint(ctx context.Context, inode uint64) (fileFingerprint, bool, error) {
+	fp := fileFingerprint{Inode: inode}
+	err := db.QueryRowContext(ctx, "SELECT hash, path, size, first_seen, last_seen, parsed_at FROM parsed_files WHERE inode = ? ORDER BY parsed_at DESC, size DESC LIMIT 1", inode).
+		Scan(&fp.Hash, &fp.Path, &fp.Size, &fp.FirstSeen, &fp.LastSeen, &fp.ParsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fp, false, nil
+	}
+	if err != nil {
+		return fp, false, err
+	}
+	return fp, true, nil
+}
+
+// saveFingerprints records files parsed to the end; a file parsed again
+// replaces its earlier record.
+func (db *database) saveFingerprints(ctx context.Context, fingerprints []fileFingerprint) error {
+	args := make([]any, 0, 7*len(fingerprints))
+	for _, fp := range fingerprints {
+		args = append(args, fp.Hash, fp.Path, fp.Inode, fp.Size, fp.FirstSeen, fp.LastSeen, fp.ParsedAt)
+	}
+	return db.upsertRows(ctx, "parsed_files", []upsertColumn{
+		{"hash", mergeKey},
+		{"path", mergeReplace},
+		{"inode", mergeReplace},
+		{"size", mergeReplace},
+		{"first_seen", mergeReplace},
+		{"last_seen", mergeReplace},
+		{"parsed_at", mergeReplace},
+	}, args)
+}
+
+// parseInput is an input file to parse, with its fingerprint when it has one.
+type parseInput struct {
+	Path          string
+	Fingerprint   fileFingerprint
+	Fingerprinted bool
+}
+
+// selectInputs fingerprints inputs and returns those to parse, leaving out
+// the ones the --already-parsed policy skips, which prog counts as read. A
+// file appended to since it was parsed gets a checkpoint where that parse
+// ended, for parseFile to resume from. st is nil for dry runs, which
+// fingerprint nothing.
+func selectInputs(ctx context.Context, st store, dbOpts dbOptions, inputs []string, policy string, prog *progress) ([]parseInput, error) {
+	parsed := make(map[string]fileFingerprint)
+	var todo []parseInput
+	for _, path := range inputs {
+		in := parseInput{Path: path}
+		if st != nil {
+			var err error
+			if in.Fingerprint, in.Fingerprinted, err = fingerprintInput(path); err != nil {
+				return nil, withExitCode(exitInput, err)
+			}
+		}
+		if in.Fingerprinted {
+			skip, resume, err := checkAlreadyParsed(ctx, st, dbOpts, in.Fingerprint, parsed, policy)
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				prog.skipFile(in.Fingerprint.Size)
+				continue
+			}
+			if resume > 0 {
+				if err := resumeAt(ctx, st, dbOpts, checkpoint{Path: path, Inode: in.Fingerprint.Inode, Offset: resume}); err != nil {
+					return nil, err
+				}
+			}
+			parsed[in.Fingerprint.Hash] = in.Fingerprint
+		}
+		todo = append(todo, in)
+	}
+	return todo, nil
+}
+
+// resumeAt saves the checkpoint cp, unless the file already has one further in.
+func resumeAt(ctx context.Context, st store, dbOpts dbOptions, cp checkpoint) error {
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	saved, ok, err := st.loadCheckpoint(ctx, cp.Path)
+	if err == nil && (!ok || saved.Inode != cp.Inode || saved.Offset < cp.Offset) {
+		err = st.saveCheckpoints(ctx, []checkpoint{cp})
+	}
+	if err != nil {
+		return withExitCode(exitDatabase, fmt.Errorf("saving checkpoint: %w", err))
+	}
+	return nil
+}
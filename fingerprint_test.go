@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// appendTestLog appends n queries of domain, a second apart from second
+// start, to the log at path.
+func appendTestLog(t *testing.T, path, domain string, start, n int) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := start; i < start+n; i++ {
+		fmt.Fprintf(f, "Mar  1 %02d:%02d:%02d dnsmasq[812]: query[A] %s from 192.168.1.10\n", i/3600, i/60%60, i%60, domain)
+	}
+}
+
+func gzipTestLog(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// parseTestLogs parses paths into st as the parse command would, and returns
+// the queries st then holds.
+func parseTestLogs(t *testing.T, st store, policy string, paths ...string) int64 {
+	t.Helper()
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	opts := addParseFlags(fs)
+	if err := fs.Parse([]string{"--workers=1", "--progress=off", "--already-parsed=" + policy}); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseInto(context.Background(), st, dbOptions{}, paths, *opts); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := st.loadDomainRows(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, r := range rows {
+		n += r.Count
+	}
+	return n
+}
+
+func TestAlreadyParsed(t *testing.T) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	// big lines are longer than the two ends of a file a fingerprint covers.
+	big := int64(2*fingerprintChunk/len("Mar  1 00:00:00 dnsmasq[812]: query[A] example.com from 192.168.1.10\n") + 100)
+	tests := []struct {
+		name   string
+		first  []string // parsed by the first run, from a directory holding a.log
+		change func(t *testing.T, dir string)
+		second []string // parsed by the second run
+		want   map[string]int64
+	}{
+		{"re-run", []string{"a.log"}, func(t *testing.T, dir string) {},
+			[]string{"a.log"}, map[string]int64{"skip": 3, "warn": 6, "parse": 6}},
+		{"rotated and compressed", []string{"a.log"}, func(t *testing.T, dir string) {
+			os.Rename(filepath.Join(dir, "a.log"), filepath.Join(dir, "a.log.1"))
+			gzipTestLog(t, filepath.Join(dir, "a.log.1"), filepath.Join(dir, "a.log.2.gz"))
+		}, []string{"a.log.1", "a.log.2.gz"}, map[string]int64{"skip": 3, "warn": 9, "parse": 9}},
+		{"appended to", []string{"a.log"}, func(t *testing.T, dir string) {
+			appendTestLog(t, filepath.Join(dir, "a.log"), "example.org", 10, 2)
+		}, []string{"a.log"}, map[string]int64{"skip": 5, "warn": 8, "parse": 8}},
+		{"appended to and rotated", []string{"a.log"}, func(t *testing.T, dir string) {
+			appendTestLog(t, filepath.Join(dir, "a.log"), "example.org", 10, 2)
+			os.Rename(filepath.Join(dir, "a.log"), filepath.Join(dir, "a.log.1"))
+			appendTestLog(t, filepath.Join(dir, "a.log"), "example.net", 20, 1)
+		}, []string{"a.log.1", "a.log"}, map[string]int64{"skip": 6, "warn": 9, "parse": 9}},
+		{"rewritten", []string{"a.log"}, func(t *testing.T, dir string) {
+			os.Truncate(filepath.Join(dir, "a.log"), 0)
+			appendTestLog(t, filepath.Join(dir, "a.log"), "example.org", 10, 4)
+		}, []string{"a.log"}, map[string]int64{"skip": 7, "warn": 7, "parse": 7}},
+		{"same start and length", []string{"a.log"}, func(t *testing.T, dir string) {
+			appendTestLog(t, filepath.Join(dir, "b.log"), "example.com", 0, int(big))
+			appendTestLog(t, filepath.Join(dir, "c.log"), "example.com", 0, int(big)-1)
+			appendTestLog(t, filepath.Join(dir, "c.log"), "example.net", int(big)-1, 1)
+		}, []string{"b.log", "c.log"}, map[string]int64{"skip": 3 + 2*big, "warn": 3 + 2*big, "parse": 3 + 2*big}},
+	}
+	for name, open := range testStores {
+		for _, tt := range tests {
+			for _, policy := range []string{"skip", "warn", "parse"} {
+				dir := t.TempDir()
+				appendTestLog(t, filepath.Join(dir, "a.log"), "example.com", 0, 3)
+				if info, err := os.Stat(filepath.Join(dir, "a.log")); err != nil || fileInode(info) == 0 && strings.HasPrefix(tt.name, "appended") {
+					continue // appends are told by inode
+				}
+				st := open(t)
+				var first []string
+				for _, p := range tt.first {
+					first = append(first, filepath.Join(dir, p))
+				}
+				parseTestLogs(t, st, policy, first...)
+				tt.change(t, dir)
+				var second []string
+				for _, p := range tt.second {
+					second = append(second, filepath.Join(dir, p))
+				}
+				if got := parseTestLogs(t, st, policy, second...); got != tt.want[policy] {
+					t.Errorf("%s, %s, --already-parsed=%s: %d queries, want %d", name, tt.name, policy, got, tt.want[policy])
+				}
+			}
+		}
+	}
+}
+
+func TestFingerprintStreamMatchesPlain(t *testing.T) {
+	for _, n := range []int{1, 100, fingerprintChunk - 1, fingerprintChunk, fingerprintChunk + 1, 2 * fingerprintChunk, 3*fingerprintChunk + 7, 5 * fingerprintChunk} {
+		content := make([]byte, n)
+		for i := range content {
+			content[i] = byte(i * 7 / 3)
+		}
+		plain, err := fingerprintPlain(bytes.NewReader(content), int64(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := fingerprintStream(iotest.HalfReader(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream != plain {
+			t.Errorf("%d bytes: streamed %s, read at the ends %s", n, stream, plain)
+		}
+	}
+}
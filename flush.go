@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+)
+
+// memoryCheckLines is how often, in lines, the heap is sampled for --max-memory.
+const memoryCheckLines = 1 << 16
+
+// flushOptions bounds the memory held by the aggregates of a long run by saving
+// them to the database part-way, relying on the upserts to merge the parts.
+type flushOptions struct {
+	Every     int
+	MaxMemory byteSize
+}
+
+// addFlushFlags registers --flush-every and --max-memory on fs.
+func addFlushFlags(fs *flag.FlagSet) *flushOptions {
+	o := &flushOptions{}
+	fs.IntVar(&o.Every, "flush-every", 0, "save to the database whenever `n` unique domains are held in memory (0 saves at the end)")
+	fs.Var(&o.MaxMemory, "max-memory", "save to the database whenever the live heap nears `size` (e.g. 512MiB), and make it the GC's soft memory limit")
+	return o
+}
+
+// flushTrigger decides when aggregates should be saved early.
+type flushTrigger struct {
+	opts   flushOptions
+	lines  int
+	sample []metrics.Sample
+}
+
+// newFlushTrigger returns a trigger for opts, or nil when neither limit is set.
+// A memory limit also becomes the runtime's soft limit, so the GC keeps the
+// live heap figure current as it is approached.
+func newFlushTrigger(opts flushOptions) *flushTrigger {
+	if opts.Every <= 0 && opts.MaxMemory <= 0 {
+		return nil
+	}
+	t := &flushTrigger{opts: opts}
+	if opts.MaxMemory > 0 {
+		debug.SetMemoryLimit(int64(opts.MaxMemory))
+		t.sample = []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	}
+	return t
+}
+
+// due is called after each line and reports whether the pending domains should
+// be saved now. A nil trigger is never due.
+func (t *flushTrigger) due(pending int) bool {
+	if t == nil || pending == 0 {
+		return false
+	}
+	if t.opts.Every > 0 && pending >= t.opts.Every {
+		return true
+	}
+	if t.sample == nil {
+		return false
+	}
+	if t.lines++; t.lines%memoryCheckLines != 0 {
+		return false
+	}
+	// Leave a quarter of the limit for what saving the aggregates allocates.
+	metrics.Read(t.sample)
+	return t.sample[0].Value.Uint64() >= uint64(t.opts.MaxMemory)/4*3
+}
+
+// byteSize is a flag value holding a number of bytes, written with an optional
+// KB, MB, GB (powers of 1000) or KiB, MiB, GiB (powers of 1024) suffix.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	units := []struct {
+		suffix string
+		size   float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	number, scale := strings.TrimSpace(value), 1.0
+	for _, u := range units {
+		if n := len(number) - len(u.suffix); n >= 0 && strings.EqualFold(number[n:], u.suffix) {
+			number, scale = strings.TrimSpace(number[:n]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || !(n >= 0) || n*scale > math.MaxInt64 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * scale)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// forwardRetry is how long forward waits before calling a collector again
+// after a failed call.
+const forwardRetry = 10 * time.Second
+
+// runForward implements the forward subcommand: follow a log file like tail,
+// but send its lines to a collect instance rather than to a database, for
+// machines such as routers that should not keep one.
+func runForward(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	collectorURL := fs.String("collector", "", "send to the collect instance at `url`, such as http://central:8054 (https:// for TLS)")
+	caFile := fs.String("collector-ca", "", "trust the CA certificates in `file` for an https:// collector, as well as the system's")
+	source := fs.String("source", "", "record the lines as read from `name` in the collector's database (default host:path)")
+	fromStart := fs.Bool("from-start", false, "send the existing contents of the file before following it")
+	parsed := fs.Bool("parsed", false, "parse lines here and send only the queries; the collector then sees no replies, so counts no cached, forwarded or blocked answers")
+	interval := fs.Duration("flush", time.Second, "how often to send the lines read")
+	batchSize := fs.Int("batch", 1000, "send as soon as `n` lines are read")
+	format := addInputFormatFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *collectorURL == "" {
+		return fmt.Errorf("--collector is required")
+	}
+	parse, err := inputFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	path := defaultInputPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	if *source == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		*source = host + ":" + path
+	}
+
+	client, err := newGRPCClient(*collectorURL, *caFile)
+	if err != nil {
+		return err
+	}
+	f, err := openFollower(path, *fromStart)
+	if err != nil {
+		return err
+	}
+	defer f.close()
+	slog.Info("following", "path", path, "collector", *collectorURL)
+
+	fw := &forwarder{client: client, batch: ingestRequest{Source: *source}}
+	readCtx, stop := notifyInterrupt(ctx)
+	defer stop()
+	interrupted := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fw.close(ctx); err != nil {
+			return err
+		}
+		slog.Warn("interrupted, sent what was read", "path", path, "offset", f.checkpoint().Offset)
+		return errInterrupted
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		line, err := f.readLine()
+		if err == nil {
+			if !*parsed {
+				fw.batch.Lines = append(fw.batch.Lines, string(line))
+			} else if l, err := parse(line, time.Now()); err == nil && l.isQuery() && len(l.Domain) > 0 {
+				fw.batch.Queries = append(fw.batch.Queries, ingestQuery{
+					Timestamp: l.Timestamp,
+					Domain:    string(l.Domain),
+					Client:    string(l.Client),
+					Type:      string(l.queryType()),
+				})
+			}
+			if fw.pending() >= *batchSize {
+				fw.send(ctx)
+			}
+			select {
+			case <-readCtx.Done():
+				return interrupted()
+			case <-ticker.C:
+				fw.send(ctx)
+			default:
+			}
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		select {
+		case <-readCtx.Done():
+			return interrupted()
+		case <-ticker.C:
+			fw.send(ctx)
+		case <-time.After(tailPollInterval):
+			if err := f.checkRotation(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// forwarder sends batches of lines, or queries, to a collector over one
+// Ingest call, starting another when it fails.
+type forwarder struct {
+	client  *grpcClient
+	call    *grpcCall
+	retryAt time.Time
+	batch   ingestRequest // read, not yet sent
+}
+
+func (fw *forwarder) pending() int {
+	return len(fw.batch.Lines) + len(fw.batch.Queries)
+}
+
+// send sends the batch, keeping it to try again if the call fails. Batches
+// sent earlier on a call that fails are not sent again: a collector that went
+// away may or may not have added them.
+func (fw *forwarder) send(ctx context.Context) {
+	if fw.pending() == 0 || time.Now().Before(fw.retryAt) {
+		return
+	}
+	if fw.call == nil {
+		fw.call = fw.client.start(ctx, "Ingest")
+	}
+	if err := fw.call.send(&fw.batch); err != nil {
+		fw.call.closeSend()
+		var resp ingestResponse
+		if recvErr := fw.call.recv(&resp); recvErr != nil && recvErr != io.EOF {
+			err = recvErr
+		}
+		slog.Warn("sending to collector", "err", err, "pending", fw.pending())
+		fw.call, fw.retryAt = nil, time.Now().Add(forwardRetry)
+		return
+	}
+	fw.batch.Lines, fw.batch.Queries = fw.batch.Lines[:0], fw.batch.Queries[:0]
+}
+
+// close sends what is left and ends the call.
+func (fw *forwarder) close(ctx context.Context) error {
+	fw.retryAt = time.Time{}
+	fw.send(ctx)
+	if fw.call == nil {
+		if fw.pending() > 0 {
+			return fmt.Errorf("%d lines not sent", fw.pending())
+		}
+		return nil
+	}
+	fw.call.closeSend()
+	var resp ingestResponse
+	if err := fw.call.recv(&resp); err != nil {
+		return fmt.Errorf("sending to collector: %w", err)
+	}
+	slog.Info("sent to collector", "lines", resp.Lines, "queries", resp.Queries)
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// addressInfo is what is known of an address from GeoIP databases: the
+// country it is in and the autonomous system announcing it. Fields a database
+// did not have are empty.
+type addressInfo struct {
+	Country   string // ISO 3166-1 alpha-2 code
+	ASN       int64
+	ASOrg     string
+	UpdatedAt int64
+}
+
+// network names the autonomous system, such as "AS15169 Google LLC", or is
+// empty if it is not known.
+func (i addressInfo) network() string {
+	if i.ASN == 0 {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("AS%d %s", i.ASN, i.ASOrg))
+}
+
+// geoIP looks addresses up in MaxMind-format databases, such as GeoLite2 or
+// DB-IP Lite Country and ASN, combining what each of them knows.
+type geoIP struct {
+	dbs []*mmdb
+}
+
+// openGeoIP reads the databases at paths.
+func openGeoIP(paths []string) (*geoIP, error) {
+	g := &geoIP{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		db, err := parseMMDB(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// lookup returns what the databases know of addr, and whether any of them
+// had it.
+func (g *geoIP) lookup(addr netip.Addr) (addressInfo, bool, error) {
+	var info addressInfo
+	found := false
+	for _, db := range g.dbs {
+		rec, ok, err := db.lookup(addr)
+		if err != nil {
+			return info, false, err
+		}
+		m, _ := rec.(map[string]any)
+		if !ok || m == nil {
+			continue
+		}
+		found = true
+		for _, key := range []string{"country", "registered_country"} {
+			if c, _ := m[key].(map[string]any); c != nil && info.Country == "" {
+				info.Country, _ = c["iso_code"].(string)
+			}
+		}
+		if n, ok := m["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = int64(n)
+			info.ASOrg, _ = m["autonomous_system_organization"].(string)
+		}
+	}
+	return info, found, nil
+}
+
+// mmdbMetadataStart marks the metadata at the end of a MaxMind DB file.
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb is a MaxMind DB file: a binary search tree over the bits of addresses
+// whose leaves point into a data section of typed values. See
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize int
+	ipVersion  int
+	ipv4Start  uint64 // the node at ::/96, where IPv4 lookups start
+}
+
+func parseMMDB(file []byte) (*mmdb, error) {
+	i := bytes.LastIndex(file, mmdbMetadataStart)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	v, _, err := (&mmdbDecoder{data: file[i+len(mmdbMetadataStart):]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	meta, _ := v.(map[string]any)
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errors.New("search tree larger than the file")
+	}
+	db := &mmdb{
+		tree:       file[:treeSize],
+		data:       file[treeSize+16 : i],
+		nodeCount:  nodeCount,
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		for range 96 {
+			if db.ipv4Start >= nodeCount {
+				break
+			}
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node uint64, bit int) uint64 {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+uint64(bit)*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(db.tree[node*8+uint64(bit)*4:]))
+	}
+}
+
+// lookup returns the data record of the network containing addr, if any.
+func (db *mmdb) lookup(addr netip.Addr) (any, bool, error) {
+	addr = addr.Unmap()
+	ip := addr.AsSlice()
+	node := uint64(0)
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr.Is6() && db.ipVersion == 4 {
+		return nil, false, nil
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, int(ip[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, false, nil
+	}
+	v, _, err := (&mmdbDecoder{data: db.data}).decode(node - db.nodeCount - 16)
+	return v, err == nil, err
+}
+
+// mmdbDecoder decodes the values of a data section, or of the metadata.
+type mmdbDecoder struct {
+	data []byte
+}
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB data")
+
+// bytes returns n bytes at offset.
+func (d *mmdbDecoder) bytes(offset, n uint64) ([]byte, error) {
+	if offset+n > uint64(len(d.data)) || offset+n < offset {
+		return nil, errMMDBCorrupt
+	}
+	return d.data[offset : offset+n], nil
+}
+
+// uint decodes a big-endian unsigned integer of n bytes at offset.
+func (d *mmdbDecoder) uint(offset, n uint64) (uint64, error) {
+	b, err := d.bytes(offset, n)
+	if err != nil || n > 8 {
+		return 0, errMMDBCorrupt
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// decode returns the value at offset and the offset following it. Maps
+// decode as map[string]any, arrays as []any, unsigned integers as uint64,
+// int32 as int64, and floats and doubles as float64.
+func (d *mmdbDecoder) decode(offset uint64) (any, uint64, error) {
+	ctrl, err := d.uint(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := ctrl >> 5
+	if typ == 1 {
+		// A pointer to a value elsewhere in the data section.
+		size := ctrl >> 3 & 3
+		v, err := d.uint(offset, size+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var target uint64
+		switch size {
+		case 0:
+			target = ctrl&7<<8 | v
+		case 1:
+			target = (ctrl&7<<16 | v) + 2048
+		case 2:
+			target = (ctrl&7<<24 | v) + 526336
+		case 3:
+			target = v
+		}
+		value, _, err := d.decode(target)
+		return value, offset + size + 1, err
+	}
+	if typ == 0 {
+		ext, err := d.uint(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		typ = 7 + ext
+	}
+	size := ctrl & 0x1f
+	if size >= 29 {
+		n := size - 28
+		v, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		size = []uint64{29, 285, 65821}[n-1] + v
+	}
+
+	switch typ {
+	case 2: // UTF-8 string
+		b, err := d.bytes(offset, size)
+		return string(b), offset + size, err
+	case 3: // double
+		v, err := d.uint(offset, 8)
+		return math.Float64frombits(v), offset + 8, err
+	case 4: // bytes
+		b, err := d.bytes(offset, size)
+		return bytes.Clone(b), offset + size, err
+	case 5, 6, 9: // uint16, uint32, uint64
+		v, err := d.uint(offset, size)
+		return v, offset + size, err
+	case 8: // int32
+		v, err := d.uint(offset, size)
+		return int64(int32(uint32(v))), offset + size, err
+	case 10: // uint128, kept as its bytes
+		b, err := d.bytes(offset, size)
+		return bytes.Clone(b), offset + size, err
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			var k, v any
+			if k, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			if v, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			var v any
+			if v, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case 14: // boolean, its value in the size
+		return size != 0, offset, nil
+	case 15: // float
+		v, err := d.uint(offset, 4)
+		return float64(math.Float32frombits(uint32(v))), offset + 4, err
+	}
+	return nil, 0, fmt.Errorf("%w: type %d", errMMDBCorrupt, typ)
+}
+
+func (db *database) saveAddressInfo(ctx context.Context, info map[string]addressInfo) error {
+	args := make([]any, 0, 5*len(info))
+	for addr, i := range info {
+		args = append(args, addr, i.Country, i.ASN, i.ASOrg, i.UpdatedAt)
+	}
+	return db.upsertRows(ctx, "addresses", []upsertColumn{
+		{"address", mergeKey},
+		{"country", mergeReplace},
+		{"asn", mergeReplace},
+		{"as_org", mergeReplace},
+		{"updated_at", mergeReplace},
+	}, args)
+}
+
+func (db *database) loadAddressInfo(ctx context.Context) (map[string]addressInfo, error) {
+	rows, err := db.QueryContext(ctx, "SELECT address, country, asn, as_org, updated_at FROM addresses")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	info := make(map[string]addressInfo)
+	for rows.Next() {
+		var addr string
+		var i addressInfo
+		if err := rows.Scan(&addr, &i.Country, &i.ASN, &i.ASOrg, &i.UpdatedAt); err != nil {
+			return nil, err
+		}
+		info[addr] = i
+	}
+	return info, rows.Err()
+}
+
+// encodeAddressInfo and decodeAddressInfo store addressInfo in bbolt as
+// NUL-separated fields.
+func encodeAddressInfo(i addressInfo) []byte {
+	return []byte(i.Country + "\x00" + strconv.FormatInt(i.ASN, 10) + "\x00" + i.ASOrg + "\x00" + strconv.FormatInt(i.UpdatedAt, 10))
+}
+
+func decodeAddressInfo(v []byte) addressInfo {
+	fields := strings.SplitN(string(v), "\x00", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	asn, _ := strconv.ParseInt(fields[1], 10, 64)
+	updated, _ := strconv.ParseInt(fields[3], 10, 64)
+	return addressInfo{Country: fields[0], ASN: asn, ASOrg: fields[2], UpdatedAt: updated}
+}
+
+// enrichGeoIP looks up every stored address in g, saving what is found.
+func enrichGeoIP(ctx context.Context, st store, g *geoIP) (found, total int, err error) {
+	rows, err := st.loadDomainAddresses(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now().Unix()
+	info := make(map[string]addressInfo)
+	seen := make(map[string]bool)
+	for _, r := range rows {
+		if seen[r.Address] {
+			continue
+		}
+		seen[r.Address] = true
+		addr, err := netip.ParseAddr(r.Address)
+		if err != nil {
+			continue
+		}
+		i, ok, err := g.lookup(addr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("looking up %s: %w", addr, err)
+		}
+		if ok {
+			i.UpdatedAt = now
+			info[r.Address] = i
+		}
+	}
+	return len(info), len(seen), st.saveAddressInfo(ctx, info)
+}
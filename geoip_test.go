@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//go:generate go run testdata/mkmmdb.go
+
+func TestGeoIPLookup(t *testing.T) {
+	tests := []struct {
+		addr  string
+		info  addressInfo
+		found bool
+	}{
+		{"23.45.67.89", addressInfo{Country: "NL", ASN: 20940, ASOrg: "Akamai International B.V."}, true},
+		{"::ffff:23.45.67.1", addressInfo{Country: "NL", ASN: 20940, ASOrg: "Akamai International B.V."}, true},
+		{"20.100.0.1", addressInfo{Country: "US", ASN: 8075, ASOrg: "MICROSOFT-CORP-MSN-AS-BLOCK"}, true}, // registered_country
+		{"2600:1406:1::1", addressInfo{Country: "US", ASN: 20940, ASOrg: "Akamai International B.V."}, true},
+		{"93.184.216.34", addressInfo{ASN: 15133, ASOrg: "EDGECAST"}, true}, // in the ASN database only
+		{"23.45.68.1", addressInfo{}, false},
+		{"8.8.8.8", addressInfo{}, false},
+		{"2001:db8::1", addressInfo{}, false},
+	}
+	for _, countries := range []string{"testdata/country.mmdb", "testdata/country-ipv4.mmdb"} {
+		g, err := openGeoIP([]string{countries, "testdata/asn.mmdb"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			want := tt.info
+			if countries == "testdata/country-ipv4.mmdb" && strings.HasPrefix(tt.addr, "2600:") {
+				want.Country = "" // not in the IPv4 database
+			}
+			info, found, err := g.lookup(netip.MustParseAddr(tt.addr))
+			if err != nil || info != want || found != tt.found {
+				t.Errorf("%s in %s: %+v, %t, %v; want %+v, %t", tt.addr, countries, info, found, err, want, tt.found)
+			}
+		}
+	}
+}
+
+func TestMMDBRecordSizes(t *testing.T) {
+	for path, recordSize := range map[string]int{
+		"testdata/asn.mmdb":          24,
+		"testdata/country.mmdb":      28,
+		"testdata/country-ipv4.mmdb": 32,
+	} {
+		db := readTestMMDB(t, path)
+		if db.recordSize != recordSize {
+			t.Errorf("%s: record size %d, want %d", path, db.recordSize, recordSize)
+		}
+		rec, ok, err := db.lookup(netip.MustParseAddr("20.64.0.0"))
+		if m, _ := rec.(map[string]any); !ok || err != nil || len(m) == 0 {
+			t.Errorf("%s: 20.64.0.0 is %v, %t, %v", path, rec, ok, err)
+		}
+		if rec, ok, err := db.lookup(netip.MustParseAddr("20.128.0.0")); ok || err != nil {
+			t.Errorf("%s: 20.128.0.0, outside 20.64.0.0/10, is %v, %v", path, rec, err)
+		}
+	}
+}
+
+func TestMMDBDataTypes(t *testing.T) {
+	db := readTestMMDB(t, "testdata/asn.mmdb")
+	rec, ok, err := db.lookup(netip.MustParseAddr("93.184.216.34"))
+	if !ok || err != nil {
+		t.Fatalf("93.184.216.34: %v, %v", ok, err)
+	}
+	want := map[string]any{
+		"autonomous_system_number":       uint64(15133),
+		"autonomous_system_organization": "EDGECAST",
+		"anycast":                        true,
+		"double":                         1.5,
+		"float":                          0.25,
+		"int32":                          int64(-3),
+		"uint16":                         uint64(443),
+		"uint64":                         uint64(1 << 63),
+		"bytes":                          []byte{0xde, 0xad},
+		"array":                          []any{"a", uint64(1)},
+		"long":                           strings.Repeat("x", 300),
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("93.184.216.34 is\n%v\nwant\n%v", rec, want)
+	}
+}
+
+func TestMMDBPointers(t *testing.T) {
+	data := make([]byte, 3000)
+	copy(data[1000:], "\x43abc")
+	copy(data[2500:], "\x43def")
+	tests := []struct {
+		name    string
+		pointer []byte
+		want    string
+	}{
+		{"11-bit", []byte{0x23, 0xe8}, "abc"},                      // 1000
+		{"19-bit", []byte{0x28, 0x01, 0xc4}, "def"},                // 2048 + 452
+		{"32-bit", []byte{0x38, 0x00, 0x00, 0x09, 0xc4}, "def"},    // 2500
+		{"past the end", []byte{0x38, 0x00, 0x01, 0x00, 0x00}, ""}, // 65536
+	}
+	for _, tt := range tests {
+		d := &mmdbDecoder{data: append(data[:3000:3000], tt.pointer...)}
+		v, next, err := d.decode(3000)
+		if tt.want == "" {
+			if !errors.Is(err, errMMDBCorrupt) {
+				t.Errorf("%s: %v, %v; want a corrupt data error", tt.name, v, err)
+			}
+			continue
+		}
+		if v != tt.want || next != 3000+uint64(len(tt.pointer)) || err != nil {
+			t.Errorf("%s: %v, next %d, %v; want %s", tt.name, v, next, err, tt.want)
+		}
+	}
+}
+
+func TestParseMMDBErrors(t *testing.T) {
+	file, err := os.ReadFile("testdata/asn.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseMMDB([]byte("not a database")); err == nil {
+		t.Error("parsed a file without metadata")
+	}
+	meta := bytes.LastIndex(file, mmdbMetadataStart)
+	if _, err := parseMMDB(file[meta-10:]); err == nil {
+		t.Error("parsed a file with its search tree cut off")
+	}
+}
+
+func readTestMMDB(t *testing.T, path string) *mmdb {
+	t.Helper()
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := parseMMDB(file)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return db
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The gRPC API of collect, as defined in proto/dnsmasq_parse.proto. It is
+// spoken here over net/http's HTTP/2 with hand-written protobuf messages, as
+// the rest of the gRPC stack would be a large dependency for three methods.
+const grpcService = "dnsmasqparse.v1.DnsmasqParse"
+
+// grpcMaxMessage is the largest message accepted, gRPC's usual default.
+const grpcMaxMessage = 4 << 20
+
+// grpcCode is a gRPC status code.
+type grpcCode int
+
+const (
+	grpcOK                grpcCode = 0
+	grpcCanceled          grpcCode = 1
+	grpcInvalidArgument   grpcCode = 3
+	grpcNotFound          grpcCode = 5
+	grpcResourceExhausted grpcCode = 8
+	grpcUnimplemented     grpcCode = 12
+	grpcInternal          grpcCode = 13
+	grpcUnavailable       grpcCode = 14
+)
+
+// grpcError is a call that failed with a gRPC status.
+type grpcError struct {
+	code grpcCode
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", e.code, e.msg)
+}
+
+func grpcErrorf(code grpcCode, format string, args ...any) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcMessage is a protobuf message of the API.
+type grpcMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// readGRPCMessage reads a length-prefixed message from r into m, returning
+// io.EOF at the end of the stream.
+func readGRPCMessage(r io.Reader, m grpcMessage) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return grpcErrorf(grpcInternal, "truncated message")
+		}
+		return err
+	}
+	if prefix[0] != 0 {
+		return grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > grpcMaxMessage {
+		return grpcErrorf(grpcResourceExhausted, "message of %d bytes exceeds the limit of %d", n, grpcMaxMessage)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return grpcErrorf(grpcInternal, "truncated message")
+	}
+	if err := m.unmarshal(b); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "decoding message: %v", err)
+	}
+	return nil
+}
+
+// writeGRPCMessage writes m to w with its length prefix.
+func writeGRPCMessage(w io.Writer, m grpcMessage) error {
+	b := m.marshal()
+	frame := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	_, err := w.Write(append(frame, b...))
+	return err
+}
+
+// grpcStream is a call being served.
+type grpcStream struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// recv reads the next request message, returning io.EOF once the client has
+// sent them all.
+func (s *grpcStream) recv(m grpcMessage) error {
+	return readGRPCMessage(s.r.Body, m)
+}
+
+// recvRequest reads the request message of a call that takes one.
+func (s *grpcStream) recvRequest(m grpcMessage) error {
+	if err := s.recv(m); err != io.EOF {
+		return err
+	}
+	return grpcErrorf(grpcInvalidArgument, "missing request message")
+}
+
+// send sends a response message.
+func (s *grpcStream) send(m grpcMessage) error {
+	if err := writeGRPCMessage(s.w, m); err != nil {
+		return err
+	}
+	return http.NewResponseController(s.w).Flush()
+}
+
+// grpcHandler serves the methods of grpcService, by name, over HTTP/2. A
+// method returning an error other than a grpcError fails with INTERNAL.
+func grpcHandler(methods map[string]func(*grpcStream) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Accept-Encoding", "identity")
+
+		var err error
+		service, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if fn, ok := methods[method]; ok && service == grpcService {
+			err = fn(&grpcStream{w: w, r: r})
+		} else {
+			err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+		}
+
+		code, msg := grpcOK, ""
+		var gerr *grpcError
+		switch {
+		case err == nil:
+		case errors.As(err, &gerr):
+			code, msg = gerr.code, gerr.msg
+		case errors.Is(err, context.Canceled):
+			code, msg = grpcCanceled, err.Error()
+		default:
+			code, msg = grpcInternal, err.Error()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(code)))
+		if msg != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+		}
+	})
+}
+
+// grpcPercentEncode encodes a status message as the Grpc-Message header
+// carries it.
+func grpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcClient calls grpcService at a URL: http:// for HTTP/2 without TLS, as
+// gRPC clients speak it by default, or https://.
+type grpcClient struct {
+	base   string
+	client *http.Client
+}
+
+// newGRPCClient returns a client for the server at rawURL, trusting the CA
+// certificates in caFile, if given, as well as the system's.
+func newGRPCClient(rawURL, caFile string) (*grpcClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	switch u.Scheme {
+	case "http":
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case "https":
+		transport.Protocols.SetHTTP2(true)
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", caFile)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported collector URL %q: want http:// or https://", rawURL)
+	}
+	return &grpcClient{base: strings.TrimSuffix(rawURL, "/"), client: &http.Client{Transport: transport}}, nil
+}
+
+// grpcCall is a call in progress: the messages sent are streamed to the
+// server as they are written.
+type grpcCall struct {
+	body *io.PipeWriter
+	done chan struct{} // closed once the response headers arrive
+	resp *http.Response
+	err  error
+}
+
+// start calls method, whose request messages are then sent with send.
+func (c *grpcClient) start(ctx context.Context, method string) *grpcCall {
+	pr, pw := io.Pipe()
+	call := &grpcCall{body: pw, done: make(chan struct{})}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/"+grpcService+"/"+method, pr)
+	if err != nil {
+		call.err = err
+		pr.CloseWithError(err)
+		close(call.done)
+		return call
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	go func() {
+		defer close(call.done)
+		call.resp, call.err = c.client.Do(req)
+		if call.err != nil {
+			pr.CloseWithError(call.err)
+		}
+	}()
+	return call
+}
+
+// send sends a request message. It fails once the call has, when recv tells
+// why.
+func (call *grpcCall) send(m grpcMessage) error {
+	return writeGRPCMessage(call.body, m)
+}
+
+// closeSend tells the server all request messages were sent.
+func (call *grpcCall) closeSend() {
+	call.body.Close()
+}
+
+// recv reads the next response message into m, returning io.EOF at the end
+// of a call that succeeded, or the status it failed with.
+func (call *grpcCall) recv(m grpcMessage) error {
+	<-call.done
+	if call.err != nil {
+		return call.err
+	}
+	if call.resp.StatusCode != http.StatusOK {
+		call.resp.Body.Close()
+		return grpcErrorf(grpcUnavailable, "unexpected HTTP status %s", call.resp.Status)
+	}
+	err := readGRPCMessage(call.resp.Body, m)
+	if err != io.EOF {
+		return err
+	}
+	call.resp.Body.Close()
+
+	// The status is in the trailers, or in the headers of a response
+	// without messages.
+	status := call.resp.Trailer.Get("Grpc-Status")
+	msg := call.resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = call.resp.Header.Get("Grpc-Status"), call.resp.Header.Get("Grpc-Message")
+	}
+	code, convErr := strconv.Atoi(status)
+	if convErr != nil {
+		return grpcErrorf(grpcInternal, "missing gRPC status")
+	}
+	if code != int(grpcOK) {
+		if unescaped, err := url.PathUnescape(msg); err == nil {
+			msg = unescaped
+		}
+		return &grpcError{code: grpcCode(code), msg: msg}
+	}
+	return io.EOF
+}
+
+// The messages of proto/dnsmasq_parse.proto.
+
+type ingestRequest struct {
+	Source  string
+	Lines   []string
+	Queries []ingestQuery
+}
+
+type ingestQuery struct {
+	Timestamp int64
+	Domain    string
+	Client    string
+	Type      string
+}
+
+type ingestResponse struct {
+	Lines   uint64
+	Queries uint64
+}
+
+type lookupRequest struct {
+	Domain string
+}
+
+type listNewSinceRequest struct {
+	Since int64
+}
+
+type domainMessage struct {
+	Domain    string
+	FirstSeen int64
+	LastSeen  int64
+	Count     int64
+}
+
+func (m *ingestRequest) marshal() []byte {
+	b := pbAppendString(nil, 1, m.Source)
+	for _, line := range m.Lines {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, line)
+	}
+	for _, q := range m.Queries {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, q.marshal())
+	}
+	return b
+}
+
+func (m *ingestRequest) unmarshal(b []byte) error {
+	return pbDecode(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return pbString(b, &m.Source)
+		case num == 2 && typ == protowire.BytesType:
+			var line string
+			n := pbString(b, &line)
+			m.Lines = append(m.Lines, line)
+			return n
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			var q ingestQuery
+			if err := q.unmarshal(v); err != nil {
+				return -1
+			}
+			m.Queries = append(m.Queries, q)
+			return n
+		}
+		return pbSkip
+	})
+}
+
+func (m *ingestQuery) marshal() []byte {
+	b := pbAppendInt(nil, 1, m.Timestamp)
+	b = pbAppendString(b, 2, m.Domain)
+	b = pbAppendString(b, 3, m.Client)
+	return pbAppendString(b, 4, m.Type)
+}
+
+func (m *ingestQuery) unmarshal(b []byte) error {
+	return pbDecode(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			return pbInt(b, &m.Timestamp)
+		case num == 2 && typ == protowire.BytesType:
+			return pbString(b, &m.Domain)
+		case num == 3 && typ == protowire.BytesType:
+			return pbString(b, &m.Client)
+		case num == 4 && typ == protowire.BytesType:
+			return pbString(b, &m.Type)
+		}
+		return pbSkip
+	})
+}
+
+func (m *ingestResponse) marshal() []byte {
+	b := pbAppendInt(nil, 1, int64(m.Lines))
+	return pbAppendInt(b, 2, int64(m.Queries))
+}
+
+func (m *ingestResponse) unmarshal(b []byte) error {
+	return pbDecode(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var v int64
+		n := pbSkip
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			n = pbInt(b, &v)
+			m.Lines = uint64(v)
+		case num == 2 && typ == protowire.VarintType:
+			n = pbInt(b, &v)
+			m.Queries = uint64(v)
+		}
+		return n
+	})
+}
+
+func (m *lookupRequest) marshal() []byte {
+	return pbAppendString(nil, 1, m.Domain)
+}
+
+func (m *lookupRequest) unmarshal(b []byte) error {
+	return pbDecode(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.BytesType {
+			return pbString(b, &m.Domain)
+		}
+		return pbSkip
+	})
+}
+
+func (m *listNewSinceRequest) marshal() []byte {
+	return pbAppendInt(nil, 1, m.Since)
+}
+
+func (m *listNewSinceRequest) unmarshal(b []byte) error {
+	return pbDecode(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.VarintType {
+			return pbInt(b, &m.Since)
+		}
+		return pbSkip
+	})
+}
+
+func (m *domainMessage) marshal() []byte {
+	b := pbAppendString(nil, 1, m.Domain)
+	b = pbAppendInt(b, 2, m.FirstSeen)
+	b = pbAppendInt(b, 3, m.LastSeen)
+	return pbAppendInt(b, 4, m.Count)
+}
+
+func (m *domainMessage) unmarshal(b []byte) error {
+	return pbDecode(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return pbString(b, &m.Domain)
+		case num == 2 && typ == protowire.VarintType:
+			return pbInt(b, &m.FirstSeen)
+		case num == 3 && typ == protowire.VarintType:
+			return pbInt(b, &m.LastSeen)
+		case num == 4 && typ == protowire.VarintType:
+			return pbInt(b, &m.Count)
+		}
+		return pbSkip
+	})
+}
+
+// pbSkip, returned by a pbDecode field function, skips a field not known.
+const pbSkip = -1 << 30
+
+// pbDecode calls field with the number, wire type and following bytes of
+// each field of the message b. field returns the length of the value it
+// consumed, a negative protowire error code, or pbSkip.
+func pbDecode(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n == pbSkip {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func pbString(b []byte, s *string) int {
+	v, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*s = v
+	}
+	return n
+}
+
+func pbInt(b []byte, i *int64) int {
+	v, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*i = int64(v)
+	}
+	return n
+}
+
+// pbAppendString appends a string field, which proto3 leaves out when empty.
+func pbAppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// pbAppendInt appends an integer field, which proto3 leaves out when zero.
+func pbAppendInt(b []byte, num protowire.Number, i int64) []byte {
+	if i == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(i))
+}
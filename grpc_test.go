@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoMessages compiles proto/dnsmasq_parse.proto, for its messages to
+// check the hand-written ones against.
+func protoMessages(t *testing.T) protoreflect.MessageDescriptors {
+	t.Helper()
+	compiler := protocompile.Compiler{Resolver: &protocompile.SourceResolver{ImportPaths: []string{"proto"}}}
+	files, err := compiler.Compile(context.Background(), "dnsmasq_parse.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0].Messages()
+}
+
+// newProtoMessage returns the message name of the .proto holding the fields
+// of the JSON text fields.
+func newProtoMessage(t *testing.T, messages protoreflect.MessageDescriptors, name, fields string) *dynamicpb.Message {
+	t.Helper()
+	m := dynamicpb.NewMessage(messages.ByName(protoreflect.Name(name)))
+	if err := protojson.Unmarshal([]byte(fields), m); err != nil {
+		t.Fatalf("%s %s: %v", name, fields, err)
+	}
+	return m
+}
+
+func TestGRPCMessagesMatchProto(t *testing.T) {
+	messages := protoMessages(t)
+	tests := []struct {
+		name   string
+		msg    grpcMessage
+		fields string // the same message as the JSON of the .proto's
+	}{
+		{"IngestRequest", &ingestRequest{
+			Source: "router1:/var/log/dnsmasq.log",
+			Lines:  []string{"Mar  1 00:00:08 dnsmasq[812]: query[A] example.com from 192.168.1.10", "garbage"},
+			Queries: []ingestQuery{
+				{Timestamp: 1700000000, Domain: "example.com", Client: "192.168.1.10", Type: "A"},
+				{Timestamp: -1, Domain: "example.org"},
+			},
+		}, `{"source": "router1:/var/log/dnsmasq.log",
+			"lines": ["Mar  1 00:00:08 dnsmasq[812]: query[A] example.com from 192.168.1.10", "garbage"],
+			"queries": [
+				{"timestamp": "1700000000", "domain": "example.com", "client": "192.168.1.10", "type": "A"},
+				{"timestamp": "-1", "domain": "example.org"}]}`},
+		{"IngestRequest", &ingestRequest{}, `{}`},
+		{"IngestResponse", &ingestResponse{Lines: 1 << 40, Queries: 3}, `{"lines": "1099511627776", "queries": "3"}`},
+		{"LookupRequest", &lookupRequest{Domain: "bücher.example"}, `{"domain": "bücher.example"}`},
+		{"ListNewSinceRequest", &listNewSinceRequest{Since: 1700000000}, `{"since": "1700000000"}`},
+		{"ListNewSinceRequest", &listNewSinceRequest{Since: -86400}, `{"since": "-86400"}`},
+		{"Domain", &domainMessage{Domain: "example.com", FirstSeen: 1, LastSeen: 2, Count: 3}, `{"domain": "example.com", "firstSeen": "1", "lastSeen": "2", "count": "3"}`},
+	}
+	for _, tt := range tests {
+		want := newProtoMessage(t, messages, tt.name, tt.fields)
+
+		got := dynamicpb.NewMessage(want.Descriptor())
+		if err := proto.Unmarshal(tt.msg.marshal(), got); err != nil {
+			t.Errorf("%s %s: decoding what marshal wrote: %v", tt.name, tt.fields, err)
+		} else if !proto.Equal(got, want) {
+			t.Errorf("%s: marshal wrote %v, want %v", tt.name, got, want)
+		}
+
+		b, err := proto.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := reflect.New(reflect.TypeOf(tt.msg).Elem()).Interface().(grpcMessage)
+		if err := decoded.unmarshal(b); err != nil {
+			t.Errorf("%s %s: unmarshal: %v", tt.name, tt.fields, err)
+		} else if !reflect.DeepEqual(decoded, tt.msg) {
+			t.Errorf("%s: unmarshal read %+v, want %+v", tt.name, decoded, tt.msg)
+		}
+	}
+}
+
+// startTestCollector serves a collector with an empty store over HTTP/2
+// without TLS, as collect does by default.
+func startTestCollector(t *testing.T) (*collector, *httptest.Server) {
+	t.Helper()
+	rejects, err := newRejectLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{st: newMemoryStore(), rejects: rejects, agg: newAggregator(nil, rejects)}
+	srv := httptest.NewUnstartedServer(c.handler())
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+// grpcResult is what a call returned: its messages and status.
+type grpcResult struct {
+	frames  [][]byte
+	status  string
+	message string
+}
+
+// callGRPC calls method at srv with the request frames, as any gRPC client
+// would, and returns what came back.
+func callGRPC(t *testing.T, srv *httptest.Server, method string, frames ...[]byte) grpcResult {
+	t.Helper()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/"+grpcService+"/"+method, bytes.NewReader(slices.Concat(frames...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("%s: HTTP status %s, content type %q", method, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result grpcResult
+	for len(body) > 0 {
+		if len(body) < 5 || body[0] != 0 {
+			t.Fatalf("%s: bad frame % x", method, body)
+		}
+		n := 5 + int(binary.BigEndian.Uint32(body[1:5]))
+		result.frames = append(result.frames, body[5:n])
+		body = body[n:]
+	}
+	result.status = resp.Trailer.Get("Grpc-Status")
+	if result.message, err = url.PathUnescape(resp.Trailer.Get("Grpc-Message")); err != nil {
+		t.Fatalf("%s: Grpc-Message %q: %v", method, resp.Trailer.Get("Grpc-Message"), err)
+	}
+	return result
+}
+
+// grpcFrame returns m with the length prefix of an uncompressed message.
+func grpcFrame(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(b))), b...)
+}
+
+func TestCollectorGRPC(t *testing.T) {
+	messages := protoMessages(t)
+	c, srv := startTestCollector(t)
+	msg := func(name, fields string) []byte {
+		return grpcFrame(t, newProtoMessage(t, messages, name, fields))
+	}
+
+	ingested := callGRPC(t, srv, "Ingest",
+		msg("IngestRequest", `{"source": "router1", "lines": ["Mar  1 00:00:08 dnsmasq[812]: query[A] www.example.com from 192.168.1.10", "garbage"]}`),
+		msg("IngestRequest", `{"queries": [{"timestamp": "1700000000", "domain": "example.org", "client": "10.0.0.1", "type": "AAAA"}]}`))
+	if err := c.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		result  grpcResult
+		reply   string   // message name of the response frames
+		want    []string // response frames, as JSON
+		status  string
+		message string
+	}{
+		{"ingest", ingested, "IngestResponse", []string{`{"lines": "2", "queries": "1"}`}, "0", ""},
+		{"lookup", callGRPC(t, srv, "Lookup", msg("LookupRequest", `{"domain": "example.org"}`)),
+			"Domain", []string{`{"domain": "example.org", "firstSeen": "1700000000", "lastSeen": "1700000000", "count": "1"}`}, "0", ""},
+		{"lookup of a domain not stored", callGRPC(t, srv, "Lookup", msg("LookupRequest", `{"domain": "bücher.example"}`)),
+			"Domain", nil, "5", "domain bücher.example not found"},
+		{"lookup without a request", callGRPC(t, srv, "Lookup"),
+			"Domain", nil, "3", "missing request message"},
+		{"list since", callGRPC(t, srv, "ListNewSince", msg("ListNewSinceRequest", `{"since": "1700000001"}`)),
+			"Domain", []string{`{"domain": "www.example.com", "firstSeen": "TIMESTAMP", "lastSeen": "TIMESTAMP", "count": "1"}`}, "0", ""},
+		{"list everything", callGRPC(t, srv, "ListNewSince", msg("ListNewSinceRequest", `{}`)),
+			"Domain", []string{
+				`{"domain": "example.org", "firstSeen": "1700000000", "lastSeen": "1700000000", "count": "1"}`,
+				`{"domain": "www.example.com", "firstSeen": "TIMESTAMP", "lastSeen": "TIMESTAMP", "count": "1"}`,
+			}, "0", ""},
+		{"unknown method", callGRPC(t, srv, "Delete", msg("LookupRequest", `{"domain": "example.org"}`)),
+			"Domain", nil, "12", "unknown method /" + grpcService + "/Delete"},
+		{"compressed message", callGRPC(t, srv, "Lookup", []byte{1, 0, 0, 0, 0}),
+			"Domain", nil, "12", "compressed messages are not supported"},
+	}
+	// The log line's year depends on the current date.
+	logged, _ := parseSyslogTimestamp([]byte("Mar  1 00:00:08"), time.Now())
+	timestamp := strconv.FormatInt(logged.Unix(), 10)
+
+	for _, tt := range tests {
+		if tt.result.status != tt.status || tt.result.message != tt.message {
+			t.Errorf("%s: status %s %q, want %s %q", tt.name, tt.result.status, tt.result.message, tt.status, tt.message)
+		}
+		var got []*dynamicpb.Message
+		for _, f := range tt.result.frames {
+			m := dynamicpb.NewMessage(messages.ByName(protoreflect.Name(tt.reply)))
+			if err := proto.Unmarshal(f, m); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got = append(got, m)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d messages, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, fields := range tt.want {
+			fields = strings.ReplaceAll(fields, "TIMESTAMP", timestamp)
+			if want := newProtoMessage(t, messages, tt.reply, fields); !proto.Equal(got[i], want) {
+				t.Errorf("%s: message %d is %v, want %v", tt.name, i, got[i], want)
+			}
+		}
+	}
+}
+
+func TestGRPCClientStatus(t *testing.T) {
+	_, srv := startTestCollector(t)
+	client, err := newGRPCClient(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := client.start(context.Background(), "Lookup")
+	if err := call.send(&lookupRequest{Domain: "bücher.example"}); err != nil {
+		t.Fatal(err)
+	}
+	call.closeSend()
+	var gerr *grpcError
+	if err := call.recv(&domainMessage{}); !errors.As(err, &gerr) || gerr.code != grpcNotFound || gerr.msg != "domain bücher.example not found" {
+		t.Errorf("lookup of a domain not stored: %v, want NOT_FOUND", err)
+	}
+
+	call = client.start(context.Background(), "Ingest")
+	if err := call.send(&ingestRequest{Queries: []ingestQuery{{Timestamp: 1700000000, Domain: "example.org", Type: "A"}}}); err != nil {
+		t.Fatal(err)
+	}
+	call.closeSend()
+	var resp ingestResponse
+	if err := call.recv(&resp); err != nil || resp != (ingestResponse{Queries: 1}) {
+		t.Errorf("ingest: %+v, %v", resp, err)
+	}
+	if err := call.recv(&resp); err != io.EOF {
+		t.Errorf("ingest: after the response, %v, want io.EOF", err)
+	}
+}
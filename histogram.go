@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// histogramBarWidth is the width of the longest bar in table output.
+const histogramBarWidth = 40
+
+// runHistogram implements the histogram subcommand: query volume per hour or day,
+// overall and for selected domains (including their subdomains).
+func runHistogram(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("histogram", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	bucket := fs.String("bucket", "hour", "bucket `size`: hour or day")
+	since := fs.String("since", "", "only count queries after this `time` (duration such as 24h or 7d, or a date)")
+	asCSV := fs.Bool("csv", false, "write CSV instead of a table")
+	var domains stringList
+	fs.Var(&domains, "domain", "also break out this `domain` and its subdomains (repeatable)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *bucket != "hour" && *bucket != "day" {
+		return fmt.Errorf("unknown bucket size %q", *bucket)
+	}
+
+	var cutoff int64
+	if *since != "" {
+		var err error
+		cutoff, err = parseSince(*since, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	hours, err := st.loadDomainHours(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+
+	reversed := make([]string, len(domains))
+	for i, d := range domains {
+		reversed[i] = reverseDomainParts(strings.ToLower(d))
+	}
+
+	// counts[bucket][0] is the overall volume, counts[bucket][i+1] that of domains[i].
+	counts := make(map[int64][]int64)
+	for _, h := range hours {
+		domain, hour, count := h.Domain, h.Hour, h.Count
+		start := hour
+		if *bucket == "day" {
+			t := time.Unix(hour, 0)
+			start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local).Unix()
+		}
+		c, ok := counts[start]
+		if !ok {
+			c = make([]int64, len(domains)+1)
+			counts[start] = c
+		}
+		c[0] += count
+		for i, r := range reversed {
+			if domain == r || strings.HasPrefix(domain, r+".") {
+				c[i+1] += count
+			}
+		}
+	}
+	buckets := make([]int64, 0, len(counts))
+	for b := range counts {
+		buckets = append(buckets, b)
+	}
+	slices.Sort(buckets)
+
+	layout := "2006-01-02 15:00"
+	if *bucket == "day" {
+		layout = "2006-01-02"
+	}
+	header := append([]string{*bucket, "total"}, domains...)
+
+	if *asCSV {
+		return writeHistogramCSV(os.Stdout, header, buckets, counts, layout)
+	}
+	writeHistogramTable(os.Stdout, header, buckets, counts, layout)
+	return nil
+}
+
+func writeHistogramCSV(w io.Writer, header []string, buckets []int64, counts map[int64][]int64, layout string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		record := []string{time.Unix(b, 0).Format(layout)}
+		for _, c := range counts[b] {
+			record = append(record, strconv.FormatInt(c, 10))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeHistogramTable prints one row per bucket with a bar scaled to the busiest bucket.
+func writeHistogramTable(w io.Writer, header []string, buckets []int64, counts map[int64][]int64, layout string) {
+	var peak int64
+	for _, c := range counts {
+		peak = max(peak, c[0])
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\t%s\t", strings.ToUpper(header[0]), strings.ToUpper(header[1]))
+	for _, domain := range header[2:] {
+		fmt.Fprintf(tw, "%s\t", domain)
+	}
+	fmt.Fprintln(tw)
+	for _, b := range buckets {
+		fmt.Fprint(tw, time.Unix(b, 0).Format(layout))
+		for _, c := range counts[b] {
+			fmt.Fprintf(tw, "\t%d", c)
+		}
+		bar := 0
+		if peak > 0 {
+			bar = int(counts[b][0] * histogramBarWidth / peak)
+		}
+		fmt.Fprintf(tw, "\t%s\n", strings.Repeat("#", bar))
+	}
+	tw.Flush()
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
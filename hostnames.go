@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ptrWorkers and ptrTimeout bound the PTR lookups of --client-names ptr.
+const (
+	ptrWorkers = 8
+	ptrTimeout = 2 * time.Second
+)
+
+// clientNames maps client addresses to host names, for reports to show
+// "laptop.lan (192.168.1.23)" rather than a bare address.
+type clientNames map[string]string
+
+// label returns client as reports show it: its host name followed by the
+// address in parentheses, or the address alone when it has no name.
+func (n clientNames) label(client string) string {
+	return clientLabel(client, n[client])
+}
+
+func clientLabel(client, hostname string) string {
+	if hostname == "" {
+		return client
+	}
+	return hostname + " (" + client + ")"
+}
+
+// Label returns the client as reports show it (see clientNames.label).
+func (c reportClient) Label() string {
+	return clientLabel(c.Client, c.Hostname)
+}
+
+// addClientNamesFlag registers --client-names on fs.
+func addClientNamesFlag(fs *flag.FlagSet) *string {
+	return fs.String("client-names", "dhcp", "name clients from `source`: dhcp, the host names of their DHCP leases; ptr, those and then PTR lookups of the rest; or none")
+}
+
+// checkClientNames reports whether source is one --client-names knows.
+func checkClientNames(source string) error {
+	switch source {
+	case "dhcp", "ptr", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown --client-names source %q", source)
+}
+
+// loadClientNames names clients from source, as --client-names has it, using
+// the devices stored in st.
+func loadClientNames(ctx context.Context, st store, source string, clients []string) (clientNames, error) {
+	if source == "none" {
+		return clientNames{}, nil
+	}
+	rows, err := st.loadDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nameClients(ctx, currentDevices(rows), source, clients)
+}
+
+// nameReportClients sets the Hostname of each of clients from source.
+func nameReportClients(ctx context.Context, st store, source string, clients []reportClient) error {
+	addresses := make([]string, len(clients))
+	for i, c := range clients {
+		addresses[i] = c.Client
+	}
+	names, err := loadClientNames(ctx, st, source, addresses)
+	if err != nil {
+		return err
+	}
+	for i := range clients {
+		clients[i].Hostname = names[clients[i].Client]
+	}
+	return nil
+}
+
+// nameClients names clients after the devices last leased their addresses
+// and, with source ptr, after the PTR records of the rest. Failed lookups
+// leave a client unnamed.
+func nameClients(ctx context.Context, devices map[string]deviceRow, source string, clients []string) (clientNames, error) {
+	names := make(clientNames)
+	if err := checkClientNames(source); err != nil || source == "none" {
+		return names, err
+	}
+	var unnamed []string
+	for _, client := range clients {
+		if d, ok := devices[client]; ok && d.Hostname != "" {
+			names[client] = d.Hostname
+		} else {
+			unnamed = append(unnamed, client)
+		}
+	}
+	if source != "ptr" || len(unnamed) == 0 {
+		return names, nil
+	}
+
+	c := newDNSClient("")
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range min(ptrWorkers, len(unnamed)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for client := range jobs {
+				if name, err := lookupPTR(ctx, c, client); err == nil && name != "" {
+					mu.Lock()
+					names[client] = name
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, client := range unnamed {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- client
+	}
+	close(jobs)
+	wg.Wait()
+	return names, ctx.Err()
+}
+
+// lookupPTR returns the first name the PTR records of address give, without
+// its trailing dot, or "" when it has none.
+func lookupPTR(ctx context.Context, c dnsClient, address string) (string, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", err
+	}
+	zone := "ip6.arpa"
+	if addr.Unmap().Is4() {
+		zone = "in-addr.arpa"
+	}
+	ctx, cancel := context.WithTimeout(ctx, ptrTimeout)
+	defer cancel()
+	// The reverse name is built as a DNSBL query is, on the arpa zone.
+	resp, err := c.exchange(ctx, dnsblQuery(address, zone), dnsmessage.TypePTR)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range resp.Answers {
+		if ptr, ok := rr.Body.(*dnsmessage.PTRResource); ok {
+			return strings.TrimSuffix(ptr.PTR.String(), "."), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// domainHour keys the hourly query counts of a (reversed) domain.
+type domainHour struct {
+	Domain string
+	Hour   int64
+}
+
+// hourOf truncates a unix timestamp to the start of its hour.
+func hourOf(timestamp int64) int64 {
+	return timestamp - ((timestamp%3600)+3600)%3600
+}
+
+func (db *database) saveDomainHours(ctx context.Context, counts map[domainHour]int64) error {
+	args := make([]any, 0, 3*len(counts))
+	for key, count := range counts {
+		args = append(args, key.Domain, key.Hour, count)
+	}
+	return db.upsertRows(ctx, "domain_hours", []upsertColumn{
+		{"domain", mergeKey},
+		{"hour", mergeKey},
+		{"count", mergeAdd},
+	}, args)
+}
+
+func (db *database) loadDomainHours(ctx context.Context, since int64) ([]domainHourCount, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, hour, count FROM domain_hours WHERE hour >= ?", hourOf(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []domainHourCount
+	for rows.Next() {
+		var c domainHourCount
+		if err := rows.Scan(&c.Domain, &c.Hour, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// parseSince turns a --since value into a unix timestamp. It accepts a duration
+// back from now ("36h", "7d") or an absolute date ("2024-05-01", RFC 3339).
+func parseSince(value string, now time.Time) (int64, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil {
+			return now.AddDate(0, 0, -n).Unix(), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d).Unix(), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q: want a duration like 24h or 7d, or a date like 2006-01-02", value)
+}
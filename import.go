@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// importChunk is the number of Pi-hole queries read at a time. FTL keeps
+// writing its database while we read it, so no read holds it for long.
+const importChunk = 50_000
+
+// importSources are the histories import reads, by name.
+var importSources = map[string]func(context.Context, []string) error{
+	"pihole-ftl": runImportPiholeFTL,
+}
+
+// runImport implements the import subcommand: fold the history another tool
+// kept into the database, as if its logs had been parsed.
+func runImport(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("import needs a source: pihole-ftl")
+	}
+	run, ok := importSources[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown import source %q (want pihole-ftl)", args[0])
+	}
+	return run(ctx, args[1:])
+}
+
+// runImportPiholeFTL imports the queries table of Pi-hole's long-term
+// database, pihole-FTL.db. The id of the last query imported is kept as a
+// checkpoint, so importing the same database again adds only newer queries.
+func runImportPiholeFTL(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import pihole-ftl", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	since := fs.String("since", "", "only import queries made after this `time` (duration such as 24h or 7d, or a date)")
+	queries := addQueryFlags(fs)
+	anonymize := addAnonymizeFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: import pihole-ftl [flags] /etc/pihole/pihole-FTL.db")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("import pihole-ftl needs one pihole-FTL.db")
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ftl, err := openDatabaseReadOnly(dbOptions{Path: path, Driver: "sqlite"})
+	if err != nil {
+		return err
+	}
+	defer ftl.Close()
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	agg := newAggregator(*clients, nil)
+	if err := queries.enable(agg, st); err != nil {
+		return err
+	}
+	if err := anonymize.enable(agg); err != nil {
+		return err
+	}
+	agg.beginSource(path)
+
+	// Reading stops on a signal, but saving what was read still runs to completion.
+	readCtx, stop := notifyInterrupt(ctx)
+	defer stop()
+
+	cp, _, err := st.loadCheckpoint(ctx, piholeCheckpoint(path))
+	if err != nil {
+		return err
+	}
+	save := func() error {
+		saveCtx, cancel := dbOpts.withTimeout(ctx)
+		defer cancel()
+		if err := agg.save(saveCtx, st); err != nil {
+			return fmt.Errorf("saving domains to database: %w", err)
+		}
+		return st.saveCheckpoints(saveCtx, []checkpoint{cp})
+	}
+
+	imported := 0
+	for readCtx.Err() == nil {
+		n, last, err := importPiholeQueries(readCtx, ftl, agg, cp.Offset, cutoff)
+		if err != nil && readCtx.Err() == nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		if n == 0 {
+			break
+		}
+		imported += n
+		cp.Offset = last
+		if err := save(); err != nil {
+			return err
+		}
+		slog.Info("imported queries", "path", path, "queries", imported, "last_id", last)
+	}
+	if readCtx.Err() != nil {
+		slog.Warn("interrupted, saved partial results", "path", path, "last_id", cp.Offset)
+		return errInterrupted
+	}
+	slog.Info("imported Pi-hole queries", "path", path, "queries", imported)
+	return nil
+}
+
+// piholeCheckpoint names the checkpoint of the Pi-hole database at path, apart
+// from those of log files: its offset is a query id rather than a byte.
+func piholeCheckpoint(path string) string {
+	return "pihole-ftl:" + path
+}
+
+// importPiholeQueries adds to agg the next importChunk queries of ftl after
+// id after that were made at cutoff or later, and returns how many rows it
+// read and the id of the last.
+func importPiholeQueries(ctx context.Context, ftl *database, agg *aggregator, after, cutoff int64) (int, int64, error) {
+	// reply_time came with FTL v5.3; older databases answer it with NULL.
+	replyTime := "NULL"
+	cols, err := ftl.QueryContext(ctx, "SELECT * FROM queries LIMIT 0")
+	if err != nil {
+		return 0, after, err
+	}
+	names, err := cols.Columns()
+	cols.Close()
+	if err != nil {
+		return 0, after, err
+	}
+	if slices.Contains(names, "reply_time") {
+		replyTime = "reply_time"
+	}
+
+	rows, err := ftl.QueryContext(ctx, "SELECT id, timestamp, type, status, domain, client, "+replyTime+
+		" FROM queries WHERE id > ? AND timestamp >= ? ORDER BY id LIMIT ?", after, cutoff, importChunk)
+	if err != nil {
+		return 0, after, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var q piholeQuery
+		if err := rows.Scan(&q.ID, &q.Timestamp, &q.Type, &q.Status, &q.Domain, &q.Client, &q.ReplyTime); err != nil {
+			return n, after, err
+		}
+		n, after = n+1, q.ID
+		for _, l := range q.lines() {
+			agg.addParsed(l)
+		}
+	}
+	return n, after, rows.Err()
+}
+
+// piholeQuery is a row of FTL's queries table.
+type piholeQuery struct {
+	ID        int64
+	Timestamp float64
+	Type      int
+	Status    int
+	Domain    string
+	Client    string
+	ReplyTime sql.NullFloat64 // seconds until the reply, upstream or local
+}
+
+// piholeTypes are the record types FTL stores as numbers. Other types are
+// stored as 100 plus their number, which dnsmasq logs as type=N.
+var piholeTypes = map[int]string{
+	1: "A", 2: "AAAA", 3: "ANY", 4: "SRV", 5: "SOA", 6: "PTR", 7: "TXT", 8: "NAPTR",
+	9: "MX", 10: "DS", 11: "RRSIG", 12: "DNSKEY", 13: "NS", 14: "OTHER", 15: "SVCB", 16: "HTTPS",
+}
+
+// lines returns the dnsmasq log lines the query stands for: the query itself
+// and what became of it, worded as Pi-hole's dnsmasq logs it, so the query
+// is counted as cached, forwarded or blocked. Queries blocked upstream count
+// as forwarded, as they do in the log, and those FTL dropped as duplicates of
+// one in flight say nothing more.
+func (q piholeQuery) lines() []logLine {
+	qtype, ok := piholeTypes[q.Type]
+	if !ok {
+		qtype = "type=" + strconv.Itoa(q.Type-100)
+	}
+	ts := int64(q.Timestamp)
+	query := logLine{Timestamp: ts, Verb: queryVerb([]byte(qtype)), Domain: []byte(q.Domain), Client: []byte(q.Client)}
+	action := logLine{Timestamp: ts, Domain: query.Domain}
+	switch q.Status {
+	case 1, 9: // gravity, and gravity via CNAME
+		action.Verb = []byte("gravity")
+	case 4, 10: // regex
+		action.Verb = []byte("regex")
+	case 5, 11: // exact denylist
+		action.Verb = []byte("exactly")
+	case 3:
+		action.Verb = []byte("cached")
+	case 17:
+		action.Verb = []byte("cached-stale")
+	case 2, 6, 7, 8, 18: // forwarded, or forwarded and blocked upstream
+		action.Verb = []byte("forwarded")
+		if !q.ReplyTime.Valid {
+			return []logLine{query, action}
+		}
+		reply := logLine{Timestamp: int64(q.Timestamp + q.ReplyTime.Float64), Verb: []byte("reply"), Domain: query.Domain}
+		return []logLine{query, action, reply}
+	default:
+		return []logLine{query}
+	}
+	return []logLine{query, action}
+}
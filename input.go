@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// stdinPath names standard input among the input files.
+const stdinPath = "-"
+
+// input is an opened input file: a plain or gzip-compressed log file, or stdin.
+type input struct {
+	io.Reader                  // the log lines, decompressed
+	file       *os.File        // the underlying file
+	info       os.FileInfo     // nil for stdin
+	raw        *countingReader // bytes read from file, before decompression
+	buf        *bufio.Reader
+	compressed bool
+}
+
+// openInput opens path, or stdin for "-", detecting gzip compression from the
+// content rather than the name so rotated files are read whatever they are called.
+func openInput(path string) (*input, error) {
+	in := &input{file: os.Stdin}
+	if path != stdinPath {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		in.file = f
+		if in.info, err = f.Stat(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	in.raw = &countingReader{r: in.file}
+	in.buf = bufio.NewReaderSize(in.raw, scanBufferSize)
+	if err := in.detect(); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+// detect sets up decompression when the buffered data starts with the gzip magic.
+func (in *input) detect() error {
+	in.Reader = in.buf
+	if magic, _ := in.buf.Peek(2); len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		in.compressed = false
+		return nil
+	}
+	gz, err := gzip.NewReader(in.buf)
+	if err != nil {
+		return err
+	}
+	in.Reader, in.compressed = gz, true
+	return nil
+}
+
+// skip moves past the first offset bytes of log lines: by seeking in a plain
+// file and by decompressing and discarding them in a compressed one.
+func (in *input) skip(offset int64) error {
+	if in.compressed || in.info == nil {
+		_, err := io.CopyN(io.Discard, in, offset)
+		return err
+	}
+	if _, err := in.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	in.raw.n.Store(offset)
+	in.buf.Reset(in.raw)
+	return nil
+}
+
+// resumes reports whether the checkpoint c applies to the input. Compressed
+// files are not appended to, so only their identity is checked: the offset
+// counts decompressed bytes and may exceed the file's size.
+func (in *input) resumes(c checkpoint) bool {
+	switch {
+	case in.info == nil:
+		return false
+	case in.compressed:
+		return c.Inode == 0 || c.Inode == fileInode(in.info)
+	}
+	return c.resumes(in.info)
+}
+
+func (in *input) Close() error {
+	if in.file == os.Stdin {
+		return nil
+	}
+	return in.file.Close()
+}
+
+// countingReader counts the bytes read through it, for reporting progress from
+// another goroutine.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// lineParser parses a log line into what it says about a query, as
+// parseLogLine does for dnsmasq's log.
+type lineParser func(line []byte) (logLine, error)
+
+// lineFormat parses a log line as lineParser does, placing a syslog timestamp,
+// which has no year, in the year before now.
+type lineFormat func(line []byte, now time.Time) (logLine, error)
+
+// at returns the parser of lines logged by now. Parse runs take now once, which
+// keeps the clock off the hot path and gives every line of a run the same year.
+func (f lineFormat) at(now time.Time) lineParser {
+	return func(line []byte) (logLine, error) { return f(line, now) }
+}
+
+// live returns the parser of lines read as they are logged, which takes the
+// time anew for each so that followed logs change year with the clock.
+func (f lineFormat) live() lineParser {
+	return func(line []byte) (logLine, error) { return f(line, time.Now()) }
+}
+
+// inputFormats are the resolver logs --input-format reads, by name.
+var inputFormats = map[string]lineFormat{
+	"dnsmasq": parseLogLine,
+	"bind":    parseBINDLine,
+	"unbound": parseUnboundLine,
+	"auto":    parseAnyLine,
+}
+
+// --input-format is neither --format, the export format where parsing and
+// exporting run together, nor --log-format, that of our own log.
+const inputFormatFlagUsage = "parse input lines as `format`: dnsmasq, bind (named's queries category), unbound (its log-queries) or auto, which tells them apart line by line"
+
+// addInputFormatFlag registers --input-format on fs.
+func addInputFormatFlag(fs *flag.FlagSet) *string {
+	return fs.String("input-format", "auto", inputFormatFlagUsage)
+}
+
+// inputFormat returns the format of the --input-format name.
+func inputFormat(name string) (lineFormat, error) {
+	parse, ok := inputFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown --input-format %q", name)
+	}
+	return parse, nil
+}
+
+// parseAnyLine parses line with the parser of the format it looks like,
+// dnsmasq's unless it is a BIND query or a line of Unbound's.
+func parseAnyLine(line []byte, now time.Time) (logLine, error) {
+	switch {
+	case isBINDLine(line):
+		return parseBINDLine(line, now)
+	case isUnboundLine(line):
+		return parseUnboundLine(line, now)
+	}
+	return parseLogLine(line, now)
+}
+
+// lineTimestamp parses the timestamp starting a line of any format, for the
+// time span of an input file. At most timestampPrefixLen bytes are looked at.
+func lineTimestamp(line []byte, now time.Time) (time.Time, bool) {
+	if t, ok := parseSyslogTimestamp(line, now); ok {
+		return t, true
+	}
+	if t, _, ok := bindTimestamp(line); ok {
+		return t, true
+	}
+	if t, _, ok := unboundTimestamp(line); ok {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// timestampPrefixLen covers the timestamps of every format.
+const timestampPrefixLen = 40
+
+// queryVerbs holds the Verb of queries of the common record types, so
+// formats that log the type apart need not build it for each line.
+var queryVerbs = func() map[string][]byte {
+	verbs := make(map[string][]byte)
+	for _, t := range []string{"A", "AAAA", "ANY", "CNAME", "DNSKEY", "DS", "HTTPS", "MX", "NS", "PTR", "SOA", "SRV", "SVCB", "TXT"} {
+		verbs[t] = []byte("query[" + t + "]")
+	}
+	return verbs
+}()
+
+// queryVerb returns the Verb of a query for qtype, such as query[AAAA].
+func queryVerb(qtype []byte) []byte {
+	if v, ok := queryVerbs[string(qtype)]; ok {
+		return v
+	}
+	return []byte("query[" + string(qtype) + "]")
+}
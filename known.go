@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// knownDomains is a bounded LRU of domains known to be stored, with an upper
+// bound on their stored first_seen. Saving a known domain that cannot move
+// first_seen earlier only needs last_seen and count updated, which spares the
+// insert attempt of an upsert (and the id it consumes on MySQL and Postgres).
+type knownDomains struct {
+	size  int
+	order *list.List // of *knownDomain, most recently used first
+	index map[string]*list.Element
+}
+
+type knownDomain struct {
+	domain    string
+	firstSeen int64
+}
+
+func newKnownDomains(size int) *knownDomains {
+	return &knownDomains{size: size, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// firstSeen returns the bound on the stored first_seen of domain, if known.
+func (k *knownDomains) firstSeen(domain string) (int64, bool) {
+	e, ok := k.index[domain]
+	if !ok {
+		return 0, false
+	}
+	k.order.MoveToFront(e)
+	return e.Value.(*knownDomain).firstSeen, true
+}
+
+// add records that domain is stored with a first_seen of at most firstSeen,
+// evicting the least recently used domain when full.
+func (k *knownDomains) add(domain string, firstSeen int64) {
+	if e, ok := k.index[domain]; ok {
+		d := e.Value.(*knownDomain)
+		d.firstSeen = min(d.firstSeen, firstSeen)
+		k.order.MoveToFront(e)
+		return
+	}
+	k.index[domain] = k.order.PushFront(&knownDomain{domain, firstSeen})
+	if k.order.Len() > k.size {
+		oldest := k.order.Back()
+		k.order.Remove(oldest)
+		delete(k.index, oldest.Value.(*knownDomain).domain)
+	}
+}
+
+// touchDomains updates last_seen and count of domains already stored, in one
+// transaction of batched updates, and returns those that turned out not to be
+// (pruned since, say).
+func (db *database) touchDomains(ctx context.Context, domains map[string]domainTimes) (missing []string, err error) {
+	names := slices.Collect(maps.Keys(domains))
+	batch := min(max(db.batchSize, 1), maxBindParams/3)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var full *sql.Stmt // prepared update of a whole batch
+	for start := 0; start < len(names); start += batch {
+		chunk := names[start:min(start+batch, len(names))]
+		args := make([]any, 0, 3*len(chunk))
+		for _, domain := range chunk {
+			args = append(args, domain, domains[domain].LastSeen, domains[domain].Count)
+		}
+		var res sql.Result
+		if len(chunk) == batch {
+			if full == nil {
+				full, err = tx.PrepareContext(ctx, db.dialect.touch(batch))
+			}
+			if err == nil {
+				res, err = full.ExecContext(ctx, args...)
+			}
+		} else {
+			res, err = tx.ExecContext(ctx, db.dialect.touch(len(chunk)), args...)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		// Every update adds to count, so each stored domain counts as affected.
+		if n, err := res.RowsAffected(); err == nil && n == int64(len(chunk)) {
+			continue
+		}
+		absent, err := db.absentDomains(ctx, tx, chunk)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		missing = append(missing, absent...)
+	}
+	return missing, tx.Commit()
+}
+
+// absentDomains returns those of domains not in the domains table.
+func (db *database) absentDomains(ctx context.Context, tx *sql.Tx, domains []string) ([]string, error) {
+	args := make([]any, len(domains))
+	for i, domain := range domains {
+		args[i] = domain
+	}
+	query := "SELECT domain FROM domains WHERE domain IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(domains)), ", ") + ")"
+	rows, err := tx.QueryContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool, len(domains))
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		stored[domain] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(slices.Clone(domains), func(d string) bool { return stored[d] }), nil
+}
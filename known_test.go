@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openTestDatabase opens a new SQLite database in a temporary directory.
+func openTestDatabase(t *testing.T, name string) *database {
+	t.Helper()
+	db, err := openDatabase(context.Background(), dbOptions{Path: filepath.Join(t.TempDir(), name), BatchSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testStores opens a new, empty store of each kind.
+var testStores = map[string]func(t *testing.T) store{
+	"sqlite": func(t *testing.T) store { return openTestDatabase(t, "test.db") },
+	"bolt": func(t *testing.T) store {
+		st, err := openStore(context.Background(), dbOptions{Path: filepath.Join(t.TempDir(), "test.bolt"), Driver: "bolt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.Close() })
+		return st
+	},
+	"memory": func(t *testing.T) store { return newMemoryStore() },
+}
+
+func TestKnownDomainsSaveLikeUpserts(t *testing.T) {
+	ctx := context.Background()
+	plain := openTestDatabase(t, "plain.db")
+	cached := openTestDatabase(t, "cached.db")
+	cached.known = newKnownDomains(4)
+
+	rounds := []map[string]domainTimes{
+		{
+			"com.example":     {FirstSeen: 100, LastSeen: 200, Count: 2},
+			"com.example.www": {FirstSeen: 110, LastSeen: 110, Count: 1},
+			"org.example":     {FirstSeen: 120, LastSeen: 150, Count: 3},
+			"net.example":     {FirstSeen: 130, LastSeen: 130, Count: 1},
+			"io.example":      {FirstSeen: 140, LastSeen: 140, Count: 1},
+		},
+		{
+			"com.example":     {FirstSeen: 300, LastSeen: 400, Count: 5}, // known: touched
+			"com.example.www": {FirstSeen: 50, LastSeen: 60, Count: 1},   // first_seen moves earlier
+			"org.example":     {FirstSeen: 160, LastSeen: 170, Count: 1}, // last_seen stays later
+			"de.example":      {FirstSeen: 310, LastSeen: 310, Count: 1}, // new
+		},
+		{
+			"com.example": {FirstSeen: 500, LastSeen: 500, Count: 1},
+			"net.example": {FirstSeen: 510, LastSeen: 520, Count: 2}, // pruned in between
+			"io.example":  {FirstSeen: 530, LastSeen: 530, Count: 1}, // evicted from the cache
+			"de.example":  {FirstSeen: 540, LastSeen: 550, Count: 4},
+		},
+	}
+	for i, round := range rounds {
+		if i == 2 {
+			for _, db := range []*database{plain, cached} {
+				if _, err := db.ExecContext(ctx, "DELETE FROM domains WHERE domain = ?", "net.example"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, db := range []*database{plain, cached} {
+			if err := db.saveDomains(ctx, round); err != nil {
+				t.Fatalf("round %d: %v", i+1, err)
+			}
+		}
+	}
+	if _, ok := cached.known.firstSeen("com.example"); !ok {
+		t.Fatal("com.example is not in the cache, so was never touched")
+	}
+
+	want := loadSortedDomainRows(t, plain)
+	got := loadSortedDomainRows(t, cached)
+	if !slices.Equal(got, want) {
+		t.Errorf("with the known domains cache, domains holds\n%v\nwithout it\n%v", got, want)
+	}
+}
+
+func loadSortedDomainRows(t *testing.T, db *database) []domainRow {
+	t.Helper()
+	rows, err := db.loadDomainRows(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(rows, func(a, b domainRow) int { return strings.Compare(a.Domain, b.Domain) })
+	return rows
+}
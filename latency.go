@@ -0,0 +1,264 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// resolution counts how the queries for a domain were answered: from the cache,
+// blocked, or forwarded upstream, with the time until the upstream reply.
+//
+// dnsmasq logs whole seconds, so a single latency is only known to within a
+// second. Summed over many replies the differences still average out to the
+// true mean, as a reply is as likely to land in the next second as the same
+// one; the maximum is only an upper bound.
+type resolution struct {
+	Cached       int64
+	Forwarded    int64
+	Blocked      int64
+	Replies      int64 // forwarded queries whose reply was seen
+	LatencyMs    int64 // summed over Replies
+	MaxLatencyMs int64
+}
+
+// meanLatencyMs returns the mean upstream latency, or 0 without replies.
+func (r resolution) meanLatencyMs() float64 {
+	if r.Replies == 0 {
+		return 0
+	}
+	return float64(r.LatencyMs) / float64(r.Replies)
+}
+
+// cacheHitRatio returns the share of the answered-or-forwarded queries that
+// were answered from the cache, or 0 without any.
+func (r resolution) cacheHitRatio() float64 {
+	if r.Cached+r.Forwarded == 0 {
+		return 0
+	}
+	return float64(r.Cached) / float64(r.Cached+r.Forwarded)
+}
+
+// plus returns the counts of r and o together.
+func (r resolution) plus(o resolution) resolution {
+	return resolution{
+		Cached:       r.Cached + o.Cached,
+		Forwarded:    r.Forwarded + o.Forwarded,
+		Blocked:      r.Blocked + o.Blocked,
+		Replies:      r.Replies + o.Replies,
+		LatencyMs:    r.LatencyMs + o.LatencyMs,
+		MaxLatencyMs: max(r.MaxLatencyMs, o.MaxLatencyMs),
+	}
+}
+
+// mergeResolution folds r into m[domain].
+func mergeResolution(m map[string]resolution, domain string, r resolution) {
+	m[domain] = m[domain].plus(r)
+}
+
+// maxFlights bounds the queries tracked while waiting for their answer; past it
+// the oldest are forgotten wholesale, losing at most a few answers.
+const maxFlights = 1 << 16
+
+// flight is a query waiting for dnsmasq to say how it was answered.
+type flight struct {
+	name      string // as logged, interned
+	domain    string // reversed, interned
+	timestamp int64
+	forwarded bool
+}
+
+// resolver follows each query through the lines about what dnsmasq did with
+// it. With log-queries=extra the lines carry the query's serial number;
+// otherwise a line belongs to the latest query for its domain.
+type resolver struct {
+	byDomain map[string]flight
+	bySerial map[uint64]flight
+}
+
+func newResolver() *resolver {
+	return &resolver{byDomain: make(map[string]flight), bySerial: make(map[uint64]flight)}
+}
+
+// query starts following the query on l, whose domain is interned as name and
+// reversed.
+func (r *resolver) query(l logLine, name, reversed string) {
+	f := flight{name: name, domain: reversed, timestamp: l.Timestamp}
+	if l.Serial != 0 {
+		if len(r.bySerial) >= maxFlights {
+			clear(r.bySerial)
+		}
+		r.bySerial[l.Serial] = f
+		return
+	}
+	if len(r.byDomain) >= maxFlights {
+		clear(r.byDomain)
+	}
+	r.byDomain[name] = f
+}
+
+// answer records in m what l says became of the query it is about, if it is
+// being followed: cached, blocked or other local answers end it, forwarding
+// waits for the reply.
+func (r *resolver) answer(l logLine, m map[string]resolution) {
+	var f flight
+	var ok bool
+	if l.Serial != 0 {
+		f, ok = r.bySerial[l.Serial]
+	} else {
+		f, ok = r.byDomain[string(l.Domain)]
+	}
+	if !ok {
+		return
+	}
+
+	var add resolution
+	switch verb := string(l.Verb); {
+	case f.forwarded && verb == "reply":
+		latency := max(l.Timestamp-f.timestamp, 0) * 1000
+		add = resolution{Replies: 1, LatencyMs: latency, MaxLatencyMs: latency}
+	case f.forwarded:
+		// Further lines about a forwarded query, such as a CNAME chain's
+		// "reply" lines for other names or "validation" results.
+		return
+	case verb == "forwarded":
+		f.forwarded = true
+		r.follow(f, l.Serial)
+		mergeResolution(m, f.domain, resolution{Forwarded: 1})
+		return
+	case strings.HasPrefix(verb, "cached"):
+		add = resolution{Cached: 1}
+	case l.blocked():
+		add = resolution{Blocked: 1}
+	}
+	r.forget(f, l.Serial)
+	if add != (resolution{}) {
+		mergeResolution(m, f.domain, add)
+	}
+}
+
+func (r *resolver) follow(f flight, serial uint64) {
+	if serial != 0 {
+		r.bySerial[serial] = f
+	} else {
+		r.byDomain[f.name] = f
+	}
+}
+
+func (r *resolver) forget(f flight, serial uint64) {
+	if serial != 0 {
+		delete(r.bySerial, serial)
+	} else {
+		delete(r.byDomain, f.name)
+	}
+}
+
+func (db *database) saveDomainResolutions(ctx context.Context, resolutions map[string]resolution) error {
+	args := make([]any, 0, 7*len(resolutions))
+	for domain, r := range resolutions {
+		args = append(args, domain, r.Cached, r.Forwarded, r.Blocked, r.Replies, r.LatencyMs, r.MaxLatencyMs)
+	}
+	return db.upsertRows(ctx, "domain_resolution", []upsertColumn{
+		{"domain", mergeKey},
+		{"cached", mergeAdd},
+		{"forwarded", mergeAdd},
+		{"blocked", mergeAdd},
+		{"replies", mergeAdd},
+		{"latency_ms", mergeAdd},
+		{"max_latency_ms", mergeMax},
+	}, args)
+}
+
+func (db *database) loadDomainResolutions(ctx context.Context) (map[string]resolution, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, cached, forwarded, blocked, replies, latency_ms, max_latency_ms FROM domain_resolution")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resolutions := make(map[string]resolution)
+	for rows.Next() {
+		var domain string
+		var r resolution
+		if err := rows.Scan(&domain, &r.Cached, &r.Forwarded, &r.Blocked, &r.Replies, &r.LatencyMs, &r.MaxLatencyMs); err != nil {
+			return nil, err
+		}
+		resolutions[domain] = r
+	}
+	return resolutions, rows.Err()
+}
+
+// domainResolution is a domain (forward) with how its queries were answered.
+type domainResolution struct {
+	Domain string
+	resolution
+}
+
+// runLatency implements the latency subcommand: how queries were answered,
+// and the domains with the slowest upstream replies.
+func runLatency(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("latency", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	n := addLimitFlag(fs, 20, "show `n` domains")
+	minReplies := fs.Int64("min-replies", 1, "only show domains with at least this many upstream replies")
+	sortBy := fs.String("sort", "mean", "order domains by `key`: mean, max or replies")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var order func(a, b domainResolution) int
+	switch *sortBy {
+	case "mean":
+		order = func(a, b domainResolution) int { return cmp.Compare(b.meanLatencyMs(), a.meanLatencyMs()) }
+	case "max":
+		order = func(a, b domainResolution) int { return cmpInt(b.MaxLatencyMs, a.MaxLatencyMs) }
+	case "replies":
+		order = func(a, b domainResolution) int { return cmpInt(b.Replies, a.Replies) }
+	default:
+		return fmt.Errorf("unknown -sort %q: want mean, max or replies", *sortBy)
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	resolutions, err := st.loadDomainResolutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	var total resolution
+	var domains []domainResolution
+	for domain, r := range resolutions {
+		total = total.plus(r)
+		if r.Replies >= *minReplies && r.Replies > 0 {
+			domains = append(domains, domainResolution{reverseDomainParts(domain), r})
+		}
+	}
+	slices.SortFunc(domains, func(a, b domainResolution) int {
+		if c := order(a, b); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+
+	fmt.Printf("%d cached answers (%.1f%% hit ratio), %d forwarded queries, %d blocked, %d upstream replies, mean latency %.0fms\n\n",
+		total.Cached, 100*total.cacheHitRatio(), total.Forwarded, total.Blocked, total.Replies, total.meanLatencyMs())
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tMEAN\tMAX\tREPLIES\tCACHED\tFORWARDED\tBLOCKED\tDOMAIN")
+	for i, d := range domains[:min(*n, len(domains))] {
+		fmt.Fprintf(tw, "%d\t%.0fms\t%dms\t%d\t%d\t%d\t%d\t%s\n",
+			i+1, d.meanLatencyMs(), d.MaxLatencyMs, d.Replies, d.Cached, d.Forwarded, d.Blocked, d.Domain)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// listedSummary is a registrable domain or resolved address on a DNSBL, and
+// what was seen of it.
+type listedSummary struct {
+	Name      string
+	Listings  []string // "zone (codes)", in zone order
+	FirstSeen int64
+	LastSeen  int64
+	Count     int64    // queries under a domain, answers with an address
+	Names     []string // queried names under the domain, or resolving to the address, in order
+}
+
+// runListed implements the listed subcommand: the registrable domains queried
+// and the addresses they resolved to that DNSBL zones list, as looked up by
+// enrich --dnsbl and --dnsbl-ip.
+func runListed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("listed", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	since := fs.String("since", "", "only show domains and addresses last seen after this `time` (duration such as 24h or 7d, or a date)")
+	n := addLimitFlag(fs, 5, "list at most `n` names per domain or address (0 for all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	results, err := st.loadDNSBL(ctx)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return errors.New("no DNSBL results stored: run enrich --dnsbl or --dnsbl-ip first")
+	}
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	addresses, err := st.loadDomainAddresses(ctx)
+	if err != nil {
+		return err
+	}
+	rows = slices.DeleteFunc(rows, func(r domainRow) bool { return r.LastSeen < cutoff })
+	addresses = slices.DeleteFunc(addresses, func(a domainAddressRow) bool { return a.LastSeen < cutoff })
+
+	domains, listedAddresses := summarizeListed(rows, addresses, dnsblListings(results))
+	fmt.Printf("%d listed domains, %d listed addresses\n", len(domains), len(listedAddresses))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, section := range []struct {
+		header  string
+		entries []listedSummary
+	}{
+		{"DOMAIN\tLISTED ON\tFIRST SEEN\tLAST SEEN\tQUERIES\tNAMES", domains},
+		{"ADDRESS\tLISTED ON\tFIRST SEEN\tLAST SEEN\tANSWERS\tNAMES", listedAddresses},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, section.header)
+		for _, l := range section.entries {
+			names := l.Names
+			if *n > 0 && len(names) > *n {
+				names = append(slices.Clip(names[:*n]), fmt.Sprintf("(%d more)", len(l.Names)-*n))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", l.Name, strings.Join(l.Listings, ", "),
+				formatUnix(l.FirstSeen), formatUnix(l.LastSeen), l.Count, strings.Join(names, " "))
+		}
+	}
+	return tw.Flush()
+}
+
+// summarizeListed groups rows by registrable domain and addresses by address,
+// keeping those with listings, the most queried or answered first.
+func summarizeListed(rows []domainRow, addresses []domainAddressRow, listings map[string][]string) (domains, listedAddresses []listedSummary) {
+	add := func(by map[string]*listedSummary, name, queried string, times domainTimes) {
+		l, ok := by[name]
+		if !ok {
+			l = &listedSummary{Name: name, Listings: listings[name], FirstSeen: times.FirstSeen, LastSeen: times.LastSeen}
+			by[name] = l
+		}
+		l.FirstSeen = min(l.FirstSeen, times.FirstSeen)
+		l.LastSeen = max(l.LastSeen, times.LastSeen)
+		l.Count += times.Count
+		l.Names = append(l.Names, queried)
+	}
+	byDomain := make(map[string]*listedSummary)
+	for _, row := range rows {
+		name := reverseDomainParts(row.Domain)
+		if domain := registrableDomain(name); len(listings[domain]) > 0 {
+			add(byDomain, domain, name, domainTimes{FirstSeen: row.FirstSeen, LastSeen: row.LastSeen, Count: row.Count})
+		}
+	}
+	byAddress := make(map[string]*listedSummary)
+	for _, a := range addresses {
+		if len(listings[a.Address]) > 0 {
+			add(byAddress, a.Address, reverseDomainParts(a.Domain), a.domainTimes)
+		}
+	}
+	return sortedListed(byDomain), sortedListed(byAddress)
+}
+
+func sortedListed(by map[string]*listedSummary) []listedSummary {
+	listed := make([]listedSummary, 0, len(by))
+	for _, l := range by {
+		slices.Sort(l.Names)
+		l.Names = slices.Compact(l.Names)
+		listed = append(listed, *l)
+	}
+	slices.SortFunc(listed, func(a, b listedSummary) int {
+		if c := cmpInt(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return listed
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+// logFlags are the logging flags shared by every subcommand.
+type logFlags struct {
+	quiet, verbose bool
+	format         string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	f := &logFlags{}
+	fs.BoolVar(&f.quiet, "quiet", false, "only log warnings and errors")
+	fs.BoolVar(&f.verbose, "verbose", false, "also log debug messages")
+	fs.StringVar(&f.format, "log-format", "text", "log `format`: text or json")
+	return f
+}
+
+// setup installs the default slog logger on stderr, keeping stdout for command output.
+func (f *logFlags) setup() error {
+	level := slog.LevelInfo
+	switch {
+	case f.quiet && f.verbose:
+		return fmt.Errorf("--quiet and --verbose are mutually exclusive")
+	case f.quiet:
+		level = slog.LevelWarn
+	case f.verbose:
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch f.format {
+	case "text":
+		handler = slog.NewTextHandler(stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", f.format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
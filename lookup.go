@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// domainDetail is everything known of one domain: what lookup prints and
+// /domains/{name} reports.
+type domainDetail struct {
+	domainRecord
+	// Registered is when the registrable domain was registered, if enrich
+	// --rdap found out.
+	Registered int64 `json:"registered,omitempty"`
+	// Rank is the place of the registrable domain in the popularity list of
+	// enrich --ranks, 0 when not on it or not looked up.
+	Rank int64 `json:"rank,omitempty"`
+	// Listed are the DNSBL zones listing the registrable domain, with their
+	// return codes, as enrich --dnsbl found.
+	Listed []string `json:"listed,omitempty"`
+	// DGAScore rates how machine generated the name looks (see dgaScore).
+	DGAScore int64 `json:"dga_score"`
+	// Liveness is what recheck last found of the name, if it ran.
+	Liveness   *liveness             `json:"liveness,omitempty"`
+	Types      []domainTypeRecord    `json:"types"`
+	Addresses  []domainAddressRecord `json:"addresses"`
+	Clients    []domainClientRecord  `json:"clients"`
+	Resolution *resolutionRecord     `json:"resolution,omitempty"`
+	Sources    []domainSourceRecord  `json:"sources"`
+}
+
+type domainTypeRecord struct {
+	Type      string `json:"type"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Count     int64  `json:"count"`
+}
+
+type domainAddressRecord struct {
+	Address   string   `json:"address"`
+	FirstSeen int64    `json:"first_seen"`
+	LastSeen  int64    `json:"last_seen"`
+	Count     int64    `json:"count"`
+	Country   string   `json:"country,omitempty"`
+	ASN       int64    `json:"asn,omitempty"`
+	ASOrg     string   `json:"as_org,omitempty"`
+	Listed    []string `json:"listed,omitempty"`
+}
+
+type domainClientRecord struct {
+	Client    string `json:"client"`
+	Hostname  string `json:"hostname,omitempty"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Count     int64  `json:"count"`
+}
+
+type resolutionRecord struct {
+	Cached        int64   `json:"cached"`
+	Forwarded     int64   `json:"forwarded"`
+	Blocked       int64   `json:"blocked"`
+	MeanLatencyMs float64 `json:"mean_latency_ms"`
+	MaxLatencyMs  int64   `json:"max_latency_ms"`
+}
+
+type domainSourceRecord struct {
+	Path      string `json:"path"`
+	Host      string `json:"host,omitempty"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Count     int64  `json:"count"`
+}
+
+// runLookup implements the lookup subcommand: everything known of a domain
+// and its subdomains, such as who queried them for what and what they
+// resolved to.
+func runLookup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	exact := fs.Bool("exact", false, "leave out the subdomains of the domain")
+	asJSON := fs.Bool("json", false, "print a JSON array of the domains rather than text")
+	naming := addClientNamesFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: lookup [flags] domain")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("lookup needs one domain")
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	details, err := loadDomainDetails(ctx, st, reverseDomainParts(canonicalDomain(fs.Arg(0))), !*exact, *naming)
+	if err != nil {
+		return err
+	}
+	if len(details) == 0 {
+		return fmt.Errorf("domain %s not found", fs.Arg(0))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(details)
+	}
+	for i, d := range details {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := writeDomainDetail(os.Stdout, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDomainDetails returns the stored domain reversed, and with subdomains
+// those under it, each after its parent, naming their clients from naming
+// (see addClientNamesFlag). Each domain's lists are ordered by count, most
+// first.
+func loadDomainDetails(ctx context.Context, st store, reversed string, subdomains bool, naming string) ([]domainDetail, error) {
+	matches := func(domain string) bool {
+		return domain == reversed || subdomains && strings.HasPrefix(domain, reversed+".")
+	}
+
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows = slices.DeleteFunc(rows, func(r domainRow) bool { return !matches(r.Domain) })
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	sortDomainRows(rows, "reversed", false)
+	details := make([]domainDetail, len(rows))
+	index := make(map[string]*domainDetail, len(rows))
+	for i, row := range rows {
+		details[i] = domainDetail{domainRecord: newDomainRecord(row), Types: []domainTypeRecord{},
+			Addresses: []domainAddressRecord{}, Clients: []domainClientRecord{}, Sources: []domainSourceRecord{}}
+		index[row.Domain] = &details[i]
+	}
+
+	types, err := st.loadDomainTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if d, ok := index[t.Domain]; ok {
+			d.Types = append(d.Types, domainTypeRecord{t.Type, t.FirstSeen, t.LastSeen, t.Count})
+		}
+	}
+
+	addresses, err := st.loadDomainAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := st.loadAddressInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results, err := st.loadDNSBL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listings := dnsblListings(results)
+	for _, a := range addresses {
+		if d, ok := index[a.Domain]; ok {
+			i := info[a.Address]
+			d.Addresses = append(d.Addresses, domainAddressRecord{a.Address, a.FirstSeen, a.LastSeen, a.Count, i.Country, i.ASN, i.ASOrg, listings[a.Address]})
+		}
+	}
+
+	clients, err := st.loadDomainClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var queriedBy []string
+	for _, c := range clients {
+		if d, ok := index[c.Domain]; ok {
+			d.Clients = append(d.Clients, domainClientRecord{Client: c.Client, FirstSeen: c.FirstSeen, LastSeen: c.LastSeen, Count: c.Count})
+			queriedBy = append(queriedBy, c.Client)
+		}
+	}
+	slices.Sort(queriedBy)
+	names, err := loadClientNames(ctx, st, naming, slices.Compact(queriedBy))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range index {
+		for i := range d.Clients {
+			d.Clients[i].Hostname = names[d.Clients[i].Client]
+		}
+	}
+
+	resolutions, err := st.loadDomainResolutions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for domain, r := range resolutions {
+		if d, ok := index[domain]; ok {
+			d.Resolution = &resolutionRecord{r.Cached, r.Forwarded, r.Blocked, r.meanLatencyMs(), r.MaxLatencyMs}
+		}
+	}
+
+	registrations, err := st.loadRegistrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scores, err := st.loadDomainScores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	checks, err := st.loadLiveness(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for domain, d := range index {
+		if score, ok := scores[domain]; ok {
+			d.DGAScore = score
+		} else {
+			d.DGAScore = dgaScore(d.Domain)
+		}
+		if l, ok := checks[domain]; ok {
+			d.Liveness = &l
+		}
+	}
+
+	ranks, err := st.loadRanks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range details {
+		registrable := registrableDomain(details[i].Domain)
+		details[i].Registered = registrations[registrable].RegisteredAt
+		details[i].Rank = ranks[registrable].Rank
+		details[i].Listed = listings[registrable]
+	}
+
+	sources, err := st.loadDomainSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		if d, ok := index[src.Domain]; ok {
+			d.Sources = append(d.Sources, domainSourceRecord{src.Path, src.Host, src.FirstSeen, src.LastSeen, src.Count})
+		}
+	}
+
+	for i := range details {
+		d := &details[i]
+		slices.SortFunc(d.Types, func(a, b domainTypeRecord) int { return cmpInt(b.Count, a.Count) })
+		slices.SortFunc(d.Addresses, func(a, b domainAddressRecord) int { return cmpInt(b.Count, a.Count) })
+		slices.SortFunc(d.Clients, func(a, b domainClientRecord) int { return cmpInt(b.Count, a.Count) })
+		slices.SortFunc(d.Sources, func(a, b domainSourceRecord) int { return cmpInt(b.Count, a.Count) })
+	}
+	return details, nil
+}
+
+// writeDomainDetail prints d as a summary followed by a table per list that
+// has entries.
+func writeDomainDetail(w io.Writer, d domainDetail) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, d.Domain)
+	fmt.Fprintf(tw, "  First seen\t%s\n", formatUnix(d.FirstSeen))
+	fmt.Fprintf(tw, "  Last seen\t%s\n", formatUnix(d.LastSeen))
+	fmt.Fprintf(tw, "  Queries\t%d\n", d.Count)
+	fmt.Fprintf(tw, "  DGA score\t%d\n", d.DGAScore)
+	if d.Rank != 0 {
+		fmt.Fprintf(tw, "  Rank\t%d\n", d.Rank)
+	}
+	if d.Registered != 0 {
+		fmt.Fprintf(tw, "  Registered\t%s\n", time.Unix(d.Registered, 0).Format("2006-01-02"))
+	}
+	if len(d.Listed) > 0 {
+		fmt.Fprintf(tw, "  Listed on\t%s\n", strings.Join(d.Listed, ", "))
+	}
+	if l := d.Liveness; l != nil {
+		fmt.Fprintf(tw, "  Rechecked\t%s at %s", l.Status, formatUnix(l.CheckedAt))
+		if len(l.Addresses) > 0 {
+			fmt.Fprintf(tw, " (%s)", strings.Join(l.Addresses, " "))
+		}
+		fmt.Fprintln(tw)
+	}
+	if r := d.Resolution; r != nil {
+		fmt.Fprintf(tw, "  Answers\t%d cached, %d forwarded (mean %.0f ms, max %d ms), %d blocked\n",
+			r.Cached, r.Forwarded, r.MeanLatencyMs, r.MaxLatencyMs, r.Blocked)
+	}
+	if len(d.Types) > 0 {
+		types := make([]string, len(d.Types))
+		for i, t := range d.Types {
+			types[i] = fmt.Sprintf("%s %d", t.Type, t.Count)
+		}
+		fmt.Fprintf(tw, "  Query types\t%s\n", strings.Join(types, ", "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(d.Addresses) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "  ADDRESS\tFIRST SEEN\tLAST SEEN\tANSWERS\tCOUNTRY\tNETWORK\tLISTED ON")
+		for _, a := range d.Addresses {
+			country, network := a.Country, addressInfo{ASN: a.ASN, ASOrg: a.ASOrg}.network()
+			if country == "" {
+				country = "-"
+			}
+			if network == "" {
+				network = "-"
+			}
+			listed := "-"
+			if len(a.Listed) > 0 {
+				listed = strings.Join(a.Listed, ", ")
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%d\t%s\t%s\t%s\n", a.Address, formatUnix(a.FirstSeen), formatUnix(a.LastSeen), a.Count, country, network, listed)
+		}
+	}
+	if len(d.Clients) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "  CLIENT\tFIRST SEEN\tLAST SEEN\tQUERIES")
+		for _, c := range d.Clients {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%d\n", clientLabel(c.Client, c.Hostname), formatUnix(c.FirstSeen), formatUnix(c.LastSeen), c.Count)
+		}
+	}
+	if len(d.Sources) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "  FILE\tHOST\tFIRST SEEN\tLAST SEEN\tQUERIES")
+		for _, s := range d.Sources {
+			host := s.Host
+			if host == "" {
+				host = "-"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\n", s.Path, host, formatUnix(s.FirstSeen), formatUnix(s.LastSeen), s.Count)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// runMaintain implements the maintain subcommand: check a SQLite database for
+// corruption, then rebuild its indexes, refresh the query planner statistics and
+// vacuum it. SQLite never gives freed pages back to the file system by itself,
+// so the file only shrinks after pruning once vacuumed.
+func runMaintain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("maintain", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	checkOnly := fs.Bool("check-only", false, "only run the integrity check")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if dbOpts.driver() != "sqlite" {
+		return fmt.Errorf("maintain works on SQLite databases, not %s", dbOpts.driver())
+	}
+	if _, err := os.Stat(dbOpts.Path); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// One connection for everything: VACUUM needs the database to itself.
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	if err := checkIntegrity(ctx, db); err != nil {
+		return err
+	}
+	fmt.Println("integrity check: ok")
+	if *checkOnly {
+		return nil
+	}
+
+	before := sqliteFileSize(dbOpts.Path)
+	for _, step := range []struct{ name, statement string }{
+		{"reindex", "REINDEX"},
+		{"analyze", "ANALYZE"},
+		{"vacuum", "VACUUM"},
+		// Fold the WAL back into the file, so its size shows what vacuuming saved.
+		{"checkpoint", "PRAGMA wal_checkpoint(TRUNCATE)"},
+	} {
+		start := time.Now()
+		if _, err := db.ExecContext(ctx, step.statement); err != nil {
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+		slog.Info("maintained database", "step", step.name, "elapsed", time.Since(start).Round(time.Millisecond))
+	}
+	after := sqliteFileSize(dbOpts.Path)
+	fmt.Printf("size: %s before, %s after (%s freed)\n",
+		shortBytes(float64(before)), shortBytes(float64(after)), shortBytes(float64(max(before-after, 0))))
+	return nil
+}
+
+// checkIntegrity runs PRAGMA integrity_check, returning the problems it finds
+// as an error.
+func checkIntegrity(ctx context.Context, db *database) error {
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []error
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, errors.New(result))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// sqliteFileSize returns the size of the database file at path with its
+// write-ahead log.
+func sqliteFileSize(path string) int64 {
+	var size int64
+	for _, name := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
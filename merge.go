@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mergeSource is a database given to the merge subcommand, as name=path or path.
+type mergeSource struct {
+	Name string // the file name without its extension unless given
+	Path string
+}
+
+func parseMergeSource(arg string) mergeSource {
+	if name, path, ok := strings.Cut(arg, "="); ok && name != "" && !strings.Contains(name, "/") {
+		return mergeSource{Name: name, Path: path}
+	}
+	base := filepath.Base(arg)
+	return mergeSource{Name: strings.TrimSuffix(base, filepath.Ext(base)), Path: arg}
+}
+
+// runMerge implements the merge subcommand: fold the aggregates of other
+// databases, such as those of several routers, into --db. Timestamps and counts
+// merge as they do when parsing. Checkpoints are not merged, as they name files
+// on the host that parsed them.
+func runMerge(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	sourceDriver := fs.String("source-driver", "", "storage `driver` of the source databases (default: inferred from each)")
+	tag := fs.Bool("tag-clients", false, "record clients as client@source, so the same address on different networks stays apart")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: merge [flags] [name=]source.db...")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("merge needs at least one source database")
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	target, _ := dbOpts.localPath()
+	for _, arg := range fs.Args() {
+		src := parseMergeSource(arg)
+		o := dbOptions{Path: src.Path, Driver: *sourceDriver, Timeout: dbOpts.Timeout, BatchSize: dbOpts.BatchSize}
+		if path, local := o.localPath(); local {
+			if sameFile(path, target) {
+				return fmt.Errorf("%s is the --db being merged into", src.Path)
+			}
+			if _, err := os.Stat(path); err != nil {
+				return err
+			}
+		}
+		if err := mergeDatabase(ctx, st, *dbOpts, src, o, *tag); err != nil {
+			return fmt.Errorf("merging %s: %w", src.Path, err)
+		}
+	}
+	return nil
+}
+
+// mergeDatabase folds everything aggregated in the database opened with o into st.
+func mergeDatabase(ctx context.Context, st store, dbOpts dbOptions, src mergeSource, o dbOptions, tag bool) error {
+	from, err := openStore(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := from.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	domains := make(map[string]domainTimes, len(rows))
+	for _, r := range rows {
+		mergeInto(domains, r.Domain, domainTimes{FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Count: r.Count})
+	}
+
+	clientRows, err := from.loadDomainClients(ctx)
+	if err != nil {
+		return err
+	}
+	clients := make(map[domainClient]domainTimes, len(clientRows))
+	for _, r := range clientRows {
+		key := r.domainClient
+		if tag {
+			key.Client += "@" + src.Name
+		}
+		mergeInto(clients, key, r.domainTimes)
+	}
+
+	hourRows, err := from.loadDomainHours(ctx, 0)
+	if err != nil {
+		return err
+	}
+	hours := make(map[domainHour]int64, len(hourRows))
+	for _, h := range hourRows {
+		hours[h.domainHour] += h.Count
+	}
+
+	resolutions, err := from.loadDomainResolutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	sourceRows, err := from.loadDomainSources(ctx)
+	if err != nil {
+		return err
+	}
+	sources := make(sourceDomains)
+	for _, r := range sourceRows {
+		mergeInto(sources.of(r.inputSource), r.Domain, r.domainTimes)
+	}
+
+	typeRows, err := from.loadDomainTypes(ctx)
+	if err != nil {
+		return err
+	}
+	types := make(map[domainType]domainTimes, len(typeRows))
+	for _, r := range typeRows {
+		mergeInto(types, r.domainType, r.domainTimes)
+	}
+
+	addressRows, err := from.loadDomainAddresses(ctx)
+	if err != nil {
+		return err
+	}
+	addresses := make(map[domainAddress]domainTimes, len(addressRows))
+	for _, r := range addressRows {
+		mergeInto(addresses, r.domainAddress, r.domainTimes)
+	}
+
+	deviceRows, err := from.loadDevices(ctx)
+	if err != nil {
+		return err
+	}
+	devices := make(map[device]domainTimes, len(deviceRows))
+	for _, r := range deviceRows {
+		key := r.device
+		if tag {
+			key.Address += "@" + src.Name
+		}
+		mergeInto(devices, key, r.domainTimes)
+	}
+
+	info, err := from.loadAddressInfo(ctx)
+	if err != nil {
+		return err
+	}
+	registrations, err := from.loadRegistrations(ctx)
+	if err != nil {
+		return err
+	}
+	ranks, err := from.loadRanks(ctx)
+	if err != nil {
+		return err
+	}
+	checks, err := from.loadLiveness(ctx)
+	if err != nil {
+		return err
+	}
+	listings, err := from.loadDNSBL(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := st.saveDomains(ctx, domains); err != nil {
+		return err
+	}
+	if err := st.saveDomainClients(ctx, clients); err != nil {
+		return err
+	}
+	if err := st.saveDomainHours(ctx, hours); err != nil {
+		return err
+	}
+	if err := st.saveDomainResolutions(ctx, resolutions); err != nil {
+		return err
+	}
+	if err := st.saveDomainSources(ctx, sources); err != nil {
+		return err
+	}
+	if err := st.saveDomainTypes(ctx, types); err != nil {
+		return err
+	}
+	if err := st.saveDomainAddresses(ctx, addresses); err != nil {
+		return err
+	}
+	if err := st.saveDomainScores(ctx, scoreDomains(domains)); err != nil {
+		return err
+	}
+	if err := st.saveDevices(ctx, devices); err != nil {
+		return err
+	}
+	if err := st.saveAddressInfo(ctx, info); err != nil {
+		return err
+	}
+	if err := st.saveRegistrations(ctx, registrations); err != nil {
+		return err
+	}
+	if err := st.saveRanks(ctx, ranks); err != nil {
+		return err
+	}
+	if err := st.saveLiveness(ctx, checks); err != nil {
+		return err
+	}
+	if err := st.saveDNSBL(ctx, listings); err != nil {
+		return err
+	}
+	slog.Info("merged database", "path", src.Path, "source", src.Name,
+		"domains", len(domains), "client_rows", len(clients), "hour_rows", len(hours))
+	return nil
+}
+
+// sameFile reports whether a and b name the same existing file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricsFlagUsage = "serve Prometheus metrics at http://`address`/metrics (e.g. :9550)"
+
+// durationBuckets are the upper bounds, in seconds, of the duration histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram counts observations in buckets with explicit upper bounds.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative, then above the last bound
+	sum    float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h histogram) count() uint64 {
+	var n uint64
+	for _, c := range h.counts {
+		n += c
+	}
+	return n
+}
+
+// metricSet holds the counters and gauges a long-running command serves to
+// Prometheus or exports with OTLP. Apart from lines, which is read as it
+// grows, they are updated as the aggregated queries are saved.
+type metricSet struct {
+	lines *uint64 // the aggregator's linesProcessed
+	start time.Time
+
+	mu         sync.Mutex
+	rejected   map[string]uint64 // by reason
+	queryTypes map[string]uint64
+	answers    resolution
+	domains    int // stored domains, new ones included, when tracked
+	newDomains uint64
+	tracked    bool // whether domains and newDomains are known
+	flushes    uint64
+	lastFlush  time.Time
+	writes     histogram // seconds per save to the database
+	files      histogram // seconds per input file parsed
+}
+
+// newMetricSet returns metrics for the lines added to agg, and makes agg count
+// query types.
+func newMetricSet(agg *aggregator) *metricSet {
+	agg.queryTypes = make(map[string]int64)
+	return &metricSet{
+		lines:      &agg.linesProcessed,
+		start:      time.Now(),
+		rejected:   make(map[string]uint64),
+		queryTypes: make(map[string]uint64),
+		writes:     newHistogram(durationBuckets),
+		files:      newHistogram(durationBuckets),
+	}
+}
+
+// observeRejects counts the lines rejected since rejects was last flushed. It
+// is a no-op on nil metrics.
+func (m *metricSet) observeRejects(rejects *rejectLog) {
+	if m == nil {
+		return
+	}
+	rejects.mu.Lock()
+	defer rejects.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for reason, n := range rejects.counts {
+		m.rejected[reason] += uint64(n)
+	}
+}
+
+// observeBatch counts what agg holds. It must be called before agg is saved,
+// and is a no-op on nil metrics.
+func (m *metricSet) observeBatch(agg *aggregator) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for typ, n := range agg.queryTypes {
+		m.queryTypes[typ] += uint64(n)
+	}
+	for _, r := range agg.resolutions {
+		m.answers = m.answers.plus(r)
+	}
+}
+
+// observeDomains records fresh, the new domains of a batch, and domains, the
+// number stored along with them. Commands that do not track new domains do
+// not call it, and leave both metrics out. It is a no-op on nil metrics.
+func (m *metricSet) observeDomains(fresh []newDomain, domains int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.domains = domains
+	m.newDomains += uint64(len(fresh))
+	m.tracked = true
+}
+
+// observeWrite records a save to the database that took d. It is a no-op on
+// nil metrics.
+func (m *metricSet) observeWrite(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushes++
+	m.lastFlush = time.Now()
+	m.writes.observe(d.Seconds())
+}
+
+// observeFile records an input file parsed in d. It is a no-op on nil metrics.
+func (m *metricSet) observeFile(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files.observe(d.Seconds())
+}
+
+type metricKind int
+
+const (
+	counterMetric metricKind = iota
+	gaugeMetric
+	histogramMetric
+)
+
+// metricFamily is a metric as both Prometheus and OTLP see it. Counters and
+// gauges have a value per label value, or one value, under "", without a label.
+type metricFamily struct {
+	name   string // without the _total suffix of Prometheus counters
+	help   string
+	unit   string // UCUM, as OTLP has it
+	kind   metricKind
+	label  string
+	values map[string]float64
+	hist   histogram
+}
+
+// families returns a snapshot of the metrics.
+func (m *metricSet) families() []metricFamily {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	single := func(v float64) map[string]float64 { return map[string]float64{"": v} }
+	byLabel := func(counts map[string]uint64) map[string]float64 {
+		values := make(map[string]float64, len(counts))
+		for k, n := range counts {
+			values[k] = float64(n)
+		}
+		return values
+	}
+	families := []metricFamily{
+		{name: "dnsmasq_parse_lines", help: "Log lines read.", unit: "{line}", kind: counterMetric,
+			values: single(float64(atomic.LoadUint64(m.lines)))},
+		{name: "dnsmasq_parse_rejected_lines", help: "Log lines that could not be parsed, by reason.", unit: "{line}", kind: counterMetric,
+			label: "reason", values: byLabel(m.rejected)},
+		{name: "dnsmasq_parse_queries", help: "Queries saved, by record type.", unit: "{query}", kind: counterMetric,
+			label: "type", values: byLabel(m.queryTypes)},
+		{name: "dnsmasq_parse_answers", help: "Queries answered from the cache, forwarded upstream or blocked.", unit: "{query}", kind: counterMetric,
+			label: "how", values: map[string]float64{
+				"cached":    float64(m.answers.Cached),
+				"forwarded": float64(m.answers.Forwarded),
+				"blocked":   float64(m.answers.Blocked),
+			}},
+		{name: "dnsmasq_parse_flushes", help: "Saves to the database.", unit: "{flush}", kind: counterMetric,
+			values: single(float64(m.flushes))},
+	}
+	if m.tracked {
+		families = append(families,
+			metricFamily{name: "dnsmasq_parse_domains", help: "Unique domains in the database.", unit: "{domain}", kind: gaugeMetric,
+				values: single(float64(m.domains))},
+			metricFamily{name: "dnsmasq_parse_new_domains", help: "Domains seen for the first time.", unit: "{domain}", kind: counterMetric,
+				values: single(float64(m.newDomains))})
+	}
+	if !m.lastFlush.IsZero() {
+		families = append(families, metricFamily{name: "dnsmasq_parse_last_flush_timestamp_seconds", help: "When the database was last saved to, in seconds since the epoch.", unit: "s", kind: gaugeMetric,
+			values: single(float64(m.lastFlush.Unix()))})
+	}
+	families = append(families, metricFamily{name: "dnsmasq_parse_db_write_seconds", help: "Time taken to save to the database.", unit: "s", kind: histogramMetric,
+		hist: cloneHistogram(m.writes)})
+	if m.files.count() > 0 {
+		families = append(families, metricFamily{name: "dnsmasq_parse_file_seconds", help: "Time taken to parse an input file.", unit: "s", kind: histogramMetric,
+			hist: cloneHistogram(m.files)})
+	}
+	return families
+}
+
+func cloneHistogram(h histogram) histogram {
+	h.counts = slices.Clone(h.counts)
+	return h
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *metricSet) write(w io.Writer) {
+	for _, f := range m.families() {
+		name, typ := f.name, "gauge"
+		switch f.kind {
+		case counterMetric:
+			name, typ = name+"_total", "counter"
+		case histogramMetric:
+			typ = "histogram"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, typ)
+
+		if f.kind == histogramMetric {
+			var cumulative uint64
+			for i, bound := range f.hist.bounds {
+				cumulative += f.hist.counts[i]
+				fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+			}
+			cumulative += f.hist.counts[len(f.hist.bounds)]
+			fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+			fmt.Fprintf(w, "%s_sum %g\n", name, f.hist.sum)
+			fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+			continue
+		}
+		if f.label == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(f.values[""]))
+			continue
+		}
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=%s} %s\n", name, f.label, metricLabel(k), formatMetricValue(f.values[k]))
+		}
+	}
+}
+
+// formatMetricValue formats v without an exponent, as the counts and
+// timestamps here are whole numbers.
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// metricLabel quotes s as a label value.
+func metricLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// serveMetrics serves m at http://addr/metrics until the returned server is
+// closed. The address is bound before it returns, so a port in use is
+// reported at start.
+func serveMetrics(addr string, m *metricSet) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("serving metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(w)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("serving metrics", "err", err)
+		}
+	}()
+	slog.Info("serving metrics", "address", ln.Addr().String())
+	return srv, nil
+}
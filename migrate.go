@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// schemaVersion is the schema version this build writes. Every change to the
+// tables of any dialect bumps it and adds the matching migration.
+const schemaVersion = 5
+
+// migration upgrades a database to Version. Migrations must be safe to run
+// again, since an interrupted upgrade repeats the steps it did not record.
+type migration struct {
+	Version int
+	Summary string
+	Apply   func(ctx context.Context, db *database) error
+}
+
+// migrateSchema applies the dialect's migrations newer than the version recorded
+// in schema_version, recording each one, and refuses databases written by a
+// newer version of the tool. Versions a dialect has no migration for (such as
+// those predating its support) are recorded without doing anything.
+func migrateSchema(ctx context.Context, db *database) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	err := db.QueryRowContext(ctx, "SELECT version FROM schema_version ORDER BY version DESC LIMIT 1").Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if current > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d); upgrade dnsmasq-parse", current, schemaVersion)
+	}
+
+	steps := make(map[int]migration)
+	for _, m := range db.dialect.migrations() {
+		steps[m.Version] = m
+	}
+	record := db.dialect.upsert("schema_version", []upsertColumn{
+		{"version", mergeKey},
+		{"applied_at", mergeMin},
+	}, 1)
+	for version := current + 1; version <= schemaVersion; version++ {
+		if m, ok := steps[version]; ok {
+			slog.Debug("migrating database", "version", version, "migration", m.Summary)
+			if err := m.Apply(ctx, db); err != nil {
+				return fmt.Errorf("migrating database to version %d (%s): %w", version, m.Summary, err)
+			}
+		}
+		if _, err := db.ExecContext(ctx, record, version, time.Now().Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasColumn reports whether a SQLite table has column.
+func hasColumn(ctx context.Context, db *database, table, column string) (bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// ensureColumn adds column to a SQLite table unless it already exists.
+func ensureColumn(ctx context.Context, db *database, table, column, definition string) error {
+	exists, err := hasColumn(ctx, db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// repairYearlessTimestamps fixes rows written by versions that stored syslog
+// timestamps in year 0, which show up as negative epoch values.
+func repairYearlessTimestamps(ctx context.Context, db *database) error {
+	now := time.Now()
+	fix := func(v int64) int64 {
+		if v >= 0 {
+			return v
+		}
+		return withLogYear(time.Unix(v, 0), now).Unix()
+	}
+
+	for _, table := range []string{"domains", "domain_clients"} {
+		rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT rowid, first_seen, last_seen FROM %s WHERE first_seen < 0 OR last_seen < 0", table))
+		if err != nil {
+			return err
+		}
+		type stale struct{ rowid, firstSeen, lastSeen int64 }
+		var found []stale
+		for rows.Next() {
+			var r stale
+			if err := rows.Scan(&r.rowid, &r.firstSeen, &r.lastSeen); err != nil {
+				rows.Close()
+				return err
+			}
+			found = append(found, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, r := range found {
+			if _, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET first_seen = ?, last_seen = ? WHERE rowid = ?", table),
+				fix(r.firstSeen), fix(r.lastSeen), r.rowid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
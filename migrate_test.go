@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tables as the builds before schema_version created them.
+const (
+	baselineDomains = `CREATE TABLE domains (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		domain TEXT UNIQUE NOT NULL,
+		first_seen INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+		last_seen INTEGER NOT NULL
+	)`
+	uncountedDomainClients = `CREATE TABLE domain_clients (
+		domain TEXT NOT NULL,
+		client TEXT NOT NULL,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (domain, client)
+	)`
+	offsetCheckpoints = `CREATE TABLE checkpoints (
+		path TEXT PRIMARY KEY,
+		inode INTEGER NOT NULL,
+		offset INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`
+	unblockedDomainResolution = `CREATE TABLE domain_resolution (
+		domain TEXT PRIMARY KEY,
+		cached INTEGER NOT NULL,
+		forwarded INTEGER NOT NULL,
+		replies INTEGER NOT NULL,
+		latency_ms INTEGER NOT NULL,
+		max_latency_ms INTEGER NOT NULL
+	)`
+)
+
+func TestMigrateSchema(t *testing.T) {
+	ctx := context.Background()
+	// Builds before the year was read from the log stored syslog times in year 0.
+	yearless := time.Date(0, time.March, 1, 12, 0, 0, 0, time.Local).Unix()
+
+	tests := []struct {
+		name       string
+		statements []string
+		applied    []int // versions already in schema_version, applied at time 1
+	}{
+		{"baseline", []string{
+			baselineDomains,
+			fmt.Sprintf("INSERT INTO domains (domain, first_seen, last_seen) VALUES ('com.example', %d, %d)", yearless, yearless),
+		}, nil},
+		{"first checkpoints", []string{
+			baselineDomains,
+			uncountedDomainClients,
+			offsetCheckpoints,
+			fmt.Sprintf("INSERT INTO domains (domain, first_seen, last_seen) VALUES ('com.example', %d, %d)", yearless, yearless),
+			fmt.Sprintf("INSERT INTO domain_clients VALUES ('com.example', '192.168.1.10', %d, %d)", yearless, yearless),
+			"INSERT INTO checkpoints VALUES ('/var/log/dnsmasq.log', 42, 1234, 1)",
+		}, nil},
+		{"version 4", []string{
+			unblockedDomainResolution,
+			"CREATE TABLE schema_version (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)",
+			"INSERT INTO schema_version VALUES (1, 1), (2, 1), (3, 1), (4, 1)",
+			"INSERT INTO domain_resolution VALUES ('com.example', 3, 1, 4, 80, 50)",
+		}, []int{1, 2, 3, 4}},
+	}
+	want := tableColumns(t, openTestDatabase(t, "fresh.db"))
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "old.db")
+		old, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range tt.statements {
+			if _, err := old.ExecContext(ctx, stmt); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		old.Close()
+
+		// Opening twice finds nothing left to do the second time.
+		for range 2 {
+			db, err := openDatabase(ctx, dbOptions{Path: path})
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if got := tableColumns(t, db); !maps.EqualFunc(got, want, slices.Equal) {
+				t.Errorf("%s: migrated tables\n%v\nwant those of a new database\n%v", tt.name, got, want)
+			}
+			for version, appliedAt := range schemaVersions(t, db) {
+				if slices.Contains(tt.applied, version) && appliedAt != 1 {
+					t.Errorf("%s: version %d applied again", tt.name, version)
+				}
+			}
+			if got := slices.Sorted(maps.Keys(schemaVersions(t, db))); !slices.Equal(got, []int{1, 2, 3, 4, 5}) {
+				t.Errorf("%s: schema versions %v, want 1 to %d", tt.name, got, schemaVersion)
+			}
+			checkMigratedRows(t, tt.name, db)
+			db.Close()
+		}
+	}
+}
+
+// checkMigratedRows checks that the rows written before the upgrade are
+// repaired, counted, indexed and readable under the new column names.
+func checkMigratedRows(t *testing.T, name string, db *database) {
+	t.Helper()
+	ctx := context.Background()
+	for _, table := range []string{"domains", "domain_clients"} {
+		var firstSeen, lastSeen, count int64
+		err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT first_seen, last_seen, count FROM %s WHERE domain = 'com.example'", table)).Scan(&firstSeen, &lastSeen, &count)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s: %v", name, table, err)
+		}
+		for _, v := range []int64{firstSeen, lastSeen} {
+			if seen := time.Unix(v, 0); seen.Year() < 2000 || seen.Month() != time.March || seen.Day() != 1 {
+				t.Errorf("%s: %s seen %v, want March 1 of a recent year", name, table, seen)
+			}
+		}
+		if count != 0 {
+			t.Errorf("%s: %s count %d, want 0", name, table, count)
+		}
+	}
+
+	var stored int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM domains").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	found, err := searchDomains(ctx, db, []string{"example"}, false)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if len(found) != stored {
+		t.Errorf("%s: search for example found %d of the %d stored domains", name, len(found), stored)
+	}
+
+	if c, ok, err := db.loadCheckpoint(ctx, "/var/log/dnsmasq.log"); err != nil {
+		t.Errorf("%s: %v", name, err)
+	} else if ok && (c.Inode != 42 || c.Offset != 1234) {
+		t.Errorf("%s: checkpoint %+v, want inode 42 at 1234", name, c)
+	}
+
+	var blocked int64 = -1
+	err = db.QueryRowContext(ctx, "SELECT blocked FROM domain_resolution WHERE domain = 'com.example'").Scan(&blocked)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err == nil && blocked != 0 {
+		t.Errorf("%s: blocked %d, want 0", name, blocked)
+	}
+}
+
+func TestMigrateSchemaNewer(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "newer.db")
+	db, err := openDatabase(ctx, dbOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO schema_version VALUES (?, 1)", schemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err := openDatabase(ctx, dbOptions{Path: path}); err == nil {
+		db.Close()
+		t.Fatal("opened a database with a newer schema version")
+	} else if !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("error %q does not say the schema is newer", err)
+	}
+}
+
+// tableColumns returns the names of the columns of each table of db, sorted,
+// as columns added by a migration come after those created with the table.
+func tableColumns(t *testing.T, db *database) map[string][]string {
+	t.Helper()
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	columns := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT name, type, pk FROM pragma_table_info('%s')", table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var name, typ string
+			var pk int
+			if err := rows.Scan(&name, &typ, &pk); err != nil {
+				t.Fatal(err)
+			}
+			columns[table] = append(columns[table], fmt.Sprintf("%s %s pk=%d", name, typ, pk))
+		}
+		rows.Close()
+		slices.Sort(columns[table])
+	}
+	return columns
+}
+
+// schemaVersions returns when each recorded schema version was applied.
+func schemaVersions(t *testing.T, db *database) map[int]int64 {
+	t.Helper()
+	rows, err := db.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	versions := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			t.Fatal(err)
+		}
+		versions[version] = appliedAt
+	}
+	return versions
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestMQTTPackets checks the packets mqttConn sends, byte by byte, against
+// MQTT 3.1.1, answering them as a broker would.
+func TestMQTTPackets(t *testing.T) {
+	tests := []struct {
+		name  string
+		send  func(c *mqttConn) error
+		want  []byte
+		reply []byte
+	}{
+		{"CONNECT", func(c *mqttConn) error { return c.connect("dnsmasq-parse-test", nil) },
+			append([]byte{0x10, 30, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 18}, "dnsmasq-parse-test"...),
+			[]byte{0x20, 2, 0, 0}},
+		{"CONNECT with a user", func(c *mqttConn) error { return c.connect("id", url.User("u")) },
+			[]byte{0x10, 17, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x82, 0, 60, 0, 2, 'i', 'd', 0, 1, 'u'},
+			[]byte{0x20, 2, 0, 0}},
+		{"CONNECT with a user and password", func(c *mqttConn) error { return c.connect("id", url.UserPassword("u", "pw")) },
+			[]byte{0x10, 21, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xc2, 0, 60, 0, 2, 'i', 'd', 0, 1, 'u', 0, 2, 'p', 'w'},
+			[]byte{0x20, 2, 0, 0}},
+		{"PUBLISH at QoS 0", func(c *mqttConn) error { return c.publish(mqttMessage{"t/new_domain", []byte("{}"), false}, 0) },
+			append([]byte{0x30, 16, 0, 12}, "t/new_domain{}"...),
+			nil},
+		{"retained PUBLISH", func(c *mqttConn) error { return c.publish(mqttMessage{"t/client/a", []byte("{}"), true}, 0) },
+			append([]byte{0x31, 14, 0, 10}, "t/client/a{}"...),
+			nil},
+		{"PUBLISH at QoS 1", func(c *mqttConn) error { return c.publish(mqttMessage{"t", []byte("x"), false}, 1) },
+			[]byte{0x32, 6, 0, 1, 't', 0, 1, 'x'},
+			[]byte{0xd0, 0, 0x40, 2, 0, 1}}, // a stray PINGRESP first, then the PUBACK
+		{"second PUBLISH at QoS 1", func(c *mqttConn) error { return c.publish(mqttMessage{"t", []byte("x"), false}, 1) },
+			[]byte{0x32, 6, 0, 1, 't', 0, 2, 'x'},
+			[]byte{0x40, 2, 0, 2}},
+		{"PUBLISH over two length bytes", func(c *mqttConn) error {
+			return c.publish(mqttMessage{"t", []byte(strings.Repeat("x", 200)), false}, 0)
+		},
+			append([]byte{0x30, 0xcb, 0x01, 0, 1, 't'}, strings.Repeat("x", 200)...),
+			nil},
+		{"PINGREQ", func(c *mqttConn) error { return c.ping() },
+			[]byte{0xc0, 0},
+			[]byte{0xd0, 0}},
+		{"DISCONNECT", func(c *mqttConn) error { c.disconnect(); return nil },
+			[]byte{0xe0, 0},
+			nil},
+	}
+
+	client, broker := net.Pipe()
+	defer broker.Close()
+	c := &mqttConn{conn: client, r: bufio.NewReader(client)}
+	for _, tt := range tests {
+		errc := make(chan error, 1)
+		go func() { errc <- tt.send(c) }()
+
+		got := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(broker, got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: sent\n% x\nwant\n% x", tt.name, got, tt.want)
+		}
+		if tt.reply != nil {
+			if _, err := broker.Write(tt.reply); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	for code, want := range map[byte]string{
+		4: "connection refused: bad user name or password",
+		9: "connection refused: code 9",
+	} {
+		client, broker := net.Pipe()
+		go func() {
+			io.CopyN(io.Discard, broker, 14) // the CONNECT
+			broker.Write([]byte{0x20, 2, 0, code})
+		}()
+		c := &mqttConn{conn: client, r: bufio.NewReader(client)}
+		if err := c.connect("", nil); err == nil || err.Error() != want {
+			t.Errorf("CONNACK code %d: %v, want %s", code, err, want)
+		}
+		broker.Close()
+	}
+}
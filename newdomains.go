@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// newDomain is a domain seen for the first time.
+type newDomain struct {
+	Domain    string    `json:"domain"`
+	Client    string    `json:"client,omitempty"` // the first client to query it, when logged
+	FirstSeen time.Time `json:"first_seen"`
+	Listed    []string  `json:"listed,omitempty"` // DNSBL listings of its registrable domain, when tail --dnsbl is set
+}
+
+// newDomainTracker tells the domains never seen before from the rest: those
+// the database did not have at start and no earlier batch had.
+type newDomainTracker struct {
+	seen map[string]bool // reversed domains stored or already reported
+}
+
+// loadNewDomainTracker loads the domains stored in st, which are not new.
+func loadNewDomainTracker(ctx context.Context, st store, dbOpts dbOptions) (*newDomainTracker, error) {
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(loadCtx)
+	if err != nil {
+		return nil, fmt.Errorf("loading domains: %w", err)
+	}
+	seen := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		seen[r.Domain] = true
+	}
+	return &newDomainTracker{seen: seen}, nil
+}
+
+// observe returns the domains of agg never seen before, the earliest first. It
+// must be called before agg is saved, and returns nil on a nil tracker.
+func (t *newDomainTracker) observe(agg *aggregator) []newDomain {
+	if t == nil {
+		return nil
+	}
+	var fresh []newDomain
+	for domain, times := range agg.domains {
+		if t.add(domain) {
+			fresh = append(fresh, newDomain{Domain: domain, FirstSeen: time.Unix(times.FirstSeen, 0)})
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+	first := make(map[string]domainClientRow)
+	for key, times := range agg.perClient {
+		if f, ok := first[key.Domain]; !ok || times.FirstSeen < f.FirstSeen {
+			first[key.Domain] = domainClientRow{key, times}
+		}
+	}
+	for i := range fresh {
+		fresh[i].Client = first[fresh[i].Domain].Client
+		fresh[i].Domain = reverseDomainParts(fresh[i].Domain)
+	}
+	slices.SortFunc(fresh, func(a, b newDomain) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	return fresh
+}
+
+// add marks the reversed domain as seen, reporting whether it is new.
+func (t *newDomainTracker) add(reversed string) bool {
+	if t.seen[reversed] {
+		return false
+	}
+	t.seen[reversed] = true
+	return true
+}
+
+// known returns the number of domains stored or already reported, or 0 on a
+// nil tracker.
+func (t *newDomainTracker) known() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.seen)
+}
+
+// onlyNewOptions is --only-new: it tells the domains a parse adds to the
+// database from those it only updates, so the run reports the new ones and
+// exports nothing else. The known ones are saved as ever, last_seen and all.
+type onlyNewOptions struct {
+	Enabled bool
+
+	tracker *newDomainTracker
+	found   map[string]bool // reversed domains new to the database
+	fresh   []newDomain
+}
+
+// addOnlyNewFlag registers --only-new on fs.
+func addOnlyNewFlag(fs *flag.FlagSet) *onlyNewOptions {
+	o := &onlyNewOptions{}
+	fs.BoolVar(&o.Enabled, "only-new", false, "report the domains the database did not have before this run, and export only those; known domains are still updated")
+	return o
+}
+
+// load reads the domains stored in st before parsing, when enabled. It does
+// nothing for dry runs, which have no st and report new domains anyway.
+func (o *onlyNewOptions) load(ctx context.Context, st store, dbOpts dbOptions) error {
+	if !o.Enabled || st == nil {
+		return nil
+	}
+	tracker, err := loadNewDomainTracker(ctx, st, dbOpts)
+	if err != nil {
+		return err
+	}
+	o.tracker, o.found, o.fresh = tracker, make(map[string]bool), nil
+	slog.Info("loaded known domains", "domains", tracker.known())
+	return nil
+}
+
+// observe notes the new domains of agg. It must be called before agg is saved.
+func (o *onlyNewOptions) observe(agg *aggregator) {
+	if o == nil || o.tracker == nil {
+		return
+	}
+	for _, d := range o.tracker.observe(agg) {
+		o.found[reverseDomainParts(d.Domain)] = true
+		o.fresh = append(o.fresh, d)
+	}
+}
+
+// report logs the new domains, the earliest first.
+func (o *onlyNewOptions) report() {
+	if o == nil || o.tracker == nil {
+		return
+	}
+	slices.SortStableFunc(o.fresh, func(a, b newDomain) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	for _, d := range o.fresh {
+		slog.Info("new domain", "domain", d.Domain, "client", d.Client, "first_seen", d.FirstSeen.Format(time.DateTime))
+	}
+	slog.Info("new domains", "domains", len(o.fresh))
+}
+
+// limit restricts specs to the new domains, when enabled.
+func (o *onlyNewOptions) limit(specs []exportSpec) {
+	if o == nil || o.tracker == nil {
+		return
+	}
+	for i := range specs {
+		specs[i].Only = o.found
+	}
+}
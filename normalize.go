@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/idna"
+)
+
+// canonicalDomain returns domain in the form it is stored in: lower case,
+// without a trailing dot, and with internationalized labels in the ASCII
+// (punycode) form they travel in. Names the IDNA rules reject are only
+// lower-cased.
+func canonicalDomain(domain string) string {
+	if !needsCanonical(domain) {
+		return domain
+	}
+	if len(domain) > 1 {
+		domain = strings.TrimSuffix(domain, ".")
+	}
+	domain = strings.ToLower(domain)
+	if !isASCII(domain) {
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			domain = ascii
+		}
+	}
+	return domain
+}
+
+// canonicalReversed is canonicalDomain for a reversed domain.
+func canonicalReversed(reversed string) string {
+	if !needsCanonical(reversed) && !strings.HasPrefix(reversed, ".") {
+		return reversed
+	}
+	return reverseDomainParts(canonicalDomain(reverseDomainParts(reversed)))
+}
+
+// needsCanonical reports whether domain may differ from its canonical form,
+// without allocating.
+func needsCanonical[S ~string | ~[]byte](domain S) bool {
+	for i := 0; i < len(domain); i++ {
+		if c := domain[i]; 'A' <= c && c <= 'Z' || c >= 0x80 {
+			return true
+		}
+	}
+	return len(domain) > 1 && domain[len(domain)-1] == '.'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeCounts are the rows normalize rewrote, or would rewrite, per table.
+type normalizeCounts map[string]int64
+
+// runNormalizeDB implements the normalize-db subcommand: rewrite the domains
+// stored before parsing canonicalized them (see canonicalDomain), merging the
+// rows of names that differed only in case, a trailing dot or their encoding
+// as the upserts of a parse would have.
+func runNormalizeDB(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("normalize-db", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "count the rows to rewrite without changing anything")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if path, local := dbOpts.localPath(); local {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	var counts normalizeCounts
+	switch st := st.(type) {
+	case *database:
+		counts, err = st.normalize(ctx, *dryRun)
+	case *boltStore:
+		counts, err = st.normalize(ctx, *dryRun)
+	default:
+		err = errors.New("normalize-db needs a database")
+	}
+	if err != nil {
+		return err
+	}
+
+	verb := "rewrote"
+	if *dryRun {
+		verb = "would rewrite"
+	}
+	var total int64
+	for _, table := range slices.Sorted(maps.Keys(counts)) {
+		fmt.Printf("%s: %s %d rows\n", table, verb, counts[table])
+		total += counts[table]
+	}
+	if total == 0 {
+		fmt.Println("all domains are already in canonical form")
+	}
+	return nil
+}
+
+// normalizedTables are the tables keyed by reversed domain, with their columns
+// merged as when saving. The domain comes first, then the rest of the key.
+var normalizedTables = []struct {
+	table   string
+	columns []upsertColumn
+}{
+	{"domains", []upsertColumn{{"domain", mergeKey}, {"first_seen", mergeMin}, {"last_seen", mergeMax}, {"count", mergeAdd}}},
+	{"domain_clients", []upsertColumn{{"domain", mergeKey}, {"client", mergeKey}, {"first_seen", mergeMin}, {"last_seen", mergeMax}, {"count", mergeAdd}}},
+	{"domain_hours", []upsertColumn{{"domain", mergeKey}, {"hour", mergeKey}, {"count", mergeAdd}}},
+	{"domain_resolution", []upsertColumn{{"domain", mergeKey}, {"cached", mergeAdd}, {"forwarded", mergeAdd}, {"blocked", mergeAdd},
+		{"replies", mergeAdd}, {"latency_ms", mergeAdd}, {"max_latency_ms", mergeMax}}},
+	{"domain_sources", []upsertColumn{{"domain", mergeKey}, {"source_id", mergeKey}, {"first_seen", mergeMin}, {"last_seen", mergeMax}, {"count", mergeAdd}}},
+	{"domain_types", []upsertColumn{{"domain", mergeKey}, {"type", mergeKey}, {"first_seen", mergeMin}, {"last_seen", mergeMax}, {"count", mergeAdd}}},
+	{"domain_addresses", []upsertColumn{{"domain", mergeKey}, {"address", mergeKey}, {"first_seen", mergeMin}, {"last_seen", mergeMax}, {"count", mergeAdd}}},
+	{"domain_scores", []upsertColumn{{"domain", mergeKey}, {"score", mergeMax}}},
+}
+
+// normalize rewrites the non-canonical domains of every table in one
+// transaction, or with dryRun only counts their rows. The rows of a domain and
+// its variants are read, merged, deleted and inserted again merged; queries,
+// which are not merged, are renamed in place.
+func (db *database) normalize(ctx context.Context, dryRun bool) (normalizeCounts, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	counts := make(normalizeCounts)
+	for _, t := range normalizedTables {
+		variants, err := nonCanonical(ctx, tx, t.table, canonicalReversed)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %s: %w", t.table, err)
+		}
+		n, err := db.normalizeTable(ctx, tx, t.table, t.columns, variants, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %s: %w", t.table, err)
+		}
+		counts[t.table] = n
+	}
+
+	variants, err := nonCanonical(ctx, tx, "queries", canonicalDomain)
+	if err != nil {
+		return nil, fmt.Errorf("normalizing queries: %w", err)
+	}
+	for variant, canonical := range variants {
+		var n int64
+		if dryRun {
+			err = tx.QueryRowContext(ctx, db.rebind("SELECT COUNT(*) FROM queries WHERE domain = ?"), variant).Scan(&n)
+		} else if res, e := tx.ExecContext(ctx, db.rebind("UPDATE queries SET domain = ? WHERE domain = ?"), canonical, variant); e != nil {
+			err = e
+		} else {
+			n, err = res.RowsAffected()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("normalizing queries: %w", err)
+		}
+		counts["queries"] += n
+	}
+
+	if dryRun {
+		return counts, nil
+	}
+	return counts, tx.Commit()
+}
+
+// nonCanonical maps the domains of table that canonical changes to their
+// canonical form.
+func nonCanonical(ctx context.Context, tx *sql.Tx, table string, canonical func(string) string) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT domain FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	variants := make(map[string]string)
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		if c := canonical(domain); c != domain {
+			variants[domain] = c
+		}
+	}
+	return variants, rows.Err()
+}
+
+// normalizeTable merges the rows of the variant domains of table into those of
+// their canonical forms, returning the number of variant rows.
+func (db *database) normalizeTable(ctx context.Context, tx *sql.Tx, table string, columns []upsertColumn, variants map[string]string, dryRun bool) (int64, error) {
+	if len(variants) == 0 {
+		return 0, nil
+	}
+	// Every row of a canonical domain takes part, as variants merge into it.
+	affected := make(map[string]bool)
+	for variant, canonical := range variants {
+		affected[variant] = true
+		affected[canonical] = true
+	}
+	domains := slices.Sorted(maps.Keys(affected))
+
+	names := make([]string, len(columns))
+	keys := 0
+	for i, c := range columns {
+		names[i] = c.Name
+		if c.Merge == mergeKey {
+			keys++
+		}
+	}
+
+	// Read and merge by canonical key.
+	type mergedRow struct {
+		key    []any
+		values []int64
+	}
+	merged := make(map[string]*mergedRow)
+	var order []string
+	var variantRows int64
+	chunk := maxBindParams / 2
+	for batch := range slices.Chunk(domains, chunk) {
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE domain IN (%s)", strings.Join(names, ", "), table, placeholders(len(batch)))
+		rows, err := tx.QueryContext(ctx, db.rebind(query), stringArgs(batch)...)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			key := make([]any, keys)
+			values := make([]int64, len(columns)-keys)
+			dest := make([]any, len(columns))
+			for i := range key {
+				dest[i] = &key[i]
+			}
+			for i := range values {
+				dest[keys+i] = &values[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			for i, k := range key {
+				if b, ok := k.([]byte); ok {
+					key[i] = string(b)
+				}
+			}
+			domain := key[0].(string)
+			if c, ok := variants[domain]; ok {
+				key[0] = c
+				variantRows++
+			}
+			id := fmt.Sprintf("%#v", key)
+			m, ok := merged[id]
+			if !ok {
+				merged[id] = &mergedRow{key, values}
+				order = append(order, id)
+				continue
+			}
+			for i, v := range values {
+				switch columns[keys+i].Merge {
+				case mergeMin:
+					m.values[i] = min(m.values[i], v)
+				case mergeMax:
+					m.values[i] = max(m.values[i], v)
+				default:
+					m.values[i] += v
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if dryRun {
+		return variantRows, nil
+	}
+
+	for batch := range slices.Chunk(domains, chunk) {
+		query := fmt.Sprintf("DELETE FROM %s WHERE domain IN (%s)", table, placeholders(len(batch)))
+		if _, err := tx.ExecContext(ctx, db.rebind(query), stringArgs(batch)...); err != nil {
+			return 0, err
+		}
+	}
+	for batch := range slices.Chunk(order, maxBindParams/len(columns)) {
+		insert, _ := insertColumns(table, columns, len(batch), db.dialect)
+		args := make([]any, 0, len(batch)*len(columns))
+		for _, id := range batch {
+			m := merged[id]
+			args = append(args, m.key...)
+			for _, v := range m.values {
+				args = append(args, v)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, insert, args...); err != nil {
+			return 0, err
+		}
+	}
+	return variantRows, nil
+}
+
+// placeholders returns n comma-separated ? placeholders, for rebinding.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func stringArgs(values []string) []any {
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+// normalize rewrites the keys of every bucket whose domain is not canonical,
+// merging their values into the canonical key's, or with dryRun only counts
+// them. Keys start with the reversed domain, followed by a NUL when there is
+// more to them.
+func (s *boltStore) normalize(ctx context.Context, dryRun bool) (normalizeCounts, error) {
+	counts := make(normalizeCounts)
+	run := s.update
+	if dryRun {
+		run = func(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return s.db.View(fn)
+		}
+	}
+	mergeHours := func(stored, v []byte) []byte {
+		return binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(stored)+binary.BigEndian.Uint64(v))
+	}
+	mergeResolutions := func(stored, v []byte) []byte {
+		return encodeResolution(decodeResolution(stored).plus(decodeResolution(v)))
+	}
+	mergeTimesValue := func(stored, v []byte) []byte {
+		t, o := decodeTimes(stored), decodeTimes(v)
+		return encodeTimes(domainTimes{FirstSeen: min(t.FirstSeen, o.FirstSeen), LastSeen: max(t.LastSeen, o.LastSeen), Count: t.Count + o.Count})
+	}
+	mergeScores := func(stored, v []byte) []byte {
+		return encodeScore(max(decodeScore(stored), decodeScore(v)))
+	}
+	err := run(ctx, func(tx *bolt.Tx) error {
+		for _, bucket := range []struct {
+			name  []byte
+			merge func(stored, v []byte) []byte
+		}{
+			{boltDomains, mergeTimesValue},
+			{boltClients, mergeTimesValue},
+			{boltHours, mergeHours},
+			{boltResolution, mergeResolutions},
+			{boltSources, mergeTimesValue},
+			{boltTypes, mergeTimesValue},
+			{boltAddresses, mergeTimesValue},
+			{boltScores, mergeScores},
+		} {
+			b := tx.Bucket(bucket.name)
+			if b == nil {
+				continue
+			}
+			type rename struct{ from, to, value []byte }
+			var renames []rename
+			err := b.ForEach(func(k, v []byte) error {
+				domain, rest := k, []byte(nil)
+				if i := bytes.IndexByte(k, 0); i >= 0 {
+					domain, rest = k[:i], k[i:]
+				}
+				c := canonicalReversed(string(domain))
+				if c != string(domain) {
+					renames = append(renames, rename{slices.Clone(k), append([]byte(c), rest...), slices.Clone(v)})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			counts[string(bucket.name)] = int64(len(renames))
+			if dryRun {
+				continue
+			}
+			for _, r := range renames {
+				if err := b.Delete(r.from); err != nil {
+					return err
+				}
+				v := r.value
+				if stored := b.Get(r.to); stored != nil {
+					v = bucket.merge(stored, v)
+				}
+				if err := b.Put(r.to, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
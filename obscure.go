@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// obscureSummary is a registrable domain outside the top of the popularity
+// list, and what was seen under it.
+type obscureSummary struct {
+	Domain    string
+	Rank      int64 // 0 when not on the list at all
+	FirstSeen int64
+	LastSeen  int64
+	Queries   int64
+	Names     []string // queried names under Domain, forward, in order
+}
+
+// runObscure implements the obscure subcommand: the registrable domains
+// queried that are not among the most popular, as ranked by enrich --ranks.
+// What is left once the well-known domains are filtered out is where
+// anything unusual is.
+func runObscure(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("obscure", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	top := fs.Int64("top", 1000000, "leave out the domains ranked `n` or better")
+	since := fs.String("since", "", "only show domains last seen after this `time` (duration such as 24h or 7d, or a date)")
+	n := addLimitFlag(fs, 5, "list at most `n` queried names per domain (0 for all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	ranks, err := st.loadRanks(ctx)
+	if err != nil {
+		return err
+	}
+	if len(ranks) == 0 {
+		return errors.New("no ranks stored: run enrich --ranks first")
+	}
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	rows = slices.DeleteFunc(rows, func(r domainRow) bool { return r.LastSeen < cutoff })
+
+	domains, unchecked := summarizeObscure(rows, ranks, *top)
+	fmt.Printf("%d domains outside the top %d\n", len(domains), *top)
+	if unchecked > 0 {
+		fmt.Printf("%d domains not ranked yet: run enrich --ranks again\n", unchecked)
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tRANK\tFIRST SEEN\tLAST SEEN\tQUERIES\tNAMES")
+	for _, d := range domains {
+		names := d.Names
+		if *n > 0 && len(names) > *n {
+			names = append(slices.Clip(names[:*n]), fmt.Sprintf("(%d more)", len(d.Names)-*n))
+		}
+		rank := "-"
+		if d.Rank != 0 {
+			rank = fmt.Sprint(d.Rank)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", d.Domain, rank,
+			formatUnix(d.FirstSeen), formatUnix(d.LastSeen), d.Queries, strings.Join(names, " "))
+	}
+	return tw.Flush()
+}
+
+// summarizeObscure groups rows by registrable domain, keeping those ranked
+// worse than top or not at all, most recently first seen first; local names
+// are left out. It also counts the registrable domains with no stored rank,
+// which were not looked up yet.
+func summarizeObscure(rows []domainRow, ranks map[string]domainRank, top int64) ([]obscureSummary, int) {
+	byDomain := make(map[string]*obscureSummary)
+	unchecked := make(map[string]bool)
+	for _, row := range rows {
+		name := reverseDomainParts(row.Domain)
+		if !publicDomain(name) {
+			continue
+		}
+		domain := registrableDomain(name)
+		r, ok := ranks[domain]
+		if !ok {
+			unchecked[domain] = true
+			continue
+		}
+		if r.Rank != 0 && r.Rank <= top {
+			continue
+		}
+		d, ok := byDomain[domain]
+		if !ok {
+			d = &obscureSummary{Domain: domain, Rank: r.Rank, FirstSeen: row.FirstSeen, LastSeen: row.LastSeen}
+			byDomain[domain] = d
+		}
+		d.FirstSeen = min(d.FirstSeen, row.FirstSeen)
+		d.LastSeen = max(d.LastSeen, row.LastSeen)
+		d.Queries += row.Count
+		d.Names = append(d.Names, name)
+	}
+
+	domains := make([]obscureSummary, 0, len(byDomain))
+	for _, d := range byDomain {
+		slices.Sort(d.Names)
+		domains = append(domains, *d)
+	}
+	slices.SortFunc(domains, func(a, b obscureSummary) int {
+		if c := cmpInt(b.FirstSeen, a.FirstSeen); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return domains, len(unchecked)
+}
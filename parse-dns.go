@@ -2,364 +2,858 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"runtime"
+	"slices"
 	"strings"
-	"sync/atomic"
 	"time"
-
-	_ "modernc.org/sqlite"
+	"unicode"
+	"unicode/utf8"
 )
 
-func main() {
-	inputPath := "./dnsmasq.log"
-	//inputPath := "/var/log/dnsmasq.log"
-	dbPath := "unique_domains.db"
+// command is a subcommand of the tool.
+type command struct {
+	Name    string
+	Summary string
+	Run     func(ctx context.Context, args []string) error
+}
 
-	fmt.Printf("Parsing: %s\n", inputPath)
+var commands = []command{
+	{"parse", "parse log files into the database", runParse},
+	{"export", "write export files from the database", runExport},
+	{"tail", "follow a growing log file into the database", runTail},
+	{"daemon", "run tail as a service: syslog input, systemd notification and reload on SIGHUP", runDaemon},
+	{"forward", "follow a growing log file, sending it to a collect instance", runForward},
+	{"collect", "receive queries from forward over gRPC into the database", runCollect},
+	{"pcap", "take DNS queries and answers from capture files or a live interface into the database", runPcap},
+	{"stats", "summarize the database", runStats},
+	{"top", "show the most-queried domains", runTop},
+	{"histogram", "show query volume per hour or day", runHistogram},
+	{"report", "render an HTML or Markdown report", runReport},
+	{"clients", "summarize the activity of each client", runClients},
+	{"devices", "list the devices DHCP leased addresses to, with their host names and vendors", runDevices},
+	{"tui", "browse the database interactively in the terminal", runTUI},
+	{"digest", "mail a digest of new domains, top talkers and blocked queries", runDigest},
+	{"latency", "show cached vs forwarded answers and upstream latency", runLatency},
+	{"sources", "show which input files a domain was seen in", runSources},
+	{"lookup", "show everything known about a domain and its subdomains", runLookup},
+	{"search", "find the domains containing a substring", runSearch},
+	{"asns", "show the networks resolved addresses belong to, and new ones", runASNs},
+	{"registered", "show the newly registered domains queried", runRegistered},
+	{"obscure", "show the domains queried outside the most popular", runObscure},
+	{"dga", "show the domains queried whose names look machine generated", runDGA},
+	{"typosquats", "show the domains queried that imitate given domains or brands", runTyposquats},
+	{"recheck", "resolve the stored domains again to find the dead and sinkholed ones", runRecheck},
+	{"check", "show the domains queried that are on blocklists or threat feeds", runCheck},
+	{"listed", "show the domains and addresses listed on DNSBLs", runListed},
+	{"serve", "serve a web dashboard and read-only JSON API over the database", runServe},
+	{"enrich", "look up the networks of resolved addresses, the ranks and registration dates of domains, and DNSBL listings", runEnrich},
+	{"diff", "show domains new, gone or seen again since an older database", runDiff},
+	{"prune", "delete domains not seen for a while", runPrune},
+	{"normalize-db", "rewrite stored domains in canonical form, merging duplicates", runNormalizeDB},
+	{"maintain", "check, reindex, analyze and vacuum a SQLite database", runMaintain},
+	{"backup", "dump the database to a portable backup file", runBackup},
+	{"restore", "load a backup file into the database", runRestore},
+	{"merge", "merge other databases into the database", runMerge},
+	{"import", "import the query history of another tool, such as Pi-hole's FTL database", runImport},
+	{"bench", "measure parsing speed on a sample file", runBench},
+}
 
-	file, err := os.Open(inputPath)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+func main() {
+	args := os.Args[1:]
+
+	// Without a subcommand, parse and export in one go as earlier versions did.
+	run := runParseAndExport
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		run = nil
+		for _, c := range commands {
+			if c.Name == args[0] {
+				run = c.Run
+			}
+		}
+		if run == nil {
+			if args[0] != "help" {
+				fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+			}
+			usage()
+			os.Exit(2)
+		}
+		args = args[1:]
 	}
-	defer file.Close()
 
-	err = initDatabase(dbPath)
-	if err != nil {
-		fmt.Printf("Error initializing database: %v\n", err)
-		return
+	err := run(context.Background(), args)
+	if stopErr := stopProfiling(); stopErr != nil {
+		slog.Error("finishing profiles: " + stopErr.Error())
+	}
+	if stopErr := stopTelemetry(); stopErr != nil {
+		slog.Error("exporting telemetry: " + stopErr.Error())
 	}
-
-	domainTimesMap, err := loadDomainsFromDatabase(dbPath)
 	if err != nil {
-		fmt.Printf("Error loading domains from database: %v\n", err)
-		return
+		if !errors.Is(err, errInterrupted) {
+			slog.Error(err.Error())
+		}
+		os.Exit(exitCode(err))
 	}
+}
 
-	scanner := bufio.NewScanner(file)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nWith no command, parse and export are run together.\n"+
+		"Run '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
 
-	var linesProcessed uint64
+// defaultInputPath is parsed when no input files are given.
+const defaultInputPath = "./dnsmasq.log"
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		atomic.AddUint64(&linesProcessed, 1)
-		domain, timestamp := extractDomainAndTimestamp(line)
-		if domain != "" {
-			reversed := reverseDomainParts(domain)
-			current, exists := domainTimesMap[reversed]
-			if !exists {
-				current.FirstSeen = timestamp
-				current.LastSeen = timestamp
-			} else {
-				current.LastSeen = timestamp
-			}
+// Input files are read in chunks of scanBufferSize; lines longer than
+// maxLineLength stop the parse with an error.
+const (
+	scanBufferSize = 256 << 10
+	maxLineLength  = 1 << 20
+)
 
-			domainTimesMap[reversed] = current
-		}
-	}
+// parseOptions configures how input files are parsed.
+type parseOptions struct {
+	Clients       clientFilter
+	Rejects       string
+	DryRun        bool
+	Workers       int
+	ParallelFiles int // --parallel-files
+	Progress      string
+	PruneAfter    string // --prune-older-than
+	AlreadyParsed string // --already-parsed
+	Flush         *flushOptions
+	Queries       *queryOptions
+	ClickHouse    *clickhouseOptions
+	Anonymize     *anonymizeOptions
+	OnlyNew       *onlyNewOptions
+	Summary       *runSummary
+	InputFormat   string
+}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Error scanning: %v\n", err)
-		return
-	}
+// addParseFlags registers the parsing flags on fs.
+func addParseFlags(fs *flag.FlagSet) *parseOptions {
+	o := &parseOptions{}
+	fs.Var(&o.Clients, "client", clientFlagUsage)
+	fs.StringVar(&o.Rejects, "rejects", "", rejectsFlagUsage)
+	fs.BoolVar(&o.DryRun, "dry-run", false, "parse and report what would change without touching the database or exports")
+	fs.IntVar(&o.Workers, "workers", runtime.NumCPU(), "number of goroutines parsing lines (1 parses on the reading goroutine)")
+	fs.IntVar(&o.ParallelFiles, "parallel-files", 1, "read up to `n` input files at once, each parsed on its own reading goroutine rather than by --workers; for backfills of many rotated or compressed logs")
+	fs.StringVar(&o.Progress, "progress", "auto", progressFlagUsage)
+	fs.StringVar(&o.PruneAfter, "prune-older-than", "", pruneFlagUsage)
+	fs.StringVar(&o.AlreadyParsed, "already-parsed", "warn", alreadyParsedFlagUsage)
+	o.Flush = addFlushFlags(fs)
+	o.Queries = addQueryFlags(fs)
+	o.ClickHouse = addClickHouseFlags(fs)
+	o.Anonymize = addAnonymizeFlags(fs)
+	o.OnlyNew = addOnlyNewFlag(fs)
+	o.Summary = addSummaryFlag(fs)
+	fs.StringVar(&o.InputFormat, "input-format", "auto", inputFormatFlagUsage)
+	return o
+}
 
-	if err := saveDomainsToDatabase(dbPath, domainTimesMap); err != nil {
-		fmt.Printf("Error saving domains to database: %v\n", err)
-		return
+// runParse implements the parse subcommand.
+func runParse(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("parse", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	parse := addParseFlags(fs)
+	watch := addWatchFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
 	}
 
-	err = sortAndExportDatabase(dbPath)
-	if err != nil {
-		fmt.Printf("Error sorting and exporting database: %v\n", err)
-		return
+	if watch.Dir != "" {
+		if fs.NArg() > 0 {
+			return errors.New("--watch parses the files of its directory, not files given as arguments")
+		}
+		if parse.Summary.enabled() {
+			return errors.New("--summary-json summarizes a run to its end, which --watch never reaches")
+		}
+		return watchDirectory(ctx, *dbOpts, *parse, *watch)
 	}
-
-	fmt.Println("Process completed successfully.")
+	return parse.Summary.write(parseInputs(ctx, *dbOpts, inputPaths(fs), *parse))
 }
 
-type domainTimes struct {
-	FirstSeen int64
-	LastSeen  int64
-}
+// runExport implements the export subcommand.
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	export := addExportFlags(fs)
+	queries := fs.String("queries-parquet", "", "also write the queries table (see parse --queries) to `path` as Parquet; - writes it to standard output")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *queries == stdinPath && export.output == stdinPath {
+		return errors.New("--queries-parquet - and --output - cannot share standard output")
+	}
 
-func initDatabase(dbPath string) error {
-	db, err := sql.Open("sqlite", dbPath)
+	specs, err := export.specs()
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS domains (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		domain TEXT UNIQUE NOT NULL,
-		first_seen INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
-		last_seen INTEGER NOT NULL
-	);
-	`
+	if *queries == "" {
+		return exportDatabase(ctx, *dbOpts, *clients, specs)
+	}
 
-	_, err = db.Exec(createTableSQL)
+	st, err := openStore(ctx, *dbOpts)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	defer st.Close()
+	if err := exportStore(ctx, st, *dbOpts, *clients, specs); err != nil {
+		return err
+	}
+	return exportQueries(ctx, st, *dbOpts, *clients, *queries)
 }
 
-func loadDomainsFromDatabase(dbPath string) (map[string]domainTimes, error) {
-	db, err := sql.Open("sqlite", dbPath)
-	if err != nil {
-		return nil, err
+// runParseAndExport is the classic single-shot run: parse, then export.
+func runParseAndExport(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	dbOpts := addDBFlag(fs)
+	noDB := fs.Bool("no-db", false, "keep the aggregates in memory and write the exports directly, without touching --db")
+	parse := addParseFlags(fs)
+	export := addExportFlags(fs)
+	if err := parseFlags(fs, args, "parse", "export"); err != nil {
+		return err
+	}
+	if parse.Summary.path == stdinPath && export.output == stdinPath {
+		return errors.New("--summary-json - and --output - cannot share standard output")
 	}
-	defer db.Close()
+	defer func() { err = parse.Summary.write(err) }()
 
-	rows, err := db.Query("SELECT domain, first_seen, last_seen FROM domains")
+	specs, err := export.specs()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	m := make(map[string]domainTimes)
-	for rows.Next() {
-		var domain string
-		var firstSeen, lastSeen int64
-		if err := rows.Scan(&domain, &firstSeen, &lastSeen); err != nil {
-			return nil, err
+	if *noDB {
+		if parse.DryRun {
+			return errors.New("--dry-run has nothing to compare against with --no-db")
+		}
+		if parse.OnlyNew.Enabled {
+			return errors.New("--only-new has nothing to compare against with --no-db")
+		}
+		st := newMemoryStore()
+		if err := parseInto(ctx, st, *dbOpts, inputPaths(fs), *parse); err != nil {
+			return err
+		}
+		if err := exportStore(ctx, st, *dbOpts, parse.Clients, specs); err != nil {
+			return fmt.Errorf("writing exports: %w", err)
 		}
-		m[domain] = domainTimes{FirstSeen: firstSeen, LastSeen: lastSeen}
+		slog.Info("process completed successfully")
+		return nil
+	}
+
+	if err := parseInputs(ctx, *dbOpts, inputPaths(fs), *parse); err != nil {
+		return err
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	if parse.DryRun {
+		slog.Info("dry run: skipping exports")
+		return nil
 	}
-	return m, nil
-}
 
-func extractDomainAndTimestamp(line string) (string, int64) {
-	if len(line) < 15 {
-		fmt.Printf("Line is too short: %s\n", line)
-		return "", 0
+	parse.OnlyNew.limit(specs)
+	if err := exportDatabase(ctx, *dbOpts, parse.Clients, specs); err != nil {
+		return fmt.Errorf("exporting database: %w", err)
 	}
 
-	timestampPart := line[:15]
-	domainPart := line[15:]
+	slog.Info("process completed successfully")
+	return nil
+}
 
-	layout := "Jan _2 15:04:05"
-	timestamp, err := time.ParseInLocation(layout, timestampPart, time.Local)
+// exportDatabase loads the rows to export from the database and writes every spec.
+func exportDatabase(ctx context.Context, dbOpts dbOptions, clients clientFilter, specs []exportSpec) error {
+	st, err := openStore(ctx, dbOpts)
 	if err != nil {
-		fmt.Printf("Error parsing timestamp: %v\n", err)
-		return "", 0
+		return err
 	}
+	defer st.Close()
+	return exportStore(ctx, st, dbOpts, clients, specs)
+}
 
-	// fmt.Printf("Timestamp: %d\n", timestamp.Unix())
-
-	parts := strings.Fields(domainPart)
-	for i, part := range parts {
-		if strings.HasPrefix(part, "query[") && i+1 < len(parts) {
-			domain := parts[i+1]
-			// fmt.Printf("Found domain: %s\n", domain)
-			return domain, timestamp.Unix()
-		}
+// exportStore loads the rows to export from st and writes every spec.
+func exportStore(ctx context.Context, st store, dbOpts dbOptions, clients clientFilter, specs []exportSpec) error {
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	domains, err := loadExportRows(loadCtx, st, clients)
+	if err != nil {
+		return withExitCode(exitDatabase, err)
 	}
+	return writeExports(ctx, domains, specs)
+}
 
-	return "", 0
+// inputPaths returns the positional arguments of fs, or the default log file.
+// "-" reads standard input.
+func inputPaths(fs *flag.FlagSet) []string {
+	if fs.NArg() == 0 {
+		return []string{defaultInputPath}
+	}
+	return fs.Args()
 }
 
-func reverseDomainParts(domain string) string {
-	parts := strings.Split(domain, ".")
-	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
-		parts[i], parts[j] = parts[j], parts[i]
+// parseInputs opens the store (unless this is a dry run) and parses inputs into it.
+func parseInputs(ctx context.Context, dbOpts dbOptions, inputs []string, opts parseOptions) error {
+	var st store
+	if !opts.DryRun {
+		var err error
+		st, err = openStore(ctx, dbOpts)
+		if err != nil {
+			return fmt.Errorf("initializing database: %w", err)
+		}
+		defer st.Close()
 	}
-	return strings.Join(parts, ".")
+	return parseInto(ctx, st, dbOpts, inputs, opts)
 }
 
-func saveDomainsToDatabase(dbPath string, domains map[string]domainTimes) error {
-	db, err := sql.Open("sqlite", dbPath)
+// parseInto parses each input file and saves the aggregated domains to st. On
+// SIGINT or SIGTERM it stops reading, saves what it has along with checkpoints
+// for the files it reached, and returns errInterrupted; the next run resumes
+// from there. st is nil for dry runs.
+func parseInto(ctx context.Context, st store, dbOpts dbOptions, inputs []string, opts parseOptions) (err error) {
+	if opts.PruneAfter != "" {
+		if _, err := parseSince(opts.PruneAfter, time.Now()); err != nil {
+			return err
+		}
+	}
+	switch opts.AlreadyParsed {
+	case "skip", "warn", "parse":
+	default:
+		return fmt.Errorf("unknown --already-parsed value %q", opts.AlreadyParsed)
+	}
+	format, err := inputFormat(opts.InputFormat)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-
-	tx, err := db.Begin()
+	rejects, err := newRejectLog(opts.Rejects)
 	if err != nil {
 		return err
 	}
+	defer rejects.close()
 
-	stmt, err := tx.Prepare(`
-		INSERT INTO domains (domain, first_seen, last_seen)
-		VALUES (?, ?, ?)
-		ON CONFLICT(domain) DO UPDATE SET
-			first_seen = MIN(first_seen, excluded.first_seen),
-			last_seen = MAX(last_seen, excluded.last_seen)
-	`)
-	if err != nil {
-		tx.Rollback()
+	ctx, parseSpan := startSpan(ctx, "parse", "inputs", len(inputs))
+	defer func() { parseSpan.end(err) }()
+
+	// Reading stops on a signal, but saving what was read still runs to completion.
+	readCtx, stop := notifyInterrupt(ctx)
+	defer stop()
+
+	agg := newAggregator(opts.Clients, rejects)
+	agg.parse = format.at(time.Now())
+	if err := opts.Queries.enable(agg, st); err != nil {
 		return err
 	}
-	defer stmt.Close()
-
-	for domain, times := range domains {
-		if _, err := stmt.Exec(domain, times.FirstSeen, times.LastSeen); err != nil {
-			tx.Rollback()
+	if err := opts.Anonymize.enable(agg); err != nil {
+		return err
+	}
+	if err := opts.OnlyNew.load(ctx, st, dbOpts); err != nil {
+		return err
+	}
+	if err := opts.Summary.begin(ctx, st, dbOpts); err != nil {
+		return err
+	}
+	defer opts.Summary.count(agg, rejects)
+	var m *metricSet
+	if telemetry != nil {
+		m = newMetricSet(agg)
+		telemetry.exportMetrics(m)
+	}
+	if opts.ClickHouse.URL != "" && !opts.DryRun {
+		sink, err := startClickHouseSink(ctx, *opts.ClickHouse)
+		if err != nil {
 			return err
 		}
+		defer sink.close()
+		agg.sink = sink
 	}
 
-	if err := tx.Commit(); err != nil {
-		return err
+	parallel := opts.ParallelFiles > 1 && len(inputs) > 1
+	var lines lineSink = agg
+	var pool *parsePool
+	if opts.Workers > 1 && !parallel {
+		pool = startParsePool(agg, opts.Workers)
+		defer pool.wait()
+		lines = pool
 	}
 
-	return nil
-}
-
-func sortAndExportDatabase(dbPath string) error {
-	db, err := sql.Open("sqlite", dbPath)
+	prog, err := startProgress(opts.Progress, inputs)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer prog.close()
 
-	rows, err := db.Query("SELECT domain, first_seen, last_seen FROM domains ORDER BY domain ASC")
-	if err != nil {
-		return err
+	// Checkpoints are kept for files only: stdin cannot be resumed.
+	var reached []checkpoint
+	withCurrent := func(current checkpoint) []checkpoint {
+		if current.Path == stdinPath {
+			return reached
+		}
+		return append(slices.Clone(reached), current)
 	}
-	defer rows.Close()
 
-	err = writeRowsToFile(rows, "unique_domains.txt")
+	// With --flush-every or --max-memory, save the aggregates part-way together
+	// with checkpoints, so a run that dies afterwards resumes without counting twice.
+	var afterLine func(current checkpoint) error
+	if trigger := newFlushTrigger(*opts.Flush); trigger != nil && st != nil {
+		afterLine = func(current checkpoint) (err error) {
+			if !trigger.due(lines.pending()) {
+				return nil
+			}
+			pool.flush()
+			n := agg.pending()
+			flushCtx, span := startSpan(ctx, "flush", "domains", n, "path", current.Path, "offset", current.Offset)
+			defer func() { span.end(err) }()
+			saveCtx, cancel := dbOpts.withTimeout(flushCtx)
+			defer cancel()
+			m.observeBatch(agg)
+			opts.OnlyNew.observe(agg)
+			opts.Summary.observe(agg)
+			start := time.Now()
+			if err := agg.save(saveCtx, st); err != nil {
+				return withExitCode(exitDatabase, fmt.Errorf("saving domains to database: %w", err))
+			}
+			m.observeWrite(time.Since(start))
+			if err := traced(saveCtx, "save checkpoints", func(ctx context.Context) error {
+				return st.saveCheckpoints(ctx, withCurrent(current))
+			}); err != nil {
+				return withExitCode(exitDatabase, fmt.Errorf("saving checkpoints: %w", err))
+			}
+			slog.Info("saved domains", "domains", n, "path", current.Path, "offset", current.Offset)
+			return nil
+		}
+	}
 
+	// Files read to the end are fingerprinted, and recorded once saved, so
+	// parsing them again can be caught (--already-parsed).
+	todo, err := selectInputs(ctx, st, dbOpts, inputs, opts.AlreadyParsed, prog)
 	if err != nil {
 		return err
 	}
-
-	rows, err = db.Query("SELECT domain, first_seen, last_seen FROM domains ORDER BY first_seen ASC")
-	if err != nil {
+	if opts.Summary.enabled() {
+		selected := make(map[string]bool, len(todo))
+		for _, in := range todo {
+			selected[in.Path] = true
+		}
+		for _, path := range inputs {
+			if !selected[path] {
+				opts.Summary.skipFile(path)
+			}
+		}
+	}
+	var fingerprints []fileFingerprint
+	finished := func(in parseInput, cp checkpoint, span domainTimes, took time.Duration) {
+		m.observeFile(took)
+		opts.Summary.addFile(in.Path, cp, span, took)
+		reached = withCurrent(cp)
+		if readCtx.Err() == nil && in.Fingerprinted {
+			fp := in.Fingerprint
+			fp.FirstSeen, fp.LastSeen, fp.ParsedAt = span.FirstSeen, span.LastSeen, time.Now().Unix()
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	if parallel {
+		// With --flush-every or --max-memory, saves come between files: a file
+		// is in agg only once read, so the checkpoints saved are those of the
+		// files merged.
+		err := parseFilesParallel(readCtx, st, dbOpts, todo, agg, opts.ParallelFiles, prog,
+			func(in parseInput, cp checkpoint, span domainTimes, took time.Duration) error {
+				if afterLine != nil {
+					if err := afterLine(cp); err != nil {
+						return err
+					}
+				}
+				finished(in, cp, span, took)
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, in := range todo {
+			fileCtx, fileSpan := startSpan(readCtx, "parse file", "path", in.Path)
+			start := time.Now()
+			cp, span, err := parseFile(fileCtx, st, dbOpts, in.Path, lines, afterLine, prog)
+			fileSpan.set("lines", span.Count, "offset", cp.Offset)
+			fileSpan.end(err)
+			if err != nil {
+				return err
+			}
+			finished(in, cp, span, time.Since(start))
+			if readCtx.Err() != nil {
+				break
+			}
+		}
+	}
+	pool.wait()
+	prog.finish()
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	defer rows.Close()
+	interrupted := readCtx.Err() != nil
 
-	err = writeFirstSeenByPrefixToFile(rows, "unique_domains_by_first_seen.txt")
-	if err != nil {
+	m.observeRejects(rejects)
+	rejects.summarize()
+	if err := agg.sink.close(); err != nil {
 		return err
 	}
 
-	return nil
+	if opts.DryRun {
+		if err := reportDryRun(ctx, dbOpts, agg); err != nil {
+			return err
+		}
+		if err := rejects.close(); err != nil {
+			return err
+		}
+		if interrupted {
+			return errInterrupted
+		}
+		return nil
+	}
+
+	flushCtx, flushSpan := startSpan(ctx, "flush", "domains", agg.pending())
+	saveCtx, cancel := dbOpts.withTimeout(flushCtx)
+	defer cancel()
+	m.observeBatch(agg)
+	opts.OnlyNew.observe(agg)
+	opts.Summary.observe(agg)
+	start := time.Now()
+	err = agg.save(saveCtx, st)
+	flushSpan.end(err)
+	if err != nil {
+		return withExitCode(exitDatabase, fmt.Errorf("saving domains to database: %w", err))
+	}
+	opts.OnlyNew.report()
+	m.observeWrite(time.Since(start))
+	if interrupted {
+		if err := st.saveCheckpoints(saveCtx, reached); err != nil {
+			return withExitCode(exitDatabase, fmt.Errorf("saving checkpoints: %w", err))
+		}
+		if len(reached) > 0 {
+			last := reached[len(reached)-1]
+			slog.Warn("interrupted, saved partial results", "path", last.Path, "offset", last.Offset)
+		} else {
+			slog.Warn("interrupted, saved partial results")
+		}
+		if err := rejects.close(); err != nil {
+			return err
+		}
+		return errInterrupted
+	}
+	if err := st.clearCheckpoints(saveCtx, inputs); err != nil {
+		return withExitCode(exitDatabase, fmt.Errorf("clearing checkpoints: %w", err))
+	}
+	if err := st.saveFingerprints(saveCtx, fingerprints); err != nil {
+		return withExitCode(exitDatabase, fmt.Errorf("saving fingerprints: %w", err))
+	}
+	if opts.PruneAfter != "" {
+		if err := pruneOlderThan(saveCtx, st, opts.PruneAfter); err != nil {
+			return err
+		}
+	}
+	return rejects.close()
 }
 
-// firstTwoComponents returns the first two dot-separated components of domain (e.g. "com.example.www" -> "com.example").
-func firstTwoComponents(domain string) string {
-	parts := strings.SplitN(domain, ".", 3)
-	if len(parts) < 2 {
-		return domain
+// parseFile feeds the lines of path (a plain or gzip-compressed file, or stdin)
+// to lines, starting from its checkpoint in st (if any) when one applies, until
+// the end of the input or until ctx is cancelled. afterLine, if not nil, is
+// called with the position after each line. It returns how far it got, offsets
+// counting decompressed bytes, and the timestamps of the first and last lines
+// read with their number.
+func parseFile(ctx context.Context, st store, dbOpts dbOptions, path string, lines lineSink, afterLine func(checkpoint) error, prog *progress) (checkpoint, domainTimes, error) {
+	var span domainTimes
+	in, err := openInput(path)
+	if err != nil {
+		return checkpoint{}, span, withExitCode(exitInput, err)
 	}
-	return parts[0] + "." + parts[1]
-}
+	defer in.Close()
 
-// writeFirstSeenByPrefixToFile writes one row per distinct first-two-components prefix:
-// the domain with the earliest first_seen for that prefix. Rows are written in first_seen ascending order.
-func writeFirstSeenByPrefixToFile(rows *sql.Rows, outputPath string) error {
-	type domainRow struct {
-		Domain    string
-		FirstSeen int64
-		LastSeen  int64
-	}
-	var byPrefix []domainRow
-	seenPrefix := make(map[string]bool)
-
-	for rows.Next() {
-		var domain sql.NullString
-		var firstSeen, lastSeen int64
-		if err := rows.Scan(&domain, &firstSeen, &lastSeen); err != nil {
-			return err
+	cp := checkpoint{Path: path}
+	if in.info != nil {
+		cp.Inode = fileInode(in.info)
+	}
+
+	if st != nil && in.info != nil {
+		loadCtx, cancel := dbOpts.withTimeout(context.WithoutCancel(ctx))
+		saved, ok, err := st.loadCheckpoint(loadCtx, path)
+		cancel()
+		if err != nil {
+			return cp, span, withExitCode(exitDatabase, fmt.Errorf("loading checkpoint: %w", err))
+		}
+		if ok && in.resumes(saved) {
+			if err := in.skip(saved.Offset); err != nil {
+				return cp, span, withExitCode(exitInput, err)
+			}
+			cp.Offset = saved.Offset
+			slog.Info("resuming", "path", path, "offset", saved.Offset)
+		}
+	}
+	// Seeking past a checkpoint in a plain file reads nothing, so leave it out of the rates.
+	skipped := cp.Offset
+	if in.compressed {
+		skipped = 0
+	}
+	prog.beginFile(in.raw, skipped)
+	defer prog.endFile(in.raw)
+	lines.beginSource(path)
+	slog.Info("parsing", "path", path, "compressed", in.compressed)
+
+	// Count consumed bytes so the offset always points at the start of the next line.
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, scanBufferSize), maxLineLength)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		cp.Offset += int64(advance)
+		return advance, token, err
+	})
+	// Only the timestamp of the last line is kept, to parse at the end.
+	now := time.Now()
+	var last [timestampPrefixLen]byte
+	lastLen := 0
+	done := ctx.Done()
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		prog.line()
+		if span.Count++; span.FirstSeen == 0 {
+			if t, ok := lineTimestamp(line, now); ok {
+				span.FirstSeen = t.Unix()
+			}
+		}
+		if len(line) >= syslogTimestampLen {
+			lastLen = copy(last[:], line)
 		}
-		domainStr := ""
-		if domain.Valid {
-			domainStr = domain.String
+		lines.addLine(line)
+		if afterLine != nil {
+			if err := afterLine(cp); err != nil {
+				return cp, span, err
+			}
 		}
-		prefix := firstTwoComponents(domainStr)
-		if seenPrefix[prefix] {
-			continue
+		select {
+		case <-done:
+			return cp, span, nil
+		default:
 		}
-		seenPrefix[prefix] = true
-		byPrefix = append(byPrefix, domainRow{domainStr, firstSeen, lastSeen})
 	}
-	if err := rows.Err(); err != nil {
-		return err
+	if err := scanner.Err(); err != nil {
+		code := exitInput
+		if errors.Is(err, bufio.ErrTooLong) {
+			code = exitParse
+		}
+		return cp, span, withExitCode(code, fmt.Errorf("scanning %s: %w", path, err))
 	}
-
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return err
+	if t, ok := lineTimestamp(last[:lastLen], now); ok {
+		span.LastSeen = t.Unix()
 	}
-	defer outFile.Close()
+	return cp, span, nil
+}
+
+// logLine is what parseLogLine finds on a line of the dnsmasq log. Its byte
+// slices point into the line.
+type logLine struct {
+	Timestamp int64
+	// Serial identifies the query a line is about with log-queries=extra; 0 otherwise.
+	Serial uint64
+	// Verb says what the line reports: query[TYPE] for a query, or what became
+	// of one, such as cached, forwarded, reply, config or a hosts file path.
+	Verb   []byte
+	Domain []byte // empty for lines about no domain
+	Client []byte // the requesting client of a query, if logged
+	Host   []byte // the host that logged the line, when read from syslog
+	// Answer is what a reply, cached, config or hosts line says the domain
+	// is: an address, or something like <CNAME> or NXDOMAIN.
+	Answer []byte
+	// MAC and Hostname are the hardware address and host name a DHCPACK line
+	// leases Client to; Hostname is empty when the client sent none.
+	MAC      []byte
+	Hostname []byte
+}
+
+// isQuery reports whether the line is a query.
+func (l logLine) isQuery() bool {
+	return bytes.HasPrefix(l.Verb, []byte("query["))
+}
 
-	writer := bufio.NewWriter(outFile)
-	for _, row := range byPrefix {
-		fmt.Fprintf(writer, "%s\t%s\t%s\n",
-			unixToDateTime(row.FirstSeen),
-			unixToDateTime(row.LastSeen),
-			row.Domain)
+// queryType returns the record type of a query, such as A or AAAA.
+func (l logLine) queryType() []byte {
+	return bytes.TrimSuffix(bytes.TrimPrefix(l.Verb, []byte("query[")), []byte("]"))
+}
+
+// action returns what dnsmasq did with a query, reporting answers from a hosts
+// file (logged with its path) as "hosts".
+func (l logLine) action() []byte {
+	if len(l.Verb) > 0 && l.Verb[0] == '/' {
+		return []byte("hosts")
 	}
-	writer.Flush()
+	return l.Verb
+}
 
-	fmt.Printf("Saved %d unique domains (by first two components) to %s\n", len(byPrefix), outputPath)
-	return nil
+// blocked reports whether the line answers a query with a block: from the
+// dnsmasq configuration (address=/domain/ and the like) or from a Pi-hole
+// blocklist.
+func (l logLine) blocked() bool {
+	return string(l.Verb) == "config" || isPiholeBlock(l.Verb) ||
+		len(l.Verb) > 0 && l.Verb[0] == '/' && bytes.Contains(l.Verb, []byte("/pihole/"))
+}
+
+// isPiholeBlock reports whether verb starts one of Pi-hole's block lines, such
+// as "gravity blocked", "regex blacklisted" or "exactly denied".
+func isPiholeBlock(verb []byte) bool {
+	switch string(verb) {
+	case "gravity", "regex", "exactly":
+		return true
+	}
+	return false
 }
 
-func writeRowsToFile(rows *sql.Rows, outputPath string) error {
+// parseLogLine parses the timestamp of a dnsmasq log line, in the year before
+// now, and what it says about a query, or the DHCP lease it acknowledges. Lines
+// about no query yield an empty Domain; malformed lines an error.
+func parseLogLine(line []byte, now time.Time) (logLine, error) {
+	if len(line) < syslogTimestampLen {
+		return logLine{}, errLineTooShort
+	}
 
-	var uniqueDomains []struct {
-		Domain    string
-		FirstSeen int64
-		LastSeen  int64
+	t, ok := parseSyslogTimestamp(line, now)
+	if !ok {
+		return logLine{}, errBadTimestamp
 	}
-	for rows.Next() {
-		var domain sql.NullString
-		var firstSeen, lastSeen int64
+	l := logLine{Timestamp: t.Unix()}
 
-		err := rows.Scan(&domain, &firstSeen, &lastSeen)
-		if err != nil {
-			return err
+	// Walk the fields in place rather than splitting the line.
+	rest := line[syslogTimestampLen:]
+	var prev []byte
+	for {
+		var field []byte
+		field, rest = nextField(rest)
+		if len(field) == 0 {
+			return l, nil
 		}
-
-		// Convert null string to regular string if not NULL
-		domainStr := ""
-		if domain.Valid {
-			domainStr = domain.String
+		if bytes.HasPrefix(field, []byte("query[")) {
+			l.Verb = field
+			break
 		}
-
-		uniqueDomains = append(uniqueDomains, struct {
-			Domain    string
-			FirstSeen int64
-			LastSeen  int64
-		}{domainStr, firstSeen, lastSeen})
+		if field[len(field)-1] == ':' {
+			// The program tag, e.g. "dnsmasq[812]:". log-queries=extra puts a
+			// serial number and the client's address/port before the verb.
+			// Syslog puts the host name before the tag; dnsmasq's own log file
+			// has none.
+			l.Host = prev
+			l.Verb, rest = nextField(rest)
+			if serial, ok := parseSerial(l.Verb); ok {
+				l.Serial = serial
+				if l.Verb, rest = nextField(rest); len(l.Verb) > 0 && l.Verb[0] != '/' && bytes.IndexByte(l.Verb, '/') >= 0 {
+					l.Verb, rest = nextField(rest)
+				}
+			}
+			break
+		}
+		prev = field
 	}
 
-	if err := rows.Err(); err != nil {
-		return err
+	if isPiholeBlock(l.Verb) {
+		// Pi-hole logs blocks in two words, e.g. "gravity blocked".
+		_, rest = nextField(rest)
+	}
+	if l.isLease() {
+		// DHCPACK(interface) address MAC [hostname]
+		l.Client, rest = nextField(rest)
+		l.MAC, rest = nextField(rest)
+		l.Hostname, _ = nextField(rest)
+		return l, nil
+	}
+	l.Domain, rest = nextField(rest)
+	if l.isQuery() {
+		if from, rest := nextField(rest); string(from) == "from" {
+			l.Client, _ = nextField(rest)
+		}
+	} else if is, rest := nextField(rest); string(is) == "is" {
+		l.Answer, _ = nextField(rest)
 	}
+	return l, nil
+}
 
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return err
+// parseSerial parses the decimal query serial number logged with
+// log-queries=extra.
+func parseSerial(b []byte) (uint64, bool) {
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
 	}
-	defer outFile.Close()
+	return n, len(b) > 0
+}
 
-	writer := bufio.NewWriter(outFile)
-	for _, domainInfo := range uniqueDomains {
-		fmt.Fprintf(writer, "%s\t%s\t%s\n",
-			unixToDateTime(domainInfo.FirstSeen),
-			unixToDateTime(domainInfo.LastSeen),
-			domainInfo.Domain)
+// nextField returns the first whitespace-separated field of s, as bytes.Fields
+// would, and what follows it. field is empty when s has no more fields.
+func nextField(s []byte) (field, rest []byte) {
+	start := -1
+	for i := 0; i < len(s); {
+		space, size := asciiSpace[s[i]] == 1, 1
+		if s[i] >= utf8.RuneSelf {
+			var r rune
+			r, size = utf8.DecodeRune(s[i:])
+			space = unicode.IsSpace(r)
+		}
+		if space {
+			if start >= 0 {
+				return s[start:i], s[i:]
+			}
+		} else if start < 0 {
+			start = i
+		}
+		i += size
+	}
+	if start < 0 {
+		return nil, nil
 	}
-	writer.Flush()
+	return s[start:], nil
+}
 
-	fmt.Printf("Saved %d unique domains to %s\n", len(uniqueDomains), outputPath)
+var asciiSpace = [256]uint8{'\t': 1, '\n': 1, '\v': 1, '\f': 1, '\r': 1, ' ': 1}
 
-	return nil
+// withLogYear places a year-less syslog timestamp in the current year, or the previous
+// one when that would put it more than a day in the future (e.g. December lines read in January).
+func withLogYear(t, now time.Time) time.Time {
+	t = t.AddDate(now.Year()-t.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
 }
 
-func unixToDateTime(unix int64) string {
-	t := time.Unix(unix, 0)
-	return t.Format("Jan _2 2006 15:04:05 MST")
+func reverseDomainParts(domain string) string {
+	b := []byte(domain)
+	reverseLabels(b)
+	return string(b)
+}
+
+// reverseLabels reverses the order of the dot-separated labels of domain in
+// place, by reversing all of it and then each label back.
+func reverseLabels(domain []byte) {
+	slices.Reverse(domain)
+	for start := 0; start <= len(domain); {
+		end := bytes.IndexByte(domain[start:], '.')
+		if end < 0 {
+			end = len(domain)
+		} else {
+			end += start
+		}
+		slices.Reverse(domain[start:end])
+		start = end + 1
+	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextField(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"   ",
+		"query[A] example.com from 192.168.1.10",
+		"  leading and trailing  ",
+		"tabs\tand\nnewlines\r\nmixed",
+		"unicode\u2003spaces\u00a0too",
+		"héllo wörld",
+	} {
+		var got []string
+		for field, rest := nextField([]byte(s)); len(field) > 0; field, rest = nextField(rest) {
+			got = append(got, string(field))
+		}
+		if want := strings.Fields(s); !slices.Equal(got, want) {
+			t.Errorf("nextField on %q gives %q; strings.Fields gives %q", s, got, want)
+		}
+	}
+}
+
+func TestRejectLogClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rejects.txt")
+	r, err := newRejectLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.add("garbage", errLineTooShort)
+	for range 2 {
+		if err := r.close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line too short\tgarbage\n"; string(data) != want {
+		t.Errorf("rejects file %q, want %q", data, want)
+	}
+}
+
+func BenchmarkLineFields(b *testing.B) {
+	rest := benchLine[syslogTimestampLen:]
+	b.Run("nextField", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for field, r := nextField(rest); len(field) > 0; field, r = nextField(r) {
+			}
+		}
+	})
+	b.Run("strings.Fields", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			strings.Fields(string(rest))
+		}
+	})
+}
+
+func TestParseLogLineYear(t *testing.T) {
+	line := []byte("Dec 31 23:59:58 dnsmasq[812]: query[A] example.com from 192.168.1.10")
+	tests := []struct {
+		now  time.Time
+		year int
+	}{
+		{time.Date(2024, time.December, 31, 23, 59, 59, 0, time.Local), 2024},
+		{time.Date(2025, time.January, 1, 0, 0, 5, 0, time.Local), 2024},
+		{time.Date(2025, time.December, 31, 12, 0, 0, 0, time.Local), 2025},
+	}
+	for _, tt := range tests {
+		l, err := parseLogLine(line, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if year := time.Unix(l.Timestamp, 0).Year(); year != tt.year {
+			t.Errorf("read at %s: year %d, want %d", tt.now.Format(time.DateTime), year, tt.year)
+		}
+	}
+}
+
+func BenchmarkParseLogLine(b *testing.B) {
+	b.Run("now per run", func(b *testing.B) {
+		parse := lineFormat(parseLogLine).at(time.Now())
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := parse(benchLine); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("now per line", func(b *testing.B) {
+		parse := lineFormat(parseLogLine).live()
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := parse(benchLine); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
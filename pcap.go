@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// packetSource is a capture file or interface read packet by packet.
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// runPcap implements the pcap subcommand: take the DNS queries and answers
+// out of capture files, or of the traffic on an interface, covering devices
+// that ask other resolvers than dnsmasq.
+func runPcap(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("pcap", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	iface := fs.String("interface", "", "capture live on `name` (Linux only) rather than reading capture files")
+	port := fs.Int("port", 53, "take DNS messages sent to or from `port`, over UDP or TCP")
+	interval := fs.Duration("flush", 30*time.Second, "how often to save to the database while capturing live")
+	queries := addQueryFlags(fs)
+	anonymize := addAnonymizeFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pcap [flags] capture.pcap[ng]...\n       pcap [flags] --interface eth0")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*iface == "") == (fs.NArg() == 0) {
+		return errors.New("pcap needs capture files or --interface, not both")
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	agg := newAggregator(*clients, nil)
+	if err := queries.enable(agg, st); err != nil {
+		return err
+	}
+	if err := anonymize.enable(agg); err != nil {
+		return err
+	}
+	save := func() error {
+		saveCtx, cancel := dbOpts.withTimeout(ctx)
+		defer cancel()
+		if err := agg.save(saveCtx, st); err != nil {
+			return fmt.Errorf("saving domains to database: %w", err)
+		}
+		return nil
+	}
+
+	// Reading stops on a signal, but saving what was read still runs to completion.
+	readCtx, stop := notifyInterrupt(ctx)
+	defer stop()
+
+	d := &dnsDecoder{agg: agg, port: uint16(*port)}
+	if *iface != "" {
+		return captureLive(readCtx, *iface, d, *interval, save)
+	}
+	for _, path := range fs.Args() {
+		n, err := readCaptureFile(readCtx, path, d)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		slog.Info("read capture", "path", path, "messages", n)
+		if readCtx.Err() != nil {
+			break
+		}
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	if readCtx.Err() != nil {
+		slog.Warn("interrupted, saved partial results")
+		return errInterrupted
+	}
+	return nil
+}
+
+// readCaptureFile feeds the DNS messages of the pcap or pcapng file at path,
+// which may be gzipped, to d and returns how many there were.
+func readCaptureFile(ctx context.Context, path string, d *dnsDecoder) (int, error) {
+	in, err := openInput(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+
+	var src packetSource
+	// pcapng files start with a section header block, 0x0A0D0D0A.
+	if magic, _ := r.Peek(4); bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		src, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	} else {
+		src, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		return 0, err
+	}
+	d.beginSource(path)
+
+	n := 0
+	for ctx.Err() == nil {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if d.decode(data, src.LinkType(), ci.Timestamp) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// dnsDecoder turns captured DNS messages into the log lines dnsmasq would
+// have written about them and adds those to agg.
+type dnsDecoder struct {
+	agg  *aggregator
+	port uint16
+}
+
+func (d *dnsDecoder) beginSource(name string) {
+	d.agg.beginSource(name)
+}
+
+// decode adds the DNS message in the packet data, if it holds one, and
+// reports whether it did. Messages over TCP are read only when a segment
+// holds the whole of one, as it does for most queries.
+func (d *dnsDecoder) decode(data []byte, link layers.LinkType, ts time.Time) bool {
+	packet := gopacket.NewPacket(data, link, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	network := packet.NetworkLayer()
+	if network == nil {
+		return false
+	}
+	var payload []byte
+	switch t := packet.TransportLayer().(type) {
+	case *layers.UDP:
+		if uint16(t.SrcPort) != d.port && uint16(t.DstPort) != d.port {
+			return false
+		}
+		payload = t.Payload
+	case *layers.TCP:
+		if uint16(t.SrcPort) != d.port && uint16(t.DstPort) != d.port || len(t.Payload) < 2 {
+			return false
+		}
+		if n := int(binary.BigEndian.Uint16(t.Payload)); n != len(t.Payload)-2 {
+			return false
+		}
+		payload = t.Payload[2:]
+	default:
+		return false
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(payload); err != nil || len(msg.Questions) == 0 {
+		return false
+	}
+	src, _ := network.NetworkFlow().Endpoints()
+	for _, l := range dnsLines(&msg, src.String(), ts.Unix()) {
+		d.agg.addParsed(l)
+	}
+	return true
+}
+
+// dnsLines returns the lines dnsmasq logs for msg, sent from src at ts: the
+// query, made by src, or the reply lines of each answer, as in "reply
+// example.com is 93.184.215.14", ending with NXDOMAIN or NODATA when there is
+// no address.
+func dnsLines(msg *dnsmessage.Message, src string, ts int64) []logLine {
+	q := msg.Questions[0]
+	name := []byte(strings.TrimSuffix(q.Name.String(), "."))
+	if !msg.Response {
+		return []logLine{{Timestamp: ts, Verb: queryVerb([]byte(dnsTypeName(q.Type))), Domain: name, Client: []byte(src)}}
+	}
+	reply := func(domain, answer string) logLine {
+		return logLine{Timestamp: ts, Verb: []byte("reply"), Domain: []byte(domain), Answer: []byte(answer)}
+	}
+	var lines []logLine
+	for _, rr := range msg.Answers {
+		domain := strings.TrimSuffix(rr.Header.Name.String(), ".")
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			lines = append(lines, reply(domain, netip.AddrFrom4(b.A).String()))
+		case *dnsmessage.AAAAResource:
+			lines = append(lines, reply(domain, netip.AddrFrom16(b.AAAA).Unmap().String()))
+		case *dnsmessage.CNAMEResource:
+			lines = append(lines, reply(domain, "<CNAME>"))
+		}
+	}
+	switch {
+	case msg.RCode == dnsmessage.RCodeNameError:
+		lines = append(lines, reply(string(name), "NXDOMAIN"))
+	case len(lines) == 0 && msg.RCode == dnsmessage.RCodeSuccess:
+		lines = append(lines, reply(string(name), "NODATA"))
+	}
+	return lines
+}
+
+// dnsTypeName returns the name dnsmasq logs for a record type, such as AAAA,
+// or type=N for those it has no name for.
+func dnsTypeName(t dnsmessage.Type) string {
+	if name, ok := strings.CutPrefix(t.String(), "Type"); ok {
+		return name
+	}
+	return fmt.Sprintf("type=%d", t)
+}
+
+// captureLive feeds the DNS messages on iface to d until ctx is done, saving
+// every interval. The interface is read in a goroutine of its own, as reads
+// of a quiet interface do not return.
+func captureLive(ctx context.Context, iface string, d *dnsDecoder, interval time.Duration, save func() error) error {
+	src, err := openLiveCapture(iface)
+	if err != nil {
+		return err
+	}
+	type packet struct {
+		data []byte
+		ts   time.Time
+	}
+	packets := make(chan packet, 1024)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			data, ci, err := src.ReadPacketData()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case packets <- packet{data, ci.Timestamp}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("capturing", "interface", iface)
+	d.beginSource(iface)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case p := <-packets:
+			d.decode(p.data, src.LinkType(), p.ts)
+		case <-ticker.C:
+			if err := save(); err != nil {
+				return err
+			}
+		case err := <-errs:
+			if saveErr := save(); saveErr != nil {
+				return saveErr
+			}
+			return fmt.Errorf("capturing on %s: %w", iface, err)
+		case <-ctx.Done():
+			if err := save(); err != nil {
+				return err
+			}
+			slog.Info("stopped capturing, saved", "interface", iface)
+			return nil
+		}
+	}
+}
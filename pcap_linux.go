@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// openLiveCapture opens an AF_PACKET socket on iface, which takes root or
+// CAP_NET_RAW. It sees the packets sent as well as those received, so on the
+// loopback interface each message is read twice.
+func openLiveCapture(iface string) (packetSource, error) {
+	h, err := pcapgo.NewEthernetHandle(iface)
+	if err != nil {
+		return nil, err
+	}
+	return ethernetSource{h}, nil
+}
+
+// ethernetSource gives an EthernetHandle, which reads Ethernet frames only, a
+// LinkType.
+type ethernetSource struct {
+	*pcapgo.EthernetHandle
+}
+
+func (ethernetSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
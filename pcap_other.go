@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openLiveCapture(iface string) (packetSource, error) {
+	return nil, errors.New("capturing from an interface needs Linux")
+}
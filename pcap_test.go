@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testPacket is a DNS message, or other payload, sent between two endpoints.
+type testPacket struct {
+	src, dst netip.AddrPort
+	tcp      bool
+	payload  []byte
+}
+
+// dnsMessage packs a message with one question and the given answers.
+func dnsMessage(t *testing.T, response bool, rcode dnsmessage.RCode, name string, qtype dnsmessage.Type, answers ...dnsmessage.Resource) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: response, RCode: rcode},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+		Answers:   answers,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func resourceHeader(name string, qtype dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET, TTL: 300}
+}
+
+// ethernetFrame wraps p in Ethernet, IP and UDP or TCP headers. TCP payloads
+// are prefixed with their length, as DNS over TCP sends them, unless raw.
+func ethernetFrame(t *testing.T, p testPacket, raw bool) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+	var network gopacket.NetworkLayer
+	var ip gopacket.SerializableLayer
+	if p.src.Addr().Is4() {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		v4 := &layers.IPv4{Version: 4, TTL: 64, SrcIP: p.src.Addr().AsSlice(), DstIP: p.dst.Addr().AsSlice()}
+		network, ip = v4, v4
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		v6 := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: p.src.Addr().AsSlice(), DstIP: p.dst.Addr().AsSlice()}
+		network, ip = v6, v6
+	}
+	payload := p.payload
+	var transport interface {
+		gopacket.SerializableLayer
+		SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+	}
+	if p.tcp {
+		if !raw {
+			payload = append(binary.BigEndian.AppendUint16(nil, uint16(len(payload))), payload...)
+		}
+		transport = &layers.TCP{SrcPort: layers.TCPPort(p.src.Port()), DstPort: layers.TCPPort(p.dst.Port()), PSH: true, ACK: true, Window: 65535}
+	} else {
+		transport = &layers.UDP{SrcPort: layers.UDPPort(p.src.Port()), DstPort: layers.UDPPort(p.dst.Port())}
+	}
+	if p.src.Addr().Is4() {
+		ip.(*layers.IPv4).Protocol = layers.IPProtocolUDP
+		if p.tcp {
+			ip.(*layers.IPv4).Protocol = layers.IPProtocolTCP
+		}
+	} else {
+		ip.(*layers.IPv6).NextHeader = layers.IPProtocolUDP
+		if p.tcp {
+			ip.(*layers.IPv6).NextHeader = layers.IPProtocolTCP
+		}
+	}
+	if err := transport.SetNetworkLayerForChecksum(network); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadCaptureFile(t *testing.T) {
+	client := netip.MustParseAddrPort("192.168.1.10:53422")
+	server := netip.MustParseAddrPort("192.168.1.1:53")
+	client6 := netip.MustParseAddrPort("[2001:db8::10]:53423")
+	server6 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	other := netip.MustParseAddrPort("192.168.1.11:53424")
+
+	frames := [][]byte{
+		ethernetFrame(t, testPacket{client, server, false, dnsMessage(t, false, 0, "www.example.com.", dnsmessage.TypeA)}, false),
+		ethernetFrame(t, testPacket{server, client, false, dnsMessage(t, true, dnsmessage.RCodeSuccess, "www.example.com.", dnsmessage.TypeA,
+			dnsmessage.Resource{Header: resourceHeader("www.example.com.", dnsmessage.TypeCNAME), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("example.com.")}},
+			dnsmessage.Resource{Header: resourceHeader("example.com.", dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{93, 184, 215, 14}}},
+		)}, false),
+		ethernetFrame(t, testPacket{client6, server6, true, dnsMessage(t, false, 0, "example.org.", dnsmessage.TypeAAAA)}, false),
+		ethernetFrame(t, testPacket{server6, client6, true, dnsMessage(t, true, dnsmessage.RCodeSuccess, "example.org.", dnsmessage.TypeAAAA,
+			dnsmessage.Resource{Header: resourceHeader("example.org.", dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2606:2800:21f:cb07:6820:80da:af6b:8b2c").As16()}},
+		)}, false),
+		ethernetFrame(t, testPacket{other, server, false, dnsMessage(t, false, 0, "nx.example.net.", dnsmessage.TypeA)}, false),
+		ethernetFrame(t, testPacket{server, other, false, dnsMessage(t, true, dnsmessage.RCodeNameError, "nx.example.net.", dnsmessage.TypeA)}, false),
+		// Not read: another port, a TCP segment holding part of a message, and no DNS message at all.
+		ethernetFrame(t, testPacket{client, netip.MustParseAddrPort("224.0.0.251:5353"), false, dnsMessage(t, false, 0, "printer.local.", dnsmessage.TypeA)}, false),
+		ethernetFrame(t, testPacket{client6, server6, true, append([]byte{0, 200}, dnsMessage(t, false, 0, "partial.example.", dnsmessage.TypeA)...)}, true),
+		ethernetFrame(t, testPacket{client, server, false, []byte("not a DNS message")}, false),
+	}
+
+	dir := t.TempDir()
+	ts := time.Unix(1700000000, 0)
+	captureInfo := func(i int, frame []byte) gopacket.CaptureInfo {
+		return gopacket.CaptureInfo{Timestamp: ts.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(frame), Length: len(frame)}
+	}
+	writePcap := func(w io.Writer) error {
+		pw := pcapgo.NewWriter(w)
+		if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+			return err
+		}
+		for i, frame := range frames {
+			if err := pw.WritePacket(captureInfo(i, frame), frame); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writers := map[string]func(w io.Writer) error{
+		"capture.pcap": writePcap,
+		"capture.pcapng": func(w io.Writer) error {
+			nw, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+			if err != nil {
+				return err
+			}
+			for i, frame := range frames {
+				if err := nw.WritePacket(captureInfo(i, frame), frame); err != nil {
+					return err
+				}
+			}
+			return nw.Flush()
+		},
+		"capture.pcap.gz": func(w io.Writer) error {
+			zw := gzip.NewWriter(w)
+			if err := writePcap(zw); err != nil {
+				return err
+			}
+			return zw.Close()
+		},
+	}
+
+	seen := domainTimes{FirstSeen: ts.Unix(), LastSeen: ts.Unix(), Count: 1}
+	wantDomains := map[string]domainTimes{"com.example.www": seen, "org.example": seen, "net.example.nx": seen}
+	wantClients := map[domainClient]domainTimes{
+		{"com.example.www", "192.168.1.10"}: seen,
+		{"org.example", "2001:db8::10"}:     seen,
+		{"net.example.nx", "192.168.1.11"}:  seen,
+	}
+	for name, write := range writers {
+		var b bytes.Buffer
+		if err := write(&b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		agg := newAggregator(nil, nil)
+		d := &dnsDecoder{agg: agg, port: 53}
+		n, err := readCaptureFile(context.Background(), path, d)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n != 6 {
+			t.Errorf("%s: %d DNS messages, want 6", name, n)
+		}
+		if !maps.Equal(agg.domains, wantDomains) {
+			t.Errorf("%s: domains %v, want %v", name, agg.domains, wantDomains)
+		}
+		if !maps.Equal(agg.perClient, wantClients) {
+			t.Errorf("%s: clients %v, want %v", name, agg.perClient, wantClients)
+		}
+		var addresses []string
+		for key := range agg.addresses {
+			addresses = append(addresses, fmt.Sprintf("%s %s", key.Domain, key.Address))
+		}
+		for _, want := range []string{"com.example.www 93.184.215.14", "org.example 2606:2800:21f:cb07:6820:80da:af6b:8b2c"} {
+			if !slices.Contains(addresses, want) {
+				t.Errorf("%s: answers %v, want %s among them", name, addresses, want)
+			}
+		}
+	}
+
+	if _, err := readCaptureFile(context.Background(), filepath.Join(dir, "missing.pcap"), &dnsDecoder{agg: newAggregator(nil, nil), port: 53}); err == nil {
+		t.Error("missing capture: no error")
+	}
+	notCapture := filepath.Join(dir, "not-a-capture")
+	if err := os.WriteFile(notCapture, []byte("Mar  1 00:00:00 dnsmasq[812]: query[A] example.com from 192.168.1.10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCaptureFile(context.Background(), notCapture, &dnsDecoder{agg: newAggregator(nil, nil), port: 53}); err == nil {
+		t.Error("log file read as a capture: no error")
+	}
+}
+
+func TestDNSLines(t *testing.T) {
+	const ts = 1700000000
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		want []string // verb domain answer client
+	}{
+		{"query", dnsmessage.Message{
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("Example.COM."), Type: dnsmessage.TypeHTTPS, Class: dnsmessage.ClassINET}},
+		}, []string{"query[HTTPS] Example.COM  192.168.1.10"}},
+		{"query of an unnamed type", dnsmessage.Message{
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: 1234, Class: dnsmessage.ClassINET}},
+		}, []string{"query[type=1234] example.com  192.168.1.10"}},
+		{"answers", dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}},
+			Answers: []dnsmessage.Resource{
+				{Header: resourceHeader("www.example.com.", dnsmessage.TypeCNAME), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("example.com.")}},
+				{Header: resourceHeader("example.com.", dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()}},
+				{Header: resourceHeader("example.com.", dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("::ffff:192.0.2.1").As16()}},
+				{Header: resourceHeader("example.com.", dnsmessage.TypeTXT), Body: &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}}},
+			},
+		}, []string{"reply www.example.com <CNAME> ", "reply example.com 2001:db8::1 ", "reply example.com 192.0.2.1 "}},
+		{"NXDOMAIN", dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("nx.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		}, []string{"reply nx.example.com NXDOMAIN "}},
+		{"NODATA", dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET}},
+		}, []string{"reply example.com NODATA "}},
+		{"SERVFAIL", dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		}, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, l := range dnsLines(&tt.msg, "192.168.1.10", ts) {
+			if l.Timestamp != ts {
+				t.Errorf("%s: timestamp %d, want %d", tt.name, l.Timestamp, ts)
+			}
+			got = append(got, fmt.Sprintf("%s %s %s %s", l.Verb, l.Domain, l.Answer, l.Client))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: lines %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
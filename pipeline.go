@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// parseBatchLines is how many lines the reader hands to a worker at a time.
+const parseBatchLines = 4096
+
+// lineSink receives the lines read from the input files.
+type lineSink interface {
+	// beginSource names the input file the following lines come from.
+	beginSource(path string)
+	// addLine must not retain line once it returns.
+	addLine(line []byte)
+	// pending reports how many domains are held in memory.
+	pending() int
+}
+
+// parsePool parses lines on several goroutines so extracting queries is not
+// limited to the reading goroutine. The workers only parse; a single goroutine
+// then aggregates the parsed batches into the target in the order they were
+// read, so the lines about a query (forwarded, reply, cached and the like) are
+// followed as they are without a pool, whichever worker parsed them.
+type parsePool struct {
+	target  *aggregator
+	source  string
+	batch   *lineBatch
+	batches chan *lineBatch // to be parsed
+	ordered chan *lineBatch // the same batches in the order read, to be aggregated
+	workers int
+	wg      sync.WaitGroup
+	held    atomic.Int64 // domains the aggregated batches added to the target
+	once    sync.Once
+}
+
+// startParsePool starts n workers feeding target.
+func startParsePool(target *aggregator, n int) *parsePool {
+	p := &parsePool{target: target, workers: n}
+	p.start()
+	return p
+}
+
+func (p *parsePool) start() {
+	p.batches = make(chan *lineBatch, p.workers)
+	p.ordered = make(chan *lineBatch, p.workers)
+	for range p.workers {
+		p.wg.Go(func() {
+			for batch := range p.batches {
+				batch.parse(p.target.parse)
+			}
+		})
+	}
+	p.wg.Go(func() {
+		for batch := range p.ordered {
+			<-batch.parsed
+			p.target.beginSource(batch.source)
+			before := p.target.pending()
+			for i, line := range batch.lines {
+				p.target.addResult(line, batch.results[i].line, batch.results[i].err)
+			}
+			p.held.Add(int64(p.target.pending() - before))
+		}
+	})
+}
+
+// beginSource hands the lines queued so far to the workers, so every batch
+// comes from one file.
+func (p *parsePool) beginSource(path string) {
+	p.send()
+	p.source = path
+}
+
+// addLine queues a copy of line, handing a batch to the workers when it is full.
+func (p *parsePool) addLine(line []byte) {
+	if p.batch == nil {
+		p.batch = newLineBatch(p.source)
+	}
+	p.batch.add(line)
+	if len(p.batch.lines) == parseBatchLines {
+		p.send()
+	}
+}
+
+// send hands the queued lines, if any, to the workers.
+func (p *parsePool) send() {
+	if p.batch == nil {
+		return
+	}
+	p.ordered <- p.batch
+	p.batches <- p.batch
+	p.batch = nil
+}
+
+// lineBatch holds lines copied into one shared buffer, so queueing a line does
+// not allocate once the buffer has grown to the batch's size, and what
+// parsing them gave, once parsed is closed.
+type lineBatch struct {
+	source  string
+	data    []byte
+	lines   [][]byte
+	results []parseResult
+	parsed  chan struct{}
+}
+
+// parseResult is what parsing a line gave. line refers to the batch's buffer.
+type parseResult struct {
+	line logLine
+	err  error
+}
+
+func newLineBatch(source string) *lineBatch {
+	return &lineBatch{
+		source: source,
+		data:   make([]byte, 0, parseBatchLines*128),
+		lines:  make([][]byte, 0, parseBatchLines),
+		parsed: make(chan struct{}),
+	}
+}
+
+func (b *lineBatch) add(line []byte) {
+	// A line that outgrows data gets a new buffer; earlier lines keep the old one.
+	start := len(b.data)
+	b.data = append(b.data, line...)
+	b.lines = append(b.lines, b.data[start:len(b.data):len(b.data)])
+}
+
+// parse parses the lines with parse and closes parsed.
+func (b *lineBatch) parse(parse lineParser) {
+	b.results = make([]parseResult, len(b.lines))
+	for i, line := range b.lines {
+		b.results[i].line, b.results[i].err = parse(line)
+	}
+	close(b.parsed)
+}
+
+// pending reports how many domains the batches aggregated since the pool was
+// started or last flushed have added to the target, which callers save after
+// flushing.
+func (p *parsePool) pending() int {
+	return int(p.held.Load())
+}
+
+// drain parses and aggregates the queued lines and stops the goroutines.
+func (p *parsePool) drain() {
+	p.send()
+	close(p.batches)
+	close(p.ordered)
+	p.wg.Wait()
+	p.held.Store(0)
+}
+
+// flush aggregates everything read so far into the target and carries on.
+// It is a no-op on a nil pool.
+func (p *parsePool) flush() {
+	if p == nil {
+		return
+	}
+	p.drain()
+	p.start()
+}
+
+// wait aggregates everything into the target and stops the goroutines for
+// good. It is a no-op on a nil pool and after the first call.
+func (p *parsePool) wait() {
+	if p == nil {
+		return
+	}
+	p.once.Do(p.drain)
+}
+
+// parseFilesParallel reads up to n of inputs at a time, each on a goroutine of
+// its own parsing into an aggregator forked from agg, so compressed files are
+// decompressed in parallel and not only parsed. Each is merged into agg once
+// read, and done is then called, one file at a time, with how far it got.
+// Reading stops when ctx is done; files not started by then are left alone.
+func parseFilesParallel(ctx context.Context, st store, dbOpts dbOptions, inputs []parseInput, agg *aggregator, n int, prog *progress, done func(in parseInput, cp checkpoint, span domainTimes, took time.Duration) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex // guards agg, firstErr and the calls of done
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan parseInput)
+	for range min(n, len(inputs)) {
+		wg.Go(func() {
+			for in := range queue {
+				fork := agg.fork()
+				fileCtx, fileSpan := startSpan(ctx, "parse file", "path", in.Path)
+				start := time.Now()
+				cp, span, err := parseFile(fileCtx, st, dbOpts, in.Path, fork, nil, prog)
+				fileSpan.set("lines", span.Count, "offset", cp.Offset)
+				fileSpan.end(err)
+
+				mu.Lock()
+				if err == nil && firstErr == nil {
+					agg.merge(fork)
+					err = done(in, cp, span, time.Since(start))
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		})
+	}
+send:
+	for _, in := range inputs {
+		select {
+		case queue <- in:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
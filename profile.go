@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profileFlags are the profiling flags shared by every subcommand, for
+// measuring changes and attaching profiles to performance bug reports.
+type profileFlags struct {
+	cpu, mem, trace string
+}
+
+func addProfileFlags(fs *flag.FlagSet) *profileFlags {
+	f := &profileFlags{}
+	fs.StringVar(&f.cpu, "cpuprofile", "", "write a CPU profile to `file`")
+	fs.StringVar(&f.mem, "memprofile", "", "write a heap profile to `file` on exit")
+	fs.StringVar(&f.trace, "trace", "", "write an execution trace to `file`")
+	return f
+}
+
+// stopProfiling finishes the profiles started by parseFlags. main calls it
+// once the command returns.
+var stopProfiling = func() error { return nil }
+
+// start starts the requested profiles and sets stopProfiling to finish them.
+func (f *profileFlags) start() error {
+	var stops []func() error
+	stop := func() error {
+		var errs []error
+		for _, s := range stops {
+			errs = append(errs, s())
+		}
+		return errors.Join(errs...)
+	}
+
+	if f.cpu != "" {
+		file, err := os.Create(f.cpu)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return fmt.Errorf("starting CPU profile: %w", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return file.Close()
+		})
+	}
+	if f.trace != "" {
+		file, err := os.Create(f.trace)
+		if err != nil {
+			stop()
+			return err
+		}
+		if err := trace.Start(file); err != nil {
+			file.Close()
+			stop()
+			return fmt.Errorf("starting trace: %w", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return file.Close()
+		})
+	}
+	if f.mem != "" {
+		path := f.mem
+		stops = append(stops, func() error {
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			// Collect first so the profile shows what is live at the end.
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(file); err != nil {
+				file.Close()
+				return fmt.Errorf("writing heap profile: %w", err)
+			}
+			return file.Close()
+		})
+	}
+	stopProfiling = stop
+	return nil
+}
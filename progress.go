@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressRedraw   = 500 * time.Millisecond // status line refresh on a terminal
+	progressLogEvery = 30 * time.Second       // progress records with --progress log
+)
+
+const progressFlagUsage = "progress `mode`: auto (a status line when stderr is a terminal), line, log (a record every 30s) or off"
+
+// progress reports how far a parse has got: lines and bytes read, their rates,
+// and an ETA when the total size of the inputs is known (not for stdin).
+// Bytes are counted as read from the files, so the ETA holds for compressed
+// inputs too.
+type progress struct {
+	start time.Time
+	total int64 // bytes in all inputs, or -1 when unknown
+	lines atomic.Int64
+
+	mu      sync.Mutex
+	done    int64             // bytes of the inputs finished so far
+	skipped int64             // bytes skipped when resuming, excluded from the rates
+	files   []*countingReader // the inputs being read
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// startProgress starts reporting on the given inputs in mode, as described by
+// progressFlagUsage.
+func startProgress(mode string, paths []string) (*progress, error) {
+	p := &progress{start: time.Now(), total: inputsSize(paths), stop: make(chan struct{})}
+	if mode == "auto" {
+		mode = "off"
+		if isTerminal(os.Stderr) {
+			mode = "line"
+		}
+	}
+	var report func()
+	every := progressRedraw
+	switch mode {
+	case "off":
+		return p, nil
+	case "line":
+		report = func() { stderr.status(p.status()) }
+	case "log":
+		report = func() {
+			attrs := p.attrs()
+			if _, _, eta := p.rates(); eta >= 0 {
+				attrs = append(attrs, "eta", eta.Round(time.Second))
+			}
+			slog.Info("progress", attrs...)
+		}
+		every = progressLogEvery
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q", mode)
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-p.stop:
+				stderr.clear()
+				return
+			}
+		}
+	}()
+	return p, nil
+}
+
+// inputsSize sums the sizes of paths, or returns -1 if any cannot be known.
+func inputsSize(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if path == stdinPath || err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		total += info.Size()
+	}
+	return total
+}
+
+// beginFile starts counting the bytes read from raw, of which the first
+// skipped were passed over to resume from a checkpoint.
+func (p *progress) beginFile(raw *countingReader, skipped int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files = append(p.files, raw)
+	p.skipped += skipped
+}
+
+// endFile adds the input read from raw to the finished ones.
+func (p *progress) endFile(raw *countingReader) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := slices.Index(p.files, raw); i >= 0 {
+		p.done += raw.n.Load()
+		p.files = slices.Delete(p.files, i, i+1)
+	}
+}
+
+// skipFile counts an input of size bytes passed over whole as read.
+func (p *progress) skipFile(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += size
+	p.skipped += size
+}
+
+// line counts a line read.
+func (p *progress) line() {
+	p.lines.Add(1)
+}
+
+// close stops reporting. It may be called more than once.
+func (p *progress) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+	})
+}
+
+// finish stops reporting and logs a summary of what was read.
+func (p *progress) finish() {
+	p.close()
+	slog.Info("read input", p.attrs()...)
+}
+
+// position returns the bytes read so far, including skipped ones, and the
+// bytes actually read by this run.
+func (p *progress) position() (read, fresh int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	read = p.done
+	for _, f := range p.files {
+		read += f.n.Load()
+	}
+	return read, read - p.skipped
+}
+
+// rates returns lines and bytes per second so far, and the estimated time left
+// (negative when it cannot be estimated).
+func (p *progress) rates() (lines, bytes float64, eta time.Duration) {
+	elapsed := time.Since(p.start).Seconds()
+	read, fresh := p.position()
+	lines = float64(p.lines.Load()) / elapsed
+	bytes = float64(fresh) / elapsed
+	eta = -1
+	if p.total >= 0 && bytes > 0 {
+		eta = time.Duration(float64(max(p.total-read, 0)) / bytes * float64(time.Second))
+	}
+	return lines, bytes, eta
+}
+
+// status formats the progress for a terminal status line.
+func (p *progress) status() string {
+	lineRate, byteRate, eta := p.rates()
+	read, _ := p.position()
+	s := fmt.Sprintf("%s lines  %s lines/s  %s/s  %s", shortCount(float64(p.lines.Load())),
+		shortCount(lineRate), shortBytes(byteRate), shortBytes(float64(read)))
+	if p.total > 0 {
+		s += fmt.Sprintf(" of %s (%.0f%%)", shortBytes(float64(p.total)), 100*float64(read)/float64(p.total))
+	}
+	if eta >= 0 {
+		s += "  ETA " + eta.Round(time.Second).String()
+	}
+	return s
+}
+
+// attrs formats the progress as log attributes, without the ETA.
+func (p *progress) attrs() []any {
+	lineRate, byteRate, _ := p.rates()
+	read, _ := p.position()
+	return []any{
+		"lines", p.lines.Load(),
+		"bytes", read,
+		"elapsed", time.Since(p.start).Round(time.Millisecond),
+		"lines_per_sec", int64(lineRate),
+		"bytes_per_sec", int64(byteRate),
+	}
+}
+
+// shortCount formats n with a k, M or G suffix.
+func shortCount(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", n/1e3)
+	}
+	return fmt.Sprintf("%.0f", n)
+}
+
+// shortBytes formats n bytes with a KiB, MiB or GiB suffix.
+func shortBytes(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", n/(1<<10))
+	}
+	return fmt.Sprintf("%.0f B", n)
+}
+
+// isTerminal reports whether f is an interactive terminal that understands
+// carriage returns and erase-line sequences.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// stderr is where logs and the status line are written. Writing a log record
+// first erases the status line, which is redrawn on the next refresh.
+var stderr = &statusWriter{w: os.Stderr}
+
+type statusWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	shown bool // a status line is on screen
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.erase()
+	return s.w.Write(b)
+}
+
+// status replaces the status line with line.
+func (s *statusWriter) status(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "\r%s\x1b[K", line)
+	s.shown = true
+}
+
+// clear erases the status line, if any.
+func (s *statusWriter) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.erase()
+}
+
+func (s *statusWriter) erase() {
+	if s.shown {
+		io.WriteString(s.w, "\r\x1b[K")
+		s.shown = false
+	}
+}
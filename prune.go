@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// pruneCounts are the rows a prune removed, or would remove.
+type pruneCounts struct {
+	Domains     int64
+	Clients     int64
+	Hours       int64
+	Resolutions int64
+	Sources     int64
+	Types       int64
+	Addresses   int64
+	Scores      int64
+	Liveness    int64
+	Devices     int64
+}
+
+func (c pruneCounts) attrs() []any {
+	return []any{"domains", c.Domains, "client_rows", c.Clients, "hour_rows", c.Hours, "resolution_rows", c.Resolutions, "source_rows", c.Sources, "type_rows", c.Types, "address_rows", c.Addresses, "score_rows", c.Scores, "liveness_rows", c.Liveness, "lease_rows", c.Devices}
+}
+
+const pruneFlagUsage = "after saving, delete domains last seen longer ago than `age` (duration such as 4320h or 180d, or a date)"
+
+// pruneEvery limits how often tail prunes with --prune-older-than.
+const pruneEvery = time.Hour
+
+// pruneOlderThan deletes the domains of st last seen before the --prune-older-than
+// value age, logging what it removed.
+func pruneOlderThan(ctx context.Context, st store, age string) error {
+	cutoff, err := parseSince(age, time.Now())
+	if err != nil {
+		return err
+	}
+	counts, err := st.prune(ctx, cutoff, false)
+	if err != nil {
+		return fmt.Errorf("pruning: %w", err)
+	}
+	slog.Info("pruned stale domains", append(counts.attrs(), "before", time.Unix(cutoff, 0).Format(time.DateTime))...)
+	return nil
+}
+
+// runPrune implements the prune subcommand: delete the domains not seen for a
+// while, with their per-client rows, hourly counts, resolution counters,
+// sources, query types, addresses, scores and recheck results, and the DHCP
+// leases not seen either, so the database does not grow forever.
+func runPrune(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	olderThan := fs.String("older-than", "", "delete domains last seen before this `time` (duration such as 180d, or a date)")
+	dryRun := fs.Bool("dry-run", false, "count what would be deleted without deleting it")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *olderThan == "" {
+		return fmt.Errorf("prune needs --older-than")
+	}
+	cutoff, err := parseSince(*olderThan, time.Now())
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	counts, err := st.prune(ctx, cutoff, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	fmt.Printf("%s %d domains last seen before %s, with %d client rows, %d hourly counts, %d resolution rows, %d source rows, %d type rows, %d address rows, %d scores, %d recheck results and %d lease rows\n",
+		verb, counts.Domains, time.Unix(cutoff, 0).Format(time.DateTime), counts.Clients, counts.Hours, counts.Resolutions, counts.Sources, counts.Types, counts.Addresses, counts.Scores, counts.Liveness, counts.Devices)
+	return nil
+}
+
+// prune deletes, or with dryRun only counts, the domains last seen before
+// cutoff along with their resolution counters, scores and recheck results,
+// the client, source, type, address and lease rows last seen before cutoff, and the
+// hourly counts before the hour containing it.
+// Entries of the sources table itself are kept: they are a few per input file.
+func (db *database) prune(ctx context.Context, cutoff int64, dryRun bool) (pruneCounts, error) {
+	var counts pruneCounts
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return counts, err
+	}
+	defer tx.Rollback()
+
+	// Rows keyed by domain alone go first, while their domains can still be found.
+	for _, step := range []struct {
+		n      *int64
+		table  string
+		where  string
+		cutoff int64
+	}{
+		{&counts.Resolutions, "domain_resolution", "domain IN (SELECT domain FROM domains WHERE last_seen < ?)", cutoff},
+		{&counts.Scores, "domain_scores", "domain IN (SELECT domain FROM domains WHERE last_seen < ?)", cutoff},
+		{&counts.Liveness, "domain_liveness", "domain IN (SELECT domain FROM domains WHERE last_seen < ?)", cutoff},
+		{&counts.Domains, "domains", "last_seen < ?", cutoff},
+		{&counts.Clients, "domain_clients", "last_seen < ?", cutoff},
+		{&counts.Sources, "domain_sources", "last_seen < ?", cutoff},
+		{&counts.Types, "domain_types", "last_seen < ?", cutoff},
+		{&counts.Addresses, "domain_addresses", "last_seen < ?", cutoff},
+		{&counts.Devices, "devices", "last_seen < ?", cutoff},
+		{&counts.Hours, "domain_hours", "hour < ?", hourOf(cutoff)},
+	} {
+		if dryRun {
+			err = tx.QueryRowContext(ctx, db.rebind("SELECT COUNT(*) FROM "+step.table+" WHERE "+step.where), step.cutoff).Scan(step.n)
+		} else {
+			var res sql.Result
+			if res, err = tx.ExecContext(ctx, db.rebind("DELETE FROM "+step.table+" WHERE "+step.where), step.cutoff); err == nil {
+				*step.n, err = res.RowsAffected()
+			}
+		}
+		if err != nil {
+			return counts, fmt.Errorf("pruning %s: %w", step.table, err)
+		}
+	}
+	if dryRun {
+		return counts, nil
+	}
+	return counts, tx.Commit()
+}
+
+func (s *memoryStore) prune(ctx context.Context, cutoff int64, dryRun bool) (pruneCounts, error) {
+	var counts pruneCounts
+	for domain, t := range s.domains {
+		if t.LastSeen >= cutoff {
+			continue
+		}
+		counts.Domains++
+		if _, ok := s.resolutions[domain]; ok {
+			counts.Resolutions++
+		}
+		if _, ok := s.scores[domain]; ok {
+			counts.Scores++
+		}
+		if _, ok := s.liveness[domain]; ok {
+			counts.Liveness++
+		}
+		if !dryRun {
+			delete(s.domains, domain)
+			delete(s.resolutions, domain)
+			delete(s.scores, domain)
+			delete(s.liveness, domain)
+		}
+	}
+	for key, t := range s.clients {
+		if t.LastSeen < cutoff {
+			counts.Clients++
+			if !dryRun {
+				delete(s.clients, key)
+			}
+		}
+	}
+	for _, domains := range s.sources {
+		for domain, t := range domains {
+			if t.LastSeen < cutoff {
+				counts.Sources++
+				if !dryRun {
+					delete(domains, domain)
+				}
+			}
+		}
+	}
+	for key, t := range s.types {
+		if t.LastSeen < cutoff {
+			counts.Types++
+			if !dryRun {
+				delete(s.types, key)
+			}
+		}
+	}
+	for key, t := range s.addresses {
+		if t.LastSeen < cutoff {
+			counts.Addresses++
+			if !dryRun {
+				delete(s.addresses, key)
+			}
+		}
+	}
+	for key, t := range s.devices {
+		if t.LastSeen < cutoff {
+			counts.Devices++
+			if !dryRun {
+				delete(s.devices, key)
+			}
+		}
+	}
+	for key := range s.hours {
+		if key.Hour < hourOf(cutoff) {
+			counts.Hours++
+			if !dryRun {
+				delete(s.hours, key)
+			}
+		}
+	}
+	return counts, ctx.Err()
+}
+
+func (s *boltStore) prune(ctx context.Context, cutoff int64, dryRun bool) (pruneCounts, error) {
+	var counts pruneCounts
+	run := s.update
+	if dryRun {
+		run = func(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return s.db.View(fn)
+		}
+	}
+	err := run(ctx, func(tx *bolt.Tx) error {
+		domains, err := staleKeys(tx, boltDomains, func(k, v []byte) bool {
+			return decodeTimes(v).LastSeen < cutoff
+		})
+		if err != nil {
+			return err
+		}
+		clients, err := staleKeys(tx, boltClients, func(k, v []byte) bool {
+			return decodeTimes(v).LastSeen < cutoff
+		})
+		if err != nil {
+			return err
+		}
+		sources, err := staleKeys(tx, boltSources, func(k, v []byte) bool {
+			return decodeTimes(v).LastSeen < cutoff
+		})
+		if err != nil {
+			return err
+		}
+		types, err := staleKeys(tx, boltTypes, func(k, v []byte) bool {
+			return decodeTimes(v).LastSeen < cutoff
+		})
+		if err != nil {
+			return err
+		}
+		addresses, err := staleKeys(tx, boltAddresses, func(k, v []byte) bool {
+			return decodeTimes(v).LastSeen < cutoff
+		})
+		if err != nil {
+			return err
+		}
+		devices, err := staleKeys(tx, boltDevices, func(k, v []byte) bool {
+			return decodeTimes(v).LastSeen < cutoff
+		})
+		if err != nil {
+			return err
+		}
+		hours, err := staleKeys(tx, boltHours, func(k, v []byte) bool {
+			return int64(binary.BigEndian.Uint64(k[len(k)-8:])) < hourOf(cutoff)
+		})
+		if err != nil {
+			return err
+		}
+		resolutions := storedKeys(tx, boltResolution, domains)
+		scores := storedKeys(tx, boltScores, domains)
+		liveness := storedKeys(tx, boltLiveness, domains)
+		counts = pruneCounts{int64(len(domains)), int64(len(clients)), int64(len(hours)), int64(len(resolutions)), int64(len(sources)),
+			int64(len(types)), int64(len(addresses)), int64(len(scores)), int64(len(liveness)), int64(len(devices))}
+		if dryRun {
+			return nil
+		}
+		for _, stale := range []struct {
+			bucket []byte
+			keys   [][]byte
+		}{{boltDomains, domains}, {boltClients, clients}, {boltHours, hours}, {boltResolution, resolutions}, {boltSources, sources},
+			{boltTypes, types}, {boltAddresses, addresses}, {boltScores, scores}, {boltLiveness, liveness}, {boltDevices, devices}} {
+			b := tx.Bucket(stale.bucket)
+			for _, k := range stale.keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// staleKeys returns the keys of bucket whose entries are stale. A bucket
+// missing from a read-only file has none.
+func staleKeys(tx *bolt.Tx, bucket []byte, stale func(k, v []byte) bool) ([][]byte, error) {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil, nil
+	}
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if stale(k, v) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// storedKeys returns those of keys present in bucket.
+func storedKeys(tx *bolt.Tx, bucket []byte, keys [][]byte) [][]byte {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	var stored [][]byte
+	for _, k := range keys {
+		if b.Get(k) != nil {
+			stored = append(stored, k)
+		}
+	}
+	return stored
+}
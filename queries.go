@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"time"
+)
+
+// queryOptions configures the optional queries table, which records every
+// query rather than only the aggregates, for ad-hoc SQL such as "everything
+// this device looked up between 2am and 3am".
+type queryOptions struct {
+	Enabled   bool
+	Retention time.Duration
+}
+
+// addQueryFlags registers --queries and --queries-retention on fs.
+func addQueryFlags(fs *flag.FlagSet) *queryOptions {
+	o := &queryOptions{}
+	fs.BoolVar(&o.Enabled, "queries", false, "also record every query (timestamp, domain, type, client, action) in the queries table")
+	fs.DurationVar(&o.Retention, "queries-retention", 30*24*time.Hour, "delete recorded queries older than `age` whenever saving (0 keeps them all)")
+	return o
+}
+
+// enable makes agg collect queries for st when --queries is given. st is nil
+// for dry runs, which have nowhere to record them.
+func (o *queryOptions) enable(agg *aggregator, st store) error {
+	if !o.Enabled || st == nil {
+		return nil
+	}
+	if _, ok := st.(*database); !ok {
+		return errors.New("--queries needs a SQL database")
+	}
+	agg.queries = newQueryLog(o.Retention)
+	return nil
+}
+
+// queryEvent is one row of the queries table. Domain is as logged, not reversed.
+type queryEvent struct {
+	Timestamp int64
+	Domain    string
+	Type      string
+	Client    string
+	Action    string // what dnsmasq did: cached, forwarded, config, hosts...; empty if not seen
+}
+
+// queryLog collects the queries of an aggregator until they are saved. A query
+// takes its action from the next line about the same domain saying what
+// dnsmasq did with it, which follows the query line directly in practice.
+type queryLog struct {
+	retention time.Duration
+	events    []queryEvent
+	awaiting  map[string]int // domain → index of its latest query without an action
+}
+
+func newQueryLog(retention time.Duration) *queryLog {
+	return &queryLog{retention: retention, awaiting: make(map[string]int)}
+}
+
+func (q *queryLog) add(e queryEvent) {
+	q.awaiting[e.Domain] = len(q.events)
+	q.events = append(q.events, e)
+}
+
+// reset drops the saved queries. Those still awaiting an action were saved
+// without one.
+func (q *queryLog) reset() {
+	q.events = q.events[:0]
+	clear(q.awaiting)
+}
+
+// takeAwaiting returns the latest query of domain still without an action, for
+// the caller to fill in, or nil.
+func (q *queryLog) takeAwaiting(domain []byte) *queryEvent {
+	i, ok := q.awaiting[string(domain)]
+	if !ok {
+		return nil
+	}
+	delete(q.awaiting, q.events[i].Domain)
+	return &q.events[i]
+}
+
+// saveQueries appends events to the queries table, leaving out those already
+// past retention, and then deletes the rows that are (retention 0 keeps all).
+func (db *database) saveQueries(ctx context.Context, events []queryEvent, retention time.Duration) error {
+	var cutoff int64
+	if retention > 0 {
+		cutoff = time.Now().Add(-retention).Unix()
+	}
+	args := make([]any, 0, 5*len(events))
+	for _, e := range events {
+		if e.Timestamp >= cutoff {
+			args = append(args, e.Timestamp, e.Domain, e.Type, e.Client, e.Action)
+		}
+	}
+	if len(args) > 0 {
+		if err := db.upsertRows(ctx, "queries", []upsertColumn{
+			{"timestamp", mergeReplace},
+			{"domain", mergeReplace},
+			{"type", mergeReplace},
+			{"client", mergeReplace},
+			{"action", mergeReplace},
+		}, args); err != nil {
+			return err
+		}
+	}
+	if cutoff > 0 {
+		_, err := db.ExecContext(ctx, "DELETE FROM queries WHERE timestamp < ?", cutoff)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// domainRank is the place of a registrable domain in a popularity list such
+// as Tranco or Umbrella. Rank is 0 when the domain was not on the list.
+type domainRank struct {
+	Rank      int64
+	UpdatedAt int64
+}
+
+// readRankList reads the ranks of the registrable domains wanted from the
+// list at path: "rank,domain" lines as in the Tranco and Umbrella CSV files,
+// or bare domains ranked by line number, optionally gzip- or zip-compressed.
+// A listed subdomain ranks its registrable domain, so the best rank wins.
+func readRankList(path string, wanted map[string]bool) (map[string]int64, error) {
+	var r io.Reader
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		z, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		if len(z.File) == 0 {
+			return nil, fmt.Errorf("%s: empty zip file", path)
+		}
+		f, err := z.File[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		in, err := openInput(path)
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		r = in
+	}
+
+	ranks := make(map[string]int64)
+	sc := bufio.NewScanner(r)
+	line := int64(0)
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rank, domain := line, text
+		if before, after, ok := strings.Cut(text, ","); ok {
+			n, err := strconv.ParseInt(before, 10, 64)
+			if err != nil {
+				continue // a header
+			}
+			rank, domain = n, after
+		}
+		domain = registrableDomain(canonicalDomain(strings.TrimSpace(domain)))
+		if !wanted[domain] {
+			continue
+		}
+		if r, ok := ranks[domain]; !ok || rank < r {
+			ranks[domain] = rank
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if line == 0 {
+		return nil, fmt.Errorf("%s: empty list", path)
+	}
+	return ranks, nil
+}
+
+// publicDomain reports whether domain is under a public suffix managed by
+// ICANN, rather than a local name such as printer.lan that no list ranks.
+func publicDomain(domain string) bool {
+	_, icann := publicsuffix.PublicSuffix(domain)
+	return icann
+}
+
+// enrichRanks stores the rank in the list at path of every registrable domain
+// of st under a public suffix, replacing what an earlier list said.
+func enrichRanks(ctx context.Context, st store, path string) (ranked, total int, err error) {
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	wanted := make(map[string]bool)
+	for _, row := range rows {
+		if domain := reverseDomainParts(row.Domain); publicDomain(domain) {
+			wanted[registrableDomain(domain)] = true
+		}
+	}
+	listed, err := readRankList(path, wanted)
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now().Unix()
+	ranks := make(map[string]domainRank, len(wanted))
+	for domain := range wanted {
+		ranks[domain] = domainRank{Rank: listed[domain], UpdatedAt: now}
+	}
+	return len(listed), len(wanted), st.saveRanks(ctx, ranks)
+}
+
+func (db *database) saveRanks(ctx context.Context, ranks map[string]domainRank) error {
+	args := make([]any, 0, 3*len(ranks))
+	for domain, r := range ranks {
+		args = append(args, domain, r.Rank, r.UpdatedAt)
+	}
+	return db.upsertRows(ctx, "ranks", []upsertColumn{
+		{"domain", mergeKey},
+		{"list_rank", mergeReplace},
+		{"updated_at", mergeReplace},
+	}, args)
+}
+
+func (db *database) loadRanks(ctx context.Context) (map[string]domainRank, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, list_rank, updated_at FROM ranks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranks := make(map[string]domainRank)
+	for rows.Next() {
+		var domain string
+		var r domainRank
+		if err := rows.Scan(&domain, &r.Rank, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		ranks[domain] = r
+	}
+	return ranks, rows.Err()
+}
+
+// encodeRank and decodeRank store a domainRank in bbolt.
+func encodeRank(r domainRank) []byte {
+	return []byte(strconv.FormatInt(r.Rank, 10) + " " + strconv.FormatInt(r.UpdatedAt, 10))
+}
+
+func decodeRank(v []byte) domainRank {
+	rank, updated, _ := strings.Cut(string(v), " ")
+	var r domainRank
+	r.Rank, _ = strconv.ParseInt(rank, 10, 64)
+	r.UpdatedAt, _ = strconv.ParseInt(updated, 10, 64)
+	return r
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rdapSaveEvery is how many lookups enrich --rdap makes between saves, so an
+// interrupted run keeps most of what it looked up.
+const rdapSaveEvery = 100
+
+// registration is what RDAP said of a registrable domain. RegisteredAt is 0
+// when the registry did not know the domain or gave no registration date.
+type registration struct {
+	RegisteredAt int64
+	CheckedAt    int64
+}
+
+// rdapOptions configures the RDAP lookups of enrich.
+type rdapOptions struct {
+	Enabled   bool
+	Refresh   time.Duration
+	Workers   int
+	Bootstrap string
+}
+
+// addRDAPFlags registers the --rdap flags on fs.
+func addRDAPFlags(fs *flag.FlagSet) *rdapOptions {
+	o := &rdapOptions{}
+	fs.BoolVar(&o.Enabled, "rdap", false, "look up the registration date of each registrable domain over RDAP")
+	fs.DurationVar(&o.Refresh, "rdap-refresh", 30*24*time.Hour, "look domains up again once their stored registration is older than `age`")
+	fs.IntVar(&o.Workers, "rdap-workers", 4, "make up to `n` RDAP requests at a time")
+	fs.StringVar(&o.Bootstrap, "rdap-bootstrap", "https://data.iana.org/rdap/dns.json", "`url` of the IANA bootstrap file listing the RDAP server of each TLD")
+	return o
+}
+
+// rdapClient looks domains up at the RDAP servers of their TLDs.
+type rdapClient struct {
+	client  *http.Client
+	servers map[string]string // TLD → base URL, ending in /
+}
+
+// newRDAPClient fetches the bootstrap file at bootstrapURL.
+func newRDAPClient(ctx context.Context, bootstrapURL string) (*rdapClient, error) {
+	c := &rdapClient{client: &http.Client{Timeout: 30 * time.Second}, servers: make(map[string]string)}
+	var bootstrap struct {
+		Services [][][]string `json:"services"`
+	}
+	if err := c.get(ctx, bootstrapURL, &bootstrap); err != nil {
+		return nil, fmt.Errorf("reading RDAP bootstrap: %w", err)
+	}
+	for _, service := range bootstrap.Services {
+		if len(service) < 2 {
+			continue
+		}
+		var base string
+		for _, u := range service[1] {
+			if strings.HasPrefix(u, "https://") || base == "" {
+				base = u
+			}
+		}
+		if base == "" {
+			continue
+		}
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		for _, tld := range service[0] {
+			c.servers[strings.ToLower(tld)] = base
+		}
+	}
+	return c, nil
+}
+
+// errRDAPNotFound is a 404 from an RDAP server: the domain is not registered.
+var errRDAPNotFound = errors.New("not found")
+
+func (c *rdapClient) get(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errRDAPNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// server returns the RDAP base URL for a registrable domain, or "" if its TLD
+// has none.
+func (c *rdapClient) server(domain string) string {
+	return c.servers[domain[strings.LastIndexByte(domain, '.')+1:]]
+}
+
+// lookup returns the registration date of domain as a unix time, or 0 when
+// the registry has none.
+func (c *rdapClient) lookup(ctx context.Context, base, domain string) (int64, error) {
+	var resp struct {
+		Events []struct {
+			Action string `json:"eventAction"`
+			Date   string `json:"eventDate"`
+		} `json:"events"`
+	}
+	err := c.get(ctx, base+"domain/"+url.PathEscape(domain), &resp)
+	if errors.Is(err, errRDAPNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range resp.Events {
+		if e.Action == "registration" {
+			t, err := time.Parse(time.RFC3339, e.Date)
+			if err != nil {
+				return 0, fmt.Errorf("registration date of %s: %w", domain, err)
+			}
+			return t.Unix(), nil
+		}
+	}
+	return 0, nil
+}
+
+// enrichRDAP looks up the registrable domains of st not looked up within
+// o.Refresh, saving as it goes. Domains whose TLD has no RDAP server, such as
+// local names, are skipped; failed lookups are logged and tried again next
+// time.
+func enrichRDAP(ctx context.Context, st store, dbOpts dbOptions, o *rdapOptions) (looked, registered int, err error) {
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(loadCtx)
+	if err != nil {
+		return 0, 0, err
+	}
+	known, err := st.loadRegistrations(loadCtx)
+	if err != nil {
+		return 0, 0, err
+	}
+	client, err := newRDAPClient(ctx, o.Bootstrap)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	wanted := make(map[string]bool)
+	for _, row := range rows {
+		domain := registrableDomain(reverseDomainParts(row.Domain))
+		if r, ok := known[domain]; ok && now.Sub(time.Unix(r.CheckedAt, 0)) < o.Refresh {
+			continue
+		}
+		if client.server(domain) != "" {
+			wanted[domain] = true
+		}
+	}
+	slog.Info("looking up registrations", "domains", len(wanted))
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	found := make(map[string]registration)
+	var wg sync.WaitGroup
+	for range max(o.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				at, err := client.lookup(ctx, client.server(domain), domain)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Warn("RDAP lookup failed", "domain", domain, "err", err)
+					}
+					continue
+				}
+				mu.Lock()
+				found[domain] = registration{RegisteredAt: at, CheckedAt: time.Now().Unix()}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	save := func() error {
+		mu.Lock()
+		batch := found
+		found = make(map[string]registration)
+		mu.Unlock()
+		for _, r := range batch {
+			looked++
+			if r.RegisteredAt != 0 {
+				registered++
+			}
+		}
+		saveCtx, cancel := dbOpts.withTimeout(context.WithoutCancel(ctx))
+		defer cancel()
+		return st.saveRegistrations(saveCtx, batch)
+	}
+	sent := 0
+	for domain := range wanted {
+		select {
+		case jobs <- domain:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if sent++; sent%rdapSaveEvery == 0 {
+			if err := save(); err != nil {
+				close(jobs)
+				wg.Wait()
+				return looked, registered, err
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := save(); err != nil {
+		return looked, registered, err
+	}
+	return looked, registered, ctx.Err()
+}
+
+func (db *database) saveRegistrations(ctx context.Context, registrations map[string]registration) error {
+	args := make([]any, 0, 3*len(registrations))
+	for domain, r := range registrations {
+		args = append(args, domain, r.RegisteredAt, r.CheckedAt)
+	}
+	return db.upsertRows(ctx, "registrations", []upsertColumn{
+		{"domain", mergeKey},
+		{"registered_at", mergeReplace},
+		{"checked_at", mergeReplace},
+	}, args)
+}
+
+func (db *database) loadRegistrations(ctx context.Context) (map[string]registration, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, registered_at, checked_at FROM registrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registrations := make(map[string]registration)
+	for rows.Next() {
+		var domain string
+		var r registration
+		if err := rows.Scan(&domain, &r.RegisteredAt, &r.CheckedAt); err != nil {
+			return nil, err
+		}
+		registrations[domain] = r
+	}
+	return registrations, rows.Err()
+}
+
+// encodeRegistration and decodeRegistration store a registration in bbolt.
+func encodeRegistration(r registration) []byte {
+	return []byte(strconv.FormatInt(r.RegisteredAt, 10) + " " + strconv.FormatInt(r.CheckedAt, 10))
+}
+
+func decodeRegistration(v []byte) registration {
+	registered, checked, _ := strings.Cut(string(v), " ")
+	var r registration
+	r.RegisteredAt, _ = strconv.ParseInt(registered, 10, 64)
+	r.CheckedAt, _ = strconv.ParseInt(checked, 10, 64)
+	return r
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// recheckSaveEvery is how many domains recheck resolves between saves.
+const recheckSaveEvery = 500
+
+// The statuses a recheck gives a domain.
+const (
+	statusLive      = "live"      // resolves to routable addresses
+	statusDead      = "dead"      // NXDOMAIN: the name no longer exists
+	statusNoAnswer  = "no-answer" // exists, with no A or AAAA records
+	statusSinkholed = "sinkholed" // resolves only to unspecified or loopback addresses
+	statusFailed    = "failed"    // no usable answer, such as SERVFAIL or a timeout
+)
+
+// liveness is what the last recheck of a domain found.
+type liveness struct {
+	Status    string   `json:"status"`
+	Addresses []string `json:"addresses,omitempty"`
+	CheckedAt int64    `json:"checked_at"`
+}
+
+// dnsClient asks one DNS server directly, over UDP and then TCP for answers
+// too long for UDP. Unlike net.Resolver it tells a name that does not exist
+// (NXDOMAIN) from one without records of the type asked for.
+type dnsClient struct {
+	server string // host:port
+}
+
+// newDNSClient returns a client of server (host or host:port), or of the
+// first nameserver of /etc/resolv.conf when server is "".
+func newDNSClient(server string) dnsClient {
+	if server == "" {
+		server = systemNameserver()
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return dnsClient{server: server}
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf, or
+// 127.0.0.1 where there is none.
+func systemNameserver() string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for line := range strings.Lines(string(data)) {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return "127.0.0.1"
+}
+
+// exchange sends a recursive query for name and returns the answer.
+func (c dnsClient) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.roundTrip(ctx, "udp", packed, query.ID)
+	if err == nil && resp.Truncated {
+		resp, err = c.roundTrip(ctx, "tcp", packed, query.ID)
+	}
+	return resp, err
+}
+
+func (c dnsClient) roundTrip(ctx context.Context, network string, packed []byte, id uint16) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		for {
+			if n, err = conn.Read(buf); err != nil {
+				return nil, err
+			}
+			// Skip stray answers to earlier queries.
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				break
+			}
+		}
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if resp.ID != id || !resp.Response {
+		return nil, errors.New("mismatched DNS response")
+	}
+	return &resp, nil
+}
+
+// checkLiveness resolves the A and AAAA records of domain with c.
+func checkLiveness(ctx context.Context, c dnsClient, domain string) liveness {
+	l := liveness{CheckedAt: time.Now().Unix()}
+	l.Status = statusSinkholed
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		resp, err := c.exchange(ctx, domain, qtype)
+		switch {
+		case err != nil:
+			return liveness{Status: statusFailed, CheckedAt: l.CheckedAt}
+		case resp.RCode == dnsmessage.RCodeNameError:
+			return liveness{Status: statusDead, CheckedAt: l.CheckedAt}
+		case resp.RCode != dnsmessage.RCodeSuccess:
+			return liveness{Status: statusFailed, CheckedAt: l.CheckedAt}
+		}
+		for _, rr := range resp.Answers {
+			var addr netip.Addr
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addr = netip.AddrFrom4(body.A)
+			case *dnsmessage.AAAAResource:
+				addr = netip.AddrFrom16(body.AAAA).Unmap()
+			default:
+				continue
+			}
+			l.Addresses = append(l.Addresses, addr.String())
+			if !addr.IsUnspecified() && !addr.IsLoopback() {
+				l.Status = statusLive
+			}
+		}
+	}
+	if len(l.Addresses) == 0 {
+		l.Status = statusNoAnswer
+	}
+	slices.Sort(l.Addresses)
+	l.Addresses = slices.Compact(l.Addresses)
+	return l
+}
+
+// runRecheck implements the recheck subcommand: resolve the stored domains
+// again to find which still resolve, and to what. Domains that no longer
+// exist are marked dead, and those answered with 0.0.0.0 or a loopback
+// address sinkholed, as names taken down or blocked upstream are.
+func runRecheck(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("recheck", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	server := fs.String("resolver", "", "resolve with the DNS server at `host[:port]` (default: the first nameserver of /etc/resolv.conf)")
+	workers := fs.Int("workers", 16, "resolve up to `n` domains at a time")
+	lookupTimeout := fs.Duration("lookup-timeout", 5*time.Second, "give up on a domain after `duration`")
+	after := fs.Duration("after", 24*time.Hour, "skip the domains rechecked within `duration`, unless the lookup failed")
+	since := fs.String("since", "", "only recheck domains last seen after this `time` (duration such as 24h or 7d, or a date)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	loadCtx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(loadCtx)
+	if err != nil {
+		return err
+	}
+	known, err := st.loadLiveness(loadCtx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	rows = slices.DeleteFunc(rows, func(r domainRow) bool {
+		l, ok := known[r.Domain]
+		return r.LastSeen < cutoff || ok && l.Status != statusFailed && now.Sub(time.Unix(l.CheckedAt, 0)) < *after
+	})
+	client := newDNSClient(*server)
+	slog.Info("rechecking domains", "domains", len(rows), "resolver", client.server)
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	found := make(map[string]liveness)
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for range max(*workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				lookupCtx, cancel := context.WithTimeout(ctx, *lookupTimeout)
+				l := checkLiveness(lookupCtx, client, reverseDomainParts(domain))
+				cancel()
+				if ctx.Err() != nil {
+					continue
+				}
+				mu.Lock()
+				found[domain] = l
+				counts[l.Status]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// flagged collects the dead and sinkholed domains to list at the end.
+	type flaggedDomain struct {
+		domainRow
+		liveness
+	}
+	var flagged []flaggedDomain
+	byDomain := make(map[string]domainRow, len(rows))
+	save := func() error {
+		mu.Lock()
+		batch := found
+		found = make(map[string]liveness)
+		mu.Unlock()
+		for domain, l := range batch {
+			if l.Status == statusDead || l.Status == statusSinkholed {
+				flagged = append(flagged, flaggedDomain{byDomain[domain], l})
+			}
+		}
+		saveCtx, cancel := dbOpts.withTimeout(context.WithoutCancel(ctx))
+		defer cancel()
+		return st.saveLiveness(saveCtx, batch)
+	}
+	for i, row := range rows {
+		byDomain[row.Domain] = row
+		select {
+		case jobs <- row.Domain:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if (i+1)%recheckSaveEvery == 0 {
+			if err := save(); err != nil {
+				close(jobs)
+				wg.Wait()
+				return err
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := save(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("rechecked %d domains: %d live, %d dead, %d sinkholed, %d without addresses, %d failed\n",
+		len(rows), counts[statusLive], counts[statusDead], counts[statusSinkholed], counts[statusNoAnswer], counts[statusFailed])
+	if len(flagged) == 0 {
+		return nil
+	}
+	slices.SortFunc(flagged, func(a, b flaggedDomain) int {
+		if c := cmpInt(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tSTATUS\tADDRESSES\tLAST SEEN\tQUERIES")
+	for _, f := range flagged {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", reverseDomainParts(f.Domain), f.Status,
+			cmp.Or(strings.Join(f.Addresses, " "), "-"), formatUnix(f.LastSeen), f.Count)
+	}
+	return tw.Flush()
+}
+
+func (db *database) saveLiveness(ctx context.Context, checks map[string]liveness) error {
+	args := make([]any, 0, 4*len(checks))
+	for domain, l := range checks {
+		args = append(args, domain, l.Status, strings.Join(l.Addresses, ","), l.CheckedAt)
+	}
+	return db.upsertRows(ctx, "domain_liveness", []upsertColumn{
+		{"domain", mergeKey},
+		{"status", mergeReplace},
+		{"addresses", mergeReplace},
+		{"checked_at", mergeReplace},
+	}, args)
+}
+
+func (db *database) loadLiveness(ctx context.Context) (map[string]liveness, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain, status, addresses, checked_at FROM domain_liveness")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := make(map[string]liveness)
+	for rows.Next() {
+		var domain, addresses string
+		var l liveness
+		if err := rows.Scan(&domain, &l.Status, &addresses, &l.CheckedAt); err != nil {
+			return nil, err
+		}
+		if addresses != "" {
+			l.Addresses = strings.Split(addresses, ",")
+		}
+		checks[domain] = l
+	}
+	return checks, rows.Err()
+}
+
+// encodeLiveness and decodeLiveness store liveness in bbolt as NUL-separated
+// fields.
+func encodeLiveness(l liveness) []byte {
+	return []byte(l.Status + "\x00" + strings.Join(l.Addresses, ",") + "\x00" + strconv.FormatInt(l.CheckedAt, 10))
+}
+
+func decodeLiveness(v []byte) liveness {
+	fields := strings.SplitN(string(v), "\x00", 3)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+	l := liveness{Status: fields[0]}
+	if fields[1] != "" {
+		l.Addresses = strings.Split(fields[1], ",")
+	}
+	l.CheckedAt, _ = strconv.ParseInt(fields[2], 10, 64)
+	return l
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// registeredSummary is a newly registered domain and what was seen under it.
+type registeredSummary struct {
+	Domain       string
+	RegisteredAt int64
+	FirstSeen    int64
+	LastSeen     int64
+	Queries      int64
+	Names        []string // queried names under Domain, forward, in order
+}
+
+// runRegistered implements the registered subcommand: the registrable domains
+// registered recently, as looked up by enrich --rdap. Newly registered
+// domains turning up in queries are a common sign of phishing or malware.
+func runRegistered(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("registered", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	within := fs.String("within", "30d", "show the domains registered after this `time` (duration such as 24h or 30d, or a date)")
+	n := addLimitFlag(fs, 5, "list at most `n` queried names per domain (0 for all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	cutoff, err := parseSince(*within, time.Now())
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	registrations, err := st.loadRegistrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(registrations) == 0 {
+		return errors.New("no registrations stored: run enrich --rdap first")
+	}
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+
+	domains := summarizeRegistered(rows, registrations, cutoff)
+	fmt.Printf("%d domains registered since %s\n", len(domains), time.Unix(cutoff, 0).Format("2006-01-02"))
+	if len(domains) == 0 {
+		return nil
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tREGISTERED\tFIRST SEEN\tLAST SEEN\tQUERIES\tNAMES")
+	for _, d := range domains {
+		names := d.Names
+		if *n > 0 && len(names) > *n {
+			names = append(slices.Clip(names[:*n]), fmt.Sprintf("(%d more)", len(d.Names)-*n))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", d.Domain, time.Unix(d.RegisteredAt, 0).Format("2006-01-02"),
+			formatUnix(d.FirstSeen), formatUnix(d.LastSeen), d.Queries, strings.Join(names, " "))
+	}
+	return tw.Flush()
+}
+
+// summarizeRegistered groups rows by registrable domain, keeping those
+// registered at or after cutoff, most recently registered first.
+func summarizeRegistered(rows []domainRow, registrations map[string]registration, cutoff int64) []registeredSummary {
+	byDomain := make(map[string]*registeredSummary)
+	for _, row := range rows {
+		name := reverseDomainParts(row.Domain)
+		domain := registrableDomain(name)
+		r, ok := registrations[domain]
+		if !ok || r.RegisteredAt == 0 || r.RegisteredAt < cutoff {
+			continue
+		}
+		d, ok := byDomain[domain]
+		if !ok {
+			d = &registeredSummary{Domain: domain, RegisteredAt: r.RegisteredAt, FirstSeen: row.FirstSeen, LastSeen: row.LastSeen}
+			byDomain[domain] = d
+		}
+		d.FirstSeen = min(d.FirstSeen, row.FirstSeen)
+		d.LastSeen = max(d.LastSeen, row.LastSeen)
+		d.Queries += row.Count
+		d.Names = append(d.Names, name)
+	}
+
+	domains := make([]registeredSummary, 0, len(byDomain))
+	for _, d := range byDomain {
+		slices.Sort(d.Names)
+		domains = append(domains, *d)
+	}
+	slices.SortFunc(domains, func(a, b registeredSummary) int {
+		if c := cmpInt(b.RegisteredAt, a.RegisteredAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return domains
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Reasons a line cannot be parsed.
+var (
+	errLineTooShort = errors.New("line too short")
+	errBadTimestamp = errors.New("bad timestamp")
+	errBadQuery     = errors.New("malformed query")
+)
+
+const rejectsFlagUsage = "write malformed lines with the reason to `file` (e.g. rejected_lines.txt)"
+
+// addRejectsFlag registers --rejects on fs.
+func addRejectsFlag(fs *flag.FlagSet) *string {
+	return fs.String("rejects", "", rejectsFlagUsage)
+}
+
+// rejectLog counts malformed lines by reason and optionally keeps them in a file.
+// add may be called from several parsing workers at once.
+type rejectLog struct {
+	mu     sync.Mutex
+	counts map[string]int
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// newRejectLog returns a reject log writing to path, or only counting when path is empty.
+func newRejectLog(path string) (*rejectLog, error) {
+	r := &rejectLog{counts: make(map[string]int)}
+	if path == "" {
+		return r, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r.file, r.writer = file, bufio.NewWriter(file)
+	return r, nil
+}
+
+func (r *rejectLog) add(line string, reason error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[reason.Error()]++
+	slog.Debug("rejected line", "reason", reason, "line", line)
+	if r.writer != nil {
+		fmt.Fprintf(r.writer, "%s\t%s\n", reason, line)
+	}
+}
+
+func (r *rejectLog) total() int {
+	n := 0
+	for _, c := range r.counts {
+		n += c
+	}
+	return n
+}
+
+// summarize logs the number of rejected lines per reason, if any.
+func (r *rejectLog) summarize() {
+	if len(r.counts) == 0 {
+		return
+	}
+	attrs := []any{"total", r.total()}
+	reasons := make([]string, 0, len(r.counts))
+	for reason := range r.counts {
+		reasons = append(reasons, reason)
+	}
+	slices.Sort(reasons)
+	for _, reason := range reasons {
+		attrs = append(attrs, strings.ReplaceAll(reason, " ", "_"), r.counts[reason])
+	}
+	if r.file != nil {
+		attrs = append(attrs, "file", r.file.Name())
+	}
+	slog.Warn("rejected malformed lines", attrs...)
+}
+
+// flush summarizes and resets the counts, and flushes the file. Long-running
+// commands call it periodically instead of summarizing once at the end.
+func (r *rejectLog) flush() error {
+	r.summarize()
+	clear(r.counts)
+	if r.writer != nil {
+		return r.writer.Flush()
+	}
+	return nil
+}
+
+// close flushes and closes the file. Closing again does nothing, so callers may
+// defer it and still close explicitly to see the error.
+func (r *rejectLog) close() error {
+	if r.file == nil {
+		return nil
+	}
+	file, writer := r.file, r.writer
+	r.file, r.writer = nil, nil
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/report.html
+var reportHTML string
+
+//go:embed templates/report.md
+var reportMarkdown string
+
+// Hours whose volume exceeds spikeFactor times the median hour, with at least
+// spikeMinQueries queries, are reported as spikes.
+const (
+	spikeFactor     = 3
+	spikeMinQueries = 10
+)
+
+// Domains forwarded at least uncachedMinForwarded times and never answered
+// from the cache are reported as bypassing it.
+const uncachedMinForwarded = 3
+
+// reportData is everything a rendered report shows for one period.
+type reportData struct {
+	Generated     time.Time
+	Since         time.Time
+	TotalQueries  int64
+	UniqueDomains int
+	TopDomains    []reportDomain
+	NewDomains    []reportDomain
+	Clients       []reportClient
+	Volume        []reportBucket
+	BucketLayout  string
+	Spikes        []reportSpike
+	Cache         resolution     // all time, as resolutions are not kept per hour
+	CacheHitRate  float64        // percent of cached and forwarded queries answered from the cache
+	Uncached      []reportDomain // Count is the number of forwarded queries
+}
+
+type reportDomain struct {
+	Domain    string
+	Count     int64
+	Percent   float64
+	FirstSeen time.Time
+}
+
+type reportClient struct {
+	Client     string
+	Queries    int64
+	Domains    int64
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	TopDomains []domainCount // forward order; only filled by the clients command
+
+	// Hostname names the client, as --client-names has it (see Label).
+	Hostname string
+	// MAC and Vendor are of the device last leased the client address (see
+	// currentDevices); only filled by the clients command.
+	MAC    string
+	Vendor string
+}
+
+type reportBucket struct {
+	Start time.Time
+	Count int64
+}
+
+// reportSpike is an unusually busy hour and the domain that contributed most to it.
+type reportSpike struct {
+	Start     time.Time
+	Count     int64
+	Factor    float64
+	TopDomain string
+	TopCount  int64
+}
+
+// runReport implements the report subcommand.
+func runReport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	since := fs.String("since", "7d", "report period start (duration such as 24h or 7d, or a date)")
+	n := addLimitFlag(fs, 20, "list the top `n` domains")
+	asHTML := fs.Bool("html", false, "render a self-contained HTML report")
+	asMarkdown := fs.Bool("markdown", false, "render a Markdown summary")
+	output := fs.String("output", "", "output `path` (default report.html or report.md)")
+	naming := addClientNamesFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *asHTML == *asMarkdown {
+		return fmt.Errorf("choose one report format: --html or --markdown")
+	}
+
+	now := time.Now()
+	cutoff, err := parseSince(*since, now)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	data, err := collectReport(ctx, st, cutoff, *n, now, *naming)
+	if err != nil {
+		return err
+	}
+
+	path := *output
+	if *asHTML {
+		if path == "" {
+			path = "report.html"
+		}
+		err = writeHTMLReport(path, data)
+	} else {
+		if path == "" {
+			path = "report.md"
+		}
+		err = writeMarkdownReport(path, data)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("saved report", "path", path)
+	return nil
+}
+
+// collectReport gathers report data for the period starting at cutoff,
+// naming clients from naming (see addClientNamesFlag).
+func collectReport(ctx context.Context, st store, cutoff int64, n int, now time.Time, naming string) (reportData, error) {
+	data := reportData{Generated: now, Since: time.Unix(cutoff, 0)}
+
+	counts, err := loadDomainCounts(ctx, st, true, cutoff)
+	if err != nil {
+		return data, err
+	}
+	for _, c := range counts {
+		data.TotalQueries += c.Count
+	}
+	data.UniqueDomains = len(counts)
+	sortDomainCounts(counts)
+	for i, c := range counts {
+		if i == n {
+			break
+		}
+		data.TopDomains = append(data.TopDomains, reportDomain{
+			Domain:  reverseDomainParts(c.Domain),
+			Count:   c.Count,
+			Percent: float64(c.Count) * 100 / float64(data.TotalQueries),
+		})
+	}
+
+	domains, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return data, err
+	}
+	sortDomainRows(domains, "reversed", false)
+	sortDomainRows(domains, "first_seen", false)
+	for _, r := range domains {
+		if r.FirstSeen >= cutoff {
+			data.NewDomains = append(data.NewDomains, reportDomain{
+				Domain:    reverseDomainParts(r.Domain),
+				Count:     r.Count,
+				FirstSeen: time.Unix(r.FirstSeen, 0),
+			})
+		}
+	}
+
+	clientRows, err := st.loadDomainClients(ctx)
+	if err != nil {
+		return data, err
+	}
+	data.Clients = summarizeClients(clientRows, nil, cutoff, 0)
+	if err := nameReportClients(ctx, st, naming, data.Clients); err != nil {
+		return data, err
+	}
+
+	hours, err := loadHourlyVolume(ctx, st, cutoff)
+	if err != nil {
+		return data, err
+	}
+	data.Spikes = findSpikes(hours)
+
+	resolutions, err := st.loadDomainResolutions(ctx)
+	if err != nil {
+		return data, err
+	}
+	data.Cache, data.Uncached = summarizeCache(resolutions, n)
+	data.CacheHitRate = 100 * data.Cache.cacheHitRatio()
+
+	// Hourly volume for short periods, daily otherwise.
+	daily := now.Unix()-cutoff > 2*24*3600
+	data.BucketLayout = "Jan 2 15:00"
+	if daily {
+		data.BucketLayout = "Jan 2"
+	}
+	for _, h := range hours {
+		start, count := time.Unix(h.Hour, 0), h.Count
+		if daily {
+			start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local)
+		}
+		if last := len(data.Volume) - 1; last >= 0 && data.Volume[last].Start.Equal(start) {
+			data.Volume[last].Count += count
+			continue
+		}
+		data.Volume = append(data.Volume, reportBucket{start, count})
+	}
+	return data, nil
+}
+
+// summarizeCache totals resolutions and returns up to n of the domains that
+// bypass the cache, most forwarded first.
+func summarizeCache(resolutions map[string]resolution, n int) (resolution, []reportDomain) {
+	var total resolution
+	var uncached []domainCount
+	for domain, r := range resolutions {
+		total = total.plus(r)
+		if r.Cached == 0 && r.Forwarded >= uncachedMinForwarded {
+			uncached = append(uncached, domainCount{reverseDomainParts(domain), r.Forwarded})
+		}
+	}
+	sortDomainCounts(uncached)
+	var domains []reportDomain
+	for _, c := range uncached[:min(n, len(uncached))] {
+		domains = append(domains, reportDomain{Domain: c.Domain, Count: c.Count})
+	}
+	return total, domains
+}
+
+// hourVolume is the total query count of one hour and its busiest domain.
+type hourVolume struct {
+	Hour      int64
+	Count     int64
+	TopDomain string
+	TopCount  int64
+}
+
+// loadHourlyVolume returns the hours since cutoff in order, with their busiest domain.
+func loadHourlyVolume(ctx context.Context, st store, cutoff int64) ([]hourVolume, error) {
+	counts, err := st.loadDomainHours(ctx, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(counts, func(a, b domainHourCount) int {
+		if c := cmpInt(a.Hour, b.Hour); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+
+	var hours []hourVolume
+	for _, c := range counts {
+		hour, domain, count := c.Hour, c.Domain, c.Count
+		if len(hours) == 0 || hours[len(hours)-1].Hour != hour {
+			hours = append(hours, hourVolume{Hour: hour})
+		}
+		h := &hours[len(hours)-1]
+		h.Count += count
+		if count > h.TopCount {
+			h.TopDomain, h.TopCount = domain, count
+		}
+	}
+	return hours, nil
+}
+
+// findSpikes returns the hours that are far busier than the median hour, busiest first.
+func findSpikes(hours []hourVolume) []reportSpike {
+	if len(hours) < 3 {
+		return nil
+	}
+	counts := make([]int64, len(hours))
+	for i, h := range hours {
+		counts[i] = h.Count
+	}
+	slices.Sort(counts)
+	median := max(counts[len(counts)/2], 1)
+
+	var spikes []reportSpike
+	for _, h := range hours {
+		if h.Count < spikeMinQueries || h.Count < spikeFactor*median {
+			continue
+		}
+		spikes = append(spikes, reportSpike{
+			Start:     time.Unix(h.Hour, 0),
+			Count:     h.Count,
+			Factor:    float64(h.Count) / float64(median),
+			TopDomain: reverseDomainParts(h.TopDomain),
+			TopCount:  h.TopCount,
+		})
+	}
+	slices.SortFunc(spikes, func(a, b reportSpike) int { return cmpInt(b.Count, a.Count) })
+	return spikes
+}
+
+// chartBar is one bar of the inline SVG volume chart.
+type chartBar struct {
+	X, Y, Width, Height float64
+	Label               string
+	Count               int64
+}
+
+const (
+	chartWidth  = 720.0
+	chartHeight = 160.0
+)
+
+// volumeChart lays out the volume buckets as SVG bars scaled to the busiest bucket.
+func volumeChart(buckets []reportBucket, layout string) []chartBar {
+	if len(buckets) == 0 {
+		return nil
+	}
+	var peak int64
+	for _, b := range buckets {
+		peak = max(peak, b.Count)
+	}
+	width := chartWidth / float64(len(buckets))
+	bars := make([]chartBar, len(buckets))
+	for i, b := range buckets {
+		h := 0.0
+		if peak > 0 {
+			h = float64(b.Count) / float64(peak) * chartHeight
+		}
+		bars[i] = chartBar{
+			X:      float64(i) * width,
+			Y:      chartHeight - h,
+			Width:  max(width-1, 1),
+			Height: h,
+			Label:  b.Start.Format(layout),
+			Count:  b.Count,
+		}
+	}
+	return bars
+}
+
+func writeHTMLReport(path string, data reportData) error {
+	tmpl, err := template.New("report").Funcs(template.FuncMap{
+		"chart": volumeChart,
+	}).Parse(reportHTML)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := tmpl.Execute(file, data); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeMarkdownReport(path string, data reportData) error {
+	tmpl, err := texttemplate.New("report").Funcs(texttemplate.FuncMap{
+		"code": markdownCode,
+	}).Parse(reportMarkdown)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := tmpl.Execute(file, data); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// markdownCode wraps s in a code span so domain names never render as Markdown.
+func markdownCode(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "") + "`"
+}
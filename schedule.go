@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduleOptions configures the daemon's --interval runs, which write the
+// exports, and a report when asked, from the database while the log is
+// followed, in place of cron.
+type scheduleOptions struct {
+	Interval    time.Duration
+	Jitter      time.Duration
+	Report      string
+	ReportSince string
+	Export      *exportFlags
+}
+
+// addScheduleFlags registers --interval and the flags that go with it on fs,
+// among them those of export.
+func addScheduleFlags(fs *flag.FlagSet) *scheduleOptions {
+	o := &scheduleOptions{}
+	fs.DurationVar(&o.Interval, "interval", 0, "every `interval`, such as 1h, save what was read and write the exports (see the export flags) and --report; 0 disables")
+	fs.DurationVar(&o.Jitter, "jitter", 0, "wait up to this much longer at random before each --interval run, so routers sharing storage do not all upload at once")
+	fs.StringVar(&o.Report, "report", "", "also render the report to `path` every --interval: HTML, or Markdown for a .md path")
+	fs.StringVar(&o.ReportSince, "report-since", "7d", "period of the --report (duration such as 24h or 7d)")
+	o.Export = addExportFlags(fs)
+	return o
+}
+
+// scheduler starts the --interval runs. A run goes on in the background while
+// the log is followed; when the next is due before it has finished, that one
+// is skipped rather than started alongside. Its methods do nothing on a nil
+// scheduler, which is what daemons without --interval have.
+type scheduler struct {
+	opts    scheduleOptions
+	specs   []exportSpec
+	st      store
+	dbOpts  dbOptions
+	clients clientFilter
+
+	timer   *time.Timer
+	running sync.Mutex // held by the run underway
+	wg      sync.WaitGroup
+}
+
+// startSchedule checks the --interval flags and sets the timer of the first
+// run, or returns nil without --interval.
+func (o *scheduleOptions) startSchedule(st store, dbOpts dbOptions, clients clientFilter) (*scheduler, error) {
+	if o == nil || o.Interval <= 0 {
+		return nil, nil
+	}
+	specs, err := o.Export.specs()
+	if err != nil {
+		return nil, err
+	}
+	if o.Report != "" {
+		if _, err := parseSince(o.ReportSince, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	s := &scheduler{opts: *o, specs: specs, st: st, dbOpts: dbOpts, clients: clients}
+	s.timer = time.NewTimer(s.next())
+	slog.Info("scheduled exports", "interval", o.Interval, "jitter", o.Jitter)
+	return s, nil
+}
+
+// next returns how long until the next run.
+func (s *scheduler) next() time.Duration {
+	if s.opts.Jitter <= 0 {
+		return s.opts.Interval
+	}
+	return s.opts.Interval + rand.N(s.opts.Jitter)
+}
+
+// due fires when the next run is due, or never for a nil scheduler.
+func (s *scheduler) due() <-chan time.Time {
+	if s == nil {
+		return nil
+	}
+	return s.timer.C
+}
+
+// run starts a run in the background, unless the last one is still going,
+// and sets the timer of the next. Callers save what was read first, for the
+// run to include it.
+func (s *scheduler) run(ctx context.Context) {
+	s.timer.Reset(s.next())
+	if !s.running.TryLock() {
+		slog.Warn("skipping scheduled run: the last is still running")
+		return
+	}
+	s.wg.Go(func() {
+		defer s.running.Unlock()
+		start := time.Now()
+		if err := s.write(ctx); err != nil {
+			slog.Error("scheduled run: " + err.Error())
+			return
+		}
+		slog.Info("scheduled run finished", "took", time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// write writes the exports and the report.
+func (s *scheduler) write(ctx context.Context) error {
+	if err := exportStore(ctx, s.st, s.dbOpts, s.clients, s.specs); err != nil {
+		return fmt.Errorf("writing exports: %w", err)
+	}
+	if s.opts.Report == "" {
+		return nil
+	}
+	now := time.Now()
+	cutoff, err := parseSince(s.opts.ReportSince, now)
+	if err != nil {
+		return err
+	}
+	loadCtx, cancel := s.dbOpts.withTimeout(ctx)
+	defer cancel()
+	data, err := collectReport(loadCtx, s.st, cutoff, 20, now, "dhcp")
+	if err != nil {
+		return fmt.Errorf("collecting report: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(s.opts.Report), ".md") {
+		err = writeMarkdownReport(s.opts.Report, data)
+	} else {
+		err = writeHTMLReport(s.opts.Report, data)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("saved report", "path", s.opts.Report)
+	return nil
+}
+
+// stop cancels the next run and waits for one underway to finish.
+func (s *scheduler) stop() {
+	if s == nil {
+		return
+	}
+	s.timer.Stop()
+	s.wg.Wait()
+}
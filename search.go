@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runSearch implements the search subcommand: the domains containing any (or
+// all) of the given terms, with when they were first and last seen and how
+// often. SQLite databases answer from the trigram index in domains_fts; other
+// stores are scanned.
+func runSearch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	all := fs.Bool("all", false, "only show domains containing every term, not any of them")
+	since := fs.String("since", "", "only show domains seen after this `time` (duration such as 24h or 7d, or a date)")
+	sortKey := fs.String("sort", "count", "sort `key`: count, first_seen, last_seen (largest or latest first) or domain")
+	n := addLimitFlag(fs, 100, "show at most `n` domains (0 for all)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: search [flags] term...")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("search needs at least one term")
+	}
+	if !slices.Contains([]string{"count", "first_seen", "last_seen", "domain"}, *sortKey) {
+		return fmt.Errorf("unknown sort key %q (available: count, first_seen, last_seen, domain)", *sortKey)
+	}
+
+	var cutoff int64
+	if *since != "" {
+		var err error
+		cutoff, err = parseSince(*since, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	terms := make([]string, 0, fs.NArg())
+	for _, term := range fs.Args() {
+		if term = strings.Trim(strings.ToLower(term), "."); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return errors.New("search terms must contain more than dots")
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := searchDomains(ctx, st, terms, *all)
+	if err != nil {
+		return err
+	}
+
+	matches := slices.DeleteFunc(rows, func(r domainRow) bool {
+		return r.LastSeen < cutoff || !matchesTerms(reverseDomainParts(r.Domain), terms, *all)
+	})
+	if len(matches) == 0 {
+		return errors.New("no domains match")
+	}
+	sortDomainRows(matches, *sortKey, *sortKey != "domain")
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tFIRST SEEN\tLAST SEEN\tQUERIES")
+	for i, r := range matches {
+		if i == *n && *n > 0 {
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", reverseDomainParts(r.Domain), formatUnix(r.FirstSeen), formatUnix(r.LastSeen), r.Count)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if *n > 0 && len(matches) > *n {
+		fmt.Printf("\n%d of %d matching domains shown (-n 0 shows all)\n", *n, len(matches))
+	}
+	return nil
+}
+
+// matchesTerms reports whether the forward domain contains any of terms, or
+// all of them.
+func matchesTerms(domain string, terms []string, all bool) bool {
+	for _, term := range terms {
+		if strings.Contains(domain, term) != all {
+			return !all
+		}
+	}
+	return all
+}
+
+// searchDomains returns the domains that may contain the terms, a superset of
+// those that do. Since domains are stored reversed, a term spanning a dot is
+// not a substring of the stored form: the index is asked for its labels
+// instead, and the caller checks the forward domain.
+func searchDomains(ctx context.Context, st store, terms []string, all bool) ([]domainRow, error) {
+	db, ok := st.(*database)
+	if !ok {
+		return st.loadDomainRows(ctx)
+	}
+	if _, ok := db.dialect.(sqliteDialect); !ok {
+		return st.loadDomainRows(ctx)
+	}
+
+	var clauses []string
+	for _, term := range terms {
+		var phrases []string
+		for _, label := range strings.Split(term, ".") {
+			// The trigram index cannot find anything shorter than three characters.
+			if len(label) >= 3 {
+				phrases = append(phrases, `"`+strings.ReplaceAll(label, `"`, `""`)+`"`)
+			}
+		}
+		switch {
+		case len(phrases) > 0:
+			clauses = append(clauses, "("+strings.Join(phrases, " AND ")+")")
+		case !all:
+			// Any domain could contain this term.
+			return st.loadDomainRows(ctx)
+		}
+	}
+	if len(clauses) == 0 {
+		return st.loadDomainRows(ctx)
+	}
+	op := " OR "
+	if all {
+		op = " AND "
+	}
+	rows, err := db.QueryContext(ctx, `SELECT d.domain, d.first_seen, d.last_seen, d.count
+		FROM domains_fts JOIN domains d ON d.id = domains_fts.rowid
+		WHERE domains_fts MATCH ?`, strings.Join(clauses, op))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanDomainRows(rows)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates/dashboard.html
+var dashboardHTML string
+
+// Pagination of list endpoints: limit defaults to apiDefaultLimit and is
+// capped at apiMaxLimit.
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiServer answers the read-only JSON API of the serve subcommand.
+type apiServer struct {
+	st     store
+	dbOpts dbOptions
+	naming string          // --client-names
+	events *eventHub       // of the log followed for /stream, if any
+	done   <-chan struct{} // closed when the server stops
+}
+
+// runServe implements the serve subcommand: a read-only JSON API over the
+// database, for dashboards and scripts, and a web dashboard built on it.
+func runServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	listen := fs.String("listen", "localhost:8053", "serve the API at `address`")
+	follow := fs.String("follow", "", "follow the log at `path`, as tail does, streaming its queries and new domains at /stream")
+	format := addInputFormatFlag(fs)
+	naming := addClientNamesFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := checkClientNames(*naming); err != nil {
+		return err
+	}
+	parse, err := inputFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	st, ok, err := openExistingStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no database at %s", dbOpts.Path)
+	}
+	defer st.Close()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	ctx, stop := notifyInterrupt(ctx)
+	defer stop()
+	api := &apiServer{st: st, dbOpts: *dbOpts, naming: *naming, done: ctx.Done()}
+	srv := &http.Server{Handler: api.routes(), ReadHeaderTimeout: 10 * time.Second}
+
+	followed, stopped := make(chan error, 1), make(chan error, 1)
+	if *follow != "" {
+		tracker, err := loadNewDomainTracker(ctx, st, *dbOpts)
+		if err != nil {
+			return err
+		}
+		api.events = newEventHub()
+		go func() {
+			followed <- followEvents(ctx, *follow, parse.live(), tracker, api.events)
+		}()
+	}
+	go func() {
+		var err error
+		select {
+		case <-ctx.Done():
+		case err = <-followed:
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		stopped <- err
+	}()
+	slog.Info("serving API", "address", ln.Addr().String())
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-stopped
+}
+
+func (s *apiServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardHTML)
+	})
+	mux.HandleFunc("GET /domains", s.domains)
+	mux.HandleFunc("GET /domains/{name}", s.domain)
+	mux.HandleFunc("GET /clients", s.clients)
+	mux.HandleFunc("GET /clients/{ip}", s.client)
+	mux.HandleFunc("GET /stats", s.stats)
+	mux.HandleFunc("GET /stream", s.stream)
+	return mux
+}
+
+// domainsPage is a page of /domains. Next, when there are more, is the URL of
+// the following page.
+type domainsPage struct {
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Next    string         `json:"next,omitempty"`
+	Domains []domainRecord `json:"domains"`
+}
+
+// domains lists the domains, seen since ?since= and containing ?q= if given,
+// sorted by ?sort= (domain, first_seen, last_seen or count) in ?order= (asc or
+// desc), a page of ?limit= from ?offset= at a time.
+func (s *apiServer) domains(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cutoff, err := sinceParam(query.Get("since"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, offset, err := pageParams(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	key := query.Get("sort")
+	if key == "" {
+		key = "domain"
+	}
+	if !slices.Contains([]string{"domain", "first_seen", "last_seen", "count"}, key) {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("unknown sort %q", key))
+		return
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("unknown order %q", order))
+		return
+	}
+	q := strings.ToLower(query.Get("q"))
+
+	ctx, cancel := s.dbOpts.withTimeout(r.Context())
+	defer cancel()
+	rows, err := s.st.loadDomainRows(ctx)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rows = slices.DeleteFunc(rows, func(row domainRow) bool {
+		return row.LastSeen < cutoff || q != "" && !strings.Contains(reverseDomainParts(row.Domain), q)
+	})
+	sortDomainRows(rows, key, order == "desc")
+
+	page := domainsPage{Total: len(rows), Offset: offset, Limit: limit, Domains: []domainRecord{}}
+	for _, row := range rows[min(offset, len(rows)):min(offset+limit, len(rows))] {
+		page.Domains = append(page.Domains, newDomainRecord(row))
+	}
+	page.Next = nextPage(r, offset, limit, len(rows))
+	writeJSON(w, page)
+}
+
+// domain reports everything known of a domain, as lookup prints it.
+func (s *apiServer) domain(w http.ResponseWriter, r *http.Request) {
+	reversed := reverseDomainParts(canonicalDomain(r.PathValue("name")))
+
+	ctx, cancel := s.dbOpts.withTimeout(r.Context())
+	defer cancel()
+	details, err := loadDomainDetails(ctx, s.st, reversed, false, s.naming)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(details) == 0 {
+		apiError(w, http.StatusNotFound, fmt.Errorf("domain %s not found", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, details[0])
+}
+
+// clientsPage is a page of /clients, as domainsPage is of /domains.
+type clientsPage struct {
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Next    string         `json:"next,omitempty"`
+	Clients []clientRecord `json:"clients"`
+}
+
+// clients lists the clients active since ?since=, if given, the busiest
+// first, a page of ?limit= from ?offset= at a time.
+func (s *apiServer) clients(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cutoff, err := sinceParam(query.Get("since"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, offset, err := pageParams(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := s.dbOpts.withTimeout(r.Context())
+	defer cancel()
+	rows, err := s.st.loadDomainClients(ctx)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	summary := summarizeClients(rows, nil, cutoff, 0)
+
+	page := clientsPage{Total: len(summary), Offset: offset, Limit: limit, Clients: []clientRecord{}}
+	shown := summary[min(offset, len(summary)):min(offset+limit, len(summary))]
+	if err := nameReportClients(ctx, s.st, s.naming, shown); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, c := range shown {
+		page.Clients = append(page.Clients, newClientRecord(c))
+	}
+	page.Next = nextPage(r, offset, limit, len(summary))
+	writeJSON(w, page)
+}
+
+// client reports the activity of a client since ?since=, if given, with its
+// ?limit= most queried domains.
+func (s *apiServer) client(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	query := r.URL.Query()
+	cutoff, err := sinceParam(query.Get("since"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, _, err := pageParams(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := s.dbOpts.withTimeout(r.Context())
+	defer cancel()
+	rows, err := s.st.loadDomainClients(ctx)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	filter := clientFilter{netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())}
+	summary := summarizeClients(rows, filter, cutoff, limit)
+	if len(summary) == 0 {
+		apiError(w, http.StatusNotFound, fmt.Errorf("client %s not found", addr))
+		return
+	}
+	if err := nameReportClients(ctx, s.st, s.naming, summary); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, newClientRecord(summary[0]))
+}
+
+// statsRecord is what /stats reports of the whole database.
+type statsRecord struct {
+	Domains      int    `json:"domains"`
+	Queries      int64  `json:"queries"`
+	Clients      int    `json:"clients"`
+	TLDs         int    `json:"tlds"`
+	FirstSeen    int64  `json:"first_seen,omitempty"`
+	FirstSeenISO string `json:"first_seen_iso,omitempty"`
+	LastSeen     int64  `json:"last_seen,omitempty"`
+	LastSeenISO  string `json:"last_seen_iso,omitempty"`
+}
+
+func (s *apiServer) stats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.dbOpts.withTimeout(r.Context())
+	defer cancel()
+	rows, err := s.st.loadDomainRows(ctx)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	clientRows, err := s.st.loadDomainClients(ctx)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	stats := statsRecord{Domains: len(rows)}
+	tlds := make(map[string]bool)
+	for _, row := range rows {
+		stats.Queries += row.Count
+		tld, _, _ := strings.Cut(row.Domain, ".")
+		tlds[tld] = true
+		if stats.FirstSeen == 0 || row.FirstSeen < stats.FirstSeen {
+			stats.FirstSeen = row.FirstSeen
+		}
+		stats.LastSeen = max(stats.LastSeen, row.LastSeen)
+	}
+	stats.TLDs = len(tlds)
+	clients := make(map[string]bool)
+	for _, c := range clientRows {
+		clients[c.Client] = true
+	}
+	stats.Clients = len(clients)
+	if len(rows) > 0 {
+		stats.FirstSeenISO = time.Unix(stats.FirstSeen, 0).Format(time.RFC3339)
+		stats.LastSeenISO = time.Unix(stats.LastSeen, 0).Format(time.RFC3339)
+	}
+	writeJSON(w, stats)
+}
+
+// sinceParam parses a ?since= value as --since flags are, returning 0 for none.
+func sinceParam(since string) (int64, error) {
+	if since == "" {
+		return 0, nil
+	}
+	return parseSince(since, time.Now())
+}
+
+// pageParams parses ?limit= and ?offset=.
+func pageParams(query map[string][]string) (limit, offset int, err error) {
+	limit, offset = apiDefaultLimit, 0
+	if v := firstValue(query, "limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+	}
+	if v := firstValue(query, "offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// nextPage returns the URL of the page after the one of r, or "" if it was
+// the last of total items.
+func nextPage(r *http.Request, offset, limit, total int) string {
+	if offset+limit >= total {
+		return ""
+	}
+	next := *r.URL
+	values := next.Query()
+	values.Set("offset", strconv.Itoa(offset+limit))
+	next.RawQuery = values.Encode()
+	return next.RequestURI()
+}
+
+func firstValue(query map[string][]string, key string) string {
+	if values := query[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("writing API response", "err", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	if status >= 500 {
+		slog.Error("serving API request", "err", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
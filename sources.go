@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// inputSource is where lines were read from: the input file (- for stdin) and,
+// for syslog files, the host that logged them.
+type inputSource struct {
+	Path string
+	Host string
+}
+
+// domainSource keys the observations of a (reversed) domain in one source.
+type domainSource struct {
+	Domain string
+	inputSource
+}
+
+// sourceDomains holds the observation windows of the (reversed) domains seen
+// in each source. Grouping by source keeps adding a line to one lookup by
+// domain, as a source rarely changes from one line to the next.
+type sourceDomains map[inputSource]map[string]domainTimes
+
+// of returns the domains seen in src, adding an empty set if there is none.
+func (s sourceDomains) of(src inputSource) map[string]domainTimes {
+	domains, ok := s[src]
+	if !ok {
+		domains = make(map[string]domainTimes)
+		s[src] = domains
+	}
+	return domains
+}
+
+// mergeFrom folds o into s.
+func (s sourceDomains) mergeFrom(o sourceDomains) {
+	for src, domains := range o {
+		into := s.of(src)
+		for domain, t := range domains {
+			mergeInto(into, domain, t)
+		}
+	}
+}
+
+// domainSourceRow is the stored observation window of a domain in one source.
+type domainSourceRow struct {
+	domainSource
+	domainTimes
+}
+
+// saveDomainSources merges the per-source observations into domain_sources,
+// adding any new sources to the sources table.
+func (db *database) saveDomainSources(ctx context.Context, sources sourceDomains) error {
+	var args []any
+	for src, domains := range sources {
+		id, err := db.sourceID(ctx, src)
+		if err != nil {
+			return fmt.Errorf("saving source %s: %w", src.Path, err)
+		}
+		for domain, t := range domains {
+			args = append(args, domain, id, t.FirstSeen, t.LastSeen, t.Count)
+		}
+	}
+	return db.upsertRows(ctx, "domain_sources", []upsertColumn{
+		{"domain", mergeKey},
+		{"source_id", mergeKey},
+		{"first_seen", mergeMin},
+		{"last_seen", mergeMax},
+		{"count", mergeAdd},
+	}, args)
+}
+
+// sourceID returns the id of s in the sources table, adding it if needed.
+func (db *database) sourceID(ctx context.Context, s inputSource) (int64, error) {
+	query := "SELECT id FROM sources WHERE path = ? AND host = ?"
+	var id int64
+	err := db.QueryRowContext(ctx, query, s.Path, s.Host).Scan(&id)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return id, err
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO sources (path, host) VALUES (?, ?)", s.Path, s.Host); err != nil {
+		// Another process may have added it meanwhile; the lookup below tells.
+		if err := db.QueryRowContext(ctx, query, s.Path, s.Host).Scan(&id); err == nil {
+			return id, nil
+		}
+		return 0, err
+	}
+	return id, db.QueryRowContext(ctx, query, s.Path, s.Host).Scan(&id)
+}
+
+func (db *database) loadDomainSources(ctx context.Context) ([]domainSourceRow, error) {
+	rows, err := db.QueryContext(ctx, `SELECT ds.domain, s.path, s.host, ds.first_seen, ds.last_seen, ds.count
+		FROM domain_sources ds JOIN sources s ON s.id = ds.source_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sources []domainSourceRow
+	for rows.Next() {
+		var r domainSourceRow
+		if err := rows.Scan(&r.Domain, &r.Path, &r.Host, &r.FirstSeen, &r.LastSeen, &r.Count); err != nil {
+			return nil, err
+		}
+		sources = append(sources, r)
+	}
+	return sources, rows.Err()
+}
+
+// runSources implements the sources subcommand: which input files (and syslog
+// hosts) a domain was seen in, first seen first, to know which log to go back
+// to when investigating it.
+func runSources(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("sources", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	subdomains := fs.Bool("subdomains", false, "include the subdomains of each domain")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sources [flags] domain...")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("sources needs at least one domain")
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainSources(ctx)
+	if err != nil {
+		return err
+	}
+
+	wanted := make([]string, fs.NArg())
+	for i, domain := range fs.Args() {
+		wanted[i] = reverseDomainParts(canonicalDomain(domain))
+	}
+	matches := slices.DeleteFunc(rows, func(r domainSourceRow) bool {
+		for _, w := range wanted {
+			if r.Domain == w || *subdomains && strings.HasPrefix(r.Domain, w+".") {
+				return false
+			}
+		}
+		return true
+	})
+	if len(matches) == 0 {
+		return errors.New("no sources recorded for these domains")
+	}
+	slices.SortFunc(matches, func(a, b domainSourceRow) int {
+		if c := strings.Compare(a.Domain, b.Domain); c != 0 {
+			return c
+		}
+		if c := cmpInt(a.FirstSeen, b.FirstSeen); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path+"\x00"+a.Host, b.Path+"\x00"+b.Host)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tFIRST SEEN\tLAST SEEN\tQUERIES\tHOST\tFILE")
+	for _, r := range matches {
+		host := r.Host
+		if host == "" {
+			host = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", reverseDomainParts(r.Domain),
+			formatUnix(r.FirstSeen), formatUnix(r.LastSeen), r.Count, host, r.Path)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runStats implements the stats subcommand: a summary of the domains table.
+func runStats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	n := addLimitFlag(fs, 15, "list the top `n` TLDs")
+	growth := fs.String("growth", "month", "growth bucket `size`: day, week or month")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *growth != "day" && *growth != "week" && *growth != "month" {
+		return fmt.Errorf("unknown growth bucket %q", *growth)
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	sortDomainRows(rows, "reversed", false)
+	sortDomainRows(rows, "first_seen", false)
+
+	var total, labels, queries int64
+	var oldest, newest domainRow
+	tlds := make(map[string]int64)
+	depths := make(map[int]int64)
+	var growthBuckets []domainCount // Domain holds the bucket label
+
+	for _, row := range rows {
+		if total == 0 {
+			oldest = row
+		}
+		newest = row
+		total++
+		queries += row.Count
+
+		tld, _, _ := strings.Cut(row.Domain, ".")
+		tlds[tld]++
+		depth := strings.Count(row.Domain, ".") + 1
+		depths[depth]++
+		labels += int64(depth)
+
+		label := growthLabel(time.Unix(row.FirstSeen, 0), *growth)
+		if last := len(growthBuckets) - 1; last >= 0 && growthBuckets[last].Domain == label {
+			growthBuckets[last].Count++
+		} else {
+			growthBuckets = append(growthBuckets, domainCount{label, 1})
+		}
+	}
+	if total == 0 {
+		fmt.Println("No domains in database.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Unique domains:\t%d\n", total)
+	fmt.Fprintf(tw, "Total queries:\t%d\n", queries)
+	fmt.Fprintf(tw, "Distinct TLDs:\t%d\n", len(tlds))
+	fmt.Fprintf(tw, "Average label depth:\t%.2f\n", float64(labels)/float64(total))
+	fmt.Fprintf(tw, "Oldest first_seen:\t%s\t%s\n", unixToDateTime(oldest.FirstSeen), reverseDomainParts(oldest.Domain))
+	fmt.Fprintf(tw, "Newest first_seen:\t%s\t%s\n", unixToDateTime(newest.FirstSeen), reverseDomainParts(newest.Domain))
+	tw.Flush()
+
+	byTLD := make([]domainCount, 0, len(tlds))
+	for tld, count := range tlds {
+		byTLD = append(byTLD, domainCount{tld, count})
+	}
+	sortDomainCounts(byTLD)
+	fmt.Printf("\nTop %d TLDs:\n", min(*n, len(byTLD)))
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "DOMAINS\tPCT\t  TLD")
+	for i, c := range byTLD {
+		if i == *n {
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%.1f%%\t  .%s\n", c.Count, float64(c.Count)*100/float64(total), c.Domain)
+	}
+	tw.Flush()
+
+	fmt.Println("\nLabel depth:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "LABELS\tDOMAINS\t")
+	depthKeys := make([]int, 0, len(depths))
+	for d := range depths {
+		depthKeys = append(depthKeys, d)
+	}
+	slices.Sort(depthKeys)
+	for _, d := range depthKeys {
+		fmt.Fprintf(tw, "%d\t%d\t\n", d, depths[d])
+	}
+	tw.Flush()
+
+	fmt.Printf("\nNew domains per %s:\n", *growth)
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PERIOD\tNEW\tTOTAL")
+	var cumulative int64
+	for _, b := range growthBuckets {
+		cumulative += b.Count
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", b.Domain, b.Count, cumulative)
+	}
+	return tw.Flush()
+}
+
+// growthLabel names the day, ISO week or month containing t.
+func growthLabel(t time.Time, bucket string) string {
+	switch bucket {
+	case "day":
+		return t.Format("2006-01-02")
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return t.Format("2006-01")
+}
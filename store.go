@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// store keeps the aggregated queries. SQL databases (see database), the bbolt
+// key-value file (see boltStore) and, for --no-db, memoryStore implement it.
+type store interface {
+	// saveDomains, saveDomainClients, saveDomainHours, saveDomainTypes and
+	// saveDomainAddresses merge a run's aggregates into what is stored:
+	// earliest first_seen, latest last_seen, and summed counts.
+	saveDomains(ctx context.Context, domains map[string]domainTimes) error
+	saveDomainClients(ctx context.Context, clients map[domainClient]domainTimes) error
+	saveDomainHours(ctx context.Context, counts map[domainHour]int64) error
+	// saveDomainResolutions adds to the cached, forwarded and reply counts
+	// and summed latencies, and keeps the larger maximum latency.
+	saveDomainResolutions(ctx context.Context, resolutions map[string]resolution) error
+	saveDomainSources(ctx context.Context, sources sourceDomains) error
+	saveDomainTypes(ctx context.Context, types map[domainType]domainTimes) error
+	saveDomainAddresses(ctx context.Context, addresses map[domainAddress]domainTimes) error
+	// saveDomainScores replaces the DGA score of each domain (see dgaScore).
+	saveDomainScores(ctx context.Context, scores map[string]int64) error
+	// saveLiveness replaces what the last recheck found of each domain.
+	saveLiveness(ctx context.Context, checks map[string]liveness) error
+	// saveAddressInfo replaces what is known of each address.
+	saveAddressInfo(ctx context.Context, info map[string]addressInfo) error
+	// saveRegistrations replaces what is known of each registrable domain.
+	saveRegistrations(ctx context.Context, registrations map[string]registration) error
+	// saveRanks replaces the rank of each registrable domain.
+	saveRanks(ctx context.Context, ranks map[string]domainRank) error
+	// saveDNSBL replaces the DNSBL results of each name and zone.
+	saveDNSBL(ctx context.Context, results map[dnsblKey]dnsblResult) error
+	// saveDevices merges the DHCP leases of a run into what is stored, as
+	// saveDomains does.
+	saveDevices(ctx context.Context, devices map[device]domainTimes) error
+
+	loadDomainRows(ctx context.Context) ([]domainRow, error)
+	loadDomainClients(ctx context.Context) ([]domainClientRow, error)
+	// loadDomainHours returns the hourly counts from the hour containing since onwards.
+	loadDomainHours(ctx context.Context, since int64) ([]domainHourCount, error)
+	loadDomainResolutions(ctx context.Context) (map[string]resolution, error)
+	loadDomainSources(ctx context.Context) ([]domainSourceRow, error)
+	loadDomainTypes(ctx context.Context) ([]domainTypeRow, error)
+	loadDomainAddresses(ctx context.Context) ([]domainAddressRow, error)
+	loadDomainScores(ctx context.Context) (map[string]int64, error)
+	loadLiveness(ctx context.Context) (map[string]liveness, error)
+	loadAddressInfo(ctx context.Context) (map[string]addressInfo, error)
+	loadRegistrations(ctx context.Context) (map[string]registration, error)
+	loadRanks(ctx context.Context) (map[string]domainRank, error)
+	loadDNSBL(ctx context.Context) (map[dnsblKey]dnsblResult, error)
+	loadDevices(ctx context.Context) ([]deviceRow, error)
+
+	// prune deletes, or with dryRun only counts, what was last seen before
+	// cutoff: see database.prune.
+	prune(ctx context.Context, cutoff int64, dryRun bool) (pruneCounts, error)
+
+	loadCheckpoint(ctx context.Context, path string) (checkpoint, bool, error)
+	saveCheckpoints(ctx context.Context, checkpoints []checkpoint) error
+	clearCheckpoints(ctx context.Context, paths []string) error
+
+	// loadFingerprint and saveFingerprints keep the files parsed to the end,
+	// by fingerprint: see fileFingerprint. loadInodeFingerprint returns the
+	// one last recorded of a file with inode, whatever its name and content.
+	loadFingerprint(ctx context.Context, hash string) (fileFingerprint, bool, error)
+	loadInodeFingerprint(ctx context.Context, inode uint64) (fileFingerprint, bool, error)
+	saveFingerprints(ctx context.Context, fingerprints []fileFingerprint) error
+
+	Close() error
+}
+
+// domainClientRow is the stored observation window of a domain for one client.
+type domainClientRow struct {
+	domainClient
+	domainTimes
+}
+
+// domainHourCount is the stored query count of a domain in one hour.
+type domainHourCount struct {
+	domainHour
+	Count int64
+}
+
+// openStore opens the store selected by o and brings its schema up to date.
+func openStore(ctx context.Context, o dbOptions) (store, error) {
+	var st store
+	var err error
+	if o.driver() == "bolt" {
+		st, err = openBoltStore(ctx, o, false)
+	} else {
+		st, err = openDatabase(ctx, o)
+	}
+	if err != nil {
+		return nil, withExitCode(exitDatabase, err)
+	}
+	return st, nil
+}
+
+// openExistingStore opens the store selected by o without creating or changing
+// anything. Local files are opened read-only; ok is false when the file does
+// not exist yet.
+func openExistingStore(ctx context.Context, o dbOptions) (st store, ok bool, err error) {
+	if path, local := o.localPath(); local {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+	}
+	if o.driver() == "bolt" {
+		st, err = openBoltStore(ctx, o, true)
+	} else {
+		st, err = openDatabaseReadOnly(o)
+	}
+	return st, err == nil, err
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bbolt store, named after the SQL tables they replace.
+var (
+	boltDomains     = []byte("domains")
+	boltClients     = []byte("domain_clients")
+	boltHours       = []byte("domain_hours")
+	boltResolution  = []byte("domain_resolution")
+	boltSources     = []byte("domain_sources")
+	boltTypes       = []byte("domain_types")
+	boltAddresses   = []byte("domain_addresses")
+	boltScores      = []byte("domain_scores")
+	boltLiveness    = []byte("domain_liveness")
+	boltAddressInfo = []byte("addresses")
+	boltRegistered  = []byte("registrations")
+	boltRanks       = []byte("ranks")
+	boltDNSBL       = []byte("dnsbl_results")
+	boltDevices     = []byte("devices")
+	boltCheckpoints = []byte("checkpoints")
+	boltParsedFiles = []byte("parsed_files")
+)
+
+// boltStore keeps the aggregates in a bbolt file, for appliances where even
+// SQLite is too heavy. Keys are the reversed domain, followed by a NUL and the
+// client or big-endian hour where needed; values are big-endian integers.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens the bbolt file at o.Path. The file is locked while open;
+// other processes wait for up to --db-timeout (indefinitely by default).
+func openBoltStore(ctx context.Context, o dbOptions, readOnly bool) (*boltStore, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(o.Path, 0o644, &bolt.Options{ReadOnly: readOnly, Timeout: o.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{boltDomains, boltClients, boltHours, boltResolution, boltSources, boltTypes, boltAddresses, boltScores, boltLiveness, boltAddressInfo, boltRegistered, boltRanks, boltDNSBL, boltDevices, boltCheckpoints, boltParsedFiles} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// update runs fn in a write transaction unless ctx is already done.
+func (s *boltStore) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(fn)
+}
+
+// view runs fn over every key and value of bucket unless ctx is already done.
+// A bucket missing from a read-only file reads as empty.
+func (s *boltStore) view(ctx context.Context, bucket []byte, fn func(k, v []byte)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			fn(k, v)
+			return nil
+		})
+	})
+}
+
+func encodeTimes(t domainTimes) []byte {
+	v := make([]byte, 24)
+	binary.BigEndian.PutUint64(v[0:], uint64(t.FirstSeen))
+	binary.BigEndian.PutUint64(v[8:], uint64(t.LastSeen))
+	binary.BigEndian.PutUint64(v[16:], uint64(t.Count))
+	return v
+}
+
+func decodeTimes(v []byte) domainTimes {
+	return domainTimes{
+		FirstSeen: int64(binary.BigEndian.Uint64(v[0:])),
+		LastSeen:  int64(binary.BigEndian.Uint64(v[8:])),
+		Count:     int64(binary.BigEndian.Uint64(v[16:])),
+	}
+}
+
+func encodeResolution(r resolution) []byte {
+	v := make([]byte, 0, 48)
+	for _, n := range []int64{r.Cached, r.Forwarded, r.Blocked, r.Replies, r.LatencyMs, r.MaxLatencyMs} {
+		v = binary.BigEndian.AppendUint64(v, uint64(n))
+	}
+	return v
+}
+
+func decodeResolution(v []byte) resolution {
+	n := func(i int) int64 { return int64(binary.BigEndian.Uint64(v[8*i:])) }
+	return resolution{Cached: n(0), Forwarded: n(1), Blocked: n(2), Replies: n(3), LatencyMs: n(4), MaxLatencyMs: n(5)}
+}
+
+// mergeTimes folds t into the value stored under key.
+func mergeTimes(b *bolt.Bucket, key []byte, t domainTimes) error {
+	if v := b.Get(key); v != nil {
+		stored := decodeTimes(v)
+		t.FirstSeen = min(t.FirstSeen, stored.FirstSeen)
+		t.LastSeen = max(t.LastSeen, stored.LastSeen)
+		t.Count += stored.Count
+	}
+	return b.Put(key, encodeTimes(t))
+}
+
+func clientKey(key domainClient) []byte {
+	return []byte(key.Domain + "\x00" + key.Client)
+}
+
+// sourceKey inlines the source in the key, as bbolt has no joins to give
+// sources ids for.
+func sourceKey(key domainSource) []byte {
+	return []byte(key.Domain + "\x00" + key.Path + "\x00" + key.Host)
+}
+
+func hourKey(key domainHour) []byte {
+	k := make([]byte, len(key.Domain)+9)
+	copy(k, key.Domain)
+	binary.BigEndian.PutUint64(k[len(key.Domain)+1:], uint64(key.Hour))
+	return k
+}
+
+func (s *boltStore) saveDomains(ctx context.Context, domains map[string]domainTimes) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDomains)
+		for domain, times := range domains {
+			if err := mergeTimes(b, []byte(domain), times); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainClients(ctx context.Context, clients map[domainClient]domainTimes) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltClients)
+		for key, times := range clients {
+			if err := mergeTimes(b, clientKey(key), times); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainHours(ctx context.Context, counts map[domainHour]int64) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltHours)
+		for key, count := range counts {
+			k := hourKey(key)
+			if v := b.Get(k); v != nil {
+				count += int64(binary.BigEndian.Uint64(v))
+			}
+			if err := b.Put(k, binary.BigEndian.AppendUint64(nil, uint64(count))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainResolutions(ctx context.Context, resolutions map[string]resolution) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltResolution)
+		for domain, r := range resolutions {
+			if v := b.Get([]byte(domain)); v != nil {
+				r = r.plus(decodeResolution(v))
+			}
+			if err := b.Put([]byte(domain), encodeResolution(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainSources(ctx context.Context, sources sourceDomains) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSources)
+		for src, domains := range sources {
+			for domain, times := range domains {
+				if err := mergeTimes(b, sourceKey(domainSource{domain, src}), times); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainTypes(ctx context.Context, types map[domainType]domainTimes) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTypes)
+		for key, times := range types {
+			if err := mergeTimes(b, []byte(key.Domain+"\x00"+key.Type), times); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainAddresses(ctx context.Context, addresses map[domainAddress]domainTimes) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAddresses)
+		for key, times := range addresses {
+			if err := mergeTimes(b, []byte(key.Domain+"\x00"+key.Address), times); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDomainScores(ctx context.Context, scores map[string]int64) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltScores)
+		for domain, score := range scores {
+			if err := b.Put([]byte(domain), encodeScore(score)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveLiveness(ctx context.Context, checks map[string]liveness) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLiveness)
+		for domain, l := range checks {
+			if err := b.Put([]byte(domain), encodeLiveness(l)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveAddressInfo(ctx context.Context, info map[string]addressInfo) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAddressInfo)
+		for addr, i := range info {
+			if err := b.Put([]byte(addr), encodeAddressInfo(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveRegistrations(ctx context.Context, registrations map[string]registration) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRegistered)
+		for domain, r := range registrations {
+			if err := b.Put([]byte(domain), encodeRegistration(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveRanks(ctx context.Context, ranks map[string]domainRank) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRanks)
+		for domain, r := range ranks {
+			if err := b.Put([]byte(domain), encodeRank(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDNSBL(ctx context.Context, results map[dnsblKey]dnsblResult) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDNSBL)
+		for key, r := range results {
+			if err := b.Put(dnsblBoltKey(key), encodeDNSBL(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) saveDevices(ctx context.Context, devices map[device]domainTimes) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevices)
+		for key, times := range devices {
+			if err := mergeTimes(b, deviceKey(key), times); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) loadDomainRows(ctx context.Context) ([]domainRow, error) {
+	var domains []domainRow
+	err := s.view(ctx, boltDomains, func(k, v []byte) {
+		t := decodeTimes(v)
+		domains = append(domains, domainRow{Domain: string(k), FirstSeen: t.FirstSeen, LastSeen: t.LastSeen, Count: t.Count})
+	})
+	return domains, err
+}
+
+func (s *boltStore) loadDomainClients(ctx context.Context) ([]domainClientRow, error) {
+	var clients []domainClientRow
+	err := s.view(ctx, boltClients, func(k, v []byte) {
+		domain, client, _ := bytes.Cut(k, []byte{0})
+		clients = append(clients, domainClientRow{
+			domainClient: domainClient{Domain: string(domain), Client: string(client)},
+			domainTimes:  decodeTimes(v),
+		})
+	})
+	return clients, err
+}
+
+func (s *boltStore) loadDomainHours(ctx context.Context, since int64) ([]domainHourCount, error) {
+	cutoff := hourOf(since)
+	var counts []domainHourCount
+	err := s.view(ctx, boltHours, func(k, v []byte) {
+		split := len(k) - 9
+		hour := int64(binary.BigEndian.Uint64(k[split+1:]))
+		if hour < cutoff {
+			return
+		}
+		counts = append(counts, domainHourCount{
+			domainHour: domainHour{Domain: string(k[:split]), Hour: hour},
+			Count:      int64(binary.BigEndian.Uint64(v)),
+		})
+	})
+	return counts, err
+}
+
+func (s *boltStore) loadDomainResolutions(ctx context.Context) (map[string]resolution, error) {
+	resolutions := make(map[string]resolution)
+	err := s.view(ctx, boltResolution, func(k, v []byte) {
+		resolutions[string(k)] = decodeResolution(v)
+	})
+	return resolutions, err
+}
+
+func (s *boltStore) loadDomainSources(ctx context.Context) ([]domainSourceRow, error) {
+	var sources []domainSourceRow
+	err := s.view(ctx, boltSources, func(k, v []byte) {
+		domain, rest, _ := bytes.Cut(k, []byte{0})
+		path, host, _ := bytes.Cut(rest, []byte{0})
+		sources = append(sources, domainSourceRow{
+			domainSource: domainSource{Domain: string(domain), inputSource: inputSource{Path: string(path), Host: string(host)}},
+			domainTimes:  decodeTimes(v),
+		})
+	})
+	return sources, err
+}
+
+func (s *boltStore) loadDomainTypes(ctx context.Context) ([]domainTypeRow, error) {
+	var types []domainTypeRow
+	err := s.view(ctx, boltTypes, func(k, v []byte) {
+		domain, typ, _ := bytes.Cut(k, []byte{0})
+		types = append(types, domainTypeRow{
+			domainType:  domainType{Domain: string(domain), Type: string(typ)},
+			domainTimes: decodeTimes(v),
+		})
+	})
+	return types, err
+}
+
+func (s *boltStore) loadDomainAddresses(ctx context.Context) ([]domainAddressRow, error) {
+	var addresses []domainAddressRow
+	err := s.view(ctx, boltAddresses, func(k, v []byte) {
+		domain, addr, _ := bytes.Cut(k, []byte{0})
+		addresses = append(addresses, domainAddressRow{
+			domainAddress: domainAddress{Domain: string(domain), Address: string(addr)},
+			domainTimes:   decodeTimes(v),
+		})
+	})
+	return addresses, err
+}
+
+func (s *boltStore) loadDomainScores(ctx context.Context) (map[string]int64, error) {
+	scores := make(map[string]int64)
+	err := s.view(ctx, boltScores, func(k, v []byte) {
+		scores[string(k)] = decodeScore(v)
+	})
+	return scores, err
+}
+
+func (s *boltStore) loadLiveness(ctx context.Context) (map[string]liveness, error) {
+	checks := make(map[string]liveness)
+	err := s.view(ctx, boltLiveness, func(k, v []byte) {
+		checks[string(k)] = decodeLiveness(v)
+	})
+	return checks, err
+}
+
+func (s *boltStore) loadAddressInfo(ctx context.Context) (map[string]addressInfo, error) {
+	info := make(map[string]addressInfo)
+	err := s.view(ctx, boltAddressInfo, func(k, v []byte) {
+		info[string(k)] = decodeAddressInfo(v)
+	})
+	return info, err
+}
+
+func (s *boltStore) loadRegistrations(ctx context.Context) (map[string]registration, error) {
+	registrations := make(map[string]registration)
+	err := s.view(ctx, boltRegistered, func(k, v []byte) {
+		registrations[string(k)] = decodeRegistration(v)
+	})
+	return registrations, err
+}
+
+func (s *boltStore) loadRanks(ctx context.Context) (map[string]domainRank, error) {
+	ranks := make(map[string]domainRank)
+	err := s.view(ctx, boltRanks, func(k, v []byte) {
+		ranks[string(k)] = decodeRank(v)
+	})
+	return ranks, err
+}
+
+func (s *boltStore) loadDNSBL(ctx context.Context) (map[dnsblKey]dnsblResult, error) {
+	results := make(map[dnsblKey]dnsblResult)
+	err := s.view(ctx, boltDNSBL, func(k, v []byte) {
+		key, r := decodeDNSBL(k, v)
+		results[key] = r
+	})
+	return results, err
+}
+
+func (s *boltStore) loadDevices(ctx context.Context) ([]deviceRow, error) {
+	var devices []deviceRow
+	err := s.view(ctx, boltDevices, func(k, v []byte) {
+		devices = append(devices, deviceRow{parseDeviceKey(k), decodeTimes(v)})
+	})
+	return devices, err
+}
+
+func (s *boltStore) loadCheckpoint(ctx context.Context, path string) (checkpoint, bool, error) {
+	c := checkpoint{Path: path}
+	found := false
+	if err := ctx.Err(); err != nil {
+		return c, false, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCheckpoints)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(path)); v != nil {
+			c.Inode = binary.BigEndian.Uint64(v[0:])
+			c.Offset = int64(binary.BigEndian.Uint64(v[8:]))
+			found = true
+		}
+		return nil
+	})
+	return c, found, err
+}
+
+func (s *boltStore) saveCheckpoints(ctx context.Context, checkpoints []checkpoint) error {
+	now := time.Now().Unix()
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCheckpoints)
+		for _, c := range checkpoints {
+			v := make([]byte, 24)
+			binary.BigEndian.PutUint64(v[0:], c.Inode)
+			binary.BigEndian.PutUint64(v[8:], uint64(c.Offset))
+			binary.BigEndian.PutUint64(v[16:], uint64(now))
+			if err := b.Put([]byte(c.Path), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) clearCheckpoints(ctx context.Context, paths []string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCheckpoints)
+		for _, path := range paths {
+			if err := b.Delete([]byte(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadFingerprint reads a parsed_files value: the inode, size, first and last
+// seen and parse time as big-endian integers, followed by the path.
+func (s *boltStore) loadFingerprint(ctx context.Context, hash string) (fileFingerprint, bool, error) {
+	fp := fileFingerprint{Hash: hash}
+	found := false
+	if err := ctx.Err(); err != nil {
+		return fp, false, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltParsedFiles)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(hash)); v != nil {
+			fp, found = decodeBoltFingerprint([]byte(hash), v), true
+		}
+		return nil
+	})
+	return fp, found, err
+}
+
+// loadInodeFingerprint scans parsed_files, which holds a value per file parsed.
+func (s *boltStore) loadInodeFingerprint(ctx context.Context, inode uint64) (fileFingerprint, bool, error) {
+	var last fileFingerprint
+	found := false
+	if err := ctx.Err(); err != nil {
+		return last, false, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltParsedFiles)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			fp := decodeBoltFingerprint(k, v)
+			if fp.Inode == inode && (!found || fp.ParsedAt > last.ParsedAt || fp.ParsedAt == last.ParsedAt && fp.Size > last.Size) {
+				last, found = fp, true
+			}
+			return nil
+		})
+	})
+	return last, found, err
+}
+
+func decodeBoltFingerprint(k, v []byte) fileFingerprint {
+	n := func(i int) int64 { return int64(binary.BigEndian.Uint64(v[8*i:])) }
+	return fileFingerprint{Hash: string(k), Path: string(v[40:]), Inode: uint64(n(0)), Size: n(1), FirstSeen: n(2), LastSeen: n(3), ParsedAt: n(4)}
+}
+
+func (s *boltStore) saveFingerprints(ctx context.Context, fingerprints []fileFingerprint) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltParsedFiles)
+		for _, fp := range fingerprints {
+			v := make([]byte, 0, 40+len(fp.Path))
+			for _, n := range []int64{int64(fp.Inode), fp.Size, fp.FirstSeen, fp.LastSeen, fp.ParsedAt} {
+				v = binary.BigEndian.AppendUint64(v, uint64(n))
+			}
+			if err := b.Put([]byte(fp.Hash), append(v, fp.Path...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"maps"
+)
+
+// memoryStore keeps the aggregates in maps for --no-db runs, which parse and
+// export in one go without persisting anything.
+type memoryStore struct {
+	domains     map[string]domainTimes
+	clients     map[domainClient]domainTimes
+	hours       map[domainHour]int64
+	resolutions map[string]resolution
+	sources     sourceDomains
+	types       map[domainType]domainTimes
+	addresses   map[domainAddress]domainTimes
+	scores      map[string]int64
+	liveness    map[string]liveness
+	info        map[string]addressInfo
+	registered  map[string]registration
+	ranks       map[string]domainRank
+	dnsbl       map[dnsblKey]dnsblResult
+	devices     map[device]domainTimes
+	checkpoints map[string]checkpoint
+	parsed      map[string]fileFingerprint
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		domains:     make(map[string]domainTimes),
+		clients:     make(map[domainClient]domainTimes),
+		hours:       make(map[domainHour]int64),
+		resolutions: make(map[string]resolution),
+		sources:     make(sourceDomains),
+		types:       make(map[domainType]domainTimes),
+		addresses:   make(map[domainAddress]domainTimes),
+		scores:      make(map[string]int64),
+		liveness:    make(map[string]liveness),
+		info:        make(map[string]addressInfo),
+		registered:  make(map[string]registration),
+		ranks:       make(map[string]domainRank),
+		dnsbl:       make(map[dnsblKey]dnsblResult),
+		devices:     make(map[device]domainTimes),
+		checkpoints: make(map[string]checkpoint),
+		parsed:      make(map[string]fileFingerprint),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) saveDomains(ctx context.Context, domains map[string]domainTimes) error {
+	for domain, times := range domains {
+		mergeInto(s.domains, domain, times)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainClients(ctx context.Context, clients map[domainClient]domainTimes) error {
+	for key, times := range clients {
+		mergeInto(s.clients, key, times)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainHours(ctx context.Context, counts map[domainHour]int64) error {
+	for key, count := range counts {
+		s.hours[key] += count
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainResolutions(ctx context.Context, resolutions map[string]resolution) error {
+	for domain, r := range resolutions {
+		mergeResolution(s.resolutions, domain, r)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainSources(ctx context.Context, sources sourceDomains) error {
+	s.sources.mergeFrom(sources)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainTypes(ctx context.Context, types map[domainType]domainTimes) error {
+	for key, times := range types {
+		mergeInto(s.types, key, times)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainAddresses(ctx context.Context, addresses map[domainAddress]domainTimes) error {
+	for key, times := range addresses {
+		mergeInto(s.addresses, key, times)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDomainScores(ctx context.Context, scores map[string]int64) error {
+	maps.Copy(s.scores, scores)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveLiveness(ctx context.Context, checks map[string]liveness) error {
+	maps.Copy(s.liveness, checks)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveAddressInfo(ctx context.Context, info map[string]addressInfo) error {
+	maps.Copy(s.info, info)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveRegistrations(ctx context.Context, registrations map[string]registration) error {
+	maps.Copy(s.registered, registrations)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveRanks(ctx context.Context, ranks map[string]domainRank) error {
+	maps.Copy(s.ranks, ranks)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDNSBL(ctx context.Context, results map[dnsblKey]dnsblResult) error {
+	maps.Copy(s.dnsbl, results)
+	return ctx.Err()
+}
+
+func (s *memoryStore) saveDevices(ctx context.Context, devices map[device]domainTimes) error {
+	for key, times := range devices {
+		mergeInto(s.devices, key, times)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) loadDomainRows(ctx context.Context) ([]domainRow, error) {
+	domains := make([]domainRow, 0, len(s.domains))
+	for domain, t := range s.domains {
+		domains = append(domains, domainRow{Domain: domain, FirstSeen: t.FirstSeen, LastSeen: t.LastSeen, Count: t.Count})
+	}
+	return domains, ctx.Err()
+}
+
+func (s *memoryStore) loadDomainClients(ctx context.Context) ([]domainClientRow, error) {
+	clients := make([]domainClientRow, 0, len(s.clients))
+	for key, t := range s.clients {
+		clients = append(clients, domainClientRow{domainClient: key, domainTimes: t})
+	}
+	return clients, ctx.Err()
+}
+
+func (s *memoryStore) loadDomainHours(ctx context.Context, since int64) ([]domainHourCount, error) {
+	cutoff := hourOf(since)
+	var counts []domainHourCount
+	for key, count := range s.hours {
+		if key.Hour >= cutoff {
+			counts = append(counts, domainHourCount{domainHour: key, Count: count})
+		}
+	}
+	return counts, ctx.Err()
+}
+
+func (s *memoryStore) loadDomainResolutions(ctx context.Context) (map[string]resolution, error) {
+	return maps.Clone(s.resolutions), ctx.Err()
+}
+
+func (s *memoryStore) loadDomainSources(ctx context.Context) ([]domainSourceRow, error) {
+	var sources []domainSourceRow
+	for src, domains := range s.sources {
+		for domain, t := range domains {
+			sources = append(sources, domainSourceRow{domainSource{domain, src}, t})
+		}
+	}
+	return sources, ctx.Err()
+}
+
+func (s *memoryStore) loadDomainTypes(ctx context.Context) ([]domainTypeRow, error) {
+	types := make([]domainTypeRow, 0, len(s.types))
+	for key, t := range s.types {
+		types = append(types, domainTypeRow{key, t})
+	}
+	return types, ctx.Err()
+}
+
+func (s *memoryStore) loadDomainAddresses(ctx context.Context) ([]domainAddressRow, error) {
+	addresses := make([]domainAddressRow, 0, len(s.addresses))
+	for key, t := range s.addresses {
+		addresses = append(addresses, domainAddressRow{key, t})
+	}
+	return addresses, ctx.Err()
+}
+
+func (s *memoryStore) loadDomainScores(ctx context.Context) (map[string]int64, error) {
+	return maps.Clone(s.scores), ctx.Err()
+}
+
+func (s *memoryStore) loadLiveness(ctx context.Context) (map[string]liveness, error) {
+	return maps.Clone(s.liveness), ctx.Err()
+}
+
+func (s *memoryStore) loadAddressInfo(ctx context.Context) (map[string]addressInfo, error) {
+	return maps.Clone(s.info), ctx.Err()
+}
+
+func (s *memoryStore) loadRegistrations(ctx context.Context) (map[string]registration, error) {
+	return maps.Clone(s.registered), ctx.Err()
+}
+
+func (s *memoryStore) loadRanks(ctx context.Context) (map[string]domainRank, error) {
+	return maps.Clone(s.ranks), ctx.Err()
+}
+
+func (s *memoryStore) loadDNSBL(ctx context.Context) (map[dnsblKey]dnsblResult, error) {
+	return maps.Clone(s.dnsbl), ctx.Err()
+}
+
+func (s *memoryStore) loadDevices(ctx context.Context) ([]deviceRow, error) {
+	devices := make([]deviceRow, 0, len(s.devices))
+	for key, t := range s.devices {
+		devices = append(devices, deviceRow{key, t})
+	}
+	return devices, ctx.Err()
+}
+
+func (s *memoryStore) loadCheckpoint(ctx context.Context, path string) (checkpoint, bool, error) {
+	c, ok := s.checkpoints[path]
+	if !ok {
+		c.Path = path
+	}
+	return c, ok, ctx.Err()
+}
+
+func (s *memoryStore) saveCheckpoints(ctx context.Context, checkpoints []checkpoint) error {
+	for _, c := range checkpoints {
+		s.checkpoints[c.Path] = c
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) clearCheckpoints(ctx context.Context, paths []string) error {
+	for _, path := range paths {
+		delete(s.checkpoints, path)
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) loadFingerprint(ctx context.Context, hash string) (fileFingerprint, bool, error) {
+	fp, ok := s.parsed[hash]
+	return fp, ok, ctx.Err()
+}
+
+func (s *memoryStore) loadInodeFingerprint(ctx context.Context, inode uint64) (fileFingerprint, bool, error) {
+	var last fileFingerprint
+	found := false
+	for _, fp := range s.parsed {
+		if fp.Inode == inode && (!found || fp.ParsedAt > last.ParsedAt || fp.ParsedAt == last.ParsedAt && fp.Size > last.Size) {
+			last, found = fp, true
+		}
+	}
+	return last, found, ctx.Err()
+}
+
+func (s *memoryStore) saveFingerprints(ctx context.Context, fingerprints []fileFingerprint) error {
+	for _, fp := range fingerprints {
+		s.parsed[fp.Hash] = fp
+	}
+	return ctx.Err()
+}
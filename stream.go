@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// streamBuffer is how many events a /stream client may fall behind by before
+// the events it has no room for are dropped.
+const streamBuffer = 256
+
+// streamEvent is a message of /stream: a query as it is logged, or a domain
+// seen for the first time.
+type streamEvent struct {
+	Type      string    `json:"type"` // query or new_domain
+	Time      time.Time `json:"time"` // of the query, or when the domain was first seen
+	Domain    string    `json:"domain"`
+	Client    string    `json:"client,omitempty"`
+	QueryType string    `json:"query_type,omitempty"`
+}
+
+// eventHub hands the events of a followed log to the /stream clients.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+}
+
+// streamClient is a /stream connection, with the events it asked for.
+type streamClient struct {
+	events  chan streamEvent
+	clients clientFilter
+	types   map[string]bool // all when empty
+	dropped int
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{clients: make(map[*streamClient]bool)}
+}
+
+func (h *eventHub) subscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+func (h *eventHub) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+	if c.dropped > 0 {
+		slog.Warn("stream client fell behind", "dropped", c.dropped)
+	}
+}
+
+// publish sends e to the clients that want it, without waiting for any.
+func (h *eventHub) publish(e streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if len(c.types) > 0 && !c.types[e.Type] || !c.clients.matches(e.Client) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+// followEvents follows the log at path from its end, as tail does, parsing
+// its lines with parse, and publishes its queries and the domains not in
+// tracker to hub until ctx is done.
+func followEvents(ctx context.Context, path string, parse lineParser, tracker *newDomainTracker, hub *eventHub) error {
+	f, err := openFollower(path, false)
+	if err != nil {
+		return err
+	}
+	defer f.close()
+	slog.Info("following", "path", path)
+	for {
+		line, err := f.readLine()
+		if err == nil {
+			l, err := parse(line)
+			if err != nil || !l.isQuery() || len(l.Domain) == 0 {
+				continue
+			}
+			domain := canonicalDomain(string(l.Domain))
+			e := streamEvent{Type: "query", Time: time.Unix(l.Timestamp, 0), Domain: domain, Client: string(l.Client), QueryType: string(l.queryType())}
+			hub.publish(e)
+			if tracker.add(reverseDomainParts(domain)) {
+				e.Type, e.QueryType = "new_domain", ""
+				hub.publish(e)
+			}
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailPollInterval):
+			if err := f.checkRotation(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// stream sends the events of the followed log as JSON WebSocket messages,
+// those of the clients in ?client= and of the ?type= (query or new_domain)
+// only, if given. Browsers may only connect from pages the server itself
+// served, so other sites cannot watch the queries of whoever visits them.
+func (s *apiServer) stream(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		apiError(w, http.StatusNotFound, errors.New("no log followed: start serve with --follow"))
+		return
+	}
+	c := &streamClient{events: make(chan streamEvent, streamBuffer), types: make(map[string]bool)}
+	query := r.URL.Query()
+	if v := query.Get("client"); v != "" {
+		if err := c.clients.Set(v); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	for _, typ := range strings.Split(query.Get("type"), ",") {
+		switch typ {
+		case "":
+		case "query", "new_domain":
+			c.types[typ] = true
+		default:
+			apiError(w, http.StatusBadRequest, errors.New("type must be query or new_domain"))
+			return
+		}
+	}
+
+	handshake := func(config *websocket.Config, r *http.Request) error {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return nil
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return errors.New("cross-origin connections are not allowed")
+		}
+		return nil
+	}
+	websocket.Server{Handshake: handshake, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		s.events.subscribe(c)
+		defer s.events.unsubscribe(c)
+
+		// Nothing is read from clients, but reading notices them leave.
+		gone := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(gone)
+		}()
+		for {
+			select {
+			case e := <-c.events:
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Exit statuses telling failed runs apart, for wrapper scripts and monitoring.
+// Other failures exit with 1, bad flags with 2 and interrupted runs with
+// exitInterrupted.
+const (
+	exitInput    = 3 // an input file could not be opened or read
+	exitParse    = 4 // an input could not be parsed, such as one with a line too long
+	exitDatabase = 5 // the database could not be opened, read or written
+)
+
+// exitError is an error that ends the program with a status of its own.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode returns err, if not nil, marked to exit with code.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the exit status for the error a command returned.
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.As(err, &e):
+		return e.code
+	}
+	return 1
+}
+
+// runSummary is what --summary-json writes at the end of a parse.
+type runSummary struct {
+	Lines          uint64        `json:"lines"`
+	ParseErrors    int           `json:"parse_errors"` // lines rejected as malformed
+	NewDomains     int           `json:"new_domains"`
+	UpdatedDomains int           `json:"updated_domains"`
+	Duration       float64       `json:"duration_seconds"`
+	Files          []fileSummary `json:"files"`
+	Error          string        `json:"error,omitempty"`
+	ExitCode       int           `json:"exit_code"`
+
+	path    string // --summary-json
+	start   time.Time
+	tracker *newDomainTracker
+	touched map[string]bool // reversed domains saved by the run
+}
+
+// fileSummary is what a run made of one input file.
+type fileSummary struct {
+	Path      string  `json:"path"`
+	Skipped   bool    `json:"skipped,omitempty"` // as already parsed
+	Lines     int64   `json:"lines"`
+	Offset    int64   `json:"offset"` // bytes of log lines read up to, decompressed
+	FirstSeen int64   `json:"first_seen,omitempty"`
+	LastSeen  int64   `json:"last_seen,omitempty"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+// addSummaryFlag registers --summary-json on fs.
+func addSummaryFlag(fs *flag.FlagSet) *runSummary {
+	s := &runSummary{start: time.Now(), Files: []fileSummary{}}
+	fs.StringVar(&s.path, "summary-json", "", "at the end of the run, write a JSON summary of it to `path` (- for standard output): lines, parse errors, new and updated domains, duration and the stats of each file")
+	return s
+}
+
+func (s *runSummary) enabled() bool {
+	return s != nil && s.path != ""
+}
+
+// begin loads the domains stored in st, to tell the new ones from those
+// updated. Dry runs have no st and count every domain as new.
+func (s *runSummary) begin(ctx context.Context, st store, dbOpts dbOptions) error {
+	if !s.enabled() {
+		return nil
+	}
+	s.touched = make(map[string]bool)
+	if st == nil {
+		return nil
+	}
+	tracker, err := loadNewDomainTracker(ctx, st, dbOpts)
+	if err != nil {
+		return withExitCode(exitDatabase, err)
+	}
+	s.tracker = tracker
+	return nil
+}
+
+// observe counts the domains of agg. It must be called before agg is saved.
+func (s *runSummary) observe(agg *aggregator) {
+	if !s.enabled() {
+		return
+	}
+	for domain := range agg.domains {
+		if s.touched[domain] {
+			continue
+		}
+		s.touched[domain] = true
+		if s.tracker == nil || s.tracker.add(domain) {
+			s.NewDomains++
+		} else {
+			s.UpdatedDomains++
+		}
+	}
+}
+
+// addFile records how far the input at path was read.
+func (s *runSummary) addFile(path string, cp checkpoint, span domainTimes, took time.Duration) {
+	if !s.enabled() {
+		return
+	}
+	s.Files = append(s.Files, fileSummary{Path: path, Lines: span.Count, Offset: cp.Offset,
+		FirstSeen: span.FirstSeen, LastSeen: span.LastSeen, Duration: took.Seconds()})
+}
+
+// skipFile records an input passed over as already parsed.
+func (s *runSummary) skipFile(path string) {
+	if s.enabled() {
+		s.Files = append(s.Files, fileSummary{Path: path, Skipped: true})
+	}
+}
+
+// count takes the lines read and rejected from agg and rejects.
+func (s *runSummary) count(agg *aggregator, rejects *rejectLog) {
+	if s.enabled() {
+		s.Lines = atomic.LoadUint64(&agg.linesProcessed)
+		s.ParseErrors = rejects.total()
+	}
+}
+
+// write writes the summary of a run that ended with err, and returns err, or
+// the error writing the summary when the run succeeded.
+func (s *runSummary) write(err error) error {
+	if !s.enabled() {
+		return err
+	}
+	s.Duration = time.Since(s.start).Seconds()
+	s.ExitCode = exitCode(err)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	data, jsonErr := json.MarshalIndent(s, "", "  ")
+	if jsonErr != nil {
+		return errors.Join(err, jsonErr)
+	}
+	data = append(data, '\n')
+	var writeErr error
+	if s.path == stdinPath {
+		_, writeErr = os.Stdout.Write(data)
+	} else {
+		writeErr = os.WriteFile(s.path, data, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// tailPollInterval is how often a followed file is checked for new data or rotation.
+const tailPollInterval = time.Second
+
+// runTail implements the tail subcommand: follow a log file like tail -F and save
+// the aggregated queries periodically.
+func runTail(ctx context.Context, args []string) error {
+	return followLog(ctx, args, nil)
+}
+
+// followLog follows a log file for tail, or for d when run as a daemon, until
+// interrupted or, for a daemon, told to reload.
+func followLog(ctx context.Context, args []string, d *daemon) error {
+	name := "tail"
+	if d != nil {
+		name = "daemon"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	clients := addClientFlag(fs)
+	rejectsPath := addRejectsFlag(fs)
+	interval := fs.Duration("flush", 30*time.Second, "how often to save to the database")
+	fromStart := fs.Bool("from-start", false, "read the existing contents of the file before following it")
+	flushOpts := addFlushFlags(fs)
+	knownCache := fs.Int("known-cache", 0, "remember up to `n` domains known to be stored and save them with a plain UPDATE rather than an upsert (0 disables)")
+	pruneAfter := fs.String("prune-older-than", "", pruneFlagUsage+", at most hourly")
+	queries := addQueryFlags(fs)
+	clickhouse := addClickHouseFlags(fs)
+	anonymize := addAnonymizeFlags(fs)
+	format := addInputFormatFlag(fs)
+	webhook := addWebhookFlags(fs)
+	dnsbl := addDNSBLFlags(fs)
+	mqtt := addMQTTFlags(fs)
+	metricsAddr := fs.String("metrics", "", metricsFlagUsage)
+	d.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	parse, err := inputFormat(*format)
+	if err != nil {
+		return err
+	}
+	if *pruneAfter != "" {
+		if _, err := parseSince(*pruneAfter, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	path := defaultInputPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	} else if d.listensForSyslog() {
+		// A daemon receiving syslog follows a file only when given one.
+		path = ""
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return fmt.Errorf("initializing database: %w", err)
+	}
+	defer st.Close()
+	if db, ok := st.(*database); ok && *knownCache > 0 {
+		db.known = newKnownDomains(*knownCache)
+	}
+
+	var f *follower
+	if path != "" {
+		if f, err = openFollower(path, *fromStart); err != nil {
+			return err
+		}
+		defer f.close()
+
+		// A checkpoint left by an earlier run takes precedence over --from-start.
+		loadCtx, cancel := dbOpts.withTimeout(ctx)
+		saved, ok, err := st.loadCheckpoint(loadCtx, path)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("loading checkpoint: %w", err)
+		}
+		if ok && saved.resumes(f.info) {
+			if err := f.seek(saved.Offset); err != nil {
+				return err
+			}
+			slog.Info("resuming", "path", path, "offset", saved.Offset)
+		}
+		slog.Info("following", "path", path)
+	}
+	sched, err := d.startSchedule(st, *dbOpts, *clients)
+	if err != nil {
+		return err
+	}
+	defer sched.stop()
+	syslog, err := d.listenSyslog()
+	if err != nil {
+		return err
+	}
+	defer syslog.close()
+
+	rejects, err := newRejectLog(*rejectsPath)
+	if err != nil {
+		return err
+	}
+	defer rejects.close()
+
+	agg := newAggregator(*clients, rejects)
+	agg.parse = parse.live()
+	agg.beginSource(cmp.Or(path, syslog.addr()))
+	if err := queries.enable(agg, st); err != nil {
+		return err
+	}
+	if err := anonymize.enable(agg); err != nil {
+		return err
+	}
+	if clickhouse.URL != "" {
+		sink, err := startClickHouseSink(ctx, *clickhouse)
+		if err != nil {
+			return err
+		}
+		defer sink.close()
+		agg.sink = sink
+	}
+	var tracker *newDomainTracker
+	if webhook.URL != "" || mqtt.URL != "" || *metricsAddr != "" || telemetry != nil {
+		if tracker, err = loadNewDomainTracker(ctx, st, *dbOpts); err != nil {
+			return err
+		}
+	}
+	var notifier *webhookNotifier
+	var checker *dnsblChecker
+	if webhook.URL != "" {
+		if dnsbl.enabled() {
+			if checker, err = newDNSBLChecker(ctx, st, *dbOpts, *dnsbl); err != nil {
+				return err
+			}
+		}
+		if notifier, err = startWebhookNotifier(ctx, *webhook, checker); err != nil {
+			return err
+		}
+		defer notifier.close()
+	}
+	var publisher *mqttPublisher
+	if mqtt.URL != "" {
+		if publisher, err = startMQTTPublisher(ctx, *mqtt); err != nil {
+			return err
+		}
+		defer publisher.close()
+	}
+	var m *metricSet
+	if *metricsAddr != "" || telemetry != nil {
+		m = newMetricSet(agg)
+		telemetry.exportMetrics(m)
+	}
+	if *metricsAddr != "" {
+		srv, err := serveMetrics(*metricsAddr, m)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+	var lastPrune time.Time
+	flush := func() (err error) {
+		m.observeRejects(rejects)
+		if err := rejects.flush(); err != nil {
+			return err
+		}
+		n := agg.pending()
+		flushCtx, span := startSpan(ctx, "flush", "domains", n)
+		defer func() { span.end(err) }()
+		saveCtx, cancel := dbOpts.withTimeout(flushCtx)
+		defer cancel()
+		if n > 0 {
+			fresh := tracker.observe(agg)
+			notifier.notify(fresh)
+			publisher.publish(agg, fresh)
+			m.observeBatch(agg)
+			m.observeDomains(fresh, tracker.known())
+			start := time.Now()
+			if err := agg.save(saveCtx, st); err != nil {
+				return fmt.Errorf("saving domains to database: %w", err)
+			}
+			m.observeWrite(time.Since(start))
+			slog.Info("saved domains", "domains", n)
+		}
+		if f != nil {
+			if err := traced(saveCtx, "save checkpoints", func(ctx context.Context) error {
+				return st.saveCheckpoints(ctx, []checkpoint{f.checkpoint()})
+			}); err != nil {
+				return fmt.Errorf("saving checkpoint: %w", err)
+			}
+		}
+		if results := checker.take(); len(results) > 0 {
+			if err := traced(saveCtx, "save DNSBL results", func(ctx context.Context) error {
+				return st.saveDNSBL(ctx, results)
+			}); err != nil {
+				return fmt.Errorf("saving DNSBL results: %w", err)
+			}
+		}
+		if *pruneAfter != "" && time.Since(lastPrune) >= pruneEvery {
+			if err := traced(saveCtx, "prune", func(ctx context.Context) error {
+				return pruneOlderThan(ctx, st, *pruneAfter)
+			}); err != nil {
+				return err
+			}
+			lastPrune = time.Now()
+		}
+		return nil
+	}
+
+	readCtx, stop := notifyInterrupt(ctx)
+	defer stop()
+	// stopped saves what was read before returning err: errInterrupted, or
+	// errReload for a daemon to start afresh.
+	stopped := func(err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := agg.sink.close(); err != nil {
+			return err
+		}
+		if errors.Is(err, errInterrupted) && f != nil {
+			slog.Warn("interrupted, saved partial results", "path", path, "offset", f.checkpoint().Offset)
+		}
+		return err
+	}
+	d.ready(path, syslog.addr())
+
+	trigger := newFlushTrigger(*flushOpts)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		line, err := f.readLine()
+		if err == nil {
+			agg.addLine(line)
+			if trigger.due(agg.pending()) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			select {
+			case <-readCtx.Done():
+				return stopped(errInterrupted)
+			case <-d.reloads():
+				return stopped(errReload)
+			case <-ticker.C:
+				if err := flush(); err != nil {
+					return err
+				}
+			case <-sched.due():
+				if err := flush(); err != nil {
+					return err
+				}
+				sched.run(ctx)
+			case <-d.watchdog():
+				d.ping()
+			case line := <-syslog.received():
+				agg.addLine(line)
+			default:
+			}
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		select {
+		case <-readCtx.Done():
+			return stopped(errInterrupted)
+		case <-d.reloads():
+			return stopped(errReload)
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-sched.due():
+			if err := flush(); err != nil {
+				return err
+			}
+			sched.run(ctx)
+		case <-d.watchdog():
+			d.ping()
+		case line := <-syslog.received():
+			agg.addLine(line)
+		case <-time.After(tailPollInterval):
+			if err := f.checkRotation(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// follower reads complete lines from a file that keeps growing, reopening it when
+// it is rotated (replaced) or truncated.
+type follower struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial []byte
+}
+
+func openFollower(path string, fromStart bool) (*follower, error) {
+	f := &follower{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	if !fromStart {
+		offset, err := f.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.close()
+			return nil, err
+		}
+		f.offset = offset
+	}
+	return f, nil
+}
+
+// seek moves to offset, which must be the start of a line.
+func (f *follower) seek(offset int64) error {
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	f.reader.Reset(f.file)
+	f.offset = offset
+	f.partial = f.partial[:0]
+	return nil
+}
+
+// checkpoint records the start of the first line not yet returned.
+func (f *follower) checkpoint() checkpoint {
+	return checkpoint{
+		Path:   f.path,
+		Inode:  fileInode(f.info),
+		Offset: f.offset - int64(len(f.partial)),
+	}
+}
+
+func (f *follower) open() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.info = file, info
+	f.reader = bufio.NewReader(file)
+	f.offset = 0
+	f.partial = f.partial[:0]
+	return nil
+}
+
+func (f *follower) close() {
+	if f != nil && f.file != nil {
+		f.file.Close()
+	}
+}
+
+// readLine returns the next complete line, or io.EOF when no full line is
+// available yet, as it never is from a nil follower. The line is only valid
+// until the next call.
+func (f *follower) readLine() ([]byte, error) {
+	if f == nil {
+		return nil, io.EOF
+	}
+	chunk, err := f.reader.ReadSlice('\n')
+	f.offset += int64(len(chunk))
+	if errors.Is(err, bufio.ErrBufferFull) {
+		f.partial = append(f.partial, chunk...)
+		return f.readLine()
+	}
+	if err != nil {
+		// Keep the incomplete tail until the writer finishes the line.
+		f.partial = append(f.partial, chunk...)
+		return nil, err
+	}
+
+	line := chunk[:len(chunk)-1]
+	if len(f.partial) > 0 {
+		f.partial = append(f.partial, line...)
+		line = f.partial
+		defer func() { f.partial = f.partial[:0] }()
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// checkRotation reopens the file when the path now names a different file, or
+// rewinds when the file was truncated. Missing files (mid-rotation) are retried later.
+func (f *follower) checkRotation() error {
+	if f == nil {
+		return nil
+	}
+	info, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(info, f.info) {
+		slog.Info("log rotated, reopening", "path", f.path)
+		f.file.Close()
+		return f.open()
+	}
+	if info.Size() < f.offset {
+		slog.Info("log truncated, rewinding", "path", f.path)
+		return f.seek(0)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpSpanInterval is how often finished spans are exported.
+	otlpSpanInterval = 5 * time.Second
+	// otlpSpanBatch is how many finished spans are exported at once, at most.
+	otlpSpanBatch = 512
+)
+
+// telemetryFlags are the OpenTelemetry flags shared by every subcommand, for
+// running as a service watched by an existing observability stack.
+type telemetryFlags struct {
+	endpoint string
+	headers  stringList
+	interval time.Duration
+}
+
+func addTelemetryFlags(fs *flag.FlagSet) *telemetryFlags {
+	f := &telemetryFlags{}
+	fs.StringVar(&f.endpoint, "otlp", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "export traces and metrics with OTLP/HTTP to the collector at `url`, such as http://localhost:4318")
+	fs.Var(&f.headers, "otlp-header", "`name=value` header for OTLP requests, such as an API key (repeatable)")
+	fs.DurationVar(&f.interval, "otlp-interval", time.Minute, "how often to export metrics with OTLP")
+	return f
+}
+
+// telemetry exports spans and metrics when --otlp is given, and is nil
+// otherwise.
+var telemetry *otlpExporter
+
+// stopTelemetry exports what is left and stops the exporter started by
+// parseFlags. main calls it once the command returns.
+var stopTelemetry = func() error { return nil }
+
+// start starts exporting, if requested, and sets stopTelemetry to finish.
+func (f *telemetryFlags) start() error {
+	if f.endpoint == "" {
+		return nil
+	}
+	if f.interval <= 0 {
+		return fmt.Errorf("--otlp-interval must be positive")
+	}
+	headers := make(http.Header)
+	pairs := []string(f.headers)
+	if len(pairs) == 0 {
+		if env := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); env != "" {
+			pairs = strings.Split(env, ",")
+		}
+	}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid OTLP header %q: want name=value", pair)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "dnsmasq-parse"
+	}
+	resource := []any{"service.name", service}
+	if host, err := os.Hostname(); err == nil {
+		resource = append(resource, "host.name", host)
+	}
+
+	e := &otlpExporter{
+		endpoint: strings.TrimSuffix(f.endpoint, "/"),
+		headers:  headers,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		interval: f.interval,
+		resource: map[string]any{"attributes": otlpAttributes(resource)},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	telemetry = e
+	stopTelemetry = e.close
+	return nil
+}
+
+// otlpExporter sends spans and metrics to an OpenTelemetry collector as
+// OTLP/HTTP with JSON bodies, in the background.
+type otlpExporter struct {
+	endpoint string
+	headers  http.Header
+	client   *http.Client
+	interval time.Duration
+	resource map[string]any
+
+	mu      sync.Mutex
+	spans   []map[string]any // finished, not yet exported
+	metrics *metricSet
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	err  error // of the final export
+}
+
+// exportMetrics makes the exporter send m periodically and at exit. It is a
+// no-op on a nil exporter.
+func (e *otlpExporter) exportMetrics(m *metricSet) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.metrics = m
+	e.mu.Unlock()
+}
+
+func (e *otlpExporter) close() error {
+	close(e.stop)
+	<-e.done
+	return e.err
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	spanTicker := time.NewTicker(otlpSpanInterval)
+	defer spanTicker.Stop()
+	metricTicker := time.NewTicker(e.interval)
+	defer metricTicker.Stop()
+	for {
+		select {
+		case <-e.wake:
+			e.logError("spans", e.sendSpans())
+		case <-spanTicker.C:
+			e.logError("spans", e.sendSpans())
+		case <-metricTicker.C:
+			e.logError("metrics", e.sendMetrics())
+		case <-e.stop:
+			e.err = errors.Join(e.sendSpans(), e.sendMetrics())
+			return
+		}
+	}
+}
+
+// logError logs a failed export; the next one may get through.
+func (e *otlpExporter) logError(what string, err error) {
+	if err != nil {
+		slog.Warn("exporting "+what+" with OTLP", "err", err)
+	}
+}
+
+func (e *otlpExporter) sendSpans() error {
+	for {
+		e.mu.Lock()
+		n := min(len(e.spans), otlpSpanBatch)
+		batch := e.spans[:n:n]
+		e.spans = e.spans[n:]
+		e.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		err := e.post("/v1/traces", map[string]any{"resourceSpans": []any{map[string]any{
+			"resource":   e.resource,
+			"scopeSpans": []any{map[string]any{"scope": otlpScope(), "spans": batch}},
+		}}})
+		if err != nil {
+			return fmt.Errorf("dropped %d spans: %w", n, err)
+		}
+	}
+}
+
+func (e *otlpExporter) sendMetrics() error {
+	e.mu.Lock()
+	m := e.metrics
+	e.mu.Unlock()
+	if m == nil {
+		return nil
+	}
+	start, now := otlpTime(m.start), otlpTime(time.Now())
+	var metrics []any
+	for _, f := range m.families() {
+		metric := map[string]any{"name": f.name, "description": f.help, "unit": f.unit}
+		if f.kind == histogramMetric {
+			counts := make([]string, len(f.hist.counts))
+			for i, c := range f.hist.counts {
+				counts[i] = strconv.FormatUint(c, 10)
+			}
+			metric["histogram"] = map[string]any{
+				"aggregationTemporality": 2, // cumulative
+				"dataPoints": []any{map[string]any{
+					"startTimeUnixNano": start,
+					"timeUnixNano":      now,
+					"count":             strconv.FormatUint(f.hist.count(), 10),
+					"sum":               f.hist.sum,
+					"bucketCounts":      counts,
+					"explicitBounds":    f.hist.bounds,
+				}},
+			}
+			metrics = append(metrics, metric)
+			continue
+		}
+		if len(f.values) == 0 {
+			continue
+		}
+		var points []any
+		for label, v := range f.values {
+			point := map[string]any{"timeUnixNano": now, "asDouble": v}
+			if f.label != "" {
+				point["attributes"] = otlpAttributes([]any{f.label, label})
+			}
+			if f.kind == counterMetric {
+				point["startTimeUnixNano"] = start
+			}
+			points = append(points, point)
+		}
+		if f.kind == counterMetric {
+			metric["sum"] = map[string]any{"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": points}
+		} else {
+			metric["gauge"] = map[string]any{"dataPoints": points}
+		}
+		metrics = append(metrics, metric)
+	}
+	return e.post("/v1/metrics", map[string]any{"resourceMetrics": []any{map[string]any{
+		"resource":     e.resource,
+		"scopeMetrics": []any{map[string]any{"scope": otlpScope(), "metrics": metrics}},
+	}}})
+}
+
+func (e *otlpExporter) post(path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = e.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// traceSpan is an operation being traced. Its methods are no-ops on a nil
+// span, which is what startSpan returns without --otlp.
+type traceSpan struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  *traceSpan
+	name    string
+	start   time.Time
+	attrs   []any // key/value pairs, as slog takes them
+}
+
+type traceSpanKey struct{}
+
+// startSpan starts a span named name, the child of the span in ctx if there
+// is one, and returns a context holding it.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *traceSpan) {
+	if telemetry == nil {
+		return ctx, nil
+	}
+	s := &traceSpan{name: name, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(traceSpanKey{}).(*traceSpan); ok {
+		s.traceID, s.parent = parent.traceID, parent
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, traceSpanKey{}, s), s
+}
+
+// set adds attributes, as key/value pairs, to the span.
+func (s *traceSpan) set(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// end finishes the span, as failed if err is not nil, and queues it for export.
+func (s *traceSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	span := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              1, // internal
+		"startTimeUnixNano": otlpTime(s.start),
+		"endTimeUnixNano":   otlpTime(time.Now()),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parent != nil {
+		span["parentSpanId"] = hex.EncodeToString(s.parent.spanID[:])
+	}
+	if err != nil {
+		span["status"] = map[string]any{"code": 2, "message": err.Error()}
+	}
+
+	e := telemetry
+	e.mu.Lock()
+	e.spans = append(e.spans, span)
+	full := len(e.spans) >= otlpSpanBatch
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// traced runs fn in a span named name.
+func traced(ctx context.Context, name string, fn func(context.Context) error, attrs ...any) error {
+	ctx, s := startSpan(ctx, name, attrs...)
+	err := fn(ctx)
+	s.end(err)
+	return err
+}
+
+// otlpAttributes converts key/value pairs to OTLP attributes.
+func otlpAttributes(kv []any) []any {
+	attrs := make([]any, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		var value map[string]any
+		switch v := kv[i+1].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]any{"key": fmt.Sprint(kv[i]), "value": value})
+	}
+	return attrs
+}
+
+func otlpScope() map[string]any {
+	return map[string]any{"name": "dnsmasq-parse"}
+}
+
+// otlpTime formats t in nanoseconds since the epoch, as a string as the JSON
+// encoding of 64-bit integers in OTLP has it.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// startTestTelemetry starts exporting to a server that keeps the bodies it
+// is sent, by path, and checks the headers of each request.
+func startTestTelemetry(t *testing.T) func() map[string][][]byte {
+	t.Helper()
+	var mu sync.Mutex
+	bodies := make(map[string][][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("%s %s with headers %v", r.Method, r.URL.Path, r.Header)
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		bodies[r.URL.Path] = append(bodies[r.URL.Path], b)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	f := &telemetryFlags{endpoint: srv.URL + "/", headers: stringList{"Authorization = Bearer secret"}, interval: time.Hour}
+	if err := f.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		telemetry = nil
+		stopTelemetry = func() error { return nil }
+	})
+	return func() map[string][][]byte {
+		if err := stopTelemetry(); err != nil {
+			t.Fatal(err)
+		}
+		return bodies
+	}
+}
+
+// decodeOTLP decodes the only body sent to path as OTLP/JSON into m. Unknown
+// fields and values of the wrong type are errors.
+func decodeOTLP(t *testing.T, bodies map[string][][]byte, path string, m proto.Message) {
+	t.Helper()
+	if len(bodies[path]) != 1 {
+		t.Fatalf("%d requests to %s, want 1", len(bodies[path]), path)
+	}
+	if err := protojson.Unmarshal(bodies[path][0], m); err != nil {
+		t.Fatalf("%s: %v\n%s", path, err, bodies[path][0])
+	}
+}
+
+// otlpID returns the ID as OTLP/JSON wrote it. OTLP/JSON has trace and span
+// IDs in hex rather than the base64 of protobuf's JSON mapping, so protojson
+// decoded the hex digits as base64.
+func otlpID(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestOTLPSpans(t *testing.T) {
+	stop := startTestTelemetry(t)
+	err := traced(context.Background(), "parse", func(ctx context.Context) error {
+		_, s := startSpan(ctx, "save", "domains", 3)
+		s.set("dialect", "sqlite", "merged", true, "ratio", 0.5)
+		s.end(errors.New("database is locked"))
+		return nil
+	}, "path", "/var/log/dnsmasq.log", "lines", int64(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data tracepb.TracesData
+	decodeOTLP(t, stop(), "/v1/traces", &data)
+	if len(data.ResourceSpans) != 1 || len(data.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("traces %v, want one resource and scope", &data)
+	}
+	resource := data.ResourceSpans[0]
+	if attrs := resource.Resource.Attributes; len(attrs) == 0 || attrs[0].Key != "service.name" || attrs[0].Value.GetStringValue() != "dnsmasq-parse" {
+		t.Errorf("resource attributes %v, want service.name dnsmasq-parse first", attrs)
+	}
+	scope := resource.ScopeSpans[0]
+	if scope.Scope.Name != "dnsmasq-parse" {
+		t.Errorf("scope %q", scope.Scope.Name)
+	}
+	spans := scope.Spans
+	if len(spans) != 2 || spans[0].Name != "save" || spans[1].Name != "parse" {
+		t.Fatalf("spans %v, want save then parse", spans)
+	}
+	save, parse := spans[0], spans[1]
+
+	for _, s := range spans {
+		traceID, err := hex.DecodeString(otlpID(s.TraceId))
+		if err != nil || len(traceID) != 16 {
+			t.Errorf("%s: trace ID %q, want 16 bytes in hex", s.Name, otlpID(s.TraceId))
+		}
+		spanID, err := hex.DecodeString(otlpID(s.SpanId))
+		if err != nil || len(spanID) != 8 {
+			t.Errorf("%s: span ID %q, want 8 bytes in hex", s.Name, otlpID(s.SpanId))
+		}
+		if s.Kind != tracepb.Span_SPAN_KIND_INTERNAL || s.StartTimeUnixNano == 0 || s.EndTimeUnixNano < s.StartTimeUnixNano {
+			t.Errorf("%s: kind %v, from %d to %d", s.Name, s.Kind, s.StartTimeUnixNano, s.EndTimeUnixNano)
+		}
+	}
+	if otlpID(save.TraceId) != otlpID(parse.TraceId) || otlpID(save.ParentSpanId) != otlpID(parse.SpanId) || len(parse.ParentSpanId) != 0 {
+		t.Errorf("save is not the child of parse: %v", spans)
+	}
+	if parse.Status != nil {
+		t.Errorf("parse: status %v, want none", parse.Status)
+	}
+	if save.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || save.Status.GetMessage() != "database is locked" {
+		t.Errorf("save: status %v, want the error", save.Status)
+	}
+
+	want := map[string]map[string]any{
+		"parse": {"path": "/var/log/dnsmasq.log", "lines": int64(42)},
+		"save":  {"domains": int64(3), "dialect": "sqlite", "merged": true, "ratio": 0.5},
+	}
+	for _, s := range spans {
+		if got := otlpAttributeMap(s.Attributes); !reflect.DeepEqual(got, want[s.Name]) {
+			t.Errorf("%s: attributes %v, want %v", s.Name, got, want[s.Name])
+		}
+	}
+}
+
+// otlpAttributeMap returns the values of attrs by key.
+func otlpAttributeMap(attrs []*commonpb.KeyValue) map[string]any {
+	m := make(map[string]any, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			m[a.Key] = v.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			m[a.Key] = v.BoolValue
+		case *commonpb.AnyValue_IntValue:
+			m[a.Key] = v.IntValue
+		case *commonpb.AnyValue_DoubleValue:
+			m[a.Key] = v.DoubleValue
+		default:
+			m[a.Key] = v
+		}
+	}
+	return m
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	stop := startTestTelemetry(t)
+	agg := newAggregator(nil, nil)
+	for _, line := range []string{
+		"Mar  1 00:00:08 dnsmasq[812]: query[A] example.com from 192.168.1.10",
+		"Mar  1 00:00:09 dnsmasq[812]: query[AAAA] example.com from 192.168.1.10",
+		"Mar  1 00:00:10 dnsmasq[812]: query[A] example.org from 192.168.1.11",
+	} {
+		agg.addLine([]byte(line))
+	}
+	m := newMetricSet(agg)
+	m.queryTypes["A"], m.queryTypes["AAAA"] = 2, 1
+	m.observeDomains(make([]newDomain, 2), 2)
+	m.observeWrite(20 * time.Millisecond)
+	m.observeWrite(3 * time.Second)
+	telemetry.exportMetrics(m)
+
+	var data metricspb.MetricsData
+	decodeOTLP(t, stop(), "/v1/metrics", &data)
+	if len(data.ResourceMetrics) != 1 || len(data.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("metrics %v, want one resource and scope", &data)
+	}
+	metrics := make(map[string]*metricspb.Metric)
+	for _, metric := range data.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	sums := []struct {
+		name   string
+		values map[string]float64 // by the value of the label
+	}{
+		{"dnsmasq_parse_lines", map[string]float64{"": 3}},
+		{"dnsmasq_parse_queries", map[string]float64{"A": 2, "AAAA": 1}},
+		{"dnsmasq_parse_flushes", map[string]float64{"": 2}},
+		{"dnsmasq_parse_new_domains", map[string]float64{"": 2}},
+	}
+	for _, tt := range sums {
+		sum := metrics[tt.name].GetSum()
+		if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+			t.Errorf("%s: %v, want a cumulative monotonic sum", tt.name, metrics[tt.name])
+			continue
+		}
+		got := make(map[string]float64)
+		for _, p := range sum.DataPoints {
+			label := ""
+			for _, v := range otlpAttributeMap(p.Attributes) {
+				label = v.(string)
+			}
+			got[label] = p.GetAsDouble()
+			if p.StartTimeUnixNano == 0 || p.TimeUnixNano < p.StartTimeUnixNano {
+				t.Errorf("%s: point from %d to %d", tt.name, p.StartTimeUnixNano, p.TimeUnixNano)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.values) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.values)
+		}
+	}
+
+	if p := metrics["dnsmasq_parse_domains"].GetGauge().GetDataPoints(); len(p) != 1 || p[0].GetAsDouble() != 2 {
+		t.Errorf("dnsmasq_parse_domains: %v, want a gauge of 2", metrics["dnsmasq_parse_domains"])
+	}
+	hist := metrics["dnsmasq_parse_db_write_seconds"].GetHistogram()
+	if hist == nil || len(hist.DataPoints) != 1 {
+		t.Fatalf("dnsmasq_parse_db_write_seconds: %v, want a histogram", metrics["dnsmasq_parse_db_write_seconds"])
+	}
+	p := hist.DataPoints[0]
+	wantCounts := make([]uint64, len(durationBuckets)+1)
+	wantCounts[2], wantCounts[9] = 1, 1 // at most 0.025 and 5 seconds
+	if p.Count != 2 || p.GetSum() != 3.02 || !slices.Equal(p.ExplicitBounds, durationBuckets) || !slices.Equal(p.BucketCounts, wantCounts) {
+		t.Errorf("dnsmasq_parse_db_write_seconds: %v, want 2 writes in buckets %v", p, wantCounts)
+	}
+	if metrics["dnsmasq_parse_db_write_seconds"].Unit != "s" {
+		t.Errorf("dnsmasq_parse_db_write_seconds: unit %q", metrics["dnsmasq_parse_db_write_seconds"].Unit)
+	}
+}
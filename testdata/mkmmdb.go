@@ -0,0 +1,258 @@
+//go:build ignore
+
+// mkmmdb writes the MaxMind DB files geoip_test.go reads: small ASN and
+// country databases, with records of each size, IPv6 and IPv4 trees, and
+// pointers of more than one size in the data section.
+//
+//	go run testdata/mkmmdb.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"maps"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+)
+
+type (
+	u16 uint16
+	u32 uint32
+	u64 uint64
+	i32 int32
+	f32 float32
+)
+
+func main() {
+	asn := []network{
+		{"23.45.67.0/24", map[string]any{"autonomous_system_number": u32(20940), "autonomous_system_organization": "Akamai International B.V."}},
+		{"20.64.0.0/10", map[string]any{"autonomous_system_number": u32(8075), "autonomous_system_organization": "MICROSOFT-CORP-MSN-AS-BLOCK"}},
+		{"2600:1406::/32", map[string]any{"autonomous_system_number": u32(20940), "autonomous_system_organization": "Akamai International B.V."}},
+		{"93.184.216.0/24", map[string]any{
+			"autonomous_system_number":       u32(15133),
+			"autonomous_system_organization": "EDGECAST",
+			"anycast":                        true,
+			"double":                         1.5,
+			"float":                          f32(0.25),
+			"int32":                          i32(-3),
+			"uint16":                         u16(443),
+			"uint64":                         u64(1 << 63),
+			"bytes":                          []byte{0xde, 0xad},
+			"array":                          []any{"a", u32(1)},
+			"long":                           string(bytes.Repeat([]byte("x"), 300)),
+		}},
+	}
+	country := []network{
+		{"23.45.67.0/24", map[string]any{"country": map[string]any{"iso_code": "NL", "names": map[string]any{"en": "Netherlands"}}}},
+		{"20.64.0.0/10", map[string]any{"registered_country": map[string]any{"iso_code": "US"}}},
+		{"2600:1406::/32", map[string]any{"country": map[string]any{"iso_code": "US"}}},
+	}
+	write("testdata/asn.mmdb", "Test-ASN", 24, 6, 0, asn)
+	write("testdata/country.mmdb", "Test-Country", 28, 6, 3000, country)
+	write("testdata/country-ipv4.mmdb", "Test-Country", 32, 4, 0, country[:2])
+}
+
+type network struct {
+	prefix string
+	record map[string]any
+}
+
+// node is a node of the search tree: each side another node, a record's
+// offset in the data section, or nil for no data.
+type node [2]any
+
+// write writes the networks to path. pad bytes before the data make pointers
+// to the keys, which are stored once at the start, longer.
+func write(path, dbType string, recordSize, ipVersion, pad int, networks []network) {
+	data := make([]byte, pad)
+	keys := make(map[string]int)
+	for _, k := range []string{"iso_code", "country", "names", "en", "autonomous_system_number", "autonomous_system_organization"} {
+		keys[k] = len(data)
+		data = encode(data, k, nil)
+	}
+
+	root := &node{}
+	for _, n := range networks {
+		prefix := netip.MustParsePrefix(n.prefix)
+		ip, bits := prefix.Addr().AsSlice(), prefix.Bits()
+		if ipVersion == 6 && prefix.Addr().Is4() {
+			// IPv4 networks go in ::/96.
+			ip, bits = append(make([]byte, 12), ip...), bits+96
+		}
+		offset := len(data)
+		data = encode(data, n.record, keys)
+		at := root
+		for i := range bits {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				at[bit] = offset
+				break
+			}
+			next, ok := at[bit].(*node)
+			if !ok {
+				next = &node{}
+				at[bit] = next
+			}
+			at = next
+		}
+	}
+
+	// Number the nodes breadth first.
+	var nodes []*node
+	index := make(map[*node]int)
+	for queue := []*node{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, side := range queue[0] {
+			if next, ok := side.(*node); ok {
+				queue = append(queue, next)
+			}
+		}
+	}
+	count := len(nodes)
+	value := func(side any) uint32 {
+		switch side := side.(type) {
+		case *node:
+			return uint32(index[side])
+		case int:
+			return uint32(count + 16 + side)
+		}
+		return uint32(count)
+	}
+	var tree []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(l>>24&0xf)<<4|byte(r>>24&0xf), byte(r>>16), byte(r>>8), byte(r))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, l)
+			tree = binary.BigEndian.AppendUint32(tree, r)
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, "\xab\xcd\xefMaxMind.com"...)
+	file = encode(file, map[string]any{
+		"node_count":                  u32(count),
+		"record_size":                 u16(recordSize),
+		"ip_version":                  u16(ipVersion),
+		"database_type":               dbType,
+		"languages":                   []any{"en"},
+		"binary_format_major_version": u16(2),
+		"binary_format_minor_version": u16(0),
+		"build_epoch":                 u64(1700000000),
+		"description":                 map[string]any{"en": "dnsmasq-parse test data"},
+	}, nil)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// encode appends v to b. Strings in pool are written as pointers to their
+// offsets instead.
+func encode(b []byte, v any, pool map[string]int) []byte {
+	switch v := v.(type) {
+	case string:
+		if offset, ok := pool[v]; ok {
+			return pointer(b, offset)
+		}
+		return append(control(b, 2, len(v)), v...)
+	case float64:
+		return binary.BigEndian.AppendUint64(control(b, 3, 8), math.Float64bits(v))
+	case []byte:
+		return append(control(b, 4, len(v)), v...)
+	case u16:
+		return unsigned(b, 5, uint64(v))
+	case u32:
+		return unsigned(b, 6, uint64(v))
+	case map[string]any:
+		b = control(b, 7, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			b = encode(b, k, pool)
+			b = encode(b, v[k], pool)
+		}
+		return b
+	case i32:
+		return binary.BigEndian.AppendUint32(control(b, 8, 4), uint32(v))
+	case u64:
+		return unsigned(b, 9, uint64(v))
+	case []any:
+		b = control(b, 11, len(v))
+		for _, x := range v {
+			b = encode(b, x, pool)
+		}
+		return b
+	case bool:
+		if v {
+			return control(b, 14, 1)
+		}
+		return control(b, 14, 0)
+	case f32:
+		return binary.BigEndian.AppendUint32(control(b, 15, 4), math.Float32bits(float32(v)))
+	}
+	log.Fatalf("cannot encode %T", v)
+	return nil
+}
+
+// control appends the control byte of a value of type typ and size.
+func control(b []byte, typ, size int) []byte {
+	c, ext := byte(typ<<5), -1
+	if typ > 7 {
+		c, ext = 0, typ-7
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		c |= byte(size)
+	case size < 285:
+		c |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		c |= 30
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+	default:
+		c |= 31
+		size -= 65821
+		extra = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+	}
+	b = append(b, c)
+	if ext >= 0 {
+		b = append(b, byte(ext))
+	}
+	return append(b, extra...)
+}
+
+// unsigned appends v in as few bytes as it needs.
+func unsigned(b []byte, typ int, v uint64) []byte {
+	n := 0
+	for x := v; x > 0; x >>= 8 {
+		n++
+	}
+	b = control(b, typ, n)
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+// pointer appends a pointer to offset, in the fewest bytes it fits.
+func pointer(b []byte, offset int) []byte {
+	switch {
+	case offset < 2048:
+		return append(b, 0x20|byte(offset>>8&7), byte(offset))
+	case offset < 526336:
+		p := offset - 2048
+		return append(b, 0x28|byte(p>>16&7), byte(p>>8), byte(p))
+	case offset < 134744064:
+		p := offset - 526336
+		return append(b, 0x30|byte(p>>24&7), byte(p>>16), byte(p>>8), byte(p))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0x38), uint32(offset))
+}
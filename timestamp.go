@@ -0,0 +1,121 @@
+package main
+
+import "time"
+
+// syslogTimestampLen is the length of a "Jan _2 15:04:05" syslog timestamp.
+const syslogTimestampLen = 15
+
+// parseSyslogTimestamp parses the "Jan _2 15:04:05" timestamp in the first
+// syslogTimestampLen bytes of s, in local time, placing it in a year with
+// withLogYear's rules. It accepts exactly what time.ParseInLocation does for
+// that layout (runs of spaces, one-digit days and hours, case-insensitive
+// months, a fractional second), without the cost of its generality.
+func parseSyslogTimestamp(s []byte, now time.Time) (time.Time, bool) {
+	if len(s) < syslogTimestampLen {
+		return time.Time{}, false
+	}
+	s = s[:syslogTimestampLen]
+
+	month := syslogMonth(s[0:3])
+	s, ok := skipSpaces(s[3:])
+	if month == 0 || !ok {
+		return time.Time{}, false
+	}
+	day, s, ok := number(s, false)
+	// Year-less dates are validated as in year 0, a leap year, like time.Parse.
+	if !ok || day < 1 || day > maxDays[month] {
+		return time.Time{}, false
+	}
+	s, ok = skipSpaces(s)
+	if !ok {
+		return time.Time{}, false
+	}
+	hour, s, ok := number(s, false)
+	if !ok || hour > 23 || len(s) < 6 || s[0] != ':' || s[3] != ':' {
+		return time.Time{}, false
+	}
+	minute, _, ok1 := number(s[1:3], true)
+	second, _, ok2 := number(s[4:6], true)
+	if !ok1 || !ok2 || minute > 59 || second > 59 {
+		return time.Time{}, false
+	}
+	// A fractional second may follow; it does not change the Unix second.
+	if s = s[6:]; len(s) >= 2 && (s[0] == '.' || s[0] == ',') {
+		if _, _, ok := number(s[1:2], false); ok {
+			for s = s[1:]; len(s) > 0 && s[0] >= '0' && s[0] <= '9'; s = s[1:] {
+			}
+		}
+	}
+	if len(s) != 0 {
+		return time.Time{}, false
+	}
+
+	t := time.Date(now.Year(), month, day, hour, minute, second, 0, time.Local)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = time.Date(now.Year()-1, month, day, hour, minute, second, 0, time.Local)
+	}
+	return t, true
+}
+
+// skipSpaces removes the run of spaces that must start s.
+func skipSpaces(s []byte) ([]byte, bool) {
+	if len(s) == 0 || s[0] != ' ' {
+		return s, false
+	}
+	for len(s) != 0 && s[0] == ' ' {
+		s = s[1:]
+	}
+	return s, true
+}
+
+// number parses the one- or two-digit decimal number (exactly two if fixed)
+// at the start of s and returns it with the rest of s.
+func number(s []byte, fixed bool) (int, []byte, bool) {
+	if len(s) == 0 || s[0] < '0' || s[0] > '9' {
+		return 0, s, false
+	}
+	if len(s) < 2 || s[1] < '0' || s[1] > '9' {
+		if fixed {
+			return 0, s, false
+		}
+		return int(s[0] - '0'), s[1:], true
+	}
+	return int(s[0]-'0')*10 + int(s[1]-'0'), s[2:], true
+}
+
+// syslogMonth returns the month with the three-letter abbreviation s, or 0.
+func syslogMonth(s []byte) time.Month {
+	// Fold ASCII letters to lower case and pack them into one value to switch on.
+	key := uint32(s[0]|0x20)<<16 | uint32(s[1]|0x20)<<8 | uint32(s[2]|0x20)
+	switch key {
+	case 'j'<<16 | 'a'<<8 | 'n':
+		return time.January
+	case 'f'<<16 | 'e'<<8 | 'b':
+		return time.February
+	case 'm'<<16 | 'a'<<8 | 'r':
+		return time.March
+	case 'a'<<16 | 'p'<<8 | 'r':
+		return time.April
+	case 'm'<<16 | 'a'<<8 | 'y':
+		return time.May
+	case 'j'<<16 | 'u'<<8 | 'n':
+		return time.June
+	case 'j'<<16 | 'u'<<8 | 'l':
+		return time.July
+	case 'a'<<16 | 'u'<<8 | 'g':
+		return time.August
+	case 's'<<16 | 'e'<<8 | 'p':
+		return time.September
+	case 'o'<<16 | 'c'<<8 | 't':
+		return time.October
+	case 'n'<<16 | 'o'<<8 | 'v':
+		return time.November
+	case 'd'<<16 | 'e'<<8 | 'c':
+		return time.December
+	}
+	return 0
+}
+
+// maxDays is the length of each month in a leap year: year-less dates are
+// validated as in year 0, as time.Parse does, so Feb 29 is accepted.
+var maxDays = [...]int{time.January: 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
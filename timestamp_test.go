@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// parseSyslogTimestampStd is the time.Parse path parseSyslogTimestamp replaced.
+func parseSyslogTimestampStd(s []byte, now time.Time) (time.Time, bool) {
+	if len(s) < syslogTimestampLen {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("Jan _2 15:04:05", string(s[:syslogTimestampLen]), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return withLogYear(t, now), true
+}
+
+func TestParseSyslogTimestamp(t *testing.T) {
+	midYear := time.Date(2026, time.June, 15, 12, 0, 0, 0, time.Local)
+	newYear := time.Date(2026, time.January, 1, 0, 30, 0, 0, time.Local)
+	leapYear := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		line string
+		now  time.Time
+	}{
+		{"Mar  1 00:00:08 dnsmasq[812]: query[A] example.com", midYear},
+		{"Mar 1 00:00:08  dnsmasq[812]: query[A] example.com", midYear},
+		{"Mar 15 23:59:59 dnsmasq[812]: query[A] example.com", midYear},
+		{"Mar  1 1:02:03  dnsmasq[812]: query[A] example.com", midYear},
+		{"mar  1 00:00:08", midYear},
+		{"MAR  1 00:00:08", midYear},
+		{"Jun 16 11:59:59", midYear}, // within a day ahead: this year
+		{"Jun 16 12:00:01", midYear}, // over a day ahead: last year
+		{"Dec 31 23:59:59", newYear}, // December read in January
+		{"Jan  1 00:29:59", newYear},
+		{"Jan  2 00:30:00", newYear},
+		{"Jan  2 00:30:01", newYear},
+		{"Feb 29 12:00:00", midYear}, // not a leap year: rolls into March
+		{"Feb 29 12:00:00", leapYear},
+		{"Feb 30 12:00:00", midYear},
+		{"Apr 31 12:00:00", midYear},
+		{"Mar  0 00:00:08", midYear},
+		{"Mar 32 00:00:08", midYear},
+		{"Mar  1 24:00:00", midYear},
+		{"Mar  1 00:60:00", midYear},
+		{"Mar  1 00:00:60", midYear},
+		{"Mar  1 00:0:08 ", midYear},
+		{"Mar01 00:00:08 ", midYear},
+		{"Foo  1 00:00:08", midYear},
+		{"Mar  1 00:00:0", midYear},
+		{"Mar  1 00:00:08.5", midYear},
+		{"garbage", midYear},
+		{"", midYear},
+	}
+	for _, tt := range tests {
+		got, ok := parseSyslogTimestamp([]byte(tt.line), tt.now)
+		want, wantOK := parseSyslogTimestampStd([]byte(tt.line), tt.now)
+		if ok != wantOK || !got.Equal(want) {
+			t.Errorf("parseSyslogTimestamp(%q, %s) = %s, %t; time.Parse gives %s, %t",
+				tt.line, tt.now.Format(time.DateTime), got, ok, want, wantOK)
+		}
+	}
+}
+
+var benchLine = []byte("Mar  1 00:00:08 dnsmasq[812]: query[AAAA] mail.google.com from 192.168.1.10")
+
+func BenchmarkSyslogTimestamp(b *testing.B) {
+	now := time.Now()
+	b.Run("hand-rolled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			parseSyslogTimestamp(benchLine, now)
+		}
+	})
+	b.Run("time.Parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			parseSyslogTimestampStd(benchLine, now)
+		}
+	})
+}
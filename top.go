@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// limitFlag is the value of -n, the number of entries a report lists. It is
+// refused when negative while the flags are parsed, as any int flag is when
+// not a number.
+type limitFlag int
+
+func (n *limitFlag) String() string { return strconv.Itoa(int(*n)) }
+
+func (n *limitFlag) Set(value string) error {
+	v, err := strconv.ParseInt(value, 0, strconv.IntSize)
+	if err != nil {
+		return err.(*strconv.NumError).Err
+	}
+	if v < 0 {
+		return errors.New("must not be negative")
+	}
+	*n = limitFlag(v)
+	return nil
+}
+
+// addLimitFlag registers -n on fs, defaulting to value.
+func addLimitFlag(fs *flag.FlagSet, value int, usage string) *int {
+	n := value
+	fs.Var((*limitFlag)(&n), "n", usage)
+	return &n
+}
+
+// domainCount is a domain (reversed, or forward for registrable rollups) with its query count.
+type domainCount struct {
+	Domain string
+	Count  int64
+}
+
+// runTop implements the top subcommand: the most-queried domains and registrable
+// domains, with their share of all queries.
+func runTop(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	n := addLimitFlag(fs, 10, "show the top `n` entries")
+	since := fs.String("since", "", "only count queries after this `time` (duration such as 24h or 7d, or a date)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var cutoff int64
+	if *since != "" {
+		var err error
+		cutoff, err = parseSince(*since, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+
+	counts, err := loadDomainCounts(ctx, st, *since != "", cutoff)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	registrable := make(map[string]int64)
+	for _, c := range counts {
+		total += c.Count
+		registrable[registrableDomain(reverseDomainParts(c.Domain))] += c.Count
+	}
+
+	byRegistrable := make([]domainCount, 0, len(registrable))
+	for domain, count := range registrable {
+		byRegistrable = append(byRegistrable, domainCount{domain, count})
+	}
+	for i := range counts {
+		counts[i].Domain = reverseDomainParts(counts[i].Domain)
+	}
+	sortDomainCounts(counts)
+	sortDomainCounts(byRegistrable)
+
+	window := "all time"
+	if *since != "" {
+		window = "since " + time.Unix(cutoff, 0).Format("2006-01-02 15:04")
+	}
+	fmt.Printf("%d queries for %d domains (%s)\n\n", total, len(counts), window)
+
+	fmt.Printf("Top %d domains:\n", *n)
+	printDomainCounts(os.Stdout, counts, *n, total)
+	fmt.Printf("\nTop %d registrable domains:\n", *n)
+	printDomainCounts(os.Stdout, byRegistrable, *n, total)
+	return nil
+}
+
+// loadDomainCounts returns per-domain query counts, either all-time or from the
+// hourly buckets starting at the hour containing cutoff.
+func loadDomainCounts(ctx context.Context, st store, windowed bool, cutoff int64) ([]domainCount, error) {
+	totals := make(map[string]int64)
+	if windowed {
+		hours, err := st.loadDomainHours(ctx, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hours {
+			totals[h.Domain] += h.Count
+		}
+	} else {
+		rows, err := st.loadDomainRows(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			totals[r.Domain] += r.Count
+		}
+	}
+
+	counts := make([]domainCount, 0, len(totals))
+	for domain, count := range totals {
+		if count > 0 {
+			counts = append(counts, domainCount{domain, count})
+		}
+	}
+	return counts, nil
+}
+
+// sortDomainCounts orders by count descending, then domain.
+func sortDomainCounts(counts []domainCount) {
+	slices.SortFunc(counts, func(a, b domainCount) int {
+		if c := cmpInt(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+}
+
+func printDomainCounts(w io.Writer, counts []domainCount, n int, total int64) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "RANK\tCOUNT\tPCT\t  DOMAIN")
+	for i, c := range counts {
+		if i == n {
+			break
+		}
+		pct := 0.0
+		if total > 0 {
+			pct = float64(c.Count) * 100 / float64(total)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%.1f%%\t  %s\n", i+1, c.Count, pct, c.Domain)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestLimitFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+		err  string
+	}{
+		{nil, 10, ""},
+		{[]string{"-n", "0"}, 0, ""},
+		{[]string{"-n=25"}, 25, ""},
+		{[]string{"-n", "0x10"}, 16, ""},
+		{[]string{"-n", "-1"}, 0, `invalid value "-1" for flag -n: must not be negative`},
+		{[]string{"-n", "ten"}, 0, `invalid value "ten" for flag -n: invalid syntax`},
+		{[]string{"-n", "99999999999999999999"}, 0, `invalid value "99999999999999999999" for flag -n: value out of range`},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("top", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		n := addLimitFlag(fs, 10, "show the top `n` entries")
+		err := fs.Parse(tt.args)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: error %v, want %s", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		if *n != tt.want {
+			t.Errorf("%q: -n %d, want %d", tt.args, *n, tt.want)
+		}
+	}
+}
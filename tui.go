@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// tuiHistoryDays is how many days of query counts a domain's view charts.
+const tuiHistoryDays = 14
+
+// tuiColumn is a column of the domain list, sorted by pressing its number.
+type tuiColumn struct {
+	title   string
+	sortKey string // of sortDomainRows
+	desc    bool   // the order it sorts in first
+}
+
+var tuiColumns = []tuiColumn{
+	{"Domain", "domain", false},
+	{"First seen", "first_seen", true},
+	{"Last seen", "last_seen", true},
+	{"Queries", "count", true},
+}
+
+// runTUI implements the tui subcommand: browse the database in the terminal.
+func runTUI(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	naming := addClientNamesFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := checkClientNames(*naming); err != nil {
+		return err
+	}
+
+	st, ok, err := openExistingStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no database at %s", dbOpts.Path)
+	}
+	defer st.Close()
+
+	t := &tui{ctx: ctx, st: st, dbOpts: *dbOpts, naming: *naming, sort: 3, desc: true}
+	if err := t.load(); err != nil {
+		return err
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return err
+	}
+	// Raw mode turns ^C into a key, but SIGINT or SIGTERM from elsewhere must
+	// still leave the terminal as it was.
+	ctx, stop := notifyInterrupt(ctx)
+	defer stop()
+	out := bufio.NewWriter(os.Stdout)
+	// Switch to the alternate screen and hide the cursor, and back at exit.
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+		out.Flush()
+		restore()
+	}()
+
+	keys := make(chan []string)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- decodeKeys(buf[:n])
+		}
+	}()
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+
+	for {
+		t.height, t.width = terminalSize()
+		t.draw(out)
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		select {
+		case batch, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, key := range batch {
+				if quit := t.key(key); quit {
+					return nil
+				}
+			}
+		case <-resized:
+		case <-ctx.Done():
+			return errInterrupted
+		}
+	}
+}
+
+// tui is the state of the tui subcommand: a list of domains, filtered by a
+// search and sorted by a column, or the view of one of them.
+type tui struct {
+	ctx    context.Context
+	st     store
+	dbOpts dbOptions
+	naming string // --client-names
+
+	rows    []domainRow // all domains, sorted
+	shown   []domainRow // those matching search
+	clients map[string][]domainClientRow
+	names   clientNames
+
+	sort      int // index in tuiColumns
+	desc      bool
+	search    string
+	searching bool // typing into search
+	cursor    int  // index in shown
+	top       int  // index in shown of the first row on screen
+
+	detail []string // the lines of the domain being viewed, if any
+	scroll int      // of detail
+
+	status        string
+	height, width int
+}
+
+// load reads the domains and clients from the database, and names the clients.
+func (t *tui) load() error {
+	ctx, cancel := t.dbOpts.withTimeout(t.ctx)
+	defer cancel()
+	rows, err := t.st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+	clientRows, err := t.st.loadDomainClients(ctx)
+	if err != nil {
+		return err
+	}
+	var addresses []string
+	seen := make(map[string]bool)
+	t.rows = rows
+	t.clients = make(map[string][]domainClientRow)
+	for _, c := range clientRows {
+		t.clients[c.Domain] = append(t.clients[c.Domain], c)
+		if !seen[c.Client] {
+			seen[c.Client] = true
+			addresses = append(addresses, c.Client)
+		}
+	}
+	if t.names, err = loadClientNames(ctx, t.st, t.naming, addresses); err != nil {
+		return err
+	}
+	t.resort()
+	return nil
+}
+
+func (t *tui) resort() {
+	sortDomainRows(t.rows, tuiColumns[t.sort].sortKey, t.desc)
+	t.filter()
+}
+
+// filter applies the search, keeping the selected domain selected if it
+// still matches.
+func (t *tui) filter() {
+	var selected string
+	if t.cursor < len(t.shown) {
+		selected = t.shown[t.cursor].Domain
+	}
+	t.shown = t.shown[:0]
+	search := strings.ToLower(t.search)
+	for _, row := range t.rows {
+		if search == "" || strings.Contains(reverseDomainParts(row.Domain), search) {
+			t.shown = append(t.shown, row)
+		}
+	}
+	t.cursor = max(0, slices.IndexFunc(t.shown, func(row domainRow) bool { return row.Domain == selected }))
+}
+
+// key handles a key press, reporting whether to quit.
+func (t *tui) key(key string) bool {
+	t.status = ""
+	if key == "ctrl-c" {
+		return true
+	}
+	if t.detail != nil {
+		switch key {
+		case "q":
+			return true
+		case "esc", "backspace", "left", "h":
+			t.detail = nil
+		case "up", "k":
+			t.scroll--
+		case "down", "j":
+			t.scroll++
+		case "pgup":
+			t.scroll -= t.height - 2
+		case "pgdown":
+			t.scroll += t.height - 2
+		}
+		t.scroll = max(0, min(t.scroll, len(t.detail)-(t.height-1)))
+		return false
+	}
+
+	if t.searching {
+		switch key {
+		case "enter", "down", "up":
+			t.searching = false
+		case "esc":
+			t.searching, t.search = false, ""
+		case "backspace":
+			if t.search != "" {
+				_, n := utf8.DecodeLastRuneInString(t.search)
+				t.search = t.search[:len(t.search)-n]
+			}
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				t.search += key
+			}
+		}
+		t.filter()
+		return false
+	}
+
+	page := max(1, t.height-4)
+	switch key {
+	case "q":
+		return true
+	case "/":
+		t.searching = true
+	case "esc":
+		t.search = ""
+		t.filter()
+	case "1", "2", "3", "4":
+		if col := int(key[0] - '1'); col == t.sort {
+			t.desc = !t.desc
+		} else {
+			t.sort, t.desc = col, tuiColumns[col].desc
+		}
+		t.resort()
+	case "up", "k":
+		t.cursor--
+	case "down", "j":
+		t.cursor++
+	case "pgup":
+		t.cursor -= page
+	case "pgdown":
+		t.cursor += page
+	case "home", "g":
+		t.cursor = 0
+	case "end", "G":
+		t.cursor = len(t.shown) - 1
+	case "r":
+		if err := t.load(); err != nil {
+			t.status = err.Error()
+		} else {
+			t.status = "Reloaded."
+		}
+	case "enter", "right", "l":
+		if t.cursor < len(t.shown) {
+			if err := t.view(t.shown[t.cursor]); err != nil {
+				t.status = err.Error()
+			}
+		}
+	}
+	t.cursor = max(0, min(t.cursor, len(t.shown)-1))
+	return false
+}
+
+// view opens the view of row: its counts, its clients and its daily queries
+// over the tuiHistoryDays up to when it was last seen.
+func (t *tui) view(row domainRow) error {
+	last := time.Unix(row.LastSeen, 0)
+	end := time.Date(last.Year(), last.Month(), last.Day()+1, 0, 0, 0, 0, last.Location())
+	start := end.AddDate(0, 0, -tuiHistoryDays)
+
+	ctx, cancel := t.dbOpts.withTimeout(t.ctx)
+	defer cancel()
+	hours, err := t.st.loadDomainHours(ctx, start.Unix())
+	if err != nil {
+		return err
+	}
+	resolutions, err := t.st.loadDomainResolutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	domain := reverseDomainParts(row.Domain)
+	lines := []string{
+		"\x1b[1m" + domain + "\x1b[0m",
+		fmt.Sprintf("%d queries, first seen %s, last seen %s", row.Count, tuiTime(row.FirstSeen), tuiTime(row.LastSeen)),
+	}
+	if r, ok := resolutions[row.Domain]; ok {
+		lines = append(lines, fmt.Sprintf("%d cached, %d forwarded, %d blocked, mean upstream latency %.1f ms",
+			r.Cached, r.Forwarded, r.Blocked, r.meanLatencyMs()))
+	}
+
+	days := make([]int64, tuiHistoryDays)
+	for _, h := range hours {
+		if h.Domain != row.Domain {
+			continue
+		}
+		if day := int(time.Unix(h.Hour, 0).Sub(start).Hours() / 24); day >= 0 && day < len(days) {
+			days[day] += h.Count
+		}
+	}
+	peak := max(1, slices.Max(days))
+	lines = append(lines, "", "\x1b[1mQueries per day\x1b[0m")
+	for i, n := range days {
+		bar := strings.Repeat("█", int(n*40/peak))
+		lines = append(lines, fmt.Sprintf("%s  %8d  %s", start.AddDate(0, 0, i).Format("Mon Jan 02"), n, bar))
+	}
+
+	clients := slices.Clone(t.clients[row.Domain])
+	slices.SortFunc(clients, func(a, b domainClientRow) int { return cmpInt(b.Count, a.Count) })
+	lines = append(lines, "", fmt.Sprintf("\x1b[1mClients (%d)\x1b[0m", len(clients)),
+		fmt.Sprintf("%-40s  %-16s  %-16s  %8s", "CLIENT", "FIRST SEEN", "LAST SEEN", "QUERIES"))
+	for _, c := range clients {
+		lines = append(lines, fmt.Sprintf("%-40s  %-16s  %-16s  %8d", t.names.label(c.Client), tuiTime(c.FirstSeen), tuiTime(c.LastSeen), c.Count))
+	}
+	if len(clients) == 0 {
+		lines = append(lines, "No clients recorded.")
+	}
+	t.detail, t.scroll = lines, 0
+	return nil
+}
+
+func (t *tui) draw(out *bufio.Writer) {
+	var lines []string
+	var help string
+	if t.detail != nil {
+		end := min(len(t.detail), t.scroll+t.height-1)
+		lines = t.detail[t.scroll:end]
+		help = "esc back · j/k scroll · q quit"
+	} else {
+		lines, help = t.list()
+	}
+	if t.status != "" {
+		help = t.status
+	}
+
+	fmt.Fprint(out, "\x1b[H")
+	for i := 0; i < t.height-1; i++ {
+		if i < len(lines) {
+			fmt.Fprint(out, tuiFit(lines[i], t.width))
+		}
+		fmt.Fprint(out, "\x1b[K\r\n")
+	}
+	fmt.Fprint(out, "\x1b[7m", tuiFit(help, t.width), strings.Repeat(" ", max(0, t.width-utf8.RuneCountInString(help))), "\x1b[0m")
+}
+
+// list renders the domain list and its help line.
+func (t *tui) list() ([]string, string) {
+	const timeWidth, countWidth = 16, 9
+	domainWidth := max(10, t.width-2*timeWidth-countWidth-6)
+
+	search := "Search: " + t.search
+	if t.searching {
+		search += "▏"
+	} else if t.search == "" {
+		search = "Press / to search"
+	}
+	header := ""
+	for i, col := range tuiColumns {
+		title := fmt.Sprintf("%d %s", i+1, col.title)
+		if i == t.sort {
+			title += map[bool]string{false: " ▴", true: " ▾"}[t.desc]
+		}
+		switch i {
+		case 0:
+			header += fmt.Sprintf("%-*s", domainWidth, title)
+		case 3:
+			header += fmt.Sprintf("  %*s", countWidth, title)
+		default:
+			header += fmt.Sprintf("  %-*s", timeWidth, title)
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("%s   %d of %d domains", search, len(t.shown), len(t.rows)),
+		"\x1b[1m" + header + "\x1b[0m",
+	}
+
+	visible := max(1, t.height-3)
+	t.top = max(min(t.top, t.cursor), t.cursor-visible+1)
+	for i := t.top; i < len(t.shown) && i < t.top+visible; i++ {
+		row := t.shown[i]
+		line := fmt.Sprintf("%-*s  %-*s  %-*s  %*d", domainWidth, tuiFit(reverseDomainParts(row.Domain), domainWidth),
+			timeWidth, tuiTime(row.FirstSeen), timeWidth, tuiTime(row.LastSeen), countWidth, row.Count)
+		if i == t.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	if t.searching {
+		return lines, "type to search · enter keep · esc clear"
+	}
+	return lines, "/ search · 1-4 sort · enter view · r reload · q quit"
+}
+
+func tuiTime(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04")
+}
+
+// tuiFit truncates s to width characters, not counting the escape sequences
+// that style it.
+func tuiFit(s string, width int) string {
+	n, escape := 0, 0 // 1 after ESC, 2 within the sequence that follows
+	for i, r := range s {
+		switch {
+		case escape == 1:
+			escape = 2
+		case escape == 2:
+			if r >= '@' && r <= '~' {
+				escape = 0
+			}
+		case r == '\x1b':
+			escape = 1
+		default:
+			if n == width {
+				return s[:i] + "\x1b[0m"
+			}
+			n++
+		}
+	}
+	return s
+}
+
+// csiKeys names the keys that terminals send as escape sequences.
+var csiKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left",
+	"H": "home", "F": "end", "1~": "home", "4~": "end", "7~": "home", "8~": "end",
+	"5~": "pgup", "6~": "pgdown",
+}
+
+// decodeKeys splits what was read from the terminal into key names: a
+// printable character, or one such as "enter", "esc" or "up".
+func decodeKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		if b[0] == '\x1b' {
+			if len(b) >= 3 && (b[1] == '[' || b[1] == 'O') {
+				// Parameters, then a final byte from @ to ~.
+				end := 2
+				for end < len(b) && (b[end] < '@' || b[end] > '~') {
+					end++
+				}
+				if end < len(b) {
+					if key, ok := csiKeys[string(b[2:end+1])]; ok {
+						keys = append(keys, key)
+					}
+					b = b[end+1:]
+					continue
+				}
+			}
+			keys = append(keys, "esc")
+			b = b[1:]
+			continue
+		}
+		r, n := utf8.DecodeRune(b)
+		b = b[n:]
+		switch {
+		case r == '\r' || r == '\n':
+			keys = append(keys, "enter")
+		case r == 0x7f || r == '\b':
+			keys = append(keys, "backspace")
+		case r == 3:
+			keys = append(keys, "ctrl-c")
+		case r >= ' ' && r != utf8.RuneError:
+			keys = append(keys, string(r))
+		}
+	}
+	return keys
+}
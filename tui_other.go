@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func rawTerminal() (restore func() error, err error) {
+	return nil, errors.New("tui needs a Unix terminal")
+}
+
+func terminalSize() (rows, cols int) {
+	return 24, 80
+}
+
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// rawTerminal puts the terminal in raw mode, so keys are read as they are
+// pressed, and returns a function restoring it.
+func rawTerminal() (restore func() error, err error) {
+	fd := int(os.Stdin.Fd())
+	saved, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("tui needs an interactive terminal: %w", err)
+	}
+	return func() error { return term.Restore(fd, saved) }, nil
+}
+
+// terminalSize returns the rows and columns of the terminal, or 24×80 if
+// they cannot be told.
+func terminalSize() (rows, cols int) {
+	cols, rows, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil || rows <= 0 || cols <= 0 {
+		return 24, 80
+	}
+	return rows, cols
+}
+
+// notifyResize sends to c when the terminal is resized.
+func notifyResize(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/net/idna"
+)
+
+// homoglyphs maps characters to the letter they pass for, and glyphs maps
+// letter sequences to the one they pass for, to reduce names to the skeleton
+// they look like (see skeleton).
+var (
+	homoglyphs = map[rune]rune{
+		'0': 'o', '1': 'l', 'i': 'l', '|': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+		// Cyrillic, Greek and other Latin letters that look like ASCII ones
+		'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'х': 'x', 'у': 'y', 'і': 'l', 'ј': 'j', 'ѕ': 's',
+		'ԁ': 'd', 'ӏ': 'l', 'ɡ': 'g', 'ο': 'o', 'α': 'a', 'ν': 'v', 'κ': 'k', 'τ': 't', 'ı': 'l', 'ɩ': 'l',
+		'à': 'a', 'á': 'a', 'â': 'a', 'ä': 'a', 'å': 'a', 'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e',
+		'ì': 'l', 'í': 'l', 'î': 'l', 'ï': 'l', 'ò': 'o', 'ó': 'o', 'ô': 'o', 'ö': 'o', 'ù': 'u', 'ú': 'u',
+		'û': 'u', 'ü': 'u', 'ñ': 'n', 'ç': 'c',
+	}
+	glyphs = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+)
+
+// skeleton returns what a domain label looks like once decoded from punycode
+// and with lookalike characters replaced, so paypa1 and pаypal (with a
+// Cyrillic а) both become paypal.
+func skeleton(label string) string {
+	if unicode, err := idna.ToUnicode(label); err == nil {
+		label = unicode
+	}
+	label = strings.Map(func(r rune) rune {
+		if to, ok := homoglyphs[r]; ok {
+			return to
+		}
+		return r
+	}, label)
+	return glyphs.Replace(label)
+}
+
+// editDistance returns the optimal string alignment distance of a and b: the
+// insertions, deletions, substitutions and swaps of adjacent characters
+// turning one into the other.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev2 := make([]int, len(br)+1)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ar[i-1] == br[j-2] && ar[i-2] == br[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(br)]
+}
+
+// squatReference is a domain to look for imitations of.
+type squatReference struct {
+	Domain string // registrable domain, or the bare brand name given
+	Label  string // its label under the public suffix
+	skel   string
+}
+
+func newSquatReference(arg string) squatReference {
+	domain := canonicalDomain(arg)
+	if strings.Contains(domain, ".") {
+		domain = registrableDomain(domain)
+	}
+	label, _, _ := strings.Cut(domain, ".")
+	return squatReference{Domain: domain, Label: label, skel: skeleton(label)}
+}
+
+// maxDistance is the edit distance up to which a label of n characters counts
+// as a near miss when not set: none for short names, where a single edit
+// makes another common word, and more for longer ones.
+func maxDistance(n int) int {
+	switch {
+	case n <= 4:
+		return 0
+	case n <= 8:
+		return 1
+	}
+	return 2
+}
+
+// squatMatch tells how the registrable domain imitates ref, or returns "" if
+// it does not.
+func (ref squatReference) squatMatch(domain string, distance int) string {
+	label, _, _ := strings.Cut(domain, ".")
+	if domain == ref.Domain {
+		return ""
+	}
+	if label == ref.Label {
+		if ref.Domain == ref.Label {
+			return "" // a bare brand matches it under any suffix
+		}
+		return "other suffix"
+	}
+	if skeleton(label) == ref.skel {
+		return "homoglyph"
+	}
+	if distance < 0 {
+		distance = maxDistance(len(ref.Label))
+	}
+	if d := editDistance(label, ref.Label); d <= distance {
+		return fmt.Sprintf("edit distance %d", d)
+	}
+	return ""
+}
+
+// squatSummary is an observed registrable domain imitating a reference one.
+type squatSummary struct {
+	Domain    string
+	Imitates  string
+	How       string
+	FirstSeen int64
+	LastSeen  int64
+	Queries   int64
+	Names     []string // queried names under Domain, forward, in order
+}
+
+// runTyposquats implements the typosquats subcommand: the registrable domains
+// queried that imitate the domains or brands given, by a small edit distance,
+// lookalike characters or another public suffix, as phishing domains do.
+func runTyposquats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("typosquats", flag.ExitOnError)
+	dbOpts := addDBFlag(fs)
+	listPath := fs.String("list", "", "also look for imitations of the domains in `file`, one per line")
+	distance := fs.Int("distance", -1, "largest edit distance to count as a near miss (default: 0 for names up to 4 characters, 1 up to 8, then 2)")
+	n := addLimitFlag(fs, 5, "list at most `n` queried names per domain (0 for all)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: typosquats [flags] [domain or brand...]")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	refArgs := fs.Args()
+	if *listPath != "" {
+		list, err := loadDomainList(*listPath)
+		if err != nil {
+			return err
+		}
+		for domain := range list {
+			refArgs = append(refArgs, domain)
+		}
+	}
+	if len(refArgs) == 0 {
+		return errors.New("typosquats needs domains or brands to look for, or --list")
+	}
+	refs := make([]squatReference, 0, len(refArgs))
+	references := make(map[string]bool)
+	for _, arg := range refArgs {
+		ref := newSquatReference(arg)
+		if !references[ref.Domain] {
+			refs = append(refs, ref)
+			references[ref.Domain] = true
+		}
+	}
+
+	st, err := openStore(ctx, *dbOpts)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ctx, cancel := dbOpts.withTimeout(ctx)
+	defer cancel()
+	rows, err := st.loadDomainRows(ctx)
+	if err != nil {
+		return err
+	}
+
+	squats := summarizeTyposquats(rows, refs, references, *distance)
+	fmt.Printf("%d domains imitating %d references\n", len(squats), len(refs))
+	if len(squats) == 0 {
+		return nil
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tIMITATES\tHOW\tFIRST SEEN\tLAST SEEN\tQUERIES\tNAMES")
+	for _, s := range squats {
+		names := s.Names
+		if *n > 0 && len(names) > *n {
+			names = append(slices.Clip(names[:*n]), fmt.Sprintf("(%d more)", len(s.Names)-*n))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", s.Domain, s.Imitates, s.How,
+			formatUnix(s.FirstSeen), formatUnix(s.LastSeen), s.Queries, strings.Join(names, " "))
+	}
+	return tw.Flush()
+}
+
+// summarizeTyposquats groups rows by registrable domain, keeping those that
+// imitate one of refs without being one of references, by reference and then
+// by domain. Each domain is matched against every reference once.
+func summarizeTyposquats(rows []domainRow, refs []squatReference, references map[string]bool, distance int) []squatSummary {
+	byDomain := make(map[string]*squatSummary)
+	checked := make(map[string]bool)
+	for _, row := range rows {
+		name := reverseDomainParts(row.Domain)
+		if !publicDomain(name) {
+			continue
+		}
+		domain := registrableDomain(name)
+		s, ok := byDomain[domain]
+		if !ok {
+			if checked[domain] || references[domain] {
+				continue
+			}
+			checked[domain] = true
+			for _, ref := range refs {
+				if how := ref.squatMatch(domain, distance); how != "" {
+					s = &squatSummary{Domain: domain, Imitates: ref.Domain, How: how, FirstSeen: row.FirstSeen, LastSeen: row.LastSeen}
+					byDomain[domain] = s
+					break
+				}
+			}
+			if s == nil {
+				continue
+			}
+		}
+		s.FirstSeen = min(s.FirstSeen, row.FirstSeen)
+		s.LastSeen = max(s.LastSeen, row.LastSeen)
+		s.Queries += row.Count
+		s.Names = append(s.Names, name)
+	}
+
+	squats := make([]squatSummary, 0, len(byDomain))
+	for _, s := range byDomain {
+		slices.Sort(s.Names)
+		squats = append(squats, *s)
+	}
+	slices.SortFunc(squats, func(a, b squatSummary) int {
+		if c := strings.Compare(a.Imitates, b.Imitates); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return squats
+}
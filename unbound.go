@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// isUnboundLine reports whether line looks like a line of Unbound's log: one
+// starting with the Unix time unbound prints itself, or logged by unbound.
+func isUnboundLine(line []byte) bool {
+	if _, _, ok := unboundTimestamp(line); ok {
+		return true
+	}
+	return bytes.Contains(line, []byte(" unbound[")) || bytes.Contains(line, []byte(" unbound: "))
+}
+
+// parseUnboundLine parses a line of unbound's log-queries output, logged to a
+// file, with log-time-ascii, or to syslog:
+//
+//	[1710498153] unbound[1234:0] info: 192.168.1.10 example.com. A IN
+//	Mar 15 10:22:33 unbound[1234:0] info: 192.168.1.10 example.com. A IN
+//	Mar 15 10:22:33 ns1 unbound: [1234:0] info: 192.168.1.10 example.com. A IN
+//
+// Only queries are read: the lines of log-replies, which follow the class with
+// the rcode and timings, and those of log-local-actions yield an empty Domain.
+func parseUnboundLine(line []byte, now time.Time) (logLine, error) {
+	var l logLine
+	var rest []byte
+	if t, ok := parseSyslogTimestamp(line, now); ok {
+		l.Timestamp = t.Unix()
+		rest = line[syslogTimestampLen:]
+		// Syslog puts the host name before the program tag; log-time-ascii
+		// has no host name.
+		if field, after := nextField(rest); !bytes.HasPrefix(field, []byte("unbound")) {
+			l.Host, rest = field, after
+		}
+	} else if t, after, ok := unboundTimestamp(line); ok {
+		l.Timestamp, rest = t.Unix(), after
+	} else {
+		return logLine{}, errBadTimestamp
+	}
+
+	// info: client name. type class
+	if rest = skipPast(rest, "info:"); rest == nil {
+		return l, nil
+	}
+	client, rest := nextField(rest)
+	if _, err := netip.ParseAddr(string(client)); err != nil {
+		return l, nil
+	}
+	domain, rest := nextField(rest)
+	qtype, rest := nextField(rest)
+	class, rest := nextField(rest)
+	if len(class) == 0 {
+		return logLine{}, errBadQuery
+	}
+	if extra, _ := nextField(rest); len(extra) > 0 {
+		return l, nil
+	}
+	l.Client = client
+	l.Domain, l.Verb = bytes.TrimSuffix(domain, []byte(".")), queryVerb(qtype)
+	return l, nil
+}
+
+// unboundTimestamp parses the Unix time in brackets unbound prints at the
+// start of a line, as [1710498153], and returns it with the rest of line.
+func unboundTimestamp(line []byte) (time.Time, []byte, bool) {
+	if len(line) < 3 || line[0] != '[' {
+		return time.Time{}, nil, false
+	}
+	end := bytes.IndexByte(line, ']')
+	if end < 2 {
+		return time.Time{}, nil, false
+	}
+	sec, err := strconv.ParseInt(string(line[1:end]), 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, nil, false
+	}
+	return time.Unix(sec, 0), line[end+1:], true
+}
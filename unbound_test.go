@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseUnboundLine(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.Local)
+	syslogTime, _ := parseSyslogTimestamp([]byte("Mar 15 10:22:33"), now)
+	tests := []struct {
+		line                       string
+		timestamp                  int64
+		host, client, domain, verb string
+		err                        error
+	}{
+		{"[1710498153] unbound[1234:0] info: 192.168.1.10 example.com. A IN",
+			1710498153, "", "192.168.1.10", "example.com", "query[A]", nil},
+		{"Mar 15 10:22:33 unbound[1234:0] info: 2001:db8::10 www.example.org. AAAA IN",
+			syslogTime.Unix(), "", "2001:db8::10", "www.example.org", "query[AAAA]", nil},
+		{"Mar 15 10:22:33 ns1 unbound: [1234:0] info: 192.168.1.10 example.com. TYPE65 IN",
+			syslogTime.Unix(), "ns1", "192.168.1.10", "example.com", "query[TYPE65]", nil},
+		// Replies, local actions and other messages say nothing about a query.
+		{"[1710498153] unbound[1234:0] info: 192.168.1.10 example.com. A IN NOERROR 0.012345 0 45",
+			1710498153, "", "", "", "", nil},
+		{"[1710498153] unbound[1234:0] info: ads.example.com. always_nxdomain 192.168.1.10@53422 ads.example.com. A IN",
+			1710498153, "", "", "", "", nil},
+		{"[1710498153] unbound[1234:0] notice: init module 0: validator",
+			1710498153, "", "", "", "", nil},
+		{"[1710498153] unbound[1234:0] info: 192.168.1.10 example.com. A",
+			0, "", "", "", "", errBadQuery},
+		{"[-1710498153] unbound[1234:0] info: 192.168.1.10 example.com. A IN",
+			0, "", "", "", "", errBadTimestamp},
+		{"[soon] unbound[1234:0] info: 192.168.1.10 example.com. A IN",
+			0, "", "", "", "", errBadTimestamp},
+	}
+	for _, tt := range tests {
+		l, err := parseUnboundLine([]byte(tt.line), now)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q: error %v, want %v", tt.line, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if l.Timestamp != tt.timestamp || string(l.Host) != tt.host || string(l.Client) != tt.client || string(l.Domain) != tt.domain || string(l.Verb) != tt.verb {
+			t.Errorf("%q:\ngot  %d host %q client %q domain %q verb %q\nwant %d host %q client %q domain %q verb %q", tt.line,
+				l.Timestamp, l.Host, l.Client, l.Domain, l.Verb, tt.timestamp, tt.host, tt.client, tt.domain, tt.verb)
+		}
+		if tt.domain != "" && !l.isQuery() {
+			t.Errorf("%q: not a query", tt.line)
+		}
+	}
+}
+
+func TestIsUnboundLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		unbound bool
+	}{
+		{"[1710498153] unbound[1234:0] info: 192.168.1.10 example.com. A IN", true},
+		{"Mar 15 10:22:33 unbound[1234:0] info: 192.168.1.10 example.com. A IN", true},
+		{"Mar 15 10:22:33 ns1 unbound: [1234:0] info: 192.168.1.10 example.com. A IN", true},
+		{"Mar 15 10:22:33 dnsmasq[812]: query[A] unbound.example.com from 192.168.1.10", false},
+		{"Mar 15 10:22:33 dnsmasq[812]: [1] something", false},
+	}
+	for _, tt := range tests {
+		if got := isUnboundLine([]byte(tt.line)); got != tt.unbound {
+			t.Errorf("isUnboundLine(%q) = %t, want %t", tt.line, got, tt.unbound)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// uploadTimeout bounds each upload of an export file.
+const uploadTimeout = 5 * time.Minute
+
+const uploadFlagUsage = "after writing each export, upload it to `url`: https://host/dir/ (HTTP PUT), s3://bucket/prefix/ (?region=, ?endpoint= for other S3-compatible stores) or sftp://user@host/dir/ (/~/dir/ for one in the home directory; ?key= names a private key); a URL ending in / gets the file name appended (repeatable)"
+
+// uploadTarget is where --upload sends export files.
+type uploadTarget struct {
+	URL     *url.URL
+	Headers http.Header // of HTTP uploads, from --upload-header
+}
+
+// parseUploadTarget checks an --upload URL.
+func parseUploadTarget(raw string, headers http.Header) (uploadTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return uploadTarget{}, fmt.Errorf("invalid --upload URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "s3", "sftp":
+	default:
+		return uploadTarget{}, fmt.Errorf("unknown --upload scheme %q (want https, s3 or sftp)", u.Scheme)
+	}
+	if u.Host == "" {
+		return uploadTarget{}, fmt.Errorf("--upload URL %s names no host or bucket", u.Redacted())
+	}
+	return uploadTarget{URL: u, Headers: headers}, nil
+}
+
+// single reports whether the target names a single file rather than a
+// directory the files go in.
+func (t uploadTarget) single() bool {
+	return t.URL.Path != "" && !strings.HasSuffix(t.URL.Path, "/")
+}
+
+// remotePath returns where local goes: the URL's path, with the file name
+// appended when the path is a directory.
+func (t uploadTarget) remotePath(local string) string {
+	if t.single() {
+		return t.URL.Path
+	}
+	return path.Join("/", t.URL.Path, filepath.Base(local))
+}
+
+func (t uploadTarget) String() string {
+	return t.URL.Redacted()
+}
+
+// upload sends the file at local to the target.
+func (t uploadTarget) upload(ctx context.Context, local string) error {
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	remote := t.remotePath(local)
+	switch t.URL.Scheme {
+	case "s3":
+		err = t.uploadS3(ctx, f, info.Size(), remote)
+	case "sftp":
+		err = t.uploadSFTP(ctx, f, remote)
+	default:
+		err = t.uploadHTTP(ctx, f, info.Size(), remote)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("uploaded export", "path", local, "to", t.String(), "remote", remote)
+	return nil
+}
+
+// uploadHTTP PUTs the file, with basic auth when the URL has a user.
+func (t uploadTarget) uploadHTTP(ctx context.Context, body io.Reader, size int64, remote string) error {
+	u := *t.URL
+	u.Path, u.RawPath = remote, ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	for name, values := range t.Headers {
+		req.Header[name] = values
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+	return doUpload(req)
+}
+
+// uploadS3 PUTs the file into the bucket, signed with AWS Signature Version 4
+// from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and, for temporary
+// credentials, AWS_SESSION_TOKEN environment variables. Amazon S3 is reached
+// at the bucket's virtual host; other stores, given as ?endpoint=, with the
+// bucket in the path, which MinIO, Ceph and R2 all accept.
+func (t uploadTarget) uploadS3(ctx context.Context, f *os.File, size int64, remote string) error {
+	keyID, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if keyID == "" || secret == "" {
+		return errors.New("s3 uploads need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	query := t.URL.Query()
+	region := query.Get("region")
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(env)
+		}
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	bucket := t.URL.Host
+
+	var u *url.URL
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		base, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid S3 endpoint: %w", err)
+		}
+		u = &url.URL{Scheme: base.Scheme, Host: base.Host, Path: path.Join("/", base.Path, bucket, remote)}
+	} else {
+		u = &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: remote}
+	}
+	u.RawPath = s3Escape(u.Path)
+
+	payload := sha256.New()
+	if _, err := io.Copy(payload, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	signS3(req, hex.EncodeToString(payload.Sum(nil)), region, keyID, secret, os.Getenv("AWS_SESSION_TOKEN"), time.Now().UTC())
+	return doUpload(req)
+}
+
+// signS3 adds the SigV4 Authorization header to req, whose body hashes to
+// payloadHash, signing the host and every header req already carries.
+func signS3(req *http.Request, payloadHash, region, keyID, secret, token string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for name, vs := range req.Header {
+		values[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	signed := slices.Sorted(maps.Keys(values))
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), "", headers.String(), signedHeaders, payloadHash}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes p as SigV4 wants object keys: everything but
+// unreserved characters and the slashes.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("-_.~/", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// doUpload sends req and fails on any status but success.
+func doUpload(req *http.Request) error {
+	client := &http.Client{Timeout: uploadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if detail := strings.TrimSpace(string(detail)); detail != "" {
+			return fmt.Errorf("%s: %s", resp.Status, detail)
+		}
+		return errors.New(resp.Status)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// uploadSFTP copies the file over SFTP, creating the remote directory if
+// needed. The server must be in ~/.ssh/known_hosts; it is logged in to with
+// the URL's password, the ?key= private key, the keys of ssh-agent or the
+// usual ~/.ssh/id_* keys, in that order.
+func (t uploadTarget) uploadSFTP(ctx context.Context, f *os.File, remote string) error {
+	home, _ := os.UserHomeDir()
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return fmt.Errorf("reading known hosts: %w", err)
+	}
+	user := os.Getenv("USER")
+	var auth []ssh.AuthMethod
+	if t.URL.User != nil {
+		user = t.URL.User.Username()
+		if password, ok := t.URL.User.Password(); ok {
+			auth = append(auth, ssh.Password(password))
+		}
+	}
+	keys := []string{t.URL.Query().Get("key")}
+	if keys[0] == "" {
+		keys = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keys = append(keys, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, k := range keys {
+		pem, err := os.ReadFile(k)
+		if errors.Is(err, os.ErrNotExist) && t.URL.Query().Get("key") == "" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", k, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			defer conn.Close()
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	addr := t.URL.Host
+	if t.URL.Port() == "" {
+		addr = net.JoinHostPort(t.URL.Hostname(), "22")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: hostKeys})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	// As with curl, a path starting /~/ is relative to the login directory.
+	remote = strings.TrimPrefix(remote, "/~/")
+	if dir := path.Dir(remote); dir != "." {
+		if err := sc.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	out, err := sc.Create(remote)
+	if err != nil {
+		return err
+	}
+	if _, err := out.ReadFrom(f); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
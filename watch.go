@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// parsedSuffix marks the files --processed mark has parsed.
+const parsedSuffix = ".parsed"
+
+// watchOptions configures --watch, which parses the log files dropped into a
+// directory, such as those copied there from other routers.
+type watchOptions struct {
+	Dir          string
+	Processed    string
+	ProcessedDir string
+	Settle       time.Duration
+}
+
+// addWatchFlags registers --watch and the flags that go with it on fs.
+func addWatchFlags(fs *flag.FlagSet) *watchOptions {
+	o := &watchOptions{}
+	fs.StringVar(&o.Dir, "watch", "", "keep watching `dir`, parsing the files in it and those that appear later, rather than parsing files given as arguments")
+	fs.StringVar(&o.Processed, "processed", "move", "what to do with a file --watch has parsed: move, to --processed-dir; mark, renaming it with a "+parsedSuffix+" suffix; or delete")
+	fs.StringVar(&o.ProcessedDir, "processed-dir", "", "move the files --watch has parsed to `dir` (default: processed in the watched directory)")
+	fs.DurationVar(&o.Settle, "settle", 5*time.Second, "parse a file once it has not changed for this long, so files still being copied are left alone")
+	return o
+}
+
+// watchDirectory parses the files in the --watch directory into the store of
+// dbOpts, and then each file that appears there, until interrupted. A file is
+// parsed once it has settled, then moved, marked or deleted; one that fails to
+// parse is left where it is and tried again when it next changes.
+func watchDirectory(ctx context.Context, dbOpts dbOptions, parse parseOptions, w watchOptions) error {
+	if parse.DryRun {
+		return errors.New("--watch cannot --dry-run: it moves the files it parses")
+	}
+	switch w.Processed {
+	case "move":
+		w.ProcessedDir = cmp.Or(w.ProcessedDir, filepath.Join(w.Dir, "processed"))
+		if err := os.MkdirAll(w.ProcessedDir, 0o755); err != nil {
+			return err
+		}
+	case "mark", "delete":
+	default:
+		return fmt.Errorf("unknown --processed action %q", w.Processed)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(w.Dir); err != nil {
+		return fmt.Errorf("watching %s: %w", w.Dir, err)
+	}
+
+	st, err := openStore(ctx, dbOpts)
+	if err != nil {
+		return fmt.Errorf("initializing database: %w", err)
+	}
+	defer st.Close()
+
+	// pending holds when each file waiting to be parsed last changed. Files
+	// there from the start are taken as settled.
+	pending := make(map[string]time.Time)
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if path := filepath.Join(w.Dir, e.Name()); e.Type().IsRegular() && w.wants(path) {
+			pending[path] = time.Time{}
+		}
+	}
+	slog.Info("watching", "dir", w.Dir, "files", len(pending))
+
+	readCtx, stop := notifyInterrupt(ctx)
+	defer stop()
+	ticker := time.NewTicker(max(w.Settle/2, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-readCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			slog.Info("stopped watching", "dir", w.Dir)
+			return nil
+		case err := <-watcher.Errors:
+			return fmt.Errorf("watching %s: %w", w.Dir, err)
+		case ev := <-watcher.Events:
+			switch {
+			case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+				delete(pending, ev.Name)
+			case ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write):
+				if w.wants(ev.Name) {
+					pending[ev.Name] = time.Now()
+				}
+			}
+		case now := <-ticker.C:
+			for path, changed := range pending {
+				if now.Sub(changed) < w.Settle {
+					continue
+				}
+				delete(pending, path)
+				if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				err := parseInto(ctx, st, dbOpts, []string{path}, parse)
+				if errors.Is(err, errInterrupted) {
+					return err
+				}
+				if err != nil {
+					slog.Error("parsing watched file", "path", path, "err", err)
+					continue
+				}
+				if err := w.finish(path); err != nil {
+					slog.Error("finishing watched file", "path", path, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// wants reports whether path names a file to parse: not a hidden file or a
+// partial copy, as rsync and some scp clients write, nor one already marked.
+func (w watchOptions) wants(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, parsedSuffix) {
+		return false
+	}
+	for _, suffix := range []string{".part", ".filepart", ".tmp"} {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// finish moves, marks or deletes path once parsed, as --processed says.
+// Moving or marking never replaces an earlier file of the same name: the
+// new one gets a number, as in dnsmasq.log.1 or dnsmasq.log.1.parsed.
+func (w watchOptions) finish(path string) error {
+	base, suffix := filepath.Join(w.ProcessedDir, filepath.Base(path)), ""
+	switch w.Processed {
+	case "delete":
+		slog.Info("parsed watched file, deleting", "path", path)
+		return os.Remove(path)
+	case "mark":
+		base, suffix = path, parsedSuffix
+	}
+	to := base + suffix
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(to); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		to = base + "." + strconv.Itoa(n) + suffix
+	}
+	slog.Info("parsed watched file", "path", path, "to", to)
+	return os.Rename(path, to)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// webhookTemplates are the built-in --webhook-template payloads, executed with
+// a webhookMessage.
+var webhookTemplates = map[string]string{
+	"json":    `{{json .}}`,
+	"slack":   `{"text": {{json .Text}}}`,
+	"discord": `{"content": {{json .Text}}}`,
+	"ntfy":    `{{.Text}}`,
+}
+
+// webhookOptions configures the notifications of newly seen domains.
+type webhookOptions struct {
+	URL      string
+	Template string
+	Interval time.Duration
+	Max      int
+}
+
+// addWebhookFlags registers the webhook flags on fs.
+func addWebhookFlags(fs *flag.FlagSet) *webhookOptions {
+	o := &webhookOptions{}
+	fs.StringVar(&o.URL, "webhook", "", "POST the domains never seen before to `url` as they appear")
+	fs.StringVar(&o.Template, "webhook-template", "json", "webhook payload: json, slack, discord, ntfy, or the `path` of a Go text/template executed with the message")
+	fs.DurationVar(&o.Interval, "webhook-interval", time.Minute, "send at most one webhook request per `interval`, batching the domains seen meanwhile")
+	fs.IntVar(&o.Max, "webhook-max", 20, "list at most `n` domains per webhook request, counting the rest")
+	return o
+}
+
+// webhookMessage is what a webhook request reports: the new domains, at most
+// --webhook-max of them, and how many more there were.
+type webhookMessage struct {
+	Host    string      `json:"host"`
+	Domains []newDomain `json:"domains"`
+	More    int         `json:"more,omitempty"`
+}
+
+// Text summarizes the message in a line, for chat services.
+func (m webhookMessage) Text() string {
+	var b strings.Builder
+	n := len(m.Domains) + m.More
+	fmt.Fprintf(&b, "%d new domain", n)
+	if n != 1 {
+		b.WriteString("s")
+	}
+	if m.Host != "" {
+		fmt.Fprintf(&b, " on %s", m.Host)
+	}
+	b.WriteString(": ")
+	for i, d := range m.Domains {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(d.Domain)
+		if d.Client != "" {
+			fmt.Fprintf(&b, " (%s)", d.Client)
+		}
+		if len(d.Listed) > 0 {
+			fmt.Fprintf(&b, " listed on %s", strings.Join(d.Listed, " and "))
+		}
+	}
+	if m.More > 0 {
+		fmt.Fprintf(&b, " and %d more", m.More)
+	}
+	return b.String()
+}
+
+// webhookNotifier posts the domains never seen before to a webhook. Requests
+// are sent in the background, at most one per interval, so a slow or failing
+// endpoint never holds up parsing.
+type webhookNotifier struct {
+	opts   webhookOptions
+	tmpl   *template.Template
+	client *http.Client
+	host   string
+	dnsbl  *dnsblChecker // looks the domains up before sending, when not nil
+
+	mu      sync.Mutex
+	pending []newDomain // at most opts.Max, the earliest first
+	more    int         // new domains beyond pending
+
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// startWebhookNotifier starts sending, with the DNSBL listings dnsbl finds of
+// each domain when not nil. Requests are bound to ctx.
+func startWebhookNotifier(ctx context.Context, opts webhookOptions, dnsbl *dnsblChecker) (*webhookNotifier, error) {
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("--webhook-interval must be positive")
+	}
+	text, ok := webhookTemplates[opts.Template]
+	if !ok {
+		b, err := os.ReadFile(opts.Template)
+		if err != nil {
+			return nil, fmt.Errorf("reading webhook template: %w", err)
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing webhook template: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	n := &webhookNotifier{
+		opts:   opts,
+		tmpl:   tmpl,
+		client: &http.Client{Timeout: 30 * time.Second},
+		host:   host,
+		dnsbl:  dnsbl,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go n.run(ctx)
+	return n, nil
+}
+
+// notify queues the new domains fresh, as returned by
+// newDomainTracker.observe. It is a no-op on a nil notifier.
+func (n *webhookNotifier) notify(fresh []newDomain) {
+	if n == nil || len(fresh) == 0 {
+		return
+	}
+	n.mu.Lock()
+	n.pending = append(n.pending, fresh...)
+	slices.SortFunc(n.pending, func(a, b newDomain) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	if extra := len(n.pending) - max(n.opts.Max, 1); extra > 0 {
+		n.pending = n.pending[:len(n.pending)-extra]
+		n.more += extra
+	}
+	n.mu.Unlock()
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close sends what is pending and stops. It may be called more than once, and
+// is a no-op on a nil notifier.
+func (n *webhookNotifier) close() {
+	if n == nil {
+		return
+	}
+	n.closeOnce.Do(func() { close(n.stop) })
+	<-n.done
+}
+
+func (n *webhookNotifier) run(ctx context.Context) {
+	defer close(n.done)
+	var last time.Time
+	send := func() {
+		n.mu.Lock()
+		msg := webhookMessage{Host: n.host, Domains: n.pending, More: n.more}
+		n.pending, n.more = nil, 0
+		n.mu.Unlock()
+		if len(msg.Domains) == 0 {
+			return
+		}
+		last = time.Now()
+		n.lookUpListings(ctx, msg.Domains)
+		if err := n.post(ctx, msg); err != nil {
+			// Keep going: the next batch may get through.
+			slog.Error("sending webhook", "err", err, "dropped", len(msg.Domains)+msg.More)
+			return
+		}
+		slog.Debug("sent webhook", "domains", len(msg.Domains)+msg.More)
+	}
+
+	ticker := time.NewTicker(n.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.wake:
+			if time.Since(last) >= n.opts.Interval {
+				send()
+			}
+		case <-ticker.C:
+			if time.Since(last) >= n.opts.Interval {
+				send()
+			}
+		case <-n.stop:
+			send()
+			return
+		}
+	}
+}
+
+// lookUpListings sets the DNSBL listings of the registrable domain of each of
+// domains. Those that cannot be looked up are sent without.
+func (n *webhookNotifier) lookUpListings(ctx context.Context, domains []newDomain) {
+	if n.dnsbl == nil {
+		return
+	}
+	for i, d := range domains {
+		if !publicDomain(d.Domain) {
+			continue
+		}
+		listed, err := n.dnsbl.check(ctx, registrableDomain(d.Domain))
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("DNSBL lookup failed", "domain", d.Domain, "err", err)
+		}
+		domains[i].Listed = listed
+	}
+}
+
+// post renders msg with the template and posts it, as JSON when it renders to
+// JSON and as plain text otherwise.
+func (n *webhookNotifier) post(ctx context.Context, msg webhookMessage) error {
+	var body bytes.Buffer
+	if err := n.tmpl.Execute(&body, msg); err != nil {
+		return err
+	}
+	contentType := "text/plain; charset=utf-8"
+	if json.Valid(body.Bytes()) {
+		contentType = "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.opts.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}